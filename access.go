@@ -0,0 +1,56 @@
+package p9p
+
+// CanAccess reports whether uname is likely to be permitted to open the file
+// described by dir with mode, following the permission checks of the Plan 9
+// file servers. This is a best effort check. The server is authoritative and
+// may apply rules that can't be seen from the client.
+//
+// The other bits of dir.Mode apply to all users, the owner bits if uname is
+// dir.UID and the group bits if uname is dir.GID. Group membership beyond the
+// group named for a user is unknown to the client and not considered.
+// Directories may only be opened for reading, and OTRUNC requires write
+// permission. ORCLOSE also requires write permission on the parent
+// directory, which is not checked.
+func CanAccess(dir Dir, mode Flag, uname string) bool {
+	var perm uint32
+	switch mode & 3 {
+	case OREAD:
+		perm = DMREAD
+	case OWRITE:
+		perm = DMWRITE
+	case ORDWR:
+		perm = DMREAD | DMWRITE
+	case OEXEC:
+		perm = DMEXEC
+	}
+
+	if mode&OTRUNC != 0 {
+		perm |= DMWRITE
+	}
+
+	if dir.Mode&DMDIR != 0 && perm != DMREAD {
+		return false
+	}
+
+	// permissions accumulate from other, to owner, to group.
+	allowed := dir.Mode & 7
+	if allowed&perm == perm {
+		return true
+	}
+
+	if dir.UID == uname {
+		allowed |= (dir.Mode >> 6) & 7
+		if allowed&perm == perm {
+			return true
+		}
+	}
+
+	if dir.GID == uname {
+		allowed |= (dir.Mode >> 3) & 7
+		if allowed&perm == perm {
+			return true
+		}
+	}
+
+	return false
+}
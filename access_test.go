@@ -0,0 +1,41 @@
+package p9p
+
+import "testing"
+
+func TestCanAccess(t *testing.T) {
+	file := Dir{Mode: 0640, UID: "glenda", GID: "sys"}
+	exec := Dir{Mode: 0751, UID: "glenda", GID: "sys"}
+	dir := Dir{Mode: DMDIR | 0755, UID: "glenda", GID: "sys"}
+
+	for _, testcase := range []struct {
+		description string
+		dir         Dir
+		mode        Flag
+		uname       string
+		expected    bool
+	}{
+		{"owner read", file, OREAD, "glenda", true},
+		{"owner write", file, OWRITE, "glenda", true},
+		{"owner rdwr", file, ORDWR, "glenda", true},
+		{"owner exec", file, OEXEC, "glenda", false},
+		{"group read", file, OREAD, "sys", true},
+		{"group write", file, OWRITE, "sys", false},
+		{"group truncate", file, OREAD | OTRUNC, "sys", false},
+		{"other read", file, OREAD, "bootes", false},
+		{"other exec", exec, OEXEC, "bootes", true},
+		{"other read executable", exec, OREAD, "bootes", false},
+		{"group exec", exec, OEXEC, "sys", true},
+		{"owner truncate", file, OWRITE | OTRUNC, "glenda", true},
+		{"dir read", dir, OREAD, "bootes", true},
+		{"dir write", dir, OWRITE, "glenda", false},
+		{"dir exec", dir, OEXEC, "glenda", false},
+		{"dir truncate", dir, OREAD | OTRUNC, "glenda", false},
+		{"other bits apply to owner", Dir{Mode: 0004, UID: "glenda"}, OREAD, "glenda", true},
+		{"owner and group accumulate", Dir{Mode: 0420, UID: "glenda", GID: "glenda"}, ORDWR, "glenda", true},
+	} {
+		if actual := CanAccess(testcase.dir, testcase.mode, testcase.uname); actual != testcase.expected {
+			t.Errorf("%s: CanAccess(%o, %#x, %q) = %v, expected %v",
+				testcase.description, testcase.dir.Mode, testcase.mode, testcase.uname, actual, testcase.expected)
+		}
+	}
+}
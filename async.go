@@ -0,0 +1,61 @@
+package p9p
+
+import "golang.org/x/net/context"
+
+// Future is the pending response to a request sent with SendAsync.
+type Future struct {
+	msg  Message
+	done chan struct{}
+	resp Message
+	err  error
+}
+
+// Request returns the message sent.
+func (f *Future) Request() Message {
+	return f.msg
+}
+
+// Done returns a channel that is closed once the response has arrived.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the response and returns it. An error response from the
+// server is returned as the error, and the response is nil.
+func (f *Future) Wait() (Message, error) {
+	<-f.done
+	return f.resp, f.err
+}
+
+// SendAsync sends msg on session without waiting for the response, returning
+// a Future for it. This lets a single goroutine issue many requests, which
+// are multiplexed on the connection like concurrent calls, and collect the
+// responses as they complete.
+//
+// Requests are turned into calls on the session, as by Dispatch, so that the
+// session tracks their fids as it does for any call. Extension messages are
+// sent as with Call. Once ctx is done, the request is flushed and the future
+// fails as the call would.
+//
+// If done is not nil, the future is sent on it once complete, so that the
+// completions of many requests can be received in one place. The sends wait
+// for room on done, which must be drained.
+func SendAsync(ctx context.Context, session Session, msg Message, done chan<- *Future) *Future {
+	f := &Future{msg: msg, done: make(chan struct{})}
+	handler := Dispatch(session)
+
+	go func() {
+		if emsg, ok := msg.(ExtensionMessage); ok {
+			f.resp, f.err = Call(ctx, session, emsg)
+		} else {
+			f.resp, f.err = handler.Handle(ctx, msg)
+		}
+		close(f.done)
+
+		if done != nil {
+			done <- f
+		}
+	}()
+
+	return f
+}
@@ -0,0 +1,65 @@
+package p9p
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestSendAsync issues many requests from one goroutine, collecting their
+// completions on a single channel.
+func TestSendAsync(t *testing.T) {
+	tree := newMemTree("file")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	done := make(chan *Future, n)
+	for i := 0; i < n; i++ {
+		SendAsync(ctx, session, MessageTwalk{Fid: 1, Newfid: Fid(100 + i), Wnames: []string{"file"}}, done)
+	}
+
+	var fids []Fid
+	for i := 0; i < n; i++ {
+		f := <-done
+		resp, err := f.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rwalk, ok := resp.(MessageRwalk); !ok || len(rwalk.Qids) != 1 {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+		fids = append(fids, f.Request().(MessageTwalk).Newfid)
+	}
+
+	f := SendAsync(ctx, session, MessageTwalk{Fid: 1, Newfid: 200, Wnames: []string{"missing"}}, nil)
+	<-f.Done()
+	if _, err := f.Wait(); err != ErrNotfound {
+		t.Fatalf("expected ErrNotfound: %v", err)
+	}
+
+	resp, err := SendAsync(ctx, session, MessageTstat{Fid: fids[0]}, nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rstat, ok := resp.(MessageRstat); !ok || rstat.Stat.Name != "file" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	for _, err := range ClunkAll(ctx, session, fids) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(tree.fids) != 1 {
+		t.Fatalf("fids leaked: %v", tree.fids)
+	}
+}
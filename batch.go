@@ -0,0 +1,56 @@
+package p9p
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// BatchOption configures a batch operation, such as Batch or ClunkAll.
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	failFast bool
+}
+
+// WithFailFast cancels the rest of a batch once one operation fails. Requests
+// still in flight are flushed and fail with a CancelError. By default, every
+// operation runs to completion.
+func WithFailFast() BatchOption {
+	return func(bo *batchOptions) {
+		bo.failFast = true
+	}
+}
+
+// Batch calls fn for each index in [0, n) concurrently, taking advantage of
+// the session's ability to multiplex requests. The returned slice holds the
+// error, or nil, returned by fn for each index. Each call receives a context
+// derived from ctx, which is canceled early if the batch fails fast.
+func Batch(ctx context.Context, n int, fn func(ctx context.Context, i int) error, opts ...BatchOption) []error {
+	var bo batchOptions
+	for _, opt := range opts {
+		opt(&bo)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, n)
+	)
+
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(ctx, i)
+			if errs[i] != nil && bo.failFast {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
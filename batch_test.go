@@ -0,0 +1,100 @@
+package p9p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestBatchFailFast ensures that the first error in a fail fast batch flushes
+// the operations still in flight.
+func TestBatchFailFast(t *testing.T) {
+	const n = 4
+	var (
+		started = make(chan struct{}, n)
+		flushed int32
+	)
+
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			if msg.Fid == 0 {
+				// fail once the rest of the batch is in flight.
+				for i := 0; i < n-1; i++ {
+					<-started
+				}
+				return nil, ErrPerm
+			}
+
+			started <- struct{}{}
+			<-ctx.Done()
+			atomic.AddInt32(&flushed, 1)
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := Batch(ctx, n, func(ctx context.Context, i int) error {
+		_, err := session.Read(ctx, Fid(i), make([]byte, 8), 0)
+		return err
+	}, WithFailFast())
+
+	if ctx.Err() != nil {
+		t.Fatalf("batch did not fail fast: %v", ctx.Err())
+	}
+
+	if errs[0] != ErrPerm {
+		t.Fatalf("unexpected error: %v", errs[0])
+	}
+
+	for i, err := range errs[1:] {
+		if _, ok := err.(CancelError); !ok {
+			t.Fatalf("operation %v: expected cancel error: %v", i+1, err)
+		}
+	}
+
+	// the flushes are answered once the server has canceled the requests.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&flushed) != n-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests not flushed: %v", atomic.LoadInt32(&flushed))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBatch ensures that, by default, every operation runs to completion.
+func TestBatch(t *testing.T) {
+	var calls int32
+	errs := Batch(context.Background(), 3, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 0 {
+			return ErrPerm
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return nil
+		}
+	})
+
+	if calls != 3 {
+		t.Fatalf("unexpected number of calls: %v", calls)
+	}
+
+	expected := []error{ErrPerm, nil, nil}
+	for i := range errs {
+		if errs[i] != expected[i] {
+			t.Fatalf("operation %v: unexpected error: %v != %v", i, errs[i], expected[i])
+		}
+	}
+}
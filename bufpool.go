@@ -0,0 +1,45 @@
+package p9p
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bufferMarshaler is implemented by codecs that can marshal into a caller
+// buffer, so that a channel can reuse scratch buffers rather than allocating
+// one per message.
+type bufferMarshaler interface {
+	marshalTo(b *bytes.Buffer, v interface{}) error
+}
+
+// buffers holds scratch buffers for marshaling messages. Buffers grow to the
+// largest message marshaled into them, bounded by the msize of the channel.
+var buffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty scratch buffer.
+func getBuffer() *bytes.Buffer {
+	b := buffers.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b for reuse, unless it has grown beyond msize, as it may
+// to marshal a message too large for the channel. Such buffers are left to
+// the garbage collector rather than pinning the memory in the pool.
+func putBuffer(b *bytes.Buffer, msize int) {
+	if b.Cap() > msize {
+		return
+	}
+
+	buffers.Put(b)
+}
+
+// decoders holds decoders for unmarshaling messages, reset to read from each
+// message in turn.
+var decoders = sync.Pool{
+	New: func() interface{} {
+		return &decoder{rd: bytes.NewReader(nil)}
+	},
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"time"
 
@@ -37,6 +36,40 @@ type Channel interface {
 	SetMSize(msize int)
 }
 
+// PartialReadError is returned by Channel.ReadFcall when a read fails after
+// some bytes of a frame have been consumed. The channel keeps its place in the
+// frame. If Err is a temporary net.Error, such as a read timeout, the read may
+// be retried and resumes the same frame. After any other error, the channel is
+// no longer aligned on a frame boundary and must not be read from again.
+//
+// Any other error from ReadFcall was returned before the channel consumed any
+// bytes of the next frame. If that error is a temporary net.Error, the read
+// may safely be retried.
+type PartialReadError struct {
+	N   int   // number of bytes of the frame consumed so far
+	Err error // underlying read error
+}
+
+// retryable reports whether a read that failed with err may be retried on
+// the same channel. Context errors are not retryable, though they report as
+// timeouts: the context of the read is done for good.
+func retryable(err error) bool {
+	if perr, ok := err.(PartialReadError); ok {
+		err = perr.Err
+	}
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+
+	nerr, ok := err.(net.Error)
+	return ok && (nerr.Timeout() || nerr.Temporary())
+}
+
+func (e PartialReadError) Error() string {
+	return fmt.Sprintf("9p: partial read of %d bytes: %v", e.N, e.Err)
+}
+
 func NewChannel(conn net.Conn, msize int) Channel {
 	return newChannel(conn, codec9p{}, msize)
 }
@@ -73,14 +106,23 @@ type channel struct {
 	conn   net.Conn
 	codec  Codec
 	brd    *bufio.Reader
+	frd    frameReader // reads frames from brd
 	bwr    *bufio.Writer
 	closed chan struct{}
 	msize  int
 	rdbuf  []byte
+	logger Logger // nil for the default logger
+
+	// metrics, if set, counts the frames on conn.
+	metrics WireMetrics
+
+	// readbufs, if set, provides the caller buffer to decode the data of an
+	// Rread into, by tag. The buffer may be written until release is called.
+	readbufs func(tag Tag) (buf []byte, release func())
 }
 
 func newChannel(conn net.Conn, codec Codec, msize int) *channel {
-	return &channel{
+	ch := &channel{
 		conn:   conn,
 		codec:  codec,
 		brd:    bufio.NewReaderSize(conn, msize), // msize may not be optimal buffer size
@@ -89,6 +131,9 @@ func newChannel(conn net.Conn, codec Codec, msize int) *channel {
 		msize:  msize,
 		rdbuf:  make([]byte, msize),
 	}
+	ch.frd.rd = ch.brd
+
+	return ch
 }
 
 func (ch *channel) MSize() int {
@@ -111,7 +156,9 @@ func (ch *channel) SetMSize(msize int) {
 	ch.rdbuf = make([]byte, msize)
 }
 
-// ReadFcall reads the next message from the channel into fcall.
+// ReadFcall reads the next message from the channel into fcall. If the read
+// fails after part of the frame has been consumed, a PartialReadError is
+// returned and a retried read resumes the frame.
 func (ch *channel) ReadFcall(ctx context.Context, fcall *Fcall) error {
 	select {
 	case <-ctx.Done():
@@ -127,31 +174,103 @@ func (ch *channel) ReadFcall(ctx context.Context, fcall *Fcall) error {
 	}
 
 	if err := ch.conn.SetReadDeadline(deadline); err != nil {
-		log.Printf("transport: error setting read deadline on %v: %v", ch.conn.RemoteAddr(), err)
+		logf(ch.logger, LogWarn, "transport: error setting read deadline on %v: %v", ch.conn.RemoteAddr(), err)
+	}
+
+	n, err := ch.frd.read(ch.rdbuf)
+	if ch.metrics != nil && n > 0 {
+		ch.metrics.FrameRead(n)
 	}
 
-	n, err := readmsg(ch.brd, ch.rdbuf)
 	if err != nil {
-		// TODO(stevvooe): There may be more we can do here to detect partial
-		// reads. For now, we just propagate the error untouched.
+		if n > 0 {
+			// part of the frame has been consumed. The frame reader keeps
+			// its place, so the frame can only be resumed, not read anew.
+			return PartialReadError{N: n, Err: err}
+		}
+
 		return err
 	}
 
-	if n > len(ch.rdbuf) {
-		// TODO(stevvooe): Make this error detectable and respond with error
-		// message.
-		return fmt.Errorf("message large than buffer:", n)
+	if n > ch.msize {
+		// the frame was discarded, keeping its type and tag.
+		if _, release, ok := ch.frd.take(); ok && release != nil {
+			release()
+		}
+
+		return MessageTooLargeError{
+			Type:  FcallType(ch.rdbuf[0]),
+			Tag:   Tag(binary.LittleEndian.Uint16(ch.rdbuf[1:3])),
+			Size:  n,
+			MSize: ch.msize,
+		}
 	}
 
 	// clear out the fcall
 	*fcall = Fcall{}
-	if err := ch.codec.Unmarshal(ch.rdbuf[:n], fcall); err != nil {
+
+	if dst, release, ok := ch.frd.take(); ok {
+		if release != nil {
+			defer release()
+		}
+
+		// the data was read straight into the buffer of the caller. It is
+		// nil if the caller gave up on the read while the frame was being
+		// resumed.
+		fcall.Type = Rread
+		fcall.Tag = Tag(binary.LittleEndian.Uint16(ch.rdbuf[1:3]))
+		fcall.Message = MessageRread{Data: dst}
+		return nil
+	}
+
+	// n includes the size header, so the frame needs 4+3 bytes to hold the
+	// type and tag.
+	if ch.readbufs != nil && n >= 4+3 && FcallType(ch.rdbuf[0]) == Rread {
+		tag := Tag(binary.LittleEndian.Uint16(ch.rdbuf[1:3]))
+		if buf, release := ch.readbufs(tag); release != nil {
+			defer release()
+			fcall.Message = MessageRread{Data: buf[:0:len(buf)]}
+		}
+	}
+
+	// n includes the size header, which is not part of the message.
+	if err := ch.codec.Unmarshal(ch.rdbuf[:n-4], fcall); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (ch *channel) setReadBuffers(fn func(tag Tag) ([]byte, func())) {
+	ch.readbufs = fn
+
+	if _, ok := ch.codec.(codec9p); ok {
+		// other codecs may frame the data differently.
+		ch.frd.direct = ch.directRead
+	}
+}
+
+// directRead returns the buffer to read the data of an Rread into, given the
+// start of its body. The count must fill the rest of the frame, leaving no
+// room for trailing bytes the codec might verify.
+func (ch *channel) directRead(prefix []byte) ([]byte, func()) {
+	if FcallType(prefix[0]) != Rread {
+		return nil, nil
+	}
+
+	buf, release := ch.readbufs(Tag(binary.LittleEndian.Uint16(prefix[1:3])))
+	if release == nil {
+		return nil, nil
+	}
+
+	count := int(binary.LittleEndian.Uint32(prefix[3:7]))
+	if count > len(buf) {
+		return nil, release // decoded as usual, reporting the error.
+	}
+
+	return buf[:count], release
+}
+
 func (ch *channel) WriteFcall(ctx context.Context, fcall *Fcall) error {
 	select {
 	case <-ctx.Done():
@@ -167,61 +286,231 @@ func (ch *channel) WriteFcall(ctx context.Context, fcall *Fcall) error {
 	}
 
 	if err := ch.conn.SetWriteDeadline(deadline); err != nil {
-		log.Printf("transport: error setting read deadline on %v: %v", ch.conn.RemoteAddr(), err)
+		logf(ch.logger, LogWarn, "transport: error setting write deadline on %v: %v", ch.conn.RemoteAddr(), err)
 	}
 
-	p, err := ch.codec.Marshal(fcall)
-	if err != nil {
-		return err
+	b := getBuffer()
+	defer putBuffer(b, ch.msize)
+
+	// leave room for the size header, filled in once the size is known.
+	var hdr [4]byte
+	b.Write(hdr[:])
+
+	var data []byte
+	if _, ok := ch.codec.(codec9p); ok {
+		var msg Message
+		if msg, data = splitPayload(fcall.Message); data != nil {
+			// marshal the message without its data, which is written
+			// from the caller buffer after it.
+			fcall = &Fcall{Type: fcall.Type, Tag: fcall.Tag, Message: msg}
+		}
 	}
 
-	if err := sendmsg(ch.bwr, p); err != nil {
-		return err
+	if bm, ok := ch.codec.(bufferMarshaler); ok {
+		if err := bm.marshalTo(b, fcall); err != nil {
+			return err
+		}
+	} else {
+		p, err := ch.codec.Marshal(fcall)
+		if err != nil {
+			return err
+		}
+		b.Write(p)
+	}
+
+	frame := b.Bytes()
+	if size := len(frame) + len(data); size > ch.msize {
+		return MessageTooLargeError{Type: fcall.Type, Tag: fcall.Tag, Size: size, MSize: ch.msize}
 	}
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)+len(data)))
+
+	if data != nil {
+		// patch the count, the last field before the data.
+		binary.LittleEndian.PutUint32(frame[len(frame)-4:], uint32(len(data)))
+
+		// the buffered writer is flushed after every frame, so it is safe
+		// to write to conn directly.
+		bufs := net.Buffers{frame, data}
+		if _, err := bufs.WriteTo(ch.conn); err != nil {
+			return err
+		}
+	} else {
+		if n, err := ch.bwr.Write(frame); err != nil {
+			return err
+		} else if n < len(frame) {
+			return io.ErrShortWrite
+		}
 
-	return ch.bwr.Flush()
+		if err := ch.bwr.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if ch.metrics != nil {
+		ch.metrics.FrameWritten(len(frame) + len(data))
+	}
+
+	return nil
 }
 
-// readmsg reads a 9p message into p from rd, ensuring that all bytes are
-// consumed from the size header. If the size header indicates the message is
-// larger than p, the entire message will be discarded, leaving a truncated
-// portion in p. Any error should be treated as a framing error unless n is
-// zero. The caller must check that n is less than or equal to len(p) to
-// ensure that a valid message has been read.
-func readmsg(rd io.Reader, p []byte) (n int, err error) {
-	var msize uint32
+// splitPayload returns the data of a Twrite or Rread message, along with the
+// message without it. The data is nil for other messages or if it is empty.
+func splitPayload(msg Message) (Message, []byte) {
+	switch msg := msg.(type) {
+	case MessageTwrite:
+		if len(msg.Data) > 0 {
+			data := msg.Data
+			msg.Data = nil
+			return msg, data
+		}
+	case MessageRread:
+		if len(msg.Data) > 0 {
+			data := msg.Data
+			msg.Data = nil
+			return msg, data
+		}
+	}
+
+	return msg, nil
+}
 
-	if err := binary.Read(rd, binary.LittleEndian, &msize); err != nil {
-		return 0, err
+// directPrefix is the number of bytes of the body of a frame offered to
+// frameReader.direct: the type, tag and count of an Rread.
+const directPrefix = 7
+
+// frameReader reads 9p frames from rd, keeping its place in a frame when a
+// read fails. After a timeout, the next read resumes the same frame rather
+// than taking the rest of it for the start of a new one.
+type frameReader struct {
+	rd  io.Reader
+	hdr [4]byte // size header of the current frame
+	n   int     // bytes of the current frame consumed, including hdr
+
+	// direct, if set, is offered the first directPrefix bytes of the body
+	// of each frame. If it returns a destination exactly as long as the
+	// rest of the body, the rest is read into it rather than p, sparing a
+	// copy. The destination may be written until release is called. It is
+	// released if a read fails and asked for again when the frame resumes.
+	direct func(prefix []byte) (dst []byte, release func())
+
+	offered  bool   // direct has been offered the current frame
+	directed bool   // the rest of the current frame goes to dst
+	dlen     int    // length of the rest of the frame
+	dst      []byte // nil if withdrawn while the frame was resumed
+	release  func()
+}
+
+// acquire asks direct for the destination of the rest of the frame.
+func (fr *frameReader) acquire(p []byte) {
+	dst, release := fr.direct(p[:directPrefix])
+	if release != nil && len(dst) != fr.dlen {
+		release()
+		dst, release = nil, nil
 	}
 
-	n += binary.Size(msize)
-	mbody := int(msize) - 4
+	fr.dst, fr.release = dst, release
+}
 
-	if mbody < len(p) {
-		p = p[:mbody]
+// drop releases the destination, if held.
+func (fr *frameReader) drop() {
+	if fr.release != nil {
+		fr.release()
 	}
 
-	np, err := io.ReadFull(rd, p)
-	if err != nil {
-		return np + n, err
+	fr.dst, fr.release = nil, nil
+}
+
+// take returns the destination of the frame just read, if it was read
+// directly, and resets the direct state for the next frame. The caller must
+// call release, if not nil, once done with dst.
+func (fr *frameReader) take() (dst []byte, release func(), ok bool) {
+	dst, release, ok = fr.dst, fr.release, fr.directed
+	fr.offered, fr.directed = false, false
+	fr.dst, fr.release = nil, nil
+	return dst, release, ok
+}
+
+// read reads a 9p message into p, ensuring that all bytes are consumed from
+// the size header. If the size header indicates the message is larger than p,
+// the entire message will be discarded, leaving a truncated portion in p. The
+// returned n counts the bytes of the frame consumed so far, including the
+// size header. On error, read may be called again with the same p to resume
+// the frame. The caller must check that n is less than or equal to len(p) to
+// ensure that a valid message has been read.
+func (fr *frameReader) read(p []byte) (n int, err error) {
+	for fr.n < len(fr.hdr) {
+		nn, err := fr.rd.Read(fr.hdr[fr.n:])
+		fr.n += nn
+		if err != nil {
+			return fr.n, fr.unexpected(err)
+		}
 	}
-	n += np
 
-	if mbody > len(p) {
-		// message has been read up to len(p) but we must consume the entire
-		// message. This is an error condition but is non-fatal if we can
-		// consume msize bytes.
-		nn, err := io.CopyN(ioutil.Discard, rd, int64(mbody-len(p)))
-		n += int(nn)
+	size := int(binary.LittleEndian.Uint32(fr.hdr[:]))
+	if fr.directed && fr.release == nil && fr.n < size {
+		fr.acquire(p) // resuming, the destination was released.
+	}
+
+	for fr.n < size {
+		var nn int
+		off := fr.n - len(fr.hdr)
+
+		if fr.direct != nil && !fr.offered && off == directPrefix && len(p) >= directPrefix {
+			fr.offered = true
+			fr.dlen = size - fr.n
+			fr.acquire(p)
+			fr.directed = fr.release != nil
+		}
+
+		if fr.directed {
+			if fr.dst != nil {
+				nn, err = fr.rd.Read(fr.dst[fr.dlen-(size-fr.n):])
+			} else {
+				var nd int64
+				nd, err = io.CopyN(ioutil.Discard, fr.rd, int64(size-fr.n))
+				nn = int(nd)
+			}
+		} else if off < len(p) {
+			end := size - len(fr.hdr)
+			if end > len(p) {
+				end = len(p)
+			}
+
+			if fr.direct != nil && !fr.offered && end > directPrefix && off < directPrefix {
+				end = directPrefix // stop to offer the rest to direct.
+			}
+
+			nn, err = fr.rd.Read(p[off:end])
+		} else {
+			// message has been read up to len(p) but we must consume the
+			// entire message. This is an error condition but is non-fatal
+			// if we can consume size bytes.
+			var nd int64
+			nd, err = io.CopyN(ioutil.Discard, fr.rd, int64(size-fr.n))
+			nn = int(nd)
+		}
+
+		fr.n += nn
 		if err != nil {
-			return n, err
+			fr.drop()
+			return fr.n, fr.unexpected(err)
 		}
 	}
 
+	n, fr.n = fr.n, 0
 	return n, nil
 }
 
+// unexpected converts an EOF in the middle of a frame to
+// io.ErrUnexpectedEOF.
+func (fr *frameReader) unexpected(err error) error {
+	if err == io.EOF && fr.n > 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
 // sendmsg writes a message of len(p) to wr with a 9p size header. All errors
 // should be considered terminal.
 func sendmsg(wr io.Writer, p []byte) error {
@@ -0,0 +1,362 @@
+package p9p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestReadFcallTimeout ensures that a timeout before any bytes of a frame
+// arrive is reported as a retryable net.Error and does not disturb the
+// following frame.
+func TestReadFcallTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ch := newChannel(client, codec9p{}, DefaultMSize)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var fcall Fcall
+	err := ch.ReadFcall(ctx, &fcall)
+	if _, ok := err.(PartialReadError); ok {
+		t.Fatalf("timeout without data reported as partial read: %v", err)
+	}
+
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout error: %v", err)
+	}
+
+	expected := newFcall(1, MessageTclunk{Fid: 10})
+	p, err := codec9p{}.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go sendmsg(server, p)
+
+	if err := ch.ReadFcall(context.Background(), &fcall); err != nil {
+		t.Fatalf("unexpected error after retry: %v", err)
+	}
+
+	if fcall.Tag != expected.Tag || fcall.Message != expected.Message {
+		t.Fatalf("unexpected fcall: %v != %v", &fcall, expected)
+	}
+}
+
+// TestReadFcallPartialTimeout ensures that a timeout in the middle of a frame,
+// either in the size header or in the body, is reported as a PartialReadError
+// and that retrying the read resumes the same frame.
+func TestReadFcallPartialTimeout(t *testing.T) {
+	expected := newFcall(1, MessageTclunk{Fid: 10})
+	p, err := codec9p{}.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, 4, 4+len(p))
+	frame[0] = byte(len(p) + 4)
+	frame = append(frame, p...)
+
+	for _, n := range []int{2, 4, 6} {
+		client, server := net.Pipe()
+		ch := newChannel(client, codec9p{}, DefaultMSize)
+
+		go server.Write(frame[:n])
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+		var fcall Fcall
+		err := ch.ReadFcall(ctx, &fcall)
+		cancel()
+
+		perr, ok := err.(PartialReadError)
+		if !ok {
+			t.Fatalf("%d bytes: expected partial read error: %v", n, err)
+		}
+
+		if perr.N != n {
+			t.Fatalf("%d bytes: unexpected count %v", n, perr.N)
+		}
+
+		if nerr, ok := perr.Err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("%d bytes: expected underlying timeout: %v", n, perr.Err)
+		}
+
+		if !retryable(err) {
+			t.Fatalf("%d bytes: expected retryable error: %v", n, err)
+		}
+
+		go server.Write(frame[n:])
+
+		if err := ch.ReadFcall(context.Background(), &fcall); err != nil {
+			t.Fatalf("%d bytes: unexpected error resuming frame: %v", n, err)
+		}
+
+		if fcall.Tag != expected.Tag || fcall.Message != expected.Message {
+			t.Fatalf("%d bytes: unexpected fcall: %v != %v", n, &fcall, expected)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+// TestReadFcallPartialEOF ensures that a connection closed in the middle of a
+// frame is reported as a partial read that cannot be retried.
+func TestReadFcallPartialEOF(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ch := newChannel(client, codec9p{}, DefaultMSize)
+
+	go func() {
+		server.Write([]byte{32, 0, 0, 0, byte(Rclunk)})
+		server.Close()
+	}()
+
+	var fcall Fcall
+	err := ch.ReadFcall(context.Background(), &fcall)
+	perr, ok := err.(PartialReadError)
+	if !ok || perr.Err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected partial read with unexpected EOF: %v", err)
+	}
+
+	if retryable(err) {
+		t.Fatalf("unexpected retryable error: %v", err)
+	}
+}
+
+// TestWriteFcallPooled ensures that frames marshaled into pooled buffers, with
+// and without checksums, match the frames produced by Marshal, including when
+// a buffer is reused for a smaller message.
+func TestWriteFcallPooled(t *testing.T) {
+	for _, codec := range []Codec{codec9p{}, newChecksumCodec(codec9p{}, nil)} {
+		for _, fcall := range []*Fcall{
+			newFcall(1, MessageTwrite{Fid: 1, Data: bytes.Repeat([]byte("x"), 1024)}),
+			newFcall(2, MessageTclunk{Fid: 10}),
+		} {
+			client, server := net.Pipe()
+			ch := newChannel(client, codec, DefaultMSize)
+
+			p, err := codec.Marshal(fcall)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- ch.WriteFcall(context.Background(), fcall)
+			}()
+
+			frame := make([]byte, len(p)+4)
+			if _, err := io.ReadFull(server, frame); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if binary.LittleEndian.Uint32(frame) != uint32(len(frame)) || !bytes.Equal(frame[4:], p) {
+				t.Fatalf("unexpected frame for %v: %x != %x", fcall, frame[4:], p)
+			}
+
+			client.Close()
+			server.Close()
+		}
+	}
+}
+
+// TestReadFcallDirect ensures that the data of an Rread is read straight into
+// the buffer provided for its tag, including when the read times out in the
+// middle of the data and resumes, and that a buffer withdrawn in the meantime
+// is not written.
+func TestReadFcallDirect(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 512)
+	p, err := codec9p{}.Marshal(newFcall(3, MessageRread{Data: data}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, 4, 4+len(p))
+	binary.LittleEndian.PutUint32(frame, uint32(len(p)+4))
+	frame = append(frame, p...)
+
+	for _, withdraw := range []bool{false, true} {
+		client, server := net.Pipe()
+		ch := newChannel(client, codec9p{}, DefaultMSize)
+
+		var (
+			buf      = make([]byte, len(data))
+			lookups  int
+			released int
+		)
+		ch.setReadBuffers(func(tag Tag) ([]byte, func()) {
+			if tag != 3 {
+				t.Fatalf("unexpected tag: %v", tag)
+			}
+
+			lookups++
+			if withdraw && lookups > 1 {
+				return nil, nil
+			}
+
+			return buf, func() { released++ }
+		})
+
+		// stop in the middle of the data.
+		split := 4 + directPrefix + 100
+		go server.Write(frame[:split])
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		var fcall Fcall
+		err := ch.ReadFcall(ctx, &fcall)
+		cancel()
+
+		if !retryable(err) {
+			t.Fatalf("expected retryable partial read: %v", err)
+		}
+
+		if released != 1 {
+			t.Fatalf("buffer not released after partial read: %d", released)
+		}
+
+		go server.Write(frame[split:])
+		if err := ch.ReadFcall(context.Background(), &fcall); err != nil {
+			t.Fatal(err)
+		}
+
+		rread, ok := fcall.Message.(MessageRread)
+		if !ok || fcall.Tag != 3 || fcall.Type != Rread {
+			t.Fatalf("unexpected fcall: %v", &fcall)
+		}
+
+		if withdraw {
+			if rread.Data != nil {
+				t.Fatalf("withdrawn buffer returned: %d bytes", len(rread.Data))
+			}
+
+			if !bytes.Equal(buf[:100], data[:100]) || bytes.Contains(buf[100:], []byte("a")) {
+				t.Fatal("withdrawn buffer written after it was released")
+			}
+		} else {
+			if len(rread.Data) != len(data) || &rread.Data[0] != &buf[0] {
+				t.Fatal("data not read into the provided buffer")
+			}
+
+			if !bytes.Equal(buf, data) {
+				t.Fatal("unexpected data")
+			}
+
+			if released != 2 {
+				t.Fatalf("expected buffer released twice, got %d", released)
+			}
+		}
+
+		// the channel is still aligned on frames.
+		expected := newFcall(4, MessageRclunk{})
+		p, err := codec9p{}.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go sendmsg(server, p)
+		if err := ch.ReadFcall(context.Background(), &fcall); err != nil {
+			t.Fatal(err)
+		}
+
+		if fcall.Tag != expected.Tag || fcall.Message != expected.Message {
+			t.Fatalf("unexpected fcall: %v != %v", &fcall, expected)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+// TestReadFcallShortRread ensures that a frame too short to hold a tag is
+// not matched to a read buffer by the tag of the previous frame.
+func TestReadFcallShortRread(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ch := newChannel(client, codec9p{}, DefaultMSize)
+
+	var tags []Tag
+	ch.readbufs = func(tag Tag) ([]byte, func()) {
+		tags = append(tags, tag)
+		return make([]byte, 16), func() {}
+	}
+
+	p, err := codec9p{}.Marshal(newFcall(3, MessageRread{Data: []byte("data")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		sendmsg(server, p)
+		sendmsg(server, []byte{byte(Rread)})
+	}()
+
+	var fcall Fcall
+	if err := ch.ReadFcall(context.Background(), &fcall); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ch.ReadFcall(context.Background(), &fcall); err == nil {
+		t.Fatal("expected short frame to fail")
+	}
+
+	if len(tags) != 1 || tags[0] != 3 {
+		t.Fatalf("unexpected buffer lookups: %v", tags)
+	}
+}
+
+// TestFcallMSize ensures that frames larger than the msize are neither
+// written nor read, and that the channel remains usable after either.
+func TestFcallMSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx := context.Background()
+	wr := newChannel(client, codec9p{}, 1024)
+	rd := newChannel(server, codec9p{}, 64)
+
+	large := newFcall(1, MessageTwrite{Fid: 1, Data: make([]byte, 1024)})
+	if err, ok := wr.WriteFcall(ctx, large).(MessageTooLargeError); !ok || err.Tag != 1 || err.MSize != 1024 {
+		t.Fatalf("expected message too large writing: %v", err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- wr.WriteFcall(ctx, newFcall(2, MessageTwrite{Fid: 1, Data: make([]byte, 64)}))
+		errs <- wr.WriteFcall(ctx, newFcall(3, MessageTclunk{Fid: 1}))
+	}()
+
+	var fcall Fcall
+	err, ok := rd.ReadFcall(ctx, &fcall).(MessageTooLargeError)
+	if !ok || err.Type != Twrite || err.Tag != 2 || err.Size <= 64 {
+		t.Fatalf("expected message too large reading: %v", err)
+	}
+
+	if err := rd.ReadFcall(ctx, &fcall); err != nil || fcall.Tag != 3 {
+		t.Fatalf("unexpected fcall after discarding a frame: %v, %v", fcall, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package p9p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+)
+
+// checksumSize is the number of bytes a checksum adds to each frame.
+const checksumSize = 4
+
+// checksumCodec appends a checksum of each marshaled message and verifies it
+// on unmarshal. It is only suitable for framing messages on a channel, not for
+// encoding directory entries.
+type checksumCodec struct {
+	Codec
+	newHash func() hash.Hash32
+}
+
+// newChecksumCodec wraps codec with checksums computed by newHash. If newHash
+// is nil, CRC-32C is used.
+func newChecksumCodec(codec Codec, newHash func() hash.Hash32) Codec {
+	if newHash == nil {
+		table := crc32.MakeTable(crc32.Castagnoli)
+		newHash = func() hash.Hash32 { return crc32.New(table) }
+	}
+
+	return checksumCodec{Codec: codec, newHash: newHash}
+}
+
+func (c checksumCodec) Marshal(v interface{}) ([]byte, error) {
+	p, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum [checksumSize]byte
+	binary.LittleEndian.PutUint32(sum[:], c.checksum(p))
+	return append(p, sum[:]...), nil
+}
+
+// marshalTo appends the encoding of v, followed by its checksum, to b.
+func (c checksumCodec) marshalTo(b *bytes.Buffer, v interface{}) error {
+	start := b.Len()
+	if bm, ok := c.Codec.(bufferMarshaler); ok {
+		if err := bm.marshalTo(b, v); err != nil {
+			return err
+		}
+	} else {
+		p, err := c.Codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(p)
+	}
+
+	var sum [checksumSize]byte
+	binary.LittleEndian.PutUint32(sum[:], c.checksum(b.Bytes()[start:]))
+	b.Write(sum[:])
+	return nil
+}
+
+func (c checksumCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < checksumSize {
+		return ErrChecksum
+	}
+
+	body, sum := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	if binary.LittleEndian.Uint32(sum) != c.checksum(body) {
+		return ErrChecksum
+	}
+
+	return c.Codec.Unmarshal(body, v)
+}
+
+func (c checksumCodec) Size(v interface{}) int {
+	return c.Codec.Size(v) + checksumSize
+}
+
+func (c checksumCodec) checksum(p []byte) uint32 {
+	h := c.newHash()
+	h.Write(p)
+	return h.Sum32()
+}
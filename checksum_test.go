@@ -0,0 +1,95 @@
+package p9p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestChecksumCodec(t *testing.T) {
+	codec := newChecksumCodec(codec9p{}, nil)
+	fcall := newFcall(1, MessageTwrite{Fid: 1, Data: []byte("hello")})
+
+	p, err := codec.Marshal(fcall)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p) != codec.Size(fcall) {
+		t.Fatalf("size does not match marshaled length: %v != %v", codec.Size(fcall), len(p))
+	}
+
+	var decoded Fcall
+	if err := codec.Unmarshal(p, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(decoded.Message.(MessageTwrite).Data, []byte("hello")) {
+		t.Fatalf("unexpected message: %v", decoded)
+	}
+
+	for i := range p {
+		corrupted := append([]byte(nil), p...)
+		corrupted[i] ^= 0x10
+		if err := codec.Unmarshal(corrupted, &decoded); err != ErrChecksum {
+			t.Fatalf("corruption of byte %d not detected: %v", i, err)
+		}
+	}
+}
+
+// TestChecksumSession reads a full msize worth of data over a connection with
+// checksums on both ends.
+func TestChecksumSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			return MessageRread{Data: bytes.Repeat([]byte{'x'}, int(msg.Count))}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithServerChecksums(nil))
+
+	session, err := NewSession(ctx, cconn, WithChecksums(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msize, _ := session.Version()
+	p := make([]byte, msize-IOHDRSZ)
+	n, err := session.Read(ctx, 1, p, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != len(p) {
+		t.Fatalf("short read: %v != %v", n, len(p))
+	}
+}
+
+// TestChecksumMismatch ensures that a client using checksums cannot talk to a
+// server that does not.
+func TestChecksumMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		return nil, ErrUnknownMsg
+	}))
+
+	if _, err := NewSession(ctx, cconn, WithChecksums(nil)); err == nil {
+		t.Fatalf("expected session to fail without server checksums")
+	}
+}
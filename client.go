@@ -1,45 +1,366 @@
 package p9p
 
 import (
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
 type client struct {
 	version   string
+	mu        sync.Mutex // protects msize, which changes on Renegotiate
 	msize     int
 	ctx       context.Context
+	defctx    context.Context // default context, derived from ctx
 	transport roundTripper
+	fids      *fidPool
+
+	flushTimeout time.Duration
+	clunkTimeout time.Duration
+	dirReads     int  // maximum reads of a directory in ReaddirAll
+	qidChecks    bool // warn when the qid of a fid changes
+	stats        *statCache
+	retries      *RetryPolicy
+	auth         AuthFunc
+	logger       Logger
 }
 
 // NewSession returns a session using the connection. The Context ctx provides
 // a context for out of bad messages, such as flushes, that may be sent by the
-// session. The session can effectively shutdown with this context.
-func NewSession(ctx context.Context, conn net.Conn) (Session, error) {
-	ch := newChannel(conn, codec9p{}, DefaultMSize) // sets msize, effectively.
+// session. It governs the lifetime of the session: once ctx is done, the
+// session shuts down and outstanding and future calls fail with
+// ErrSessionDone. The context passed to each call only governs that call.
+//
+// The returned session implements io.Closer.
+func NewSession(ctx context.Context, conn net.Conn, opts ...SessionOption) (Session, error) {
+	so := newSessionOptions(opts)
+
+	ch, version, msize, err := negotiateConn(ctx, conn, so)
+	if err != nil {
+		return nil, err
+	}
 
-	// negotiate the protocol version
-	version, err := clientnegotiate(ctx, ch, DefaultVersion)
+	return newClient(ctx, newTransport(ctx, ch, so), version, msize, so), nil
+}
+
+// NewChannelSession returns a session over ch, a Channel framing fcalls over
+// a transport other than a net.Conn. The version is negotiated over ch before
+// NewChannelSession returns. The context ctx and options are used as with
+// NewSession, except that options configuring the connection, such as
+// WithCompression, WithEncryption and WithChecksums, are ignored: framing is
+// left to ch. If ch implements io.Closer, it is closed with the session.
+func NewChannelSession(ctx context.Context, ch Channel, opts ...SessionOption) (Session, error) {
+	so := newSessionOptions(opts)
+	so.compress, so.checksums, so.frameCompress = false, false, nil
+
+	ch, version, msize, err := negotiateChannel(ctx, ch, so)
 	if err != nil {
 		return nil, err
 	}
 
-	return &client{
-		version:   version,
-		msize:     ch.MSize(),
-		ctx:       ctx,
-		transport: newTransport(ctx, ch),
-	}, nil
+	return newClient(ctx, newTransport(ctx, ch, so), version, msize, so), nil
+}
+
+// NewRoundTripperSession returns a session sending its requests through rt,
+// which must be connected with the msize and version negotiated for it, as
+// returned by NewRoundTripper. The context ctx and options are used as with
+// NewSession, except for options that configure the connection. If rt is the
+// RoundTripper returned by NewRoundTripper, the session supports every
+// feature of a session from NewSession, such as Flush. Otherwise, those
+// features are unavailable. Closing the session closes rt, if it implements
+// io.Closer.
+func NewRoundTripperSession(ctx context.Context, rt RoundTripper, msize int, version string, opts ...SessionOption) Session {
+	so := newSessionOptions(opts)
+
+	t, ok := rt.(roundTripper)
+	if !ok {
+		t = roundTripperFunc{rt: rt}
+	}
+
+	return newClient(ctx, t, version, msize, so)
+}
+
+// negotiateConn prepares a channel on conn, as configured by so, and
+// negotiates the protocol version. The returned msize leaves room for any
+// framing overhead added by so.
+func negotiateConn(ctx context.Context, conn net.Conn, so sessionOptions) (Channel, string, int, error) {
+	ctx, cancel := so.handshakeContext(ctx)
+	defer cancel()
+
+	if so.encryptKey != nil {
+		econn, err := EncryptConn(ctx, conn, so.encryptKey)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		conn = econn
+	}
+
+	if so.compress {
+		cconn, err := CompressConn(conn, so.compressLevel)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		conn = cconn
+	}
+
+	var codec Codec = codec9p{}
+	if so.frameCompress != nil {
+		codec = newFrameCompressCodec(codec, so.frameCompress)
+	}
+
+	if so.checksums {
+		codec = newChecksumCodec(codec, so.newHash)
+	}
+
+	nch := newChannel(conn, codec, DefaultMSize) // sets msize, effectively.
+	nch.logger = so.logger
+	if wm, ok := so.metrics.(WireMetrics); ok {
+		nch.metrics = wm
+	}
+
+	ch, version, msize, err := negotiateChannel(ctx, nch, so)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	msize -= so.frameOverhead() // leave room in each frame for the codec.
+
+	return ch, version, msize, nil
+}
+
+// negotiateChannel negotiates the protocol version over ch, returning the
+// channel to use for the session.
+func negotiateChannel(ctx context.Context, ch Channel, so sessionOptions) (Channel, string, int, error) {
+	ctx, cancel := so.handshakeContext(ctx)
+	defer cancel()
+
+	versions, err := so.offers()
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if so.msize > 0 {
+		ch.SetMSize(so.msize)
+	}
+
+	if so.trace != nil {
+		ch = TraceChannel(ch, so.trace)
+	}
+
+	// negotiate the protocol version
+	version, err := clientnegotiate(ctx, ch, versions...)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return ch, version, ch.MSize(), nil
+}
+
+func newClient(ctx context.Context, transport roundTripper, version string, msize int, so sessionOptions) *client {
+	defctx := ctx
+	if so.defaultctx != nil {
+		defctx = so.defaultctx(ctx)
+	}
+
+	if so.maxDirReads <= 0 {
+		so.maxDirReads = DefaultMaxDirReads
+	}
+
+	c := &client{
+		version:      version,
+		msize:        msize,
+		ctx:          ctx,
+		defctx:       defctx,
+		transport:    transport,
+		fids:         newFidPool(so.fidPaths),
+		flushTimeout: so.flushTimeout,
+		clunkTimeout: so.clunkTimeout,
+		dirReads:     so.maxDirReads,
+		qidChecks:    so.qidChecks,
+		logger:       so.logger,
+		retries:      so.retries,
+		auth:         so.auth,
+	}
+
+	if so.statTTL > 0 {
+		c.stats = newStatCache(so.statTTL)
+	}
+
+	if so.keepalive > 0 {
+		go c.keepalive(so.keepalive, so.keepaliveTimeout, so.keepaliveDead)
+	}
+
+	return c
 }
 
 var _ Session = &client{}
+var _ io.Closer = &client{}
+
+// Close closes the session. Calls waiting on a response fail with ErrClosed.
+// If the session was created WithClunkOnClose, the fids in use are clunked
+// first. If it was created WithFlushOnClose, outstanding requests are flushed
+// before closing.
+func (c *client) Close() error {
+	if c.clunkTimeout > 0 {
+		ctx, cancel := context.WithTimeout(c.ctx, c.clunkTimeout)
+		defer cancel()
+
+		for _, info := range c.clunkAll(ctx) {
+			logf(c.logger, LogWarn, "9p: fid %v leaked on close", info.Fid)
+		}
+	}
+
+	if fa, ok := c.transport.(flushAller); ok && c.flushTimeout > 0 {
+		ctx, cancel := context.WithTimeout(c.ctx, c.flushTimeout)
+		defer cancel()
+
+		// closing proceeds even if the server doesn't answer in time.
+		fa.flushAll(ctx)
+	}
+
+	return c.close()
+}
+
+// close closes the transport of the session.
+func (c *client) close() error {
+	if closer, ok := c.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// shutdowner is implemented by transports that can close after the
+// outstanding requests are answered.
+type shutdowner interface {
+	shutdown(ctx context.Context) error
+}
+
+// Shutdown gracefully closes the session. New calls fail with ErrClosed,
+// while calls waiting on a response are allowed to complete, or to be
+// flushed if their context is done. Once no requests are outstanding, the
+// session is closed. If ctx is done first, the session is closed anyway,
+// failing the remaining calls with ErrClosed, and the error from ctx is
+// returned. Sessions that can't shut down gracefully are closed.
+func Shutdown(ctx context.Context, session Session) error {
+	if c, ok := clientOf(session); ok {
+		if sd, ok := c.transport.(shutdowner); ok {
+			return sd.shutdown(ctx)
+		}
+	}
+
+	if closer, ok := closerOf(session); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (c *client) fidpool() *fidPool {
+	return c.fids
+}
+
+// send sends msg on the session's transport, for messages not covered by the
+// Session interface.
+func (c *client) send(ctx context.Context, msg Message) (Message, error) {
+	return c.transport.send(ctx, msg)
+}
+
+func (c *client) defaultContext() context.Context {
+	return c.defctx
+}
+
+func (c *client) maxDirReads() int {
+	return c.dirReads
+}
+
+// checkQid warns if qid, returned by op on fid, does not match the qid
+// recorded for fid.
+func (c *client) checkQid(op string, fid Fid, qid Qid) {
+	if !c.qidChecks {
+		return
+	}
+
+	if expected, ok := c.fids.qid(fid); ok && expected.Path != qid.Path {
+		logf(c.logger, LogWarn, "9p: %s of fid %v returned qid path %#x, expected %#x", op, fid, qid.Path, expected.Path)
+	}
+}
+
+// invalidateStat drops the cached Stat of the file fid refers to, if any.
+func (c *client) invalidateStat(fid Fid) {
+	if c.stats == nil {
+		return
+	}
+
+	if qid, ok := c.fids.qid(fid); ok {
+		c.stats.invalidate(qid.Path)
+	}
+}
+
+// checkNames returns ErrNameTooLong if any of names cannot be encoded as a 9p
+// string. Catching this before sending keeps a bad frame off the connection.
+func checkNames(names ...string) error {
+	for _, name := range names {
+		if len(name) > maxStringLen {
+			return ErrNameTooLong
+		}
+	}
+
+	return nil
+}
 
 func (c *client) Version() (int, string) {
+	if lt, ok := c.transport.(*lazyTransport); ok {
+		return lt.negotiated()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.msize, c.version
 }
 
+// Renegotiate sends a new Tversion on session, offering msize, so that a
+// session can grow its messages for bulk transfers or shrink them for a
+// constrained link. It waits for outstanding calls to complete, and holds
+// new calls until the server answers. The msize the server accepts, which
+// may be smaller, is returned and reported by Version from then on.
+//
+// Per version(5), the server resets the session: every fid is clunked and
+// must be established again with Attach. The negotiated version does not
+// change. Renegotiate returns ErrUnsupported for sessions that can't
+// renegotiate, such as those dialed WithLazyDial or WithReconnect.
+func Renegotiate(ctx context.Context, session Session, msize int) (int, error) {
+	c, ok := clientOf(session)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+
+	rn, ok := c.transport.(renegotiator)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+
+	msize, err := rn.renegotiate(ctx, c.version, msize)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.msize = msize
+	c.mu.Unlock()
+
+	c.fids.reset()
+	return msize, nil
+}
+
 func (c *client) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid, error) {
+	if err := checkNames(uname, aname); err != nil {
+		return Qid{}, err
+	}
+
 	m := MessageTauth{
 		Afid:  afid,
 		Uname: uname,
@@ -48,7 +369,7 @@ func (c *client) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid,
 
 	resp, err := c.transport.send(ctx, m)
 	if err != nil {
-		return Qid{}, nil
+		return Qid{}, err
 	}
 
 	rauth, ok := resp.(MessageRauth)
@@ -56,10 +377,25 @@ func (c *client) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid,
 		return Qid{}, ErrUnexpectedMsg
 	}
 
+	c.fids.mark(afid, rauth.Qid, "")
 	return rauth.Qid, nil
 }
 
 func (c *client) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	if err := checkNames(uname, aname); err != nil {
+		return Qid{}, err
+	}
+
+	if afid == NOFID && c.auth != nil {
+		return authAttach(ctx, c, c.fids, c.auth, fid, uname, aname, func(afid Fid) (Qid, error) {
+			return c.attach(ctx, fid, afid, uname, aname)
+		})
+	}
+
+	return c.attach(ctx, fid, afid, uname, aname)
+}
+
+func (c *client) attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
 	m := MessageTattach{
 		Fid:   fid,
 		Afid:  afid,
@@ -77,10 +413,87 @@ func (c *client) Attach(ctx context.Context, fid, afid Fid, uname, aname string)
 		return Qid{}, ErrUnexpectedMsg
 	}
 
+	c.fids.mark(fid, rattach.Qid, "/")
+	if afid == NOFID {
+		c.fids.attached(fid, uname, aname)
+	}
 	return rattach.Qid, nil
 }
 
+// authAttach attaches fid on session after authenticating with fn over an
+// afid from fids, unless the server refuses the Tauth. The attach itself,
+// with the afid or NOFID, is left to attach.
+func authAttach(ctx context.Context, session Session, fids *fidPool, fn AuthFunc, fid Fid, uname, aname string, attach func(afid Fid) (Qid, error)) (Qid, error) {
+	afid, err := fids.get()
+	if err != nil {
+		return Qid{}, err
+	}
+
+	if afid == fid {
+		// fid is not in use until the attach, so the pool may hand it out.
+		afid, err = fids.get()
+		fids.put(fid)
+		if err != nil {
+			return Qid{}, err
+		}
+	}
+
+	if _, err := session.Auth(ctx, afid, uname, aname); err != nil {
+		fids.put(afid)
+		if _, ok := err.(MessageRerror); !ok {
+			return Qid{}, err
+		}
+
+		// no authentication required, or none the server can do.
+		return attach(NOFID)
+	}
+	defer session.Clunk(ctx, afid)
+
+	if err := fn(ctx, session, afid, uname, aname); err != nil {
+		return Qid{}, err
+	}
+
+	return attach(afid)
+}
+
+// Authenticate returns a Middleware that authenticates each call to Attach
+// with NOFID as afid using fn, as WithAuth does, for sessions dialed without
+// it. The wrapped session must have a fid pool, from which the afid is
+// allocated; otherwise, Attach fails with ErrNoFidPool.
+func Authenticate(fn AuthFunc) Middleware {
+	return func(next Session) Session {
+		return authenticating{Session: next, auth: fn}
+	}
+}
+
+type authenticating struct {
+	Session
+	auth AuthFunc
+}
+
+func (a authenticating) Unwrap() Session {
+	return a.Session
+}
+
+func (a authenticating) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	if afid != NOFID {
+		return a.Session.Attach(ctx, fid, afid, uname, aname)
+	}
+
+	fids, err := fidpoolOf(a.Session)
+	if err != nil {
+		return Qid{}, err
+	}
+
+	return authAttach(ctx, a.Session, fids, a.auth, fid, uname, aname, func(afid Fid) (Qid, error) {
+		return a.Session.Attach(ctx, fid, afid, uname, aname)
+	})
+}
+
 func (c *client) Clunk(ctx context.Context, fid Fid) error {
+	// the fid is no longer valid after a clunk, even if it fails.
+	defer c.fids.put(fid)
+
 	resp, err := c.transport.send(ctx, MessageTclunk{
 		Fid: fid,
 	})
@@ -97,6 +510,10 @@ func (c *client) Clunk(ctx context.Context, fid Fid) error {
 }
 
 func (c *client) Remove(ctx context.Context, fid Fid) error {
+	// remove clunks the fid, even if it fails.
+	defer c.fids.put(fid)
+	defer c.invalidateStat(fid)
+
 	resp, err := c.transport.send(ctx, MessageTremove{
 		Fid: fid,
 	})
@@ -113,14 +530,26 @@ func (c *client) Remove(ctx context.Context, fid Fid) error {
 }
 
 func (c *client) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) ([]Qid, error) {
-	if len(names) > 16 {
+	if len(names) > maxWalkNames {
 		return nil, ErrWalkLimit
 	}
 
-	resp, err := c.transport.send(ctx, MessageTwalk{
-		Fid:    fid,
-		Newfid: newfid,
-		Wnames: names,
+	if err := checkNames(names...); err != nil {
+		return nil, err
+	}
+
+	if newfid != fid && c.fids.established(newfid) {
+		// the server would either reject the walk or silently replace the
+		// fid, depending on the implementation.
+		return nil, ErrFidInUse
+	}
+
+	resp, err := c.retry(ctx, func() (Message, error) {
+		return c.transport.send(ctx, MessageTwalk{
+			Fid:    fid,
+			Newfid: newfid,
+			Wnames: names,
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -131,14 +560,38 @@ func (c *client) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string)
 		return nil, ErrUnexpectedMsg
 	}
 
+	if len(rwalk.Qids) == len(names) {
+		// newfid is only established if the walk completes.
+		var qid Qid
+		if len(names) > 0 {
+			qid = rwalk.Qids[len(names)-1]
+		}
+
+		c.fids.walked(fid, newfid, names, qid)
+	}
+
 	return rwalk.Qids, nil
 }
 
 func (c *client) Read(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
-	resp, err := c.transport.send(ctx, MessageTread{
+	// the server returns at most the iounit of the fid, and may reject
+	// larger reads.
+	if size := IOUnit(c, fid); len(p) > size {
+		p = p[:size]
+	}
+
+	msg := MessageTread{
 		Fid:    fid,
 		Offset: uint64(offset),
 		Count:  uint32(len(p)),
+	}
+
+	resp, err := c.retry(ctx, func() (Message, error) {
+		if ri, ok := c.transport.(readIntoer); ok {
+			return ri.sendInto(ctx, msg, p)
+		}
+
+		return c.transport.send(ctx, msg)
 	})
 	if err != nil {
 		return 0, err
@@ -149,10 +602,36 @@ func (c *client) Read(ctx context.Context, fid Fid, p []byte, offset int64) (n i
 		return 0, ErrUnexpectedMsg
 	}
 
+	if len(rread.Data) > 0 && len(p) > 0 && &rread.Data[0] == &p[0] {
+		return len(rread.Data), nil // decoded in place.
+	}
+
 	return copy(p, rread.Data), nil
 }
 
 func (c *client) Write(ctx context.Context, fid Fid, p []byte, offset int64) (n int, err error) {
+	// even a failed write may have changed the file.
+	defer c.invalidateStat(fid)
+
+	// writes larger than the iounit of the fid are split, since the server
+	// may reject them. A short write ends the split.
+	size := IOUnit(c, fid)
+	for {
+		chunk := p[n:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		nn, err := c.write(ctx, fid, chunk, offset+int64(n))
+		n += nn
+		if err != nil || nn < len(chunk) || n == len(p) {
+			return n, err
+		}
+	}
+}
+
+// write writes p at offset in a single message.
+func (c *client) write(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
 	resp, err := c.transport.send(ctx, MessageTwrite{
 		Fid:    fid,
 		Offset: uint64(offset),
@@ -167,6 +646,12 @@ func (c *client) Write(ctx context.Context, fid Fid, p []byte, offset int64) (n
 		return 0, ErrUnexpectedMsg
 	}
 
+	if int(rwrite.Count) > len(p) {
+		// the server claims to have written more than we sent. We can't
+		// trust the count to advance an offset.
+		return 0, ErrBadcount
+	}
+
 	return int(rwrite.Count), nil
 }
 
@@ -184,10 +669,20 @@ func (c *client) Open(ctx context.Context, fid Fid, mode Flag) (Qid, uint32, err
 		return Qid{}, 0, ErrUnexpectedMsg
 	}
 
+	c.checkQid("open", fid, ropen.Qid)
+	if mode&OTRUNC != 0 {
+		c.invalidateStat(fid)
+	}
+	c.fids.opened(fid, "", ropen.Qid, mode, ropen.IOUnit)
+
 	return ropen.Qid, ropen.IOUnit, nil
 }
 
 func (c *client) Create(ctx context.Context, parent Fid, name string, perm uint32, mode Flag) (Qid, uint32, error) {
+	if err := checkNames(name); err != nil {
+		return Qid{}, 0, err
+	}
+
 	resp, err := c.transport.send(ctx, MessageTcreate{
 		Fid:  parent,
 		Name: name,
@@ -203,11 +698,31 @@ func (c *client) Create(ctx context.Context, parent Fid, name string, perm uint3
 		return Qid{}, 0, ErrUnexpectedMsg
 	}
 
+	c.invalidateStat(parent) // the directory has a new entry.
+	c.fids.opened(parent, name, rcreate.Qid, mode, rcreate.IOUnit)
+
 	return rcreate.Qid, rcreate.IOUnit, nil
 }
 
 func (c *client) Stat(ctx context.Context, fid Fid) (Dir, error) {
-	resp, err := c.transport.send(ctx, MessageTstat{Fid: fid})
+	var (
+		qid    Qid
+		cached bool
+		gen    uint64
+	)
+	if c.stats != nil {
+		if qid, cached = c.fids.qid(fid); cached {
+			d, g, hit := c.stats.get(qid.Path)
+			if hit {
+				return d, nil
+			}
+			gen = g
+		}
+	}
+
+	resp, err := c.retry(ctx, func() (Message, error) {
+		return c.transport.send(ctx, MessageTstat{Fid: fid})
+	})
 	if err != nil {
 		return Dir{}, err
 	}
@@ -217,10 +732,20 @@ func (c *client) Stat(ctx context.Context, fid Fid) (Dir, error) {
 		return Dir{}, ErrUnexpectedMsg
 	}
 
+	c.checkQid("stat", fid, rstat.Stat.Qid)
+	if cached && rstat.Stat.Qid.Path == qid.Path {
+		c.stats.put(qid.Path, gen, rstat.Stat)
+	}
+
 	return rstat.Stat, nil
 }
 
 func (c *client) WStat(ctx context.Context, fid Fid, dir Dir) error {
+	if err := checkNames(dir.Name, dir.UID, dir.GID, dir.MUID); err != nil {
+		return err
+	}
+	defer c.invalidateStat(fid)
+
 	resp, err := c.transport.send(ctx, MessageTwstat{
 		Fid:  fid,
 		Stat: dir,
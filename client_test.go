@@ -0,0 +1,548 @@
+package p9p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newTestSession returns a client session connected over an in-memory pipe
+// to a server dispatching to handler, configured with opts. Call the returned
+// function to tear down both ends.
+func newTestSession(t *testing.T, handler Handler, opts ...SessionOption) (Session, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cconn, sconn := net.Pipe()
+
+	go ServeConn(ctx, sconn, handler)
+
+	session, err := NewSession(ctx, cconn, opts...)
+	if err != nil {
+		cancel()
+		t.Fatalf("error creating session: %v", err)
+	}
+
+	return session, func() {
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+// TestCloseFlush ensures that closing a session created WithFlushOnClose
+// flushes every outstanding request and waits for the server to acknowledge
+// them.
+func TestCloseFlush(t *testing.T) {
+	const n = 3
+	started := make(chan context.Context, n)
+	handler := HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			started <- ctx
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrUnknownMsg
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, handler)
+
+	session, err := NewSession(ctx, cconn, WithFlushOnClose(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := session.Read(ctx, 1, make([]byte, 10), 0)
+			errs <- err
+		}()
+	}
+
+	var handlers []context.Context
+	for i := 0; i < n; i++ {
+		handlers = append(handlers, <-started)
+	}
+
+	if err := session.(io.Closer).Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	for _, hctx := range handlers {
+		if hctx.Err() == nil {
+			t.Fatalf("request was not flushed on the server")
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		err := <-errs
+		cerr, ok := err.(CancelError)
+		if !ok || !cerr.Flushed || cerr.Err != ErrClosed {
+			t.Fatalf("unexpected error for flushed request: %#v", err)
+		}
+	}
+
+	if _, err := session.Read(ctx, 1, make([]byte, 10), 0); err != ErrClosed {
+		t.Fatalf("expected closed session: %v", err)
+	}
+}
+
+// TestWriteCountExceeded ensures that a server reporting more bytes written
+// than were sent is treated as a protocol error.
+func TestWriteCountExceeded(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTwrite:
+			return MessageRwrite{Count: uint32(len(msg.Data) + 1)}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	n, err := session.Write(context.Background(), 1, []byte("data"), 0)
+	if err != ErrBadcount {
+		t.Fatalf("expected bad count error: %v", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("unexpected count: %v", n)
+	}
+}
+
+// TestNameTooLong ensures that names that cannot be encoded are rejected
+// before they are sent.
+func TestNameTooLong(t *testing.T) {
+	var calls int32
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	name := strings.Repeat("a", 70000)
+
+	if _, err := session.Attach(ctx, 1, NOFID, name, "/"); err != ErrNameTooLong {
+		t.Fatalf("attach: expected name too long: %v", err)
+	}
+
+	if _, err := session.Attach(ctx, 1, NOFID, "user", name); err != ErrNameTooLong {
+		t.Fatalf("attach: expected name too long: %v", err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "a", name); err != ErrNameTooLong {
+		t.Fatalf("walk: expected name too long: %v", err)
+	}
+
+	if _, _, err := session.Create(ctx, 1, name, 0644, OREAD); err != ErrNameTooLong {
+		t.Fatalf("create: expected name too long: %v", err)
+	}
+
+	if err := session.WStat(ctx, 1, Dir{Name: name}); err != ErrNameTooLong {
+		t.Fatalf("wstat: expected name too long: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("unexpected requests reached the server: %v", n)
+	}
+
+	if _, err := NewCodec().Marshal(MessageTcreate{Name: name}); err != ErrNameTooLong {
+		t.Fatalf("marshal: expected name too long: %v", err)
+	}
+}
+
+// TestQidChecks ensures that a change in the qid path of a fid is reported.
+func TestQidChecks(t *testing.T) {
+	var path uint64 = 1
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR, Path: path}}, nil
+		case MessageTstat:
+			return MessageRstat{Stat: Dir{Qid: Qid{Type: QTDIR, Path: path}}}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithQidChecks())
+	defer cleanup()
+
+	var buf logBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "qid path") {
+		t.Fatalf("unexpected warning: %q", buf.String())
+	}
+
+	path = 2
+	if _, err := session.Stat(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "stat of fid 1 returned qid path 0x2, expected 0x1") {
+		t.Fatalf("expected warning: %q", buf.String())
+	}
+}
+
+// TestWithLogger ensures that the output of a session goes to its logger, at
+// the expected level.
+func TestWithLogger(t *testing.T) {
+	warnings := make(chan string, 1)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR, Path: 1}}, nil
+		case MessageTstat:
+			return MessageRstat{Stat: Dir{Qid: Qid{Type: QTDIR, Path: 2}}}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithQidChecks(), WithLogger(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		if level != LogWarn {
+			return
+		}
+
+		select {
+		case warnings <- fmt.Sprintf(format, args...):
+		default:
+		}
+	})))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case warning := <-warnings:
+		if !strings.Contains(warning, "stat of fid 1 returned qid path 0x2, expected 0x1") {
+			t.Fatalf("unexpected warning: %q", warning)
+		}
+	default:
+		t.Fatal("expected warning")
+	}
+}
+
+// logBuffer captures log output, which may be written by other goroutines
+// while the test reads it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func TestDefaultContext(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		return nil, ErrUnknownMsg
+	}), WithDefaultContext(func(ctx context.Context) context.Context {
+		return WithPriority(ctx, PriorityHigh)
+	}))
+
+	ctx := DefaultContext(session)
+	if priority := GetPriority(ctx); priority != PriorityHigh {
+		t.Fatalf("default context lost its values: priority %v", priority)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatalf("default context done early: %v", ctx.Err())
+	}
+
+	cleanup() // cancels the session context.
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("default context not done with the session")
+	}
+
+	if ctx := DefaultContext(nil); ctx != context.Background() {
+		t.Fatalf("expected background context for a bare session: %v", ctx)
+	}
+}
+
+// TestShutdown ensures that Shutdown lets outstanding calls complete while
+// refusing new ones.
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			close(started)
+			<-release
+			return MessageRread{Data: []byte("data")}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	reads := make(chan error, 1)
+	go func() {
+		_, err := session.Read(ctx, 1, make([]byte, 8), 0)
+		reads <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- Shutdown(ctx, session)
+	}()
+
+	// wait for the shutdown to refuse requests.
+	for {
+		if _, err := session.Stat(ctx, 1); err == ErrClosed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request outstanding: %v", err)
+	default:
+	}
+
+	close(release)
+	if err := <-reads; err != nil {
+		t.Fatalf("outstanding read failed: %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+}
+
+// TestShutdownTimeout ensures that Shutdown closes the session when its
+// context is done before the outstanding calls complete.
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	reads := make(chan error, 1)
+	go func() {
+		_, err := session.Read(context.Background(), 1, make([]byte, 8), 0)
+		reads <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := Shutdown(ctx, session); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded: %v", err)
+	}
+
+	if err := <-reads; err != ErrClosed {
+		t.Fatalf("expected outstanding read to fail with closed: %v", err)
+	}
+}
+
+type countingRoundTripper struct {
+	RoundTripper
+	calls int32
+}
+
+func (rt *countingRoundTripper) RoundTrip(ctx context.Context, msg Message) (Message, error) {
+	atomic.AddInt32(&rt.calls, 1)
+	return rt.RoundTripper.RoundTrip(ctx, msg)
+}
+
+func (rt *countingRoundTripper) Close() error {
+	return rt.RoundTripper.(io.Closer).Close()
+}
+
+// TestRoundTripperSession ensures that a session can be created over a
+// RoundTripper wrapping the one returned by NewRoundTripper.
+func TestRoundTripperSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTstat:
+			return MessageRstat{Stat: Dir{Name: "wrapped"}}, nil
+		}
+
+		return nil, ErrUnknownfid
+	}))
+
+	base, msize, version, err := NewRoundTripper(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &countingRoundTripper{RoundTripper: base}
+	session := NewRoundTripperSession(ctx, rt, msize, version)
+
+	if ms, v := session.Version(); ms != msize || v != DefaultVersion {
+		t.Fatalf("unexpected version: %v %v", ms, v)
+	}
+
+	d, err := session.Stat(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Name != "wrapped" {
+		t.Fatalf("unexpected stat: %v", d)
+	}
+
+	if err := session.Clunk(ctx, 1); err != ErrUnknownfid {
+		t.Fatalf("expected error response: %v", err)
+	}
+
+	if calls := atomic.LoadInt32(&rt.calls); calls != 2 {
+		t.Fatalf("expected 2 calls through the wrapper, got %d", calls)
+	}
+
+	if err := session.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := base.RoundTrip(ctx, MessageTstat{Fid: 1}); err != ErrClosed {
+		t.Fatalf("expected closed RoundTripper: %v", err)
+	}
+}
+
+// TestWithMSize ensures that the msize offered is used, unless the server
+// answers with a smaller one.
+func TestWithMSize(t *testing.T) {
+	for _, tc := range []struct {
+		offer, expected int
+	}{
+		{8192, 8192},
+		{4 * DefaultMSize, DefaultMSize},
+	} {
+		session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return nil, ErrUnknownMsg
+		}), WithMSize(tc.offer))
+
+		if msize, _ := session.Version(); msize != tc.expected {
+			t.Fatalf("offered %v: unexpected msize: %v != %v", tc.offer, msize, tc.expected)
+		}
+		cleanup()
+	}
+}
+
+func TestWithHandshakeTimeout(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close() // never answers.
+
+	start := time.Now()
+	if _, err := NewSession(context.Background(), cconn, WithHandshakeTimeout(50*time.Millisecond)); err == nil {
+		t.Fatal("expected negotiation to time out")
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("negotiation took %v", elapsed)
+	}
+}
+
+// TestWithAuth ensures that attaching runs the authentication protocol over
+// an afid, which is clunked afterwards, and that servers refusing Tauth are
+// attached to without it.
+func TestWithAuth(t *testing.T) {
+	for _, required := range []bool{true, false} {
+		var (
+			mu     sync.Mutex
+			secret string
+		)
+		session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch msg := msg.(type) {
+			case MessageTauth:
+				if !required {
+					return nil, errors.New("authentication not required")
+				}
+
+				return MessageRauth{Qid: Qid{Type: QTAUTH}}, nil
+			case MessageTwrite:
+				secret = string(msg.Data)
+				return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+			case MessageTattach:
+				if required && (msg.Afid == NOFID || secret != "secret") {
+					return nil, ErrPerm
+				}
+
+				return MessageRattach{}, nil
+			case MessageTclunk:
+				return MessageRclunk{}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}), WithAuth(func(ctx context.Context, session Session, afid Fid, uname, aname string) error {
+			_, err := session.Write(ctx, afid, []byte("secret"), 0)
+			return err
+		}))
+
+		ctx := context.Background()
+		if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+			t.Fatalf("required %v: %v", required, err)
+		}
+
+		if fids := OpenFids(session); len(fids) != 1 || fids[0].Fid != 1 {
+			t.Fatalf("required %v: unexpected fids: %v", required, fids)
+		}
+		cleanup()
+	}
+}
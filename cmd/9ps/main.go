@@ -25,48 +25,34 @@ func main() {
 	log.SetFlags(0)
 	flag.Parse()
 
-	proto := "tcp"
+	var (
+		listener net.Listener
+		err      error
+	)
 	if strings.HasPrefix(addr, "unix:") {
-		proto = "unix"
-		addr = addr[5:]
+		listener, err = p9p.ListenUnix(ctx, addr[5:])
+	} else {
+		listener, err = net.Listen("tcp", addr)
 	}
-
-	listener, err := net.Listen(proto, addr)
 	if err != nil {
 		log.Fatalln("error listening:", err)
 	}
 	defer listener.Close()
 
-	for {
-		c, err := listener.Accept()
-		if err != nil {
-			log.Fatalln("error accepting:", err)
-			continue
-		}
-
-		go func(conn net.Conn) {
-			defer conn.Close()
-
-			ctx := context.WithValue(ctx, "conn", conn)
-			log.Println("connected", conn.RemoteAddr())
-			session, err := newLocalSession(ctx, root)
-			if err != nil {
-				log.Println("error creating session")
-				return
-			}
-
-			if err := p9p.ServeConn(ctx, conn, p9p.Dispatch(session)); err != nil {
-				log.Printf("serving conn: %v", err)
-			}
-		}(c)
+	err = p9p.Serve(ctx, listener, func(ctx context.Context, info p9p.ConnInfo) (p9p.Session, error) {
+		log.Println("connected", info.RemoteAddr)
+		return newLocalSession(ctx, root, info)
+	})
+	if err != nil {
+		log.Fatalln("error serving:", err)
 	}
 }
 
 // newLocalSession returns a session to serve the local filesystem, restricted
 // to the provided root.
-func newLocalSession(ctx context.Context, root string) (p9p.Session, error) {
+func newLocalSession(ctx context.Context, root string, info p9p.ConnInfo) (p9p.Session, error) {
 	// silly, just connect to ufs for now! replace this with real code later!
-	log.Println("dialing", ":5640", "for", ctx.Value("conn"))
+	log.Println("dialing", ":5640", "for", info.RemoteAddr)
 	conn, err := net.Dial("tcp", ":5640")
 	if err != nil {
 		return nil, err
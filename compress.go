@@ -0,0 +1,92 @@
+package p9p
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// CompressConn wraps conn in a deflate stream, at the provided compress/flate
+// level. Both ends of the connection must be wrapped, since the result is not
+// compatible with plain 9p. On the client, use WithCompression. On the
+// server, pass the wrapped connection to ServeConn.
+//
+// The compressor is flushed on every write, which the channel issues once per
+// frame, so messages are never held back waiting for more data. This keeps
+// request latency close to an uncompressed connection but costs a few bytes
+// of sync marker per frame and some CPU on each end. It pays off for
+// directory listings and text over slow links and is a loss for data that is
+// already compressed.
+//
+// The compressor state cannot survive a failed write, so all write errors,
+// including timeouts, are permanent.
+func CompressConn(conn net.Conn, level int) (net.Conn, error) {
+	zw, err := flate.NewWriter(conn, level)
+	if err != nil {
+		return nil, err
+	}
+
+	// The decompressor also cannot survive a read timeout. Decompress into a
+	// pipe from a separate goroutine and apply read deadlines to the pipe.
+	rd, wr := net.Pipe()
+	go func() {
+		io.Copy(wr, flate.NewReader(conn))
+		wr.Close()
+	}()
+
+	return &compressConn{
+		Conn: conn,
+		rd:   rd,
+		zw:   zw,
+	}, nil
+}
+
+// compressConn reads decompressed data from rd and compresses writes through
+// zw onto the embedded connection.
+type compressConn struct {
+	net.Conn
+	rd   net.Conn
+	zw   *flate.Writer
+	werr error
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	if c.werr != nil {
+		return 0, c.werr
+	}
+
+	n, err := c.zw.Write(p)
+	if err == nil {
+		err = c.zw.Flush()
+	}
+
+	if err != nil {
+		c.werr = fmt.Errorf("9p: compressed write failed: %v", err)
+		return n, c.werr
+	}
+
+	return n, nil
+}
+
+func (c *compressConn) Close() error {
+	c.rd.Close()
+	return c.Conn.Close()
+}
+
+func (c *compressConn) SetDeadline(t time.Time) error {
+	if err := c.rd.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *compressConn) SetReadDeadline(t time.Time) error {
+	return c.rd.SetReadDeadline(t)
+}
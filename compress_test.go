@@ -0,0 +1,51 @@
+package p9p
+
+import (
+	"bytes"
+	"compress/flate"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCompressedSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	zconn, err := CompressConn(sconn, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ServeConn(ctx, zconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			return MessageRread{Data: data[:msg.Count]}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+
+	session, err := NewSession(ctx, cconn, WithCompression(flate.BestSpeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		p := make([]byte, len(data))
+		n, err := session.Read(ctx, 1, p, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(p[:n], data) {
+			t.Fatalf("unexpected data read over compressed session")
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package p9p
 
 import (
+	"net"
+
 	"golang.org/x/net/context"
 )
 
 type contextKey string
 
 const (
-	versionKey contextKey = "9p.version"
+	versionKey  contextKey = "9p.version"
+	connInfoKey contextKey = "9p.conn"
 )
 
 func withVersion(ctx context.Context, version string) context.Context {
@@ -24,3 +27,81 @@ func GetVersion(ctx context.Context) string {
 	}
 	return v
 }
+
+func withConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey, info)
+}
+
+// GetConnInfo returns the connection a request was received on, from the
+// context passed to a handler, or to the SessionFactory of a connection, by
+// a server. If the context is not from a server, false is returned.
+func GetConnInfo(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey).(ConnInfo)
+	return info, ok
+}
+
+// RemoteAddr returns the address of the peer a request was received from,
+// from the context passed to a handler by a server. If the address is not
+// known, such as for a connection served with ServeChannel, nil is returned.
+func RemoteAddr(ctx context.Context) net.Addr {
+	info, _ := GetConnInfo(ctx)
+	return info.RemoteAddr
+}
+
+// Priority orders the requests waiting to be sent on a client session. When
+// more requests are ready than the connection can take, requests with a higher
+// priority are sent first. Requests of equal priority are sent in the order
+// they were made. Any value may be used; the constants cover common cases.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0 // default for requests without a priority
+	PriorityHigh   Priority = 1
+)
+
+const priorityKey contextKey = "9p.priority"
+
+// WithPriority returns a context that sends client requests made with it at
+// the provided priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey, priority)
+}
+
+// GetPriority returns the request priority from the context. If no priority
+// has been set, PriorityNormal is returned.
+func GetPriority(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey).(Priority)
+	if !ok {
+		return PriorityNormal
+	}
+	return p
+}
+
+// DefaultContext returns the default context of a client session, for tools
+// and helpers that have no context of their own. It is derived from the
+// context passed to NewSession, so it is done once the session is done. Use
+// WithDefaultContext to attach values, such as a priority, to it. For other
+// sessions, context.Background() is returned.
+//
+// The default context is never combined with the context passed to a
+// Session method. An explicit context always takes precedence and is used as
+// is.
+func DefaultContext(session Session) context.Context {
+	var dc defaultContexter
+	walkSessions(session, func(session Session) bool {
+		dc, _ = session.(defaultContexter)
+		return dc != nil
+	})
+
+	if dc != nil {
+		return dc.defaultContext()
+	}
+
+	return context.Background()
+}
+
+// defaultContexter is implemented by sessions that carry a default context.
+type defaultContexter interface {
+	defaultContext() context.Context
+}
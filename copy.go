@@ -0,0 +1,96 @@
+package p9p
+
+import (
+	"errors"
+	pathpkg "path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+var errCopyIntoSelf = errors.New("cannot copy a directory into itself")
+
+// Copy copies the file at srcPath on src to dstPath on dst, which may be
+// clients of different servers. Directories are copied recursively, merging
+// with any directory already at dstPath, and files at dstPath are replaced.
+//
+// Data is streamed as with OpenStream and written in messages of the size
+// dst allows. Once the contents of a copy are written, its mode and
+// modification time are set to those of the source with wstat.
+func Copy(ctx context.Context, dst *Client, dstPath string, src *Client, srcPath string) error {
+	if dst == src {
+		s, d := pathpkg.Clean("/"+srcPath), pathpkg.Clean("/"+dstPath)
+		if d == s || strings.HasPrefix(d, strings.TrimSuffix(s, "/")+"/") {
+			return &PathError{Op: "copy", Path: dstPath, Err: errCopyIntoSelf}
+		}
+	}
+
+	dir, err := src.Stat(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+
+	if dir.Qid.Type&QTDIR != 0 {
+		err = copyDir(ctx, dst, dstPath, src, srcPath, dir)
+	} else {
+		err = copyFile(ctx, dst, dstPath, src, srcPath, dir)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return dst.setModes(ctx, dstPath, dir)
+}
+
+func copyDir(ctx context.Context, dst *Client, dstPath string, src *Client, srcPath string, dir Dir) error {
+	if err := dst.MkdirAll(ctx, dstPath, dir.Mode&0777); err != nil {
+		return err
+	}
+
+	entries, err := src.ReadDir(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range entries {
+		if err := Copy(ctx, dst, pathpkg.Join(dstPath, d.Name), src, pathpkg.Join(srcPath, d.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(ctx context.Context, dst *Client, dstPath string, src *Client, srcPath string, dir Dir) error {
+	rc, err := src.OpenStream(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := dst.createTrunc(ctx, dstPath, dir.Mode&0777)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFrom(ctx, dst.session, f.fid, 0, rc, f.size)
+	if cerr := dst.session.Clunk(ctx, f.fid); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return &PathError{Op: "copy", Path: dstPath, Err: err}
+	}
+
+	return nil
+}
+
+// setModes sets the mode and modification time of the file at path to those
+// of dir, leaving the rest of its entry alone.
+func (c *Client) setModes(ctx context.Context, path string, dir Dir) error {
+	d := syncDir
+	d.Mode = dir.Mode
+	d.ModTime = dir.ModTime
+	return c.wstat(ctx, "wstat", path, d)
+}
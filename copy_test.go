@@ -0,0 +1,91 @@
+package p9p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestCopy copies a directory tree between two servers, ensuring that data,
+// modes and modification times are preserved.
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	mtime := time.Unix(1000000000, 0)
+
+	src := newMemTree("dir/a", "dir/sub/b")
+	src.data["dir/a"] = bytes.Repeat([]byte("0123456789"), 100)
+	src.data["dir/sub/b"] = []byte("b")
+	src.modes["dir"] = DMDIR | 0750
+	src.modes["dir/a"] = 0640
+	src.mtimes["dir/a"] = mtime
+	src.mtimes["dir/sub"] = mtime.Add(time.Hour)
+
+	dst := newMemTree("copy/a")
+	dst.data["copy/a"] = bytes.Repeat([]byte("x"), 2000) // replaced by the copy.
+
+	clients := make([]*Client, 2)
+	for i, tree := range []*memTree{src, dst} {
+		session, cleanup := newTestSession(t, tree, WithMSize(IOHDRSZ+300))
+		defer cleanup()
+
+		c, err := NewClient(ctx, session, "test", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	if err := Copy(ctx, clients[1], "/copy", clients[0], "/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	for _, p := range []string{"a", "sub/b"} {
+		if !bytes.Equal(dst.data["copy/"+p], src.data["dir/"+p]) {
+			t.Fatalf("%v: unexpected data: %q", p, dst.data["copy/"+p])
+		}
+	}
+
+	if !dst.files["copy/sub"] {
+		t.Fatalf("expected directory copy/sub")
+	}
+
+	if dst.modes["copy"] != DMDIR|0750 || dst.modes["copy/a"] != 0640 {
+		t.Fatalf("unexpected modes: %o, %o", dst.modes["copy"], dst.modes["copy/a"])
+	}
+
+	if !dst.mtimes["copy/a"].Equal(mtime) || !dst.mtimes["copy/sub"].Equal(mtime.Add(time.Hour)) {
+		t.Fatalf("unexpected modification times: %v", dst.mtimes)
+	}
+
+	if len(dst.fids) != 1 {
+		t.Fatalf("fids leaked: %v", dst.fids)
+	}
+}
+
+func TestCopyIntoSelf(t *testing.T) {
+	ctx := context.Background()
+	session, cleanup := newTestSession(t, newMemTree("dir/a"))
+	defer cleanup()
+
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, dstPath := range []string{"/dir", "dir/copy"} {
+		err := Copy(ctx, c, dstPath, c, "/dir")
+		if perr, ok := err.(*PathError); !ok || perr.Err != errCopyIntoSelf {
+			t.Fatalf("%v: expected error copying into itself: %v", dstPath, err)
+		}
+	}
+
+	if err := Copy(ctx, c, "/dir2", c, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package p9p
+
+import "golang.org/x/net/context"
+
+// CreateExclusive creates and opens name in the directory dir, failing with
+// ErrExist if the file already exists. As with Session.Create, dir refers to
+// the new file on success.
+//
+// The server decides whether a file exists, so this is as atomic as its
+// create. Note that the DMEXCL bit of perm requests an exclusive use file,
+// which is unrelated to exclusive creation.
+func CreateExclusive(ctx context.Context, session Session, dir Fid, name string, perm uint32, mode Flag) (Qid, uint32, error) {
+	qid, iounit, err := session.Create(ctx, dir, name, perm, mode)
+	if err != nil {
+		if IsExist(err) {
+			return Qid{}, 0, ErrExist
+		}
+
+		return Qid{}, 0, err
+	}
+
+	return qid, iounit, nil
+}
+
+// createOrOpenAttempts limits how many times CreateOrOpen retries when the
+// file is removed and created by others between its calls.
+const createOrOpenAttempts = 3
+
+// CreateOrOpen creates and opens name in the directory dir, opening the
+// existing file with mode if it already exists. The result reports whether
+// the file was created. Either way, dir refers to the file on success.
+//
+// If the file exists but cannot be opened, dir may already refer to the file
+// rather than the directory and should be clunked.
+func CreateOrOpen(ctx context.Context, session Session, dir Fid, name string, perm uint32, mode Flag) (qid Qid, iounit uint32, created bool, err error) {
+	for attempt := 0; attempt < createOrOpenAttempts; attempt++ {
+		qid, iounit, err = CreateExclusive(ctx, session, dir, name, perm, mode)
+		if err != ErrExist {
+			return qid, iounit, err == nil, err
+		}
+
+		// walk in place, leaving dir untouched unless name is still there.
+		qids, werr := session.Walk(ctx, dir, dir, name)
+		if werr != nil && !IsNotExist(werr) {
+			return Qid{}, 0, false, werr
+		}
+
+		if len(qids) != 1 {
+			continue // removed since the create, try again.
+		}
+
+		qid, iounit, err = session.Open(ctx, dir, mode)
+		return qid, iounit, false, err
+	}
+
+	// the file keeps appearing and disappearing under us.
+	return Qid{}, 0, false, err
+}
@@ -0,0 +1,58 @@
+package p9p
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCreateExclusive(t *testing.T) {
+	var opened []string
+	files := map[string]bool{"existing": true}
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTcreate:
+			if files[msg.Name] {
+				return nil, MessageRerror{Ename: "file exists"} // wording varies
+			}
+
+			files[msg.Name] = true
+			return MessageRcreate{Qid: Qid{Path: 1}}, nil
+		case MessageTwalk:
+			if len(msg.Wnames) != 1 || !files[msg.Wnames[0]] {
+				return nil, ErrNotfound
+			}
+
+			opened = append(opened, msg.Wnames[0])
+			return MessageRwalk{Qids: []Qid{{Path: 2}}}, nil
+		case MessageTopen:
+			return MessageRopen{Qid: Qid{Path: 2}}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, _, err := CreateExclusive(ctx, session, 1, "new", 0644, OWRITE); err != nil {
+		t.Fatalf("unexpected error creating: %v", err)
+	}
+
+	if _, _, err := CreateExclusive(ctx, session, 1, "new", 0644, OWRITE); err != ErrExist {
+		t.Fatalf("expected exists error: %v", err)
+	}
+
+	qid, _, created, err := CreateOrOpen(ctx, session, 1, "other", 0644, OWRITE)
+	if err != nil || !created || qid.Path != 1 {
+		t.Fatalf("expected create, got qid %v, created %v: %v", qid, created, err)
+	}
+
+	qid, _, created, err = CreateOrOpen(ctx, session, 1, "existing", 0644, OWRITE)
+	if err != nil || created || qid.Path != 2 {
+		t.Fatalf("expected open, got qid %v, created %v: %v", qid, created, err)
+	}
+
+	if len(opened) != 1 || opened[0] != "existing" {
+		t.Fatalf("unexpected walks: %v", opened)
+	}
+}
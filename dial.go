@@ -0,0 +1,124 @@
+package p9p
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Dial connects to address on the named network and returns a session over
+// the connection, as with net.Dial and NewSession. The context ctx governs
+// both the connection attempt and the lifetime of the session.
+//
+// If a Metrics is configured, the time spent connecting and negotiating is
+// reported once the session is established. If the session is dialed
+// WithLazyDial, connecting is deferred until the session is first used.
+func Dial(ctx context.Context, network, address string, opts ...SessionOption) (Session, error) {
+	so := newSessionOptions(opts)
+	return dialSession(ctx, func(ctx context.Context) (Channel, string, int, error) {
+		_, ch, version, msize, err := dial(ctx, network, address, so)
+		return ch, version, msize, err
+	}, so)
+}
+
+// connectFunc connects to a server and negotiates a channel, returning the
+// version and msize negotiated.
+type connectFunc func(ctx context.Context) (Channel, string, int, error)
+
+// dialSession returns a session over the channel from connect, lazily or
+// reconnecting as configured by so.
+func dialSession(ctx context.Context, connect connectFunc, so sessionOptions) (Session, error) {
+	if so.reconnect {
+		return dialReconnect(ctx, connect, so)
+	}
+
+	if so.lazy {
+		lt := newLazyTransport(ctx, so, func() (Channel, string, int, error) {
+			return connect(ctx)
+		})
+
+		return newClient(ctx, lt, "", 0, so), nil
+	}
+
+	ch, version, msize, err := connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(ctx, newTransport(ctx, ch, so), version, msize, so), nil
+}
+
+// dial connects to address and negotiates a channel over the connection. The
+// connection is returned for callers that abandon the channel to close.
+func dial(ctx context.Context, network, address string, so sessionOptions) (net.Conn, Channel, string, int, error) {
+	ctx, cancel := so.handshakeContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	conn, err := dialConn(ctx, network, address)
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+
+	if so.tlsConfig != nil {
+		tconn := tls.Client(conn, so.tlsConfig)
+		if err := handshake(ctx, tconn, tconn.Handshake); err != nil {
+			conn.Close()
+			return nil, nil, "", 0, err
+		}
+		conn = tconn
+	}
+	connected := time.Now()
+
+	ch, version, msize, err := negotiateConn(ctx, conn, so)
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", 0, err
+	}
+
+	if so.metrics != nil {
+		so.metrics.Dialed(network, address, connected.Sub(start), time.Since(connected))
+	}
+
+	return conn, ch, version, msize, nil
+}
+
+// dialConn connects to address on the named network, dialing the vsock and
+// npipe networks that the net package does not support.
+func dialConn(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "vsock":
+		addr, err := parseVsockAddr(address)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialVsock(ctx, addr)
+	case "npipe":
+		return dialNamedPipe(ctx, address)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// dialReconnect dials a session that dials again when the connection is lost,
+// as configured WithReconnect.
+func dialReconnect(ctx context.Context, connect connectFunc, so sessionOptions) (Session, error) {
+	ch, version, msize, err := connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := newReconnectTransport(ctx, newTransport(ctx, ch, so), nil)
+	c := newClient(ctx, rt, version, msize, so)
+	if so.restoreFids {
+		c.fids.trackOrigins()
+	}
+
+	rt.dial = redialer(ctx, connect, so, version, msize, c.fids, so.restoreFids)
+	return c, nil
+}
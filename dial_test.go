@@ -0,0 +1,152 @@
+package p9p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type dialMetrics struct {
+	network, address   string
+	connect, negotiate time.Duration
+	calls              int
+}
+
+func (m *dialMetrics) Dialed(network, address string, connect, negotiate time.Duration) {
+	m.network, m.address = network, address
+	m.connect, m.negotiate = connect, negotiate
+	m.calls++
+}
+
+func TestDialMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+
+	const delay = 50 * time.Millisecond
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		time.Sleep(delay) // a slow handshake
+		ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return nil, ErrUnknownMsg
+		}))
+	}()
+
+	var metrics dialMetrics
+	session, err := Dial(ctx, "tcp", l.Addr().String(), WithMetrics(&metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if metrics.calls != 1 || metrics.network != "tcp" || metrics.address != l.Addr().String() {
+		t.Fatalf("unexpected dial report: %+v", metrics)
+	}
+
+	// the server may start its delay before the connect is timed.
+	if metrics.negotiate < delay/2 || metrics.connect >= delay {
+		t.Fatalf("unexpected dial latency: connect %v, negotiate %v", metrics.connect, metrics.negotiate)
+	}
+}
+
+func TestDialLazy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+
+			go ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+				switch msg.(type) {
+				case MessageTstat:
+					return MessageRstat{Stat: Dir{Name: "lazy"}}, nil
+				}
+
+				return nil, ErrUnknownMsg
+			}))
+		}
+	}()
+
+	// closing before first use never connects.
+	unused, err := Dial(ctx, "tcp", l.Addr().String(), WithLazyDial())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unused.(io.Closer).Close(); err != nil {
+		t.Fatalf("unexpected error closing unused session: %v", err)
+	}
+
+	if _, err := unused.Stat(ctx, 1); err != ErrClosed {
+		t.Fatalf("expected closed session: %v", err)
+	}
+
+	var metrics dialMetrics
+	session, err := Dial(ctx, "tcp", l.Addr().String(), WithLazyDial(), WithMetrics(&metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	select {
+	case <-accepted:
+		t.Fatalf("connected before first use")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	d, err := session.Stat(ctx, 1)
+	if err != nil {
+		t.Fatalf("unexpected error on first use: %v", err)
+	}
+
+	if d.Name != "lazy" || metrics.calls != 1 {
+		t.Fatalf("unexpected result: %v, %d dials", d, metrics.calls)
+	}
+
+	if msize, version := session.Version(); msize != DefaultMSize || version != DefaultVersion {
+		t.Fatalf("unexpected version: %v, %v", msize, version)
+	}
+
+	select {
+	case <-accepted:
+	default:
+		t.Fatalf("no connection accepted")
+	}
+
+	// connection errors surface on first use.
+	addr := l.Addr().String()
+	l.Close()
+	broken, err := Dial(ctx, "tcp", addr, WithLazyDial())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := broken.Stat(ctx, 1); err == nil {
+		t.Fatalf("expected connection error on first use")
+	}
+}
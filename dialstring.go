@@ -0,0 +1,212 @@
+package p9p
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultPort is the port of the 9fs service, used when an address names
+// none.
+const DefaultPort = "564"
+
+// Addr is the address of a 9p server and the tree to attach on it, as parsed
+// by ParseAddr.
+type Addr struct {
+	Network string // network and address, as accepted by Dial
+	Address string
+	Uname   string // user to attach as, if named by a URL
+	Aname   string // tree to attach
+}
+
+// ParseAddr parses the address of a 9p server, given as a Plan 9 dial string,
+// a URL or a plain host and port.
+//
+// A dial string has the form "net!host!service", such as "tcp!host!564" or
+// "unix!/tmp/ns.user/srv". The network may be tcp, unix, vsock, npipe or net,
+// which stands for tcp. The service may be omitted or named 9fs for the
+// default port, and a bare "host!service" is dialed over tcp.
+//
+// A URL has the scheme 9p, for tcp, or 9p+net for another network, such as
+// "9p://user@host:564/aname" or "9p+unix:///tmp/ns.user/srv?aname=main". The
+// tree to attach is the path of the URL, without its leading slash, or the
+// aname query parameter, which is the only way to name one over unix. The
+// user, if any, is the user to attach as.
+func ParseAddr(s string) (Addr, error) {
+	switch {
+	case strings.Contains(s, "://"):
+		return parseAddrURL(s)
+	case strings.Contains(s, "!"):
+		return parseDialString(s)
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, DefaultPort
+	}
+
+	if host == "" {
+		return Addr{}, fmt.Errorf("address %q: missing host", s)
+	}
+
+	return Addr{Network: "tcp", Address: net.JoinHostPort(host, port)}, nil
+}
+
+func parseDialString(s string) (Addr, error) {
+	parts := strings.SplitN(s, "!", 2)
+	network, rest := parts[0], parts[1]
+
+	switch network {
+	case "unix", "npipe":
+		if rest == "" {
+			return Addr{}, fmt.Errorf("dial string %q: missing path", s)
+		}
+
+		if network == "unix" {
+			rest = unixAddress(rest)
+		}
+
+		return Addr{Network: network, Address: rest}, nil
+	case "net", "tcp", "vsock":
+	default:
+		// "host!service", dialed over the default network.
+		network, rest = "tcp", s
+	}
+
+	if network == "net" {
+		network = "tcp"
+	}
+
+	parts = strings.Split(rest, "!")
+	if len(parts) > 2 || parts[0] == "" {
+		return Addr{}, fmt.Errorf("dial string %q: expected net!host!service", s)
+	}
+
+	host, port := strings.TrimSuffix(strings.TrimPrefix(parts[0], "["), "]"), DefaultPort
+	if len(parts) == 2 && parts[1] != "9fs" {
+		port = parts[1]
+	}
+
+	if network == "vsock" {
+		if len(parts) != 2 {
+			return Addr{}, fmt.Errorf("dial string %q: missing vsock port", s)
+		}
+
+		return Addr{Network: network, Address: host + ":" + port}, nil
+	}
+
+	return Addr{Network: network, Address: net.JoinHostPort(host, port)}, nil
+}
+
+func parseAddrURL(s string) (Addr, error) {
+	// the url package rejects schemes beginning with a digit, so the rest of
+	// the URL is parsed under another.
+	i := strings.Index(s, "://")
+	scheme := s[:i]
+
+	network := "tcp"
+	switch scheme {
+	case "9p":
+	case "9p+tcp", "9p+unix", "9p+vsock":
+		network = strings.TrimPrefix(scheme, "9p+")
+	default:
+		return Addr{}, fmt.Errorf("address %q: unsupported scheme %q", s, scheme)
+	}
+
+	u, err := url.Parse("p9p" + s[i:])
+	if err != nil {
+		return Addr{}, err
+	}
+
+	addr := Addr{Network: network, Aname: u.Query().Get("aname")}
+	if u.User != nil {
+		addr.Uname = u.User.Username()
+	}
+
+	if network == "unix" {
+		if u.Path == "" {
+			return Addr{}, fmt.Errorf("address %q: missing path", s)
+		}
+
+		addr.Address = unixAddress(u.Path)
+		return addr, nil
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return Addr{}, fmt.Errorf("address %q: missing host", s)
+	}
+
+	if port == "" {
+		if network == "vsock" {
+			return Addr{}, fmt.Errorf("address %q: missing vsock port", s)
+		}
+		port = DefaultPort
+	}
+
+	if network == "vsock" {
+		addr.Address = host + ":" + port
+	} else {
+		addr.Address = net.JoinHostPort(host, port)
+	}
+
+	if addr.Aname == "" {
+		addr.Aname = strings.TrimPrefix(u.Path, "/")
+	}
+
+	return addr, nil
+}
+
+// DialAddr dials the server at addr, as parsed by ParseAddr, and returns a
+// Client attached to the tree it names, as the user it names or else uname.
+// Closing the client closes the session. If dialed WithStripes, the client
+// attaches on each connection.
+func DialAddr(ctx context.Context, addr, uname string, opts ...SessionOption) (*Client, error) {
+	a, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Uname != "" {
+		uname = a.Uname
+	}
+
+	c, err := dialClient(ctx, a, uname, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for n := newSessionOptions(opts).stripes; len(c.stripes) < n-1; {
+		sc, err := dialClient(ctx, a, uname, opts)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.stripes = append(c.stripes, sc)
+	}
+
+	return c, nil
+}
+
+// dialClient dials a session to a and returns a Client that owns it.
+func dialClient(ctx context.Context, a Addr, uname string, opts []SessionOption) (*Client, error) {
+	session, err := Dial(ctx, a.Network, a.Address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	closer, _ := closerOf(session)
+	c, err := NewClient(ctx, session, uname, a.Aname)
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	c.closer = closer
+
+	return c, nil
+}
@@ -0,0 +1,113 @@
+package p9p
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		addr Addr
+	}{
+		{"tcp!host!564", Addr{Network: "tcp", Address: "host:564"}},
+		{"tcp!host", Addr{Network: "tcp", Address: "host:564"}},
+		{"net!host!9fs", Addr{Network: "tcp", Address: "host:564"}},
+		{"host!5640", Addr{Network: "tcp", Address: "host:5640"}},
+		{"tcp!::1!564", Addr{Network: "tcp", Address: "[::1]:564"}},
+		{"unix!/tmp/ns.user/srv", Addr{Network: "unix", Address: "/tmp/ns.user/srv"}},
+		{"vsock!3!5640", Addr{Network: "vsock", Address: "3:5640"}},
+		{"host:5640", Addr{Network: "tcp", Address: "host:5640"}},
+		{"host", Addr{Network: "tcp", Address: "host:564"}},
+		{"9p://host:564/aname", Addr{Network: "tcp", Address: "host:564", Aname: "aname"}},
+		{"9p://glenda@host", Addr{Network: "tcp", Address: "host:564", Uname: "glenda"}},
+		{"9p://[::1]//export/data", Addr{Network: "tcp", Address: "[::1]:564", Aname: "/export/data"}},
+		{"9p+unix:///tmp/ns.user/srv?aname=main", Addr{Network: "unix", Address: "/tmp/ns.user/srv", Aname: "main"}},
+		{"9p+vsock://3:5640/", Addr{Network: "vsock", Address: "3:5640"}},
+	} {
+		addr, err := ParseAddr(tc.s)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.s, err)
+		}
+
+		if !reflect.DeepEqual(addr, tc.addr) {
+			t.Fatalf("%q: %+v != %+v", tc.s, addr, tc.addr)
+		}
+	}
+
+	for _, s := range []string{
+		"", "tcp!", "unix!", "tcp!host!564!extra", "vsock!3",
+		"http://host/", "9p:///aname", "9p+unix://host",
+	} {
+		if addr, err := ParseAddr(s); err == nil {
+			t.Fatalf("%q: expected error, got %+v", s, addr)
+		}
+	}
+}
+
+// TestDialAddr dials a dial string, ensuring that the client is attached to
+// the tree named and that closing it closes the session.
+func TestDialAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p9p-dialaddr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "9p.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := ListenUnix(ctx, path)
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+
+	anames := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				tree := newMemTree("file")
+				ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+					if m, ok := msg.(MessageTattach); ok {
+						anames <- m.Uname + " " + m.Aname
+					}
+					return tree.Handle(ctx, msg)
+				}))
+			}(conn)
+		}
+	}()
+
+	client, err := DialAddr(ctx, "9p+unix://glenda@"+path+"?aname=main", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attached := <-anames; attached != "glenda main" {
+		t.Fatalf("unexpected attach: %q", attached)
+	}
+
+	if _, err := client.Stat(ctx, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Session().Stat(ctx, 1); err != ErrClosed {
+		t.Fatalf("expected session closed: %v", err)
+	}
+}
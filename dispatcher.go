@@ -24,6 +24,9 @@ func (fn HandlerFunc) Handle(ctx context.Context, msg Message) (Message, error)
 // Dispatch returns a handler that dispatches messages to the target session.
 // No concurrency is managed by the returned handler. It simply turns messages
 // into function calls on the session.
+//
+// Extension messages, registered with RegisterMessage, are passed to the
+// session's Handle method if it implements Handler.
 func Dispatch(session Session) Handler {
 	return HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
 		switch msg := msg.(type) {
@@ -125,6 +128,18 @@ func Dispatch(session Session) Handler {
 			}
 
 			return MessageRwstat{}, nil
+		case ExtensionMessage:
+			var h Handler
+			walkSessions(session, func(session Session) bool {
+				h, _ = session.(Handler)
+				return h != nil
+			})
+
+			if h != nil {
+				return h.Handle(ctx, msg)
+			}
+
+			return nil, ErrUnknownMsg
 		default:
 			return nil, ErrUnknownMsg
 		}
@@ -12,11 +12,12 @@ proxied through clients and servers.
 Getting Started
 
 The best place to get started is with Serve. Serve can be provided a
-connection and a handler. A typical implementation will call Serve as part of
-a listen/accept loop. As each network connection is created, Serve can be
-called with a handler for the specific connection. The handler can be
-implemented with a Session via the Dispatch function or can generate sessions
-for dispatch in response to client messages. (See cmd/9ps for an example)
+listener and a function returning the session for each connection it
+accepts, which is dispatched with the Dispatch function. For more control,
+ServeConn can be provided a connection and a handler, as part of a
+listen/accept loop or through a Server. The handler can be implemented with a
+Session via the Dispatch function or can generate sessions for dispatch in
+response to client messages. (See cmd/9ps for an example)
 
 On the client side, NewSession provides a 9p session from a connection. After
 a version negotiation, methods can be called on the session, in parallel, and
@@ -0,0 +1,312 @@
+package p9p
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Version9P2000L is the version string of the 9P2000.L dialect, which extends
+// 9P2000 with messages for Linux file system semantics.
+const Version9P2000L = "9P2000.L"
+
+// 9P2000.L message types. These share the type space of 9P2000 but are only
+// defined on sessions that negotiate Version9P2000L.
+const (
+	Rlerror   FcallType = 7
+	Treadlink FcallType = 22
+	Rreadlink FcallType = 23
+	Tgetattr  FcallType = 24
+	Rgetattr  FcallType = 25
+	Tsetattr  FcallType = 26
+	Rsetattr  FcallType = 27
+)
+
+// dotLSupports reports whether 9P2000.L defines the message type typ. The
+// dialect keeps the messages of 9P2000 that manage fids and move data, but
+// replaces Topen, Tcreate, Tstat and Twstat with its own messages and Rerror
+// with Rlerror.
+func dotLSupports(typ FcallType) bool {
+	switch typ {
+	case Tversion, Rversion, Tauth, Rauth, Tattach, Rattach, Tflush, Rflush,
+		Twalk, Rwalk, Tread, Rread, Twrite, Rwrite, Tclunk, Rclunk, Tremove, Rremove:
+		return true
+	case Rlerror, Treadlink, Rreadlink, Tgetattr, Rgetattr, Tsetattr, Rsetattr:
+		return true
+	}
+
+	return false
+}
+
+// MessageRlerror is the error response of 9P2000.L, carrying a Linux errno in
+// place of the error string of Rerror.
+type MessageRlerror struct {
+	Ecode uint32
+}
+
+func (e MessageRlerror) Error() string {
+	return fmt.Sprintf("9p: errno %d", e.Ecode)
+}
+
+type MessageTreadlink struct {
+	Fid Fid
+}
+
+type MessageRreadlink struct {
+	Target string
+}
+
+// MessageTgetattr requests the attributes selected by Mask, a combination of
+// AttrMask values.
+type MessageTgetattr struct {
+	Fid  Fid
+	Mask uint64
+}
+
+// MessageRgetattr holds the attributes of a file. Valid is the AttrMask of
+// the fields filled in by the server. Times are split into seconds and
+// nanoseconds since the epoch.
+type MessageRgetattr struct {
+	Valid       uint64
+	Qid         Qid
+	Mode        uint32
+	UID         uint32
+	GID         uint32
+	NLink       uint64
+	RDev        uint64
+	Size        uint64
+	BlockSize   uint64
+	Blocks      uint64
+	ATimeSec    uint64
+	ATimeNsec   uint64
+	MTimeSec    uint64
+	MTimeNsec   uint64
+	CTimeSec    uint64
+	CTimeNsec   uint64
+	BTimeSec    uint64
+	BTimeNsec   uint64
+	Gen         uint64
+	DataVersion uint64
+}
+
+// MessageTsetattr sets the attributes selected by Valid, a combination of
+// SetAttrMask values.
+type MessageTsetattr struct {
+	Fid       Fid
+	Valid     uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Size      uint64
+	ATimeSec  uint64
+	ATimeNsec uint64
+	MTimeSec  uint64
+	MTimeNsec uint64
+}
+
+type MessageRsetattr struct{}
+
+func (MessageRlerror) Type() FcallType   { return Rlerror }
+func (MessageTreadlink) Type() FcallType { return Treadlink }
+func (MessageRreadlink) Type() FcallType { return Rreadlink }
+func (MessageTgetattr) Type() FcallType  { return Tgetattr }
+func (MessageRgetattr) Type() FcallType  { return Rgetattr }
+func (MessageTsetattr) Type() FcallType  { return Tsetattr }
+func (MessageRsetattr) Type() FcallType  { return Rsetattr }
+
+// AttrMask selects the attributes requested by GetAttr and reports those
+// returned in Attr.Valid.
+type AttrMask uint64
+
+const (
+	AttrMode        AttrMask = 0x00000001
+	AttrNLink       AttrMask = 0x00000002
+	AttrUID         AttrMask = 0x00000004
+	AttrGID         AttrMask = 0x00000008
+	AttrRDev        AttrMask = 0x00000010
+	AttrATime       AttrMask = 0x00000020
+	AttrMTime       AttrMask = 0x00000040
+	AttrCTime       AttrMask = 0x00000080
+	AttrIno         AttrMask = 0x00000100 // the qid path
+	AttrSize        AttrMask = 0x00000200
+	AttrBlocks      AttrMask = 0x00000400
+	AttrBTime       AttrMask = 0x00000800
+	AttrGen         AttrMask = 0x00001000
+	AttrDataVersion AttrMask = 0x00002000
+
+	AttrBasic AttrMask = 0x000007ff // the fields of stat(2)
+	AttrAll   AttrMask = 0x00003fff
+)
+
+// SetAttrMask selects the attributes changed by SetAttr.
+type SetAttrMask uint32
+
+const (
+	SetAttrMode  SetAttrMask = 0x00000001
+	SetAttrUID   SetAttrMask = 0x00000002
+	SetAttrGID   SetAttrMask = 0x00000004
+	SetAttrSize  SetAttrMask = 0x00000008
+	SetAttrATime SetAttrMask = 0x00000010 // set to the server's time, unless SetAttrATimeSet
+	SetAttrMTime SetAttrMask = 0x00000020 // set to the server's time, unless SetAttrMTimeSet
+	SetAttrCTime SetAttrMask = 0x00000040 // set to the server's time
+
+	SetAttrATimeSet SetAttrMask = 0x00000080 // with SetAttrATime, set to Attr.ATime
+	SetAttrMTimeSet SetAttrMask = 0x00000100 // with SetAttrMTime, set to Attr.MTime
+)
+
+// Attr holds the Linux attributes of a file, as returned by GetAttr and set
+// by SetAttr. Only the fields selected by the mask of the call are
+// meaningful.
+type Attr struct {
+	Valid       AttrMask // fields returned by the server, set by GetAttr
+	Qid         Qid
+	Mode        uint32
+	UID         uint32
+	GID         uint32
+	NLink       uint64
+	RDev        uint64
+	Size        uint64
+	BlockSize   uint64
+	Blocks      uint64
+	ATime       time.Time
+	MTime       time.Time
+	CTime       time.Time
+	BTime       time.Time
+	Gen         uint64
+	DataVersion uint64
+}
+
+// sender is implemented by sessions that can send any message, such as those
+// of a dialect not covered by the Session interface.
+type sender interface {
+	send(ctx context.Context, msg Message) (Message, error)
+}
+
+// senderOf returns the outermost of session and the sessions it wraps that
+// can send any message.
+func senderOf(session Session) (sender, bool) {
+	var s sender
+	walkSessions(session, func(session Session) bool {
+		s, _ = session.(sender)
+		return s != nil
+	})
+
+	return s, s != nil
+}
+
+// sendDialect sends msg on session, returning ErrUnsupported if the session
+// did not negotiate a version that defines msg.
+func sendDialect(ctx context.Context, session Session, msg Message) (Message, error) {
+	s, ok := senderOf(session)
+	if !ok || !Supports(session, msg.Type()) {
+		return nil, ErrUnsupported
+	}
+
+	return s.send(ctx, msg)
+}
+
+// ReadLink returns the target of the symbolic link referred to by fid. The
+// session must have negotiated Version9P2000L, otherwise ErrUnsupported is
+// returned.
+func ReadLink(ctx context.Context, session Session, fid Fid) (string, error) {
+	resp, err := sendDialect(ctx, session, MessageTreadlink{Fid: fid})
+	if err != nil {
+		return "", err
+	}
+
+	rreadlink, ok := resp.(MessageRreadlink)
+	if !ok {
+		return "", ErrUnexpectedMsg
+	}
+
+	return rreadlink.Target, nil
+}
+
+// GetAttr returns the attributes of the file referred to by fid, requesting
+// those selected by mask. The server may return more or fewer attributes than
+// requested, reported by Attr.Valid. The session must have negotiated
+// Version9P2000L, otherwise ErrUnsupported is returned.
+func GetAttr(ctx context.Context, session Session, fid Fid, mask AttrMask) (Attr, error) {
+	resp, err := sendDialect(ctx, session, MessageTgetattr{Fid: fid, Mask: uint64(mask)})
+	if err != nil {
+		return Attr{}, err
+	}
+
+	r, ok := resp.(MessageRgetattr)
+	if !ok {
+		return Attr{}, ErrUnexpectedMsg
+	}
+
+	valid := AttrMask(r.Valid)
+	attr := Attr{
+		Valid:       valid,
+		Qid:         r.Qid,
+		Mode:        r.Mode,
+		UID:         r.UID,
+		GID:         r.GID,
+		NLink:       r.NLink,
+		RDev:        r.RDev,
+		Size:        r.Size,
+		BlockSize:   r.BlockSize,
+		Blocks:      r.Blocks,
+		Gen:         r.Gen,
+		DataVersion: r.DataVersion,
+	}
+
+	// times the server didn't return are left zero, rather than the epoch.
+	if valid&AttrATime != 0 {
+		attr.ATime = unixTime(r.ATimeSec, r.ATimeNsec)
+	}
+	if valid&AttrMTime != 0 {
+		attr.MTime = unixTime(r.MTimeSec, r.MTimeNsec)
+	}
+	if valid&AttrCTime != 0 {
+		attr.CTime = unixTime(r.CTimeSec, r.CTimeNsec)
+	}
+	if valid&AttrBTime != 0 {
+		attr.BTime = unixTime(r.BTimeSec, r.BTimeNsec)
+	}
+
+	return attr, nil
+}
+
+// SetAttr sets the attributes selected by mask on the file referred to by
+// fid to the values in attr. Other fields of attr are ignored. The session
+// must have negotiated Version9P2000L, otherwise ErrUnsupported is returned.
+func SetAttr(ctx context.Context, session Session, fid Fid, mask SetAttrMask, attr Attr) error {
+	msg := MessageTsetattr{
+		Fid:   fid,
+		Valid: uint32(mask),
+		Mode:  attr.Mode,
+		UID:   attr.UID,
+		GID:   attr.GID,
+		Size:  attr.Size,
+	}
+
+	if mask&SetAttrATimeSet != 0 {
+		msg.ATimeSec, msg.ATimeNsec = unixParts(attr.ATime)
+	}
+	if mask&SetAttrMTimeSet != 0 {
+		msg.MTimeSec, msg.MTimeNsec = unixParts(attr.MTime)
+	}
+
+	resp, err := sendDialect(ctx, session, msg)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := resp.(MessageRsetattr); !ok {
+		return ErrUnexpectedMsg
+	}
+
+	return nil
+}
+
+func unixTime(sec, nsec uint64) time.Time {
+	return time.Unix(int64(sec), int64(nsec)).UTC()
+}
+
+func unixParts(t time.Time) (sec, nsec uint64) {
+	return uint64(t.Unix()), uint64(t.Nanosecond())
+}
@@ -0,0 +1,223 @@
+package p9p
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// serveVersion serves handler on cn like ServeConn, negotiating version
+// rather than DefaultVersion. This stands in for a server of another dialect.
+func serveVersion(ctx context.Context, cn net.Conn, version string, handler Handler) error {
+	ch := newChannel(cn, codec9p{}, DefaultMSize)
+	if err := servernegotiate(ctx, ch, version); err != nil {
+		return err
+	}
+
+	c := &conn{
+		ctx:     withVersion(ctx, version),
+		ch:      ch,
+		handler: handler,
+		closed:  make(chan struct{}),
+	}
+
+	return c.serve()
+}
+
+// newDotLSession returns a client session negotiating 9P2000.L with a mock
+// server dispatching to handler.
+func newDotLSession(t *testing.T, handler Handler) (Session, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cconn, sconn := net.Pipe()
+
+	go serveVersion(ctx, sconn, Version9P2000L, handler)
+
+	session, err := NewSession(ctx, cconn, WithVersion(Version9P2000L))
+	if err != nil {
+		cancel()
+		t.Fatalf("error creating session: %v", err)
+	}
+
+	return session, func() {
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+func TestReadLink(t *testing.T) {
+	session, cleanup := newDotLSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTreadlink:
+			if msg.Fid != 1 {
+				return nil, MessageRlerror{Ecode: 2}
+			}
+
+			return MessageRreadlink{Target: "../target"}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	if _, version := session.Version(); version != Version9P2000L {
+		t.Fatalf("unexpected version: %v", version)
+	}
+
+	ctx := context.Background()
+	target, err := ReadLink(ctx, session, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "../target" {
+		t.Fatalf("unexpected target: %q", target)
+	}
+
+	// the server answers with an Rerror, since only the client side speaks
+	// Rlerror.
+	if _, err := ReadLink(ctx, session, 2); err == nil {
+		t.Fatalf("expected error reading link")
+	}
+}
+
+func TestReadLinkUnsupported(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		t.Errorf("unexpected message: %v", msg)
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	if _, err := ReadLink(context.Background(), session, 1); err != ErrUnsupported {
+		t.Fatalf("expected unsupported error: %v", err)
+	}
+}
+
+func TestRlerror(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{})
+	defer tr.(*transport).Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.send(ctx, MessageTreadlink{Fid: 1})
+		errs <- err
+	}()
+
+	req := <-ch.outgoing
+	ch.incoming <- newFcall(req.Tag, MessageRlerror{Ecode: 2})
+
+	if err := <-errs; err != (MessageRlerror{Ecode: 2}) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestAttrEncoding ensures the attribute messages have the sizes defined by
+// 9P2000.L and survive a round trip through the codec.
+func TestAttrEncoding(t *testing.T) {
+	codec := NewCodec()
+	for _, testcase := range []struct {
+		msg  Message
+		size int
+	}{
+		{MessageTgetattr{Fid: 1, Mask: uint64(AttrAll)}, 4 + 8},
+		{MessageRgetattr{Valid: uint64(AttrBasic), Qid: Qid{Path: 1}, Size: 10, DataVersion: 3}, 8 + 13 + 3*4 + 5*8 + 8*8 + 2*8},
+		{MessageTsetattr{Fid: 1, Valid: uint32(SetAttrSize), Size: 10, MTimeNsec: 5}, 5*4 + 5*8},
+		{MessageRsetattr{}, 0},
+	} {
+		fcall := newFcall(1, testcase.msg)
+		p, err := codec.Marshal(fcall)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// type and tag precede the message.
+		if len(p) != 3+testcase.size {
+			t.Fatalf("%v: unexpected size: %v != %v", testcase.msg.Type(), len(p)-3, testcase.size)
+		}
+
+		var decoded Fcall
+		if err := codec.Unmarshal(p, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(&decoded, fcall) {
+			t.Fatalf("%v: unexpected fcall: %#v != %#v", testcase.msg.Type(), decoded, fcall)
+		}
+	}
+}
+
+func TestGetSetAttr(t *testing.T) {
+	mtime := time.Unix(1500000000, 12345).UTC()
+	var setattr MessageTsetattr
+
+	session, cleanup := newDotLSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTgetattr:
+			// return a subset of the requested fields.
+			valid := AttrMask(msg.Mask) & (AttrMode | AttrSize | AttrMTime)
+			return MessageRgetattr{
+				Valid:     uint64(valid),
+				Mode:      0644,
+				Size:      42,
+				MTimeSec:  uint64(mtime.Unix()),
+				MTimeNsec: uint64(mtime.Nanosecond()),
+			}, nil
+		case MessageTsetattr:
+			setattr = msg
+			return MessageRsetattr{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	attr, err := GetAttr(ctx, session, 1, AttrBasic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Attr{
+		Valid: AttrMode | AttrSize | AttrMTime,
+		Mode:  0644,
+		Size:  42,
+		MTime: mtime,
+	}
+
+	if !reflect.DeepEqual(attr, expected) {
+		t.Fatalf("unexpected attributes: %#v != %#v", attr, expected)
+	}
+
+	if !attr.ATime.IsZero() {
+		t.Fatalf("atime not requested, should be zero: %v", attr.ATime)
+	}
+
+	// only the fields in the mask are sent.
+	if err := SetAttr(ctx, session, 1, SetAttrSize|SetAttrMTime|SetAttrMTimeSet, Attr{
+		Mode:  0777,
+		Size:  7,
+		ATime: mtime,
+		MTime: mtime,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if setattr.Valid != uint32(SetAttrSize|SetAttrMTime|SetAttrMTimeSet) || setattr.Size != 7 {
+		t.Fatalf("unexpected setattr: %#v", setattr)
+	}
+
+	if setattr.MTimeSec != uint64(mtime.Unix()) || setattr.MTimeNsec != uint64(mtime.Nanosecond()) {
+		t.Fatalf("unexpected mtime: %#v", setattr)
+	}
+
+	if setattr.ATimeSec != 0 || setattr.ATimeNsec != 0 {
+		t.Fatalf("atime sent without SetAttrATimeSet: %#v", setattr)
+	}
+}
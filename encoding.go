@@ -5,7 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"reflect"
 	"strings"
 	"time"
@@ -31,21 +31,31 @@ func NewCodec() Codec {
 type codec9p struct{}
 
 func (c codec9p) Unmarshal(data []byte, v interface{}) error {
-	dec := &decoder{bytes.NewReader(data)}
+	dec := decoders.Get().(*decoder)
+	defer decoders.Put(dec)
+
+	rd := dec.rd.(*bytes.Reader)
+	rd.Reset(data)
+	defer rd.Reset(nil) // don't hold on to data in the pool.
+
 	return dec.decode(v)
 }
 
 func (c codec9p) Marshal(v interface{}) ([]byte, error) {
 	var b bytes.Buffer
-	enc := &encoder{&b}
-
-	if err := enc.encode(v); err != nil {
+	if err := c.marshalTo(&b, v); err != nil {
 		return nil, err
 	}
 
 	return b.Bytes(), nil
 }
 
+// marshalTo appends the encoding of v to b.
+func (c codec9p) marshalTo(b *bytes.Buffer, v interface{}) error {
+	enc := encoder{b}
+	return enc.encode(v)
+}
+
 func (c codec9p) Size(v interface{}) int {
 	return int(size9p(v))
 }
@@ -81,6 +91,9 @@ func EncodeDir(codec Codec, wr io.Writer, d *Dir) error {
 	return err
 }
 
+// maxStringLen is the longest string that fits the 16-bit length prefix.
+const maxStringLen = 1<<16 - 1
+
 type encoder struct {
 	wr io.Writer
 }
@@ -107,6 +120,10 @@ func (e *encoder) encode(vs ...interface{}) error {
 				return err
 			}
 		case string:
+			if len(v) > maxStringLen {
+				return ErrNameTooLong
+			}
+
 			if err := binary.Write(e.wr, binary.LittleEndian, uint16(len(v))); err != nil {
 				return err
 			}
@@ -205,6 +222,15 @@ func (e *encoder) encode(vs ...interface{}) error {
 			if err := e.encode(*v); err != nil {
 				return err
 			}
+		case ExtensionMessage:
+			p, err := v.MarshalBinary()
+			if err != nil {
+				return err
+			}
+
+			if _, err := e.wr.Write(p); err != nil {
+				return err
+			}
 		case Message:
 			elements, err := fields9p(v)
 			if err != nil {
@@ -250,7 +276,12 @@ func (d *decoder) decode(vs ...interface{}) error {
 				return err
 			}
 
-			*v = make([]byte, int(ll))
+			if cap(*v) >= int(ll) {
+				// decode into the provided buffer
+				*v = (*v)[:ll]
+			} else {
+				*v = make([]byte, int(ll))
+			}
 
 			if err := binary.Read(d.rd, binary.LittleEndian, v); err != nil {
 				return err
@@ -329,7 +360,7 @@ func (d *decoder) decode(vs ...interface{}) error {
 			// must consume entire dir entry.
 			n, err := io.ReadFull(d.rd, b)
 			if err != nil {
-				log.Println("dir readfull failed:", err, ll, n)
+				logf(nil, LogDebug, "dir readfull failed: %v %v %v", err, ll, n)
 				return err
 			}
 
@@ -365,11 +396,31 @@ func (d *decoder) decode(vs ...interface{}) error {
 				return err
 			}
 
+			if em, ok := message.(ExtensionMessage); ok {
+				// the remainder of the frame is the message body.
+				p, err := ioutil.ReadAll(d.rd)
+				if err != nil {
+					return err
+				}
+
+				if err := em.UnmarshalBinary(p); err != nil {
+					return err
+				}
+
+				v.Message = em
+				continue
+			}
+
 			// NOTE(stevvooe): We do a little pointer dance to allocate the
 			// new type, write to it, then assign it back to the interface as
 			// a concrete type, avoiding a pointer (the interface) to a
 			// pointer.
 			rv := reflect.New(reflect.TypeOf(message))
+			if v.Message != nil && reflect.TypeOf(v.Message) == rv.Elem().Type() {
+				// start from the provided message, reusing its buffers.
+				rv.Elem().Set(reflect.ValueOf(v.Message))
+			}
+
 			if err := d.decode(rv.Interface()); err != nil {
 				return err
 			}
@@ -480,6 +531,11 @@ func size9p(vs ...interface{}) uint32 {
 			s += size9p(v.Type, v.Tag, v.Message)
 		case *Fcall:
 			s += size9p(*v)
+		case ExtensionMessage:
+			// the message must be marshaled to find its size. Errors are
+			// detected when encoding.
+			p, _ := v.MarshalBinary()
+			s += uint32(len(p))
 		case Message:
 			// special case twstat and rstat for size fields. See bugs in
 			// http://man.cat-v.org/plan_9/5/stat to make sense of this.
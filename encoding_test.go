@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -388,3 +391,130 @@ func TestEncodeDecode(t *testing.T) {
 
 	}
 }
+
+// messageTping is an extension message used to test the registry.
+type messageTping struct {
+	Payload string
+}
+
+func (messageTping) Type() FcallType { return Tping }
+
+func (m messageTping) MarshalBinary() ([]byte, error) {
+	return []byte(m.Payload), nil
+}
+
+func (m *messageTping) UnmarshalBinary(p []byte) error {
+	m.Payload = string(p)
+	return nil
+}
+
+// messageRping answers messageTping.
+type messageRping struct {
+	Payload string
+}
+
+func (messageRping) Type() FcallType { return Rping }
+
+func (m messageRping) MarshalBinary() ([]byte, error) {
+	return []byte(m.Payload), nil
+}
+
+func (m *messageRping) UnmarshalBinary(p []byte) error {
+	m.Payload = string(p)
+	return nil
+}
+
+const (
+	Tping FcallType = 250
+	Rping FcallType = 251
+)
+
+// registerTping registers messageTping and messageRping once, since there is
+// no way to unregister a message and tests may run more than once.
+var registerTping sync.Once
+
+func TestRegisterMessage(t *testing.T) {
+	registerTping.Do(func() {
+		if err := RegisterMessage(Tping, func() Message { return &messageTping{} }); err != nil {
+			t.Fatalf("unexpected error registering message: %v", err)
+		}
+
+		if err := RegisterMessage(Rping, func() Message { return &messageRping{} }); err != nil {
+			t.Fatalf("unexpected error registering message: %v", err)
+		}
+	})
+
+	if err := RegisterMessage(Tping, func() Message { return &messageTping{} }); err == nil {
+		t.Fatalf("expected error registering message twice")
+	}
+
+	if err := RegisterMessage(Twalk, func() Message { return MessageTwalk{} }); err == nil {
+		t.Fatalf("expected error registering standard message")
+	}
+
+	codec := NewCodec()
+	fcall := newFcall(1, &messageTping{Payload: "hello"})
+	p, err := codec.Marshal(fcall)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{byte(Tping), 0x1, 0x0, 'h', 'e', 'l', 'l', 'o'}
+	if !bytes.Equal(p, expected) {
+		t.Fatalf("unexpected encoding: %v != %v", p, expected)
+	}
+
+	if codec.Size(fcall) != len(expected) {
+		t.Fatalf("unexpected size: %v != %v", codec.Size(fcall), len(expected))
+	}
+
+	var decoded Fcall
+	if err := codec.Unmarshal(p, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, fcall) {
+		t.Fatalf("unexpected fcall: %#v != %#v", decoded, fcall)
+	}
+}
+
+// pingSession answers Tping through Dispatch. Calls to other messages panic.
+type pingSession struct {
+	Session
+}
+
+func (pingSession) Handle(ctx context.Context, msg Message) (Message, error) {
+	tping, ok := msg.(*messageTping)
+	if !ok {
+		return nil, ErrUnknownMsg
+	}
+
+	return &messageRping{Payload: tping.Payload}, nil
+}
+
+// TestCallExtension sends an extension message from a client session to a
+// server dispatching to a session that handles it.
+func TestCallExtension(t *testing.T) {
+	TestRegisterMessage(t)
+
+	session, closeSession := newTestSession(t, Dispatch(pingSession{}))
+	defer closeSession()
+
+	resp, err := Call(context.Background(), session, &messageTping{Payload: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rping, ok := resp.(*messageRping)
+	if !ok || rping.Payload != "hello" {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+
+	// a session that does not handle extensions rejects them.
+	session, closeOther := newTestSession(t, Dispatch(struct{ Session }{}))
+	defer closeOther()
+
+	if _, err := Call(context.Background(), session, &messageTping{}); err != ErrUnknownMsg {
+		t.Fatalf("expected ErrUnknownMsg: %v", err)
+	}
+}
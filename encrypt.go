@@ -0,0 +1,248 @@
+package p9p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Sizes used by EncryptConn.
+const (
+	encryptNonceSize  = 32       // random value sent by each end in the handshake
+	encryptMinKeySize = 16       // shortest pre-shared key accepted
+	encryptRecordSize = 64 << 10 // largest plaintext of a record
+)
+
+// EncryptConn wraps conn in authenticated encryption keyed from key, a secret
+// shared by both ends. Both ends of the connection must be wrapped, with the
+// same key, since the result is not compatible with plain 9p. On the client,
+// use WithEncryption. On the server, pass the wrapped connection to
+// ServeConn. The key must be at least 16 bytes, and should be random.
+//
+// EncryptConn first exchanges random values with the peer, abandoning the
+// exchange when ctx is done, and derives a fresh AES-256-GCM key for each
+// direction from them and key. Data is then sent in sealed records. A
+// connection using another key, or data that was tampered with, fails reads
+// with ErrDecrypt. This provides privacy and integrity without certificates,
+// but no forward secrecy: whoever learns key can decrypt recorded traffic.
+// Prefer TLS when certificates can be managed.
+//
+// As with CompressConn, the cipher state cannot survive a failed write, so
+// all write errors, including timeouts, are permanent.
+func EncryptConn(ctx context.Context, conn net.Conn, key []byte) (net.Conn, error) {
+	if len(key) < encryptMinKeySize {
+		return nil, fmt.Errorf("9p: encryption key shorter than %d bytes", encryptMinKeySize)
+	}
+
+	var local, remote [encryptNonceSize]byte
+	if _, err := rand.Read(local[:]); err != nil {
+		return nil, err
+	}
+
+	if err := handshake(ctx, conn, func() error {
+		// both ends write first, so write while reading the peer.
+		errs := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(local[:])
+			errs <- err
+		}()
+
+		if _, err := io.ReadFull(conn, remote[:]); err != nil {
+			return err
+		}
+
+		return <-errs
+	}); err != nil {
+		return nil, err
+	}
+
+	if local == remote {
+		// our own value was sent back, which would let the records we
+		// send be accepted as coming from the peer.
+		return nil, fmt.Errorf("9p: encryption handshake reflected")
+	}
+
+	seal, err := newEncryptAEAD(key, local[:], remote[:])
+	if err != nil {
+		return nil, err
+	}
+
+	open, err := newEncryptAEAD(key, remote[:], local[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// As with CompressConn, decrypt into a pipe from a separate goroutine
+	// so that read deadlines can be applied without losing records.
+	rd, wr := net.Pipe()
+	c := &encryptConn{
+		Conn: conn,
+		rd:   rd,
+		seal: seal,
+	}
+
+	go c.decrypt(open, wr)
+
+	return c, nil
+}
+
+// newEncryptAEAD returns the cipher for the direction of the connection
+// whose sender generated from and whose receiver generated to.
+func newEncryptAEAD(key, from, to []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("9p encrypt"))
+	mac.Write(from)
+	mac.Write(to)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptConn seals writes into records on the embedded connection and reads
+// the opened records from rd.
+type encryptConn struct {
+	net.Conn
+	rd net.Conn
+
+	// write side, used by one writer at a time.
+	seal   cipher.AEAD
+	wseq   uint64
+	wbuf   []byte
+	werr   error
+	wnonce [12]byte
+
+	mu   sync.Mutex
+	rerr error // reason the read side stopped, reported in place of io.EOF
+}
+
+func (c *encryptConn) Read(p []byte) (int, error) {
+	n, err := c.rd.Read(p)
+	if err == io.EOF {
+		c.mu.Lock()
+		if c.rerr != nil {
+			err = c.rerr
+		}
+		c.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func (c *encryptConn) Write(p []byte) (int, error) {
+	if c.werr != nil {
+		return 0, c.werr
+	}
+
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > encryptRecordSize {
+			chunk = chunk[:encryptRecordSize]
+		}
+
+		binary.LittleEndian.PutUint64(c.wnonce[4:], c.wseq)
+		c.wseq++
+
+		var hdr [4]byte
+		c.wbuf = c.seal.Seal(append(c.wbuf[:0], hdr[:]...), c.wnonce[:], chunk, nil)
+		binary.LittleEndian.PutUint32(c.wbuf, uint32(len(c.wbuf)-len(hdr)))
+
+		if _, err := c.Conn.Write(c.wbuf); err != nil {
+			c.werr = fmt.Errorf("9p: encrypted write failed: %v", err)
+			return n, c.werr
+		}
+
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// decrypt opens the records read from the connection and writes their
+// plaintext to wr, until reading or opening a record fails.
+func (c *encryptConn) decrypt(open cipher.AEAD, wr net.Conn) {
+	err := c.readRecords(open, wr)
+	if err != nil && err != io.EOF {
+		c.mu.Lock()
+		c.rerr = err
+		c.mu.Unlock()
+	}
+
+	wr.Close()
+}
+
+func (c *encryptConn) readRecords(open cipher.AEAD, wr net.Conn) error {
+	var (
+		nonce [12]byte
+		seq   uint64
+		hdr   [4]byte
+		buf   []byte
+	)
+
+	for {
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return err
+		}
+
+		n := int(binary.LittleEndian.Uint32(hdr[:]))
+		if n < open.Overhead() || n > encryptRecordSize+open.Overhead() {
+			return ErrDecrypt
+		}
+
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+
+		if _, err := io.ReadFull(c.Conn, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		binary.LittleEndian.PutUint64(nonce[4:], seq)
+		seq++
+
+		p, err := open.Open(buf[:0], nonce[:], buf, nil)
+		if err != nil {
+			return ErrDecrypt
+		}
+
+		if _, err := wr.Write(p); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *encryptConn) Close() error {
+	c.rd.Close()
+	return c.Conn.Close()
+}
+
+func (c *encryptConn) SetDeadline(t time.Time) error {
+	if err := c.rd.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *encryptConn) SetReadDeadline(t time.Time) error {
+	return c.rd.SetReadDeadline(t)
+}
@@ -0,0 +1,102 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+var testEncryptKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	data := bytes.Repeat([]byte("secret "), 20000)
+
+	go func() {
+		econn, err := EncryptConn(ctx, sconn, testEncryptKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		ServeConn(ctx, econn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			switch msg := msg.(type) {
+			case MessageTread:
+				return MessageRread{Data: data[:msg.Count]}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}))
+	}()
+
+	session, err := NewSession(ctx, cconn, WithEncryption(testEncryptKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reads larger than a record span several of them.
+	msize, _ := session.Version()
+	p := make([]byte, msize-IOHDRSZ)
+	n, err := session.Read(ctx, 1, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p[:n], data[:len(p)]) {
+		t.Fatalf("unexpected data read over encrypted session")
+	}
+}
+
+// TestEncryptKeyMismatch ensures that ends using different keys fail reads
+// with ErrDecrypt and that nothing is sent in the clear.
+func TestEncryptKeyMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	errs := make(chan error, 1)
+	var bconn net.Conn
+	go func() {
+		var err error
+		bconn, err = EncryptConn(ctx, b, []byte("fedcba9876543210fedcba9876543210"))
+		errs <- err
+	}()
+
+	aconn, err := EncryptConn(ctx, a, testEncryptKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	go aconn.Write([]byte("hello"))
+
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(bconn, p); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt: %v %q", err, p)
+	}
+}
+
+func TestEncryptShortKey(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := EncryptConn(context.Background(), a, []byte("short")); err == nil {
+		t.Fatalf("expected error for short key")
+	}
+}
@@ -3,8 +3,26 @@ package p9p
 import (
 	"errors"
 	"fmt"
+	"os"
+	"strings"
 )
 
+// MessageTooLargeError is returned by channels for a frame larger than the
+// msize. A frame too large to write is not written, and one too large to
+// read is discarded, so the channel remains usable. Servers answer requests
+// too large to read with an Rerror, and clients fail the request of a
+// response too large to read.
+type MessageTooLargeError struct {
+	Type  FcallType
+	Tag   Tag
+	Size  int // of the frame, including the size header
+	MSize int
+}
+
+func (e MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message too large: %v > msize %v", e.Size, e.MSize)
+}
+
 // MessageRerror provides both a Go error type and message type.
 type MessageRerror struct {
 	Ename string
@@ -19,6 +37,7 @@ var (
 	ErrCreatenondir = new9pError("create in non-directory")
 	ErrDupfid       = new9pError("duplicate fid")
 	ErrDuptag       = new9pError("duplicate tag")
+	ErrExist        = new9pError("file already exists")
 	ErrIsdir        = new9pError("is a directory")
 	ErrNocreate     = new9pError("create prohibited")
 	ErrNomem        = new9pError("out of memory")
@@ -38,7 +57,55 @@ var (
 	ErrUnknownMsg    = new9pError("unknown message")    // returned when encountering unknown message type
 	ErrUnexpectedMsg = new9pError("unexpected message") // returned when an unexpected message is encountered
 	ErrWalkLimit     = new9pError("too many wnames in walk")
+	ErrNameTooLong   = new9pError("name too long")         // returned when a string exceeds the 16-bit length prefix
+	ErrInternal      = new9pError("internal server error") // returned when a handler panics
+	ErrBusy          = new9pError("server busy")           // returned for work beyond the limits of a server
 	ErrClosed        = errors.New("closed")
+
+	// ErrServerClosed is returned by the methods of a Server once it is
+	// shut down, and to requests arriving while it shuts down.
+	ErrServerClosed = errors.New("server closed")
+
+	// ErrChecksum is returned when a frame fails verification on a
+	// connection using checksums. The connection is closed, since the frame
+	// boundaries can no longer be trusted.
+	ErrChecksum = errors.New("frame checksum mismatch")
+
+	// ErrDecrypt is returned by reads on a connection wrapped with
+	// EncryptConn when a record fails authentication, because the peer
+	// uses another key or the data was altered. The connection cannot be
+	// read further.
+	ErrDecrypt = errors.New("record decryption failed")
+
+	// ErrFrameTooLarge is returned when a frame on a connection using frame
+	// compression decompresses to more than the maximum frame size.
+	ErrFrameTooLarge = errors.New("decompressed frame too large")
+
+	// ErrFidInUse is returned by a client session when asked to walk to a
+	// newfid that already refers to a file, and by ReleaseFid for such a
+	// fid. Clunk the fid first.
+	ErrFidInUse = errors.New("fid already in use")
+
+	// ErrFlushed is held by the CancelError returned from a call whose
+	// request was flushed with Flush before it was answered.
+	ErrFlushed = errors.New("request flushed")
+
+	// ErrUnsupported is returned when a call requires a message that is not
+	// defined by the protocol version negotiated for the session.
+	ErrUnsupported = errors.New("operation not supported by protocol version")
+
+	// ErrTooManyRequests is returned by a client session limited with
+	// WithMaxOutstanding when the limit is reached and the session was
+	// configured not to wait.
+	ErrTooManyRequests = errors.New("too many outstanding requests")
+
+	// ErrSessionDone is returned by calls on a client session after the
+	// context passed to NewSession is done.
+	ErrSessionDone = errors.New("session context done")
+
+	// ErrCrossDir is returned by Client.Rename when the new path is in
+	// another directory, since wstat only renames a file within its parent.
+	ErrCrossDir = errors.New("rename across directories")
 )
 
 // new9pError returns a new 9p error ready for the wire.
@@ -53,3 +120,42 @@ func (MessageRerror) Type() FcallType {
 func (e MessageRerror) Error() string {
 	return fmt.Sprintf("9p: %v", e.Ename)
 }
+
+// IsNotExist reports whether err indicates that a file does not exist. Servers
+// word their errors differently, so Rerrors are matched on common phrasings of
+// the condition. Other errors are checked with os.IsNotExist.
+func IsNotExist(err error) bool {
+	return classify(err, os.IsNotExist, "not found", "does not exist", "no such file")
+}
+
+// IsExist reports whether err indicates that a file already exists, matching
+// errors in the same manner as IsNotExist.
+func IsExist(err error) bool {
+	return classify(err, os.IsExist, "exists")
+}
+
+// IsPermission reports whether err indicates that permission was denied,
+// matching errors in the same manner as IsNotExist.
+func IsPermission(err error) bool {
+	return classify(err, os.IsPermission, "permission denied", "not permitted")
+}
+
+func classify(err error, fn func(error) bool, phrases ...string) bool {
+	if perr, ok := err.(*PathError); ok {
+		err = perr.Err
+	}
+
+	rerr, ok := err.(MessageRerror)
+	if !ok {
+		return err != nil && fn(err)
+	}
+
+	ename := strings.ToLower(rerr.Ename)
+	for _, phrase := range phrases {
+		if strings.Contains(ename, phrase) {
+			return true
+		}
+	}
+
+	return false
+}
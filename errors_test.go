@@ -0,0 +1,31 @@
+package p9p
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	for _, testcase := range []struct {
+		err                   error
+		notexist, exist, perm bool
+	}{
+		{err: ErrNotfound, notexist: true},
+		{err: MessageRerror{Ename: "No such file or directory"}, notexist: true},
+		{err: &PathError{Op: "walk", Path: "a", Err: ErrNotfound}, notexist: true},
+		{err: ErrExist, exist: true},
+		{err: MessageRerror{Ename: "file exists"}, exist: true},
+		{err: ErrPerm, perm: true},
+		{err: os.ErrPermission, perm: true},
+		{err: ErrBadcount},
+		{err: errors.New("file not found, but not an rerror")},
+		{err: nil},
+	} {
+		if IsNotExist(testcase.err) != testcase.notexist ||
+			IsExist(testcase.err) != testcase.exist ||
+			IsPermission(testcase.err) != testcase.perm {
+			t.Errorf("unexpected classification of %v", testcase.err)
+		}
+	}
+}
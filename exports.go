@@ -0,0 +1,329 @@
+package p9p
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Exports is a table of the trees served by a server, routing each Tattach
+// by its aname to the session of the export with that name. Anames not in
+// the table go to the default export or, without one, fail with
+// ErrBadattach. Serve the table with its NewSession method:
+//
+//	exports := p9p.NewExports(newRootSession)
+//	exports.Export("tmp", newTmpSession)
+//	p9p.Serve(ctx, l, exports.NewSession)
+//
+// The session of an export is created from its factory on the first attach
+// to it on each connection, kept for the later ones, and closed with the
+// connection if it implements io.Closer. The default export has one session
+// per connection, whatever the aname. Fids walked from an attached fid stay
+// with its export. Exports is safe for concurrent use, and changes apply to
+// the attaches that follow.
+type Exports struct {
+	mu       sync.RWMutex
+	exports  map[string]SessionFactory // by aname
+	fallback SessionFactory
+}
+
+// NewExports returns a table with only the default export, served by
+// sessions from fallback, or with no exports if fallback is nil.
+func NewExports(fallback SessionFactory) *Exports {
+	return &Exports{exports: map[string]SessionFactory{}, fallback: fallback}
+}
+
+// Export serves the tree named aname with sessions from newSession,
+// replacing any export of that name.
+func (e *Exports) Export(aname string, newSession SessionFactory) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exports[aname] = newSession
+}
+
+// Unexport removes the export named aname, whose anames then go to the
+// default export. Fids already attached to it are unaffected.
+func (e *Exports) Unexport(aname string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.exports, aname)
+}
+
+// lookup returns the factory of the export serving aname, reporting
+// whether it is the default export.
+func (e *Exports) lookup(aname string) (SessionFactory, bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if newSession, ok := e.exports[aname]; ok {
+		return newSession, false, nil
+	}
+
+	if e.fallback == nil {
+		return nil, false, ErrBadattach
+	}
+
+	return e.fallback, true, nil
+}
+
+// NewSession returns the session serving a connection from the table, as a
+// SessionFactory.
+func (e *Exports) NewSession(ctx context.Context, info ConnInfo) (Session, error) {
+	return &exportSession{
+		exports:  e,
+		ctx:      ctx,
+		info:     info,
+		sessions: map[string]Session{},
+	}, nil
+}
+
+// exportSession routes the calls of a connection to the sessions of the
+// exports it attaches to.
+type exportSession struct {
+	exports *Exports
+	ctx     context.Context
+	info    ConnInfo
+
+	mu       sync.Mutex
+	sessions map[string]Session // by aname, created on first attach
+	fallback Session            // of the default export, shared by anames
+	fids     FidTable           // of *exportFid
+}
+
+var _ Session = &exportSession{}
+
+// exportFid holds the session serving a fid. It is not an io.Closer, so
+// clunking the fid in the table leaves the session open.
+type exportFid struct {
+	session Session
+}
+
+// route returns the session of the export serving aname, creating it if it
+// is the first attach to the export on the connection.
+func (s *exportSession) route(aname string) (Session, error) {
+	newSession, fallback, err := s.exports.lookup(aname)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fallback && s.fallback != nil {
+		return s.fallback, nil
+	} else if session, ok := s.sessions[aname]; ok && !fallback {
+		return session, nil
+	}
+
+	session, err := newSession(s.ctx, s.info)
+	if err != nil {
+		return nil, err
+	}
+
+	if fallback {
+		s.fallback = session
+	} else {
+		s.sessions[aname] = session
+	}
+
+	return session, nil
+}
+
+// session returns the session serving fid.
+func (s *exportSession) session(fid Fid) (Session, error) {
+	v, err := s.fids.Get(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*exportFid).session, nil
+}
+
+func (s *exportSession) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid, error) {
+	if _, err := s.fids.Get(afid); err == nil {
+		return Qid{}, ErrDupfid
+	}
+
+	session, err := s.route(aname)
+	if err != nil {
+		return Qid{}, err
+	}
+
+	qid, err := session.Auth(ctx, afid, uname, aname)
+	if err != nil {
+		return Qid{}, err
+	}
+
+	return qid, s.add(ctx, session, afid)
+}
+
+func (s *exportSession) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	if _, err := s.fids.Get(fid); err == nil {
+		return Qid{}, ErrDupfid
+	}
+
+	session, err := s.route(aname)
+	if err != nil {
+		return Qid{}, err
+	}
+
+	if afid != NOFID {
+		// the afid must be authenticated with the export attached to.
+		if auth, err := s.session(afid); err != nil {
+			return Qid{}, err
+		} else if auth != session {
+			return Qid{}, ErrBadattach
+		}
+	}
+
+	qid, err := session.Attach(ctx, fid, afid, uname, aname)
+	if err != nil {
+		return Qid{}, err
+	}
+
+	return qid, s.add(ctx, session, fid)
+}
+
+// add routes fid to session once established on it, clunking it there if
+// the fid was taken meanwhile by a concurrent request.
+func (s *exportSession) add(ctx context.Context, session Session, fid Fid) error {
+	if err := s.fids.Add(fid, &exportFid{session: session}); err != nil {
+		session.Clunk(ctx, fid)
+		return err
+	}
+
+	return nil
+}
+
+func (s *exportSession) Clunk(ctx context.Context, fid Fid) error {
+	session, err := s.session(fid)
+	if err != nil {
+		return err
+	}
+
+	// the fid is released even if the clunk fails.
+	err = session.Clunk(ctx, fid)
+	s.fids.Clunk(fid)
+	return err
+}
+
+func (s *exportSession) Remove(ctx context.Context, fid Fid) error {
+	session, err := s.session(fid)
+	if err != nil {
+		return err
+	}
+
+	err = session.Remove(ctx, fid)
+	s.fids.Clunk(fid)
+	return err
+}
+
+func (s *exportSession) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) ([]Qid, error) {
+	var qids []Qid
+	err := s.fids.Clone(fid, newfid, func(v interface{}) (interface{}, error) {
+		var err error
+		qids, err = v.(*exportFid).session.Walk(ctx, fid, newfid, names...)
+		if err == nil && len(qids) < len(names) {
+			// a partial walk leaves newfid unused.
+			err = errPartialWalk
+		}
+
+		return v, err
+	})
+
+	if err == errPartialWalk {
+		return qids, nil
+	}
+
+	return qids, err
+}
+
+// errPartialWalk stops newfid being routed after a partial walk.
+var errPartialWalk = errors.New("partial walk")
+
+func (s *exportSession) Read(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	session, err := s.session(fid)
+	if err != nil {
+		return 0, err
+	}
+
+	return session.Read(ctx, fid, p, offset)
+}
+
+func (s *exportSession) Write(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	session, err := s.session(fid)
+	if err != nil {
+		return 0, err
+	}
+
+	return session.Write(ctx, fid, p, offset)
+}
+
+func (s *exportSession) Open(ctx context.Context, fid Fid, mode Flag) (Qid, uint32, error) {
+	session, err := s.session(fid)
+	if err != nil {
+		return Qid{}, 0, err
+	}
+
+	return session.Open(ctx, fid, mode)
+}
+
+func (s *exportSession) Create(ctx context.Context, parent Fid, name string, perm uint32, mode Flag) (Qid, uint32, error) {
+	session, err := s.session(parent)
+	if err != nil {
+		return Qid{}, 0, err
+	}
+
+	return session.Create(ctx, parent, name, perm, mode)
+}
+
+func (s *exportSession) Stat(ctx context.Context, fid Fid) (Dir, error) {
+	session, err := s.session(fid)
+	if err != nil {
+		return Dir{}, err
+	}
+
+	return session.Stat(ctx, fid)
+}
+
+func (s *exportSession) WStat(ctx context.Context, fid Fid, dir Dir) error {
+	session, err := s.session(fid)
+	if err != nil {
+		return err
+	}
+
+	return session.WStat(ctx, fid, dir)
+}
+
+func (s *exportSession) Version() (int, string) {
+	if s.info.Version == "" {
+		return DefaultMSize, DefaultVersion
+	}
+
+	return s.info.MSize, s.info.Version
+}
+
+// Close closes the sessions of the exports attached to, returning the first
+// error.
+func (s *exportSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := s.sessions
+	if s.fallback != nil {
+		sessions[""] = s.fallback // never a key otherwise
+	}
+	s.sessions, s.fallback = map[string]Session{}, nil
+
+	var first error
+	for _, session := range sessions {
+		if closer, ok := closerOf(session); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,121 @@
+package p9p
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// exportTree is a tree served by an export, named in its stats.
+type exportTree struct {
+	Session
+	name   string
+	closed *int
+}
+
+func (t exportTree) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	return Qid{Type: QTDIR}, nil
+}
+
+// Walk fails on the first name of every walk.
+func (t exportTree) Walk(ctx context.Context, fid, newfid Fid, names ...string) ([]Qid, error) {
+	return nil, nil
+}
+
+func (t exportTree) Stat(ctx context.Context, fid Fid) (Dir, error) {
+	return Dir{Name: t.name, Mode: DMDIR}, nil
+}
+
+func (t exportTree) Clunk(ctx context.Context, fid Fid) error {
+	return nil
+}
+
+func (t exportTree) Close() error {
+	*t.closed++
+	return nil
+}
+
+// TestExports routes attaches by aname, ensuring that walked fids stay with
+// their export and that the sessions of the exports close with the
+// connection.
+func TestExports(t *testing.T) {
+	ctx := context.Background()
+
+	var closed int
+	tree := func(name string) SessionFactory {
+		return func(ctx context.Context, info ConnInfo) (Session, error) {
+			return exportTree{name: name, closed: &closed}, nil
+		}
+	}
+
+	exports := NewExports(tree("root"))
+	exports.Export("tmp", tree("tmp"))
+
+	session, err := exports.NewSession(ctx, ConnInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fid, aname := range map[Fid]string{1: "tmp", 2: "", 3: "unknown"} {
+		if _, err := session.Attach(ctx, fid, NOFID, "test", aname); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "tmp"); err != ErrDupfid {
+		t.Fatalf("expected ErrDupfid: %v", err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 2, 5, "missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	for fid, name := range map[Fid]string{1: "tmp", 2: "root", 3: "root", 4: "tmp"} {
+		dir, err := session.Stat(ctx, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dir.Name != name {
+			t.Fatalf("fid %v routed to %q, expected %q", fid, dir.Name, name)
+		}
+	}
+
+	// a partial walk leaves newfid unused.
+	if _, err := session.Stat(ctx, 5); err != ErrUnknownfid {
+		t.Fatalf("expected ErrUnknownfid: %v", err)
+	}
+
+	if err := session.Clunk(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 4); err != ErrUnknownfid {
+		t.Fatalf("expected ErrUnknownfid: %v", err)
+	}
+
+	if err := session.(*exportSession).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if closed != 2 {
+		t.Fatalf("expected a session per export closed: %d", closed)
+	}
+
+	// without a default export, unknown anames fail.
+	exports = NewExports(nil)
+	exports.Export("tmp", tree("tmp"))
+
+	session, err = exports.NewSession(ctx, ConnInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "unknown"); err != ErrBadattach {
+		t.Fatalf("expected ErrBadattach: %v", err)
+	}
+}
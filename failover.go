@@ -0,0 +1,167 @@
+package p9p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNoAddrs is returned when dialing a server without candidate addresses.
+var ErrNoAddrs = errors.New("9p: no addresses to dial")
+
+// lookupSRV is replaced by tests.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// DialAny dials the first of addrs, in order of preference, that accepts a
+// connection and negotiates a session, as with Dial. Addresses are parsed
+// with ParseAddr, ignoring any tree or user they name. If the session is
+// dialed WithParallelDial, every address is dialed at once and the first
+// session negotiated is kept.
+//
+// A session dialed WithReconnect fails over to the other addresses when its
+// connection is lost, dialing them again in the same way.
+func DialAny(ctx context.Context, addrs []string, opts ...SessionOption) (Session, error) {
+	candidates := make([]Addr, len(addrs))
+	for i, addr := range addrs {
+		a, err := ParseAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		candidates[i] = a
+	}
+
+	so := newSessionOptions(opts)
+	return dialSession(ctx, func(ctx context.Context) (Channel, string, int, error) {
+		return dialCandidates(ctx, candidates, so)
+	}, so)
+}
+
+// DialSRV dials a server of the 9fs service at domain, as with DialAny, with
+// the candidate addresses found in the _9fs._tcp SRV records of domain,
+// ordered by priority and weight. A session dialed WithReconnect looks up the
+// records again for each new connection.
+func DialSRV(ctx context.Context, domain string, opts ...SessionOption) (Session, error) {
+	so := newSessionOptions(opts)
+	return dialSession(ctx, func(ctx context.Context) (Channel, string, int, error) {
+		candidates, err := lookupCandidates(ctx, domain)
+		if err != nil {
+			return nil, "", 0, err
+		}
+
+		return dialCandidates(ctx, candidates, so)
+	}, so)
+}
+
+// lookupCandidates returns the tcp addresses of the 9fs SRV records of
+// domain, in the order returned by the resolver.
+func lookupCandidates(ctx context.Context, domain string) ([]Addr, error) {
+	_, srvs, err := lookupSRV(ctx, "9fs", "tcp", domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Addr
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if target == "" {
+			continue // "." declares the service unavailable.
+		}
+
+		candidates = append(candidates, Addr{
+			Network: "tcp",
+			Address: net.JoinHostPort(target, strconv.Itoa(int(srv.Port))),
+		})
+	}
+
+	return candidates, nil
+}
+
+// dialCandidates connects to one of candidates, in order or in parallel as
+// configured by so. If all fail, the error names each candidate.
+func dialCandidates(ctx context.Context, candidates []Addr, so sessionOptions) (Channel, string, int, error) {
+	if len(candidates) == 0 {
+		return nil, "", 0, ErrNoAddrs
+	}
+
+	if so.parallelDial {
+		return dialParallel(ctx, candidates, so)
+	}
+
+	errs := make([]error, len(candidates))
+	for i, a := range candidates {
+		_, ch, version, msize, err := dial(ctx, a.Network, a.Address, so)
+		if err == nil {
+			return ch, version, msize, nil
+		}
+		errs[i] = err
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		logf(so.logger, LogInfo, "9p: dial %v %v failed, trying next address: %v", a.Network, a.Address, err)
+	}
+
+	return nil, "", 0, candidatesError(candidates, errs)
+}
+
+// dialParallel dials every candidate at once. The first channel negotiated is
+// returned, and the others are abandoned and closed.
+func dialParallel(ctx context.Context, candidates []Addr, so sessionOptions) (Channel, string, int, error) {
+	type result struct {
+		i       int
+		conn    net.Conn
+		ch      Channel
+		version string
+		msize   int
+		err     error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(candidates))
+	for i, a := range candidates {
+		go func(i int, a Addr) {
+			conn, ch, version, msize, err := dial(ctx, a.Network, a.Address, so)
+			results <- result{i, conn, ch, version, msize, err}
+		}(i, a)
+	}
+
+	errs := make([]error, len(candidates))
+	for n := range candidates {
+		r := <-results
+		if r.err != nil {
+			errs[r.i] = r.err
+			continue
+		}
+
+		// close the channels negotiated after this one.
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.err == nil {
+					r.conn.Close()
+				}
+			}
+		}(len(candidates) - n - 1)
+
+		return r.ch, r.version, r.msize, nil
+	}
+
+	return nil, "", 0, candidatesError(candidates, errs)
+}
+
+func candidatesError(candidates []Addr, errs []error) error {
+	msgs := make([]string, 0, len(errs))
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%v %v: %v", candidates[i].Network, candidates[i].Address, err))
+		}
+	}
+
+	return fmt.Errorf("9p: all addresses failed: %v", strings.Join(msgs, "; "))
+}
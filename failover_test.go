@@ -0,0 +1,181 @@
+package p9p
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// testServer serves a memTree on the connections accepted from a listener,
+// counting attaches.
+type testServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	attaches int
+}
+
+func newTestServer(t *testing.T, ctx context.Context, network, address string) *testServer {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+
+	srv := &testServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				tree := newMemTree("file")
+				ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+					if _, ok := msg.(MessageTattach); ok {
+						srv.mu.Lock()
+						srv.attaches++
+						srv.mu.Unlock()
+					}
+					return tree.Handle(ctx, msg)
+				}))
+			}()
+		}
+	}()
+
+	return srv
+}
+
+// stop closes the listener and every connection accepted.
+func (srv *testServer) stop() {
+	srv.l.Close()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+func (srv *testServer) attached() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.attaches
+}
+
+// TestDialAny ensures that DialAny skips unreachable addresses, in order and
+// in parallel, and fails over to the next address after losing the
+// connection.
+func TestDialAny(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p9p-failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	missing := "unix!" + filepath.Join(dir, "missing.sock")
+	first := newTestServer(t, ctx, "unix", filepath.Join(dir, "first.sock"))
+	second := newTestServer(t, ctx, "unix", filepath.Join(dir, "second.sock"))
+	addrs := []string{missing, "unix!" + first.l.Addr().String(), "unix!" + second.l.Addr().String()}
+
+	for _, opts := range [][]SessionOption{nil, {WithParallelDial()}} {
+		session, err := DialAny(ctx, addrs, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+		session.(io.Closer).Close()
+	}
+
+	if _, err := DialAny(ctx, []string{missing, missing + "2"}); err == nil || !strings.Contains(err.Error(), "missing.sock2") {
+		t.Fatalf("expected error naming each address: %v", err)
+	}
+
+	if _, err := DialAny(ctx, nil); err != ErrNoAddrs {
+		t.Fatalf("expected ErrNoAddrs: %v", err)
+	}
+
+	session, err := DialAny(ctx, addrs[1:], WithReconnect(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	attaches := second.attached()
+	first.stop()
+	if _, err := session.Stat(ctx, 1); err != nil {
+		t.Fatalf("unexpected error after failover: %v", err)
+	}
+
+	if n := second.attached(); n != attaches+1 {
+		t.Fatalf("expected the fid restored on the second server: %v attaches", n-attaches)
+	}
+}
+
+func TestDialSRV(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newTestServer(t, ctx, "tcp", "127.0.0.1:0")
+	defer srv.stop()
+	_, port, _ := net.SplitHostPort(srv.l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	// a port nothing listens on, by closing a listener.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, cport, _ := net.SplitHostPort(closed.Addr().String())
+	cp, _ := strconv.Atoi(cport)
+
+	defer func(fn func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)) {
+		lookupSRV = fn
+	}(lookupSRV)
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service != "9fs" || proto != "tcp" || name != "example.com" {
+			t.Fatalf("unexpected lookup: %v %v %v", service, proto, name)
+		}
+
+		return "_9fs._tcp.example.com.", []*net.SRV{
+			{Target: ".", Port: uint16(p)},
+			{Target: "127.0.0.1.", Port: uint16(cp)},
+			{Target: "127.0.0.1.", Port: uint16(p)},
+		}, nil
+	}
+
+	session, err := DialSRV(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+}
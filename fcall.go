@@ -95,6 +95,20 @@ func (fct FcallType) String() string {
 		return "Twstat"
 	case Rwstat:
 		return "Rwstat"
+	case Rlerror:
+		return "Rlerror"
+	case Treadlink:
+		return "Treadlink"
+	case Rreadlink:
+		return "Rreadlink"
+	case Tgetattr:
+		return "Tgetattr"
+	case Rgetattr:
+		return "Rgetattr"
+	case Tsetattr:
+		return "Tsetattr"
+	case Rsetattr:
+		return "Rsetattr"
 	default:
 		return "Tunknown"
 	}
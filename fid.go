@@ -0,0 +1,435 @@
+package p9p
+
+import (
+	"errors"
+	pathpkg "path"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNoFidPool is returned by helpers that need to allocate fids when the
+// provided session does not manage a fid pool.
+var ErrNoFidPool = errors.New("session does not allocate fids")
+
+// FidInfo describes a fid in use on a client session.
+type FidInfo struct {
+	Fid    Fid
+	Qid    Qid    // qid of the file the fid refers to, if known
+	Opened bool   // fid has been opened or created
+	Mode   Flag   // mode used to open the fid
+	IOUnit uint32 // iounit returned when the fid was opened, zero if none
+	Path   string // path from the attach root, if tracking WithFidPaths
+}
+
+// fidPool tracks the fids in use on a client session and allocates unused
+// fids for helpers that need scratch fids. Fids chosen by the caller are
+// marked in use as they are established by the session, so allocated fids
+// will not collide with them. The pool is safe for concurrent use.
+type fidPool struct {
+	mu       sync.Mutex
+	next     Fid
+	inuse    map[Fid]*FidInfo
+	reserved map[Fid]bool // allocated but not yet established
+	paths    bool         // track paths of walked fids
+
+	// origins records how each fid was established, if tracking them for
+	// restoring fids after a reconnect.
+	origins map[Fid]*fidOrigin
+}
+
+// fidOrigin describes how to establish a fid again on a new connection: by
+// attaching, walking names from the root of the attach and opening the file
+// with mode, if it was opened.
+type fidOrigin struct {
+	uname, aname string
+	names        []string
+	opened       bool
+	mode         Flag
+}
+
+func newFidPool(paths bool) *fidPool {
+	return &fidPool{
+		next:     1,
+		inuse:    make(map[Fid]*FidInfo),
+		reserved: make(map[Fid]bool),
+		paths:    paths,
+	}
+}
+
+// trackOrigins records the origin of fids established from now on.
+func (p *fidPool) trackOrigins() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.origins == nil {
+		p.origins = make(map[Fid]*fidOrigin)
+	}
+}
+
+// get allocates an unused fid and marks it in use.
+func (p *fidPool) get() (Fid, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	for {
+		fid := p.next
+		p.next++
+
+		if fid != NOFID {
+			if _, ok := p.inuse[fid]; !ok {
+				p.inuse[fid] = &FidInfo{Fid: fid}
+				p.reserved[fid] = true
+				return fid, nil
+			}
+		}
+
+		if p.next == start {
+			return NOFID, ErrNomem
+		}
+	}
+}
+
+// mark records fid as in use, referring to the file with qid at path.
+func (p *fidPool) mark(fid Fid, qid Qid, path string) {
+	if fid == NOFID {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := &FidInfo{Fid: fid, Qid: qid}
+	if p.paths {
+		info.Path = path
+	}
+	p.inuse[fid] = info
+	delete(p.reserved, fid)
+	delete(p.origins, fid)
+}
+
+// attached records that fid is the root of an attach by uname to aname.
+func (p *fidPool) attached(fid Fid, uname, aname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.origins != nil {
+		p.origins[fid] = &fidOrigin{uname: uname, aname: aname}
+	}
+}
+
+// walked records newfid as the result of walking names from fid.
+func (p *fidPool) walked(fid, newfid Fid, names []string, qid Qid) {
+	var (
+		path   string
+		origin *fidOrigin
+	)
+
+	p.mu.Lock()
+	if parent, ok := p.origins[fid]; ok {
+		origin = &fidOrigin{
+			uname: parent.uname,
+			aname: parent.aname,
+			names: append(append([]string(nil), parent.names...), names...),
+		}
+	}
+
+	if parent, ok := p.inuse[fid]; ok {
+		if len(names) == 0 {
+			qid = parent.Qid // a clone refers to the same file.
+		}
+
+		if p.paths {
+			path = pathpkg.Join(append([]string{parent.Path}, names...)...)
+		}
+	}
+	p.mu.Unlock()
+
+	p.mark(newfid, qid, path)
+
+	if origin != nil {
+		p.mu.Lock()
+		p.origins[newfid] = origin
+		p.mu.Unlock()
+	}
+}
+
+// opened records that fid has been opened with mode, referring to qid. If
+// name is not empty, fid has moved to the newly created file name.
+func (p *fidPool) opened(fid Fid, name string, qid Qid, mode Flag, iounit uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.inuse[fid]
+	if !ok {
+		return
+	}
+
+	info.Qid = qid
+	info.Opened = true
+	info.Mode = mode
+	info.IOUnit = iounit
+	if p.paths && name != "" {
+		info.Path = pathpkg.Join(info.Path, name)
+	}
+
+	if origin, ok := p.origins[fid]; ok {
+		if name != "" {
+			origin.names = append(origin.names, name)
+		}
+
+		// the file exists now, so it is opened again without truncating
+		// it.
+		origin.opened = true
+		origin.mode = mode &^ OTRUNC
+	}
+}
+
+// put returns fid to the pool.
+func (p *fidPool) put(fid Fid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inuse, fid)
+	delete(p.reserved, fid)
+	delete(p.origins, fid)
+}
+
+// release returns fid to the pool unless it is established, reporting
+// whether it was released or not in use at all.
+func (p *fidPool) release(fid Fid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.inuse[fid]; ok && !p.reserved[fid] {
+		return false
+	}
+
+	delete(p.inuse, fid)
+	delete(p.reserved, fid)
+	return true
+}
+
+// reset forgets every fid, as when the server resets the session.
+func (p *fidPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inuse = make(map[Fid]*FidInfo)
+	p.reserved = make(map[Fid]bool)
+	if p.origins != nil {
+		p.origins = make(map[Fid]*fidOrigin)
+	}
+}
+
+// restorable returns the fids that can be established again, with their
+// origins and qids, ordered by fid. Fids established with authentication
+// cannot be restored.
+func (p *fidPool) restorable() ([]Fid, []fidOrigin, []Qid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var fids []Fid
+	for fid := range p.origins {
+		fids = append(fids, fid)
+	}
+	sort.Sort(fidList(fids))
+
+	origins := make([]fidOrigin, len(fids))
+	qids := make([]Qid, len(fids))
+	for i, fid := range fids {
+		origins[i] = *p.origins[fid]
+		qids[i] = p.inuse[fid].Qid
+	}
+
+	return fids, origins, qids
+}
+
+// qid returns the qid recorded for fid, if it is established.
+func (p *fidPool) qid(fid Fid) (Qid, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.inuse[fid]
+	if !ok || p.reserved[fid] {
+		return Qid{}, false
+	}
+
+	return info.Qid, true
+}
+
+// iounit returns the iounit recorded for fid when it was opened.
+func (p *fidPool) iounit(fid Fid) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if info, ok := p.inuse[fid]; ok {
+		return info.IOUnit
+	}
+
+	return 0
+}
+
+// established reports whether fid refers to a file on the server. Fids
+// allocated with get are not established until they are walked.
+func (p *fidPool) established(fid Fid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.inuse[fid]
+	return ok && !p.reserved[fid]
+}
+
+// list returns a description of each fid in use, ordered by fid.
+func (p *fidPool) list() []FidInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos := make([]FidInfo, 0, len(p.inuse))
+	for _, info := range p.inuse {
+		infos = append(infos, *info)
+	}
+
+	sort.Sort(fidInfos(infos))
+	return infos
+}
+
+// live returns a description of each established fid, ordered by fid.
+func (p *fidPool) live() []FidInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos := make([]FidInfo, 0, len(p.inuse))
+	for fid, info := range p.inuse {
+		if !p.reserved[fid] {
+			infos = append(infos, *info)
+		}
+	}
+
+	sort.Sort(fidInfos(infos))
+	return infos
+}
+
+type fidList []Fid
+
+func (fl fidList) Len() int           { return len(fl) }
+func (fl fidList) Less(i, j int) bool { return fl[i] < fl[j] }
+func (fl fidList) Swap(i, j int)      { fl[i], fl[j] = fl[j], fl[i] }
+
+type fidInfos []FidInfo
+
+func (fi fidInfos) Len() int           { return len(fi) }
+func (fi fidInfos) Less(i, j int) bool { return fi[i].Fid < fi[j].Fid }
+func (fi fidInfos) Swap(i, j int)      { fi[i], fi[j] = fi[j], fi[i] }
+
+// OpenFids describes the fids in use on session, whether or not they have
+// been opened. This is useful for tracking down fid leaks. If session does
+// not track fids, nil is returned.
+func OpenFids(session Session) []FidInfo {
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return nil
+	}
+
+	return fids.list()
+}
+
+// AllocFid allocates an unused fid on session, never NOFID, for the caller
+// to attach or walk. Allocated fids do not collide with each other or with
+// fids in use on the session, so libraries sharing a session can allocate
+// fids independently. The fid is reclaimed once clunked or removed through
+// the session. A fid that is never established, such as after a failed walk,
+// must be returned with ReleaseFid. If session does not manage a fid pool,
+// ErrNoFidPool is returned.
+func AllocFid(session Session) (Fid, error) {
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return NOFID, err
+	}
+
+	return fids.get()
+}
+
+// ReleaseFid returns fid, allocated with AllocFid, to the pool of session.
+// It fails with ErrFidInUse if fid has been established, since the server
+// still holds it: clunk the fid instead.
+func ReleaseFid(session Session, fid Fid) error {
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return err
+	}
+
+	if !fids.release(fid) {
+		return ErrFidInUse
+	}
+
+	return nil
+}
+
+// fidAllocator is implemented by sessions that manage a fid pool.
+type fidAllocator interface {
+	fidpool() *fidPool
+}
+
+// fidpoolOf returns the fid pool for session.
+func fidpoolOf(session Session) (*fidPool, error) {
+	var fa fidAllocator
+	walkSessions(session, func(session Session) bool {
+		fa, _ = session.(fidAllocator)
+		return fa != nil
+	})
+
+	if fa == nil {
+		return nil, ErrNoFidPool
+	}
+
+	return fa.fidpool(), nil
+}
+
+// CloseAll clunks every fid in use on session, as far as ctx allows, then
+// closes the session. The fids that could not be clunked, which the server
+// may still hold, are returned along with the error from closing. If session
+// does not track fids, it is only closed.
+func CloseAll(ctx context.Context, session Session) ([]FidInfo, error) {
+	c, ok := clientOf(session)
+	if !ok {
+		if closer, ok := closerOf(session); ok {
+			return nil, closer.Close()
+		}
+
+		return nil, nil
+	}
+
+	leaked := c.clunkAll(ctx)
+	return leaked, c.close()
+}
+
+// clunkAll clunks the established fids of the session, returning those that
+// failed.
+func (c *client) clunkAll(ctx context.Context) []FidInfo {
+	infos := c.fids.live()
+	fids := make([]Fid, len(infos))
+	for i, info := range infos {
+		fids[i] = info.Fid
+	}
+
+	var leaked []FidInfo
+	for i, err := range ClunkAll(ctx, c, fids) {
+		if err != nil {
+			leaked = append(leaked, infos[i])
+		}
+	}
+
+	return leaked
+}
+
+// ClunkAll clunks each of the fids concurrently, as a Batch. The returned
+// slice holds the error, or nil, for the fid at the same index. Every fid is
+// released, including those that fail to clunk, since a fid is invalid after
+// a clunk regardless of the outcome.
+func ClunkAll(ctx context.Context, session Session, fids []Fid, opts ...BatchOption) []error {
+	return Batch(ctx, len(fids), func(ctx context.Context, i int) error {
+		return session.Clunk(ctx, fids[i])
+	}, opts...)
+}
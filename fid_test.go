@@ -0,0 +1,435 @@
+package p9p
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestClunkAll(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{}, nil
+		case MessageTclunk:
+			if msg.Fid == 3 {
+				return nil, ErrUnknownfid
+			}
+
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	fids := []Fid{1, 2, 3, 4}
+	for _, fid := range fids {
+		if _, err := session.Attach(ctx, fid, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := ClunkAll(ctx, session, fids)
+	if len(errs) != len(fids) {
+		t.Fatalf("unexpected number of errors: %v", errs)
+	}
+
+	for i, err := range errs {
+		expected := error(nil)
+		if fids[i] == 3 {
+			expected = ErrUnknownfid
+		}
+
+		if err != expected {
+			t.Fatalf("fid %v: unexpected error: %v != %v", fids[i], err, expected)
+		}
+	}
+
+	// all fids go back to the pool, even the one that failed.
+	if pool := session.(*client).fids; len(pool.inuse) != 0 {
+		t.Fatalf("fids not released: %v", pool.inuse)
+	}
+}
+
+// TestCloseAll ensures that closing a session clunks the established fids,
+// reporting those that fail, and leaves fids that were only allocated alone.
+func TestCloseAll(t *testing.T) {
+	for _, closeAll := range []bool{false, true} {
+		var (
+			mu      sync.Mutex
+			clunked []Fid
+		)
+		session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			switch msg := msg.(type) {
+			case MessageTattach:
+				return MessageRattach{}, nil
+			case MessageTclunk:
+				mu.Lock()
+				clunked = append(clunked, msg.Fid)
+				mu.Unlock()
+
+				if msg.Fid == 3 {
+					return nil, ErrUnknownfid
+				}
+
+				return MessageRclunk{}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}), WithClunkOnClose(time.Second))
+		defer cleanup()
+
+		ctx := context.Background()
+		for _, fid := range []Fid{1, 2, 3} {
+			if _, err := session.Attach(ctx, fid, NOFID, "test", "/"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := AllocFid(session); err != nil {
+			t.Fatal(err)
+		}
+
+		if closeAll {
+			leaked, err := CloseAll(ctx, session)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(leaked) != 1 || leaked[0].Fid != 3 {
+				t.Fatalf("unexpected leaked fids: %v", leaked)
+			}
+		} else if err := session.(io.Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		sort.Sort(fidList(clunked))
+		if !reflect.DeepEqual(clunked, []Fid{1, 2, 3}) {
+			t.Fatalf("unexpected fids clunked: %v", clunked)
+		}
+		mu.Unlock()
+
+		if _, err := session.Attach(ctx, 5, NOFID, "test", "/"); err == nil {
+			t.Fatal("expected session to be closed")
+		}
+	}
+}
+
+func TestOpenFids(t *testing.T) {
+	handler := HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR, Path: 1}}, nil
+		case MessageTwalk:
+			qids := make([]Qid, len(msg.Wnames))
+			for i := range qids {
+				qids[i] = Qid{Path: uint64(10 + i)}
+			}
+
+			return MessageRwalk{Qids: qids}, nil
+		case MessageTopen:
+			return MessageRopen{Qid: Qid{Path: 11}}, nil
+		case MessageTcreate:
+			return MessageRcreate{Qid: Qid{Path: 20}}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	})
+
+	for _, paths := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cconn, sconn := net.Pipe()
+		go ServeConn(ctx, sconn, handler)
+
+		var opts []SessionOption
+		if paths {
+			opts = append(opts, WithFidPaths())
+		}
+
+		session, err := NewSession(ctx, cconn, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Walk(ctx, 1, 2, "a", "b"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := session.Open(ctx, 2, ORDWR); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Walk(ctx, 1, 3, "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := session.Create(ctx, 3, "new", 0644, OWRITE); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []FidInfo{
+			{Fid: 1, Qid: Qid{Type: QTDIR, Path: 1}, Path: "/"},
+			{Fid: 2, Qid: Qid{Path: 11}, Opened: true, Mode: ORDWR, Path: "/a/b"},
+			{Fid: 3, Qid: Qid{Path: 20}, Opened: true, Mode: OWRITE, Path: "/a/new"},
+		}
+
+		if !paths {
+			for i := range expected {
+				expected[i].Path = ""
+			}
+		}
+
+		if fids := OpenFids(session); !reflect.DeepEqual(fids, expected) {
+			t.Fatalf("unexpected fids: %v != %v", fids, expected)
+		}
+
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+// TestWalkFidInUse ensures that walking to a newfid that is already
+// established fails on the client, without reaching the server.
+func TestWalkFidInUse(t *testing.T) {
+	var walks int
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTwalk:
+			walks++
+			return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+		case MessageTclunk:
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fids := range [][2]Fid{{1, 2}, {2, 1}} {
+		if _, err := session.Walk(ctx, fids[0], fids[1], "b"); err != ErrFidInUse {
+			t.Fatalf("expected fid in use walking %v: %v", fids, err)
+		}
+	}
+
+	if walks != 1 {
+		t.Fatalf("rejected walks reached the server: %v walks", walks)
+	}
+
+	// walking in place and reusing a clunked fid remain valid.
+	if _, err := session.Walk(ctx, 2, 2, "c"); err != nil {
+		t.Fatalf("unexpected error walking in place: %v", err)
+	}
+
+	if err := session.Clunk(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "b"); err != nil {
+		t.Fatalf("unexpected error reusing clunked fid: %v", err)
+	}
+}
+
+// TestAllocFid allocates fids concurrently alongside fids chosen by the
+// caller, ensuring that they never collide and are reclaimed.
+func TestAllocFid(t *testing.T) {
+	tree := newMemTree("file")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fid chosen by the caller, ahead of the allocator.
+	if _, err := session.Walk(ctx, 1, 3, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	fids := make([]Fid, n)
+	errs := Batch(ctx, n, func(ctx context.Context, i int) error {
+		fid, err := AllocFid(session)
+		fids[i] = fid
+		return err
+	})
+
+	seen := map[Fid]bool{1: true, 3: true}
+	for i, fid := range fids {
+		if errs[i] != nil {
+			t.Fatalf("unexpected error allocating fid: %v", errs[i])
+		}
+
+		if seen[fid] || fid == NOFID {
+			t.Fatalf("fid %v allocated twice", fid)
+		}
+		seen[fid] = true
+
+		if _, err := session.Walk(ctx, 1, fid, "file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ReleaseFid(session, fids[0]); err != ErrFidInUse {
+		t.Fatalf("expected established fid not to be released: %v", err)
+	}
+
+	for _, fid := range fids {
+		if err := session.Clunk(ctx, fid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fid, err := AllocFid(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReleaseFid(session, fid); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(OpenFids(session)) != 2 {
+		t.Fatalf("fids not reclaimed: %v", OpenFids(session))
+	}
+}
+
+// TestIOUnit ensures that reads are sized by the iounit of a fid, falling
+// back to the msize when the server returns an iounit of zero.
+func TestIOUnit(t *testing.T) {
+	const iounit = 100
+	var counts []uint32
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{}, nil
+		case MessageTwalk:
+			return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+		case MessageTopen:
+			if msg.Fid == 1 {
+				return MessageRopen{IOUnit: 0}, nil
+			}
+
+			return MessageRopen{IOUnit: iounit}, nil
+		case MessageTread:
+			counts = append(counts, msg.Count)
+			return MessageRread{Data: make([]byte, msg.Count)}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	msize, _ := session.Version()
+	for fid, expected := range map[Fid]int{1: msize - IOHDRSZ, 2: iounit} {
+		if _, _, err := session.Open(ctx, fid, OREAD); err != nil {
+			t.Fatal(err)
+		}
+
+		if size := IOUnit(session, fid); size != expected {
+			t.Fatalf("unexpected iounit for fid %v: %v != %v", fid, size, expected)
+		}
+	}
+
+	counts = nil
+	if _, err := ReadInto(ctx, session, 2, make([]byte, 3*iounit), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range counts {
+		if count != iounit {
+			t.Fatalf("read not sized by iounit: %v", counts)
+		}
+	}
+
+	if size := IOUnit(session, 3); size != msize-IOHDRSZ {
+		t.Fatalf("unexpected iounit for unopened fid: %v", size)
+	}
+}
+
+// TestSessionIOUnit ensures that reads and writes on a session larger than
+// the iounit of the fid are limited or split, rather than sent as is.
+func TestSessionIOUnit(t *testing.T) {
+	const iounit = 100
+	var sizes []int
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{}, nil
+		case MessageTopen:
+			return MessageRopen{IOUnit: iounit}, nil
+		case MessageTread:
+			sizes = append(sizes, int(msg.Count))
+			return MessageRread{Data: make([]byte, msg.Count)}, nil
+		case MessageTwrite:
+			sizes = append(sizes, len(msg.Data))
+			if msg.Offset >= 4*iounit {
+				return MessageRwrite{Count: 1}, nil // out of space.
+			}
+
+			return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := session.Open(ctx, 1, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := session.Read(ctx, 1, make([]byte, 3*iounit), 0); err != nil || n != iounit {
+		t.Fatalf("unexpected read of %v bytes: %v", n, err)
+	}
+
+	if n, err := session.Write(ctx, 1, make([]byte, 5*iounit/2), 0); err != nil || n != 5*iounit/2 {
+		t.Fatalf("unexpected write of %v bytes: %v", n, err)
+	}
+
+	if n, err := session.Write(ctx, 1, make([]byte, 3*iounit), 3*iounit); err != nil || n != iounit+1 {
+		t.Fatalf("expected write to stop short: %v bytes: %v", n, err)
+	}
+
+	if expected := []int{100, 100, 100, 50, 100, 100}; !reflect.DeepEqual(sizes, expected) {
+		t.Fatalf("unexpected message sizes: %v != %v", sizes, expected)
+	}
+}
@@ -0,0 +1,300 @@
+package p9p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// errFileClosed is returned by operations on a File after Close.
+var errFileClosed = errors.New("file already closed")
+
+// FidIO reads and writes an opened fid through the standard io interfaces,
+// so that remote files can be passed to functions such as io.Copy. Read,
+// Write and Seek share an offset, as with os.File, while ReadAt and WriteAt
+// leave it alone. Each message carries at most the iounit of the fid, bounded
+// by the msize of the session. Calls use the default context of the session.
+//
+// Writes may be buffered with SetWriteBehind. Other calls flush the buffered
+// writes first, so they observe the data written.
+//
+// A FidIO is safe for concurrent use. It does not own the fid, which the
+// caller must clunk once done.
+type FidIO struct {
+	session Session
+	fid     Fid
+	size    int // data per message
+
+	mu     sync.Mutex
+	offset int64
+	closed bool         // set by File.Close
+	wb     *writeBehind // set by SetWriteBehind
+}
+
+var (
+	_ io.ReadWriteSeeker = &FidIO{}
+	_ io.ReaderAt        = &FidIO{}
+	_ io.WriterAt        = &FidIO{}
+	_ io.ReaderFrom      = &FidIO{}
+	_ io.WriterTo        = &FidIO{}
+)
+
+// NewFidIO returns a FidIO for fid, opened on session with iounit, as
+// returned by Open or Create. If iounit is zero, the iounit recorded by the
+// session's fid pool is used, if any.
+func NewFidIO(session Session, fid Fid, iounit uint32) *FidIO {
+	size := IOUnit(session, fid)
+	if iounit > 0 {
+		msize, _ := session.Version()
+		size = iosize(msize, iounit)
+	}
+
+	return &FidIO{session: session, fid: fid, size: size}
+}
+
+// Fid returns the fid read and written.
+func (f *FidIO) Fid() Fid { return f.fid }
+
+func (f *FidIO) ctx() context.Context {
+	return DefaultContext(f.session)
+}
+
+// Read reads up to len(p) bytes at the offset, in a single message, and
+// advances the offset. At the end of the file, it returns io.EOF.
+func (f *FidIO) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+
+	if err := f.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	if len(p) > f.size {
+		p = p[:f.size]
+	}
+
+	n, err := f.session.Read(f.ctx(), f.fid, p, f.offset)
+	f.offset += int64(n)
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes at offset, as with ReadInto.
+func (f *FidIO) ReadAt(p []byte, offset int64) (int, error) {
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+
+	return readInto(f.ctx(), f.session, f.fid, p, offset, f.size)
+}
+
+// WriteTo writes the data from the offset to the end of the file to w and
+// advances the offset.
+func (f *FidIO) WriteTo(w io.Writer) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+
+	if err := f.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, f.size)
+
+	var written int64
+	for {
+		n, err := f.session.Read(f.ctx(), f.fid, buf, f.offset)
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			return written, nil
+		}
+		f.offset += int64(n)
+
+		nn, err := w.Write(buf[:n])
+		written += int64(nn)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Write writes p at the offset and advances the offset. With write behind,
+// p is buffered and an error may be from an earlier write.
+func (f *FidIO) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	wb := f.wb
+	if wb != nil && !f.closed {
+		defer f.mu.Unlock()
+
+		if err := wb.write(p, f.offset); err != nil {
+			return 0, err
+		}
+
+		f.offset += int64(len(p))
+		return len(p), nil
+	}
+	f.mu.Unlock()
+
+	n, err := f.ReadFrom(bytes.NewReader(p))
+	return int(n), err
+}
+
+// ReadFrom writes the data read from r at the offset, as with WriteFrom, and
+// advances the offset.
+func (f *FidIO) ReadFrom(r io.Reader) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+
+	if err := f.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	n, err := writeFrom(f.ctx(), f.session, f.fid, f.offset, r, f.size)
+	f.offset += n
+	return n, err
+}
+
+// WriteAt writes p at offset, as with WriteFrom.
+func (f *FidIO) WriteAt(p []byte, offset int64) (int, error) {
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+
+	n, err := writeFrom(f.ctx(), f.session, f.fid, offset, bytes.NewReader(p), f.size)
+	return int(n), err
+}
+
+// Seek sets the offset for the next Read or Write, as with io.Seeker.
+// Seeking relative to the end stats the fid for the length of the file.
+func (f *FidIO) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, errFileClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		if err := f.flushLocked(); err != nil {
+			return 0, err
+		}
+
+		d, err := f.session.Stat(f.ctx(), f.fid)
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(d.Length)
+	default:
+		return 0, ErrBadoffset
+	}
+
+	if offset < 0 {
+		return 0, ErrBadoffset
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// SetWriteBehind buffers the data of Write, sending it in messages of the
+// full iounit in the background with up to window writes in flight, which
+// suits many small writes over a slow link. Write returns once p is
+// buffered, so an error writing it is returned by a later call: use Flush or
+// Sync to wait for the data to be written. Once a write fails, later calls
+// fail with the same error. A window of zero flushes the buffered writes and
+// disables buffering.
+func (f *FidIO) SetWriteBehind(window int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return errFileClosed
+	}
+
+	if err := f.flushLocked(); err != nil {
+		return err
+	}
+
+	f.wb = nil
+	if window > 0 {
+		f.wb = newWriteBehind(f, window)
+	}
+
+	return nil
+}
+
+// Flush sends the buffered writes and waits for them to complete, returning
+// the first error from writing. Without write behind, it does nothing.
+func (f *FidIO) Flush() error {
+	return f.flush()
+}
+
+// Sync flushes the buffered writes, then asks the server to commit the file
+// to stable storage. Servers may ignore the request.
+func (f *FidIO) Sync() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	return f.session.WStat(f.ctx(), f.fid, syncDir)
+}
+
+func (f *FidIO) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return errFileClosed
+	}
+
+	return f.flushLocked()
+}
+
+func (f *FidIO) flushLocked() error {
+	if f.wb == nil {
+		return nil
+	}
+
+	return f.wb.flush()
+}
+
+// close flushes the buffered writes and marks f closed, reporting whether it
+// already was.
+func (f *FidIO) close() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return true, nil
+	}
+	f.closed = true
+
+	return false, f.flushLocked()
+}
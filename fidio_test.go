@@ -0,0 +1,184 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestFidIO copies data to and from a file through a FidIO, ensuring that
+// messages respect the iounit and that the offset is tracked.
+func TestFidIO(t *testing.T) {
+	const iounit = 100
+	tree := newMemTree("file")
+
+	var largest uint32
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			if msg.Count > largest {
+				largest = msg.Count
+			}
+		case MessageTwrite:
+			if n := uint32(len(msg.Data)); n > largest {
+				largest = n
+			}
+		}
+
+		return tree.Handle(ctx, msg)
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := session.Open(ctx, 2, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFidIO(session, 2, iounit)
+	data := bytes.Repeat([]byte("0123456789"), 105)
+	if n, err := io.Copy(f, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+		t.Fatalf("unexpected copy of %v bytes: %v", n, err)
+	}
+
+	if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != int64(len(data)) {
+		t.Fatalf("unexpected offset %v: %v", off, err)
+	}
+
+	if off, err := f.Seek(-50, io.SeekEnd); err != nil || off != int64(len(data)-50) {
+		t.Fatalf("unexpected offset %v: %v", off, err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := io.Copy(&buf, f); err != nil || n != 50 || !bytes.Equal(buf.Bytes(), data[len(data)-50:]) {
+		t.Fatalf("unexpected copy of %v bytes: %v", n, err)
+	}
+
+	if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF at end of file: %v %v", n, err)
+	}
+
+	if _, err := f.WriteAt([]byte("abc"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 2*iounit+5)
+	if n, err := f.ReadAt(p, 5); err != nil || n != len(p) {
+		t.Fatalf("unexpected read of %v bytes: %v", n, err)
+	}
+
+	if string(p[:8]) != "56789abc" {
+		t.Fatalf("unexpected data: %q", p[:8])
+	}
+
+	if largest > iounit {
+		t.Fatalf("message of %v bytes exceeds iounit", largest)
+	}
+}
+
+// TestWriteBehind ensures that small writes are coalesced into messages of
+// the iounit, and that errors from the background are surfaced by Flush.
+func TestWriteBehind(t *testing.T) {
+	const iounit = 100
+	tree := newMemTree("file")
+
+	var (
+		mu     sync.Mutex
+		writes []int
+		synced bool
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTwrite:
+			if msg.Offset >= 2000 {
+				return nil, ErrNowrite
+			}
+
+			mu.Lock()
+			writes = append(writes, len(msg.Data))
+			mu.Unlock()
+		case MessageTwstat:
+			mu.Lock()
+			synced = msg.Stat.Length == ^uint64(0) && msg.Stat.Name == "" &&
+				uint32(msg.Stat.ModTime.Unix()) == ^uint32(0)
+			mu.Unlock()
+			return MessageRwstat{}, nil
+		}
+
+		return tree.Handle(ctx, msg)
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := session.Open(ctx, 2, ORDWR); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFidIO(session, 2, iounit)
+	if err := f.SetWriteBehind(2); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 105)
+	for p := data; len(p) > 0; p = p[10:] {
+		if n, err := f.Write(p[:10]); err != nil || n != 10 {
+			t.Fatalf("unexpected write of %v bytes: %v", n, err)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes in flight may complete in any order.
+	mu.Lock()
+	if !synced {
+		t.Fatal("expected a wstat changing nothing")
+	}
+
+	sort.Ints(writes)
+	if len(writes) != 11 || writes[0] != 50 || writes[1] != iounit {
+		t.Fatalf("unexpected writes: %v", writes)
+	}
+	mu.Unlock()
+
+	p := make([]byte, len(data))
+	if n, err := f.ReadAt(p, 0); err != nil || !bytes.Equal(p[:n], data) {
+		t.Fatalf("unexpected read of %v bytes: %v", n, err)
+	}
+
+	if _, err := f.Seek(2000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("full")); err != nil {
+		t.Fatalf("expected buffered write to succeed: %v", err)
+	}
+
+	if err := f.Flush(); err != ErrNowrite {
+		t.Fatalf("expected error from flush: %v", err)
+	}
+
+	if _, err := f.Write([]byte("again")); err != ErrNowrite {
+		t.Fatalf("expected sticky error: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package p9p
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// FidTable maps the fids of a connection to the resources a server
+// associates with them, such as open files. Sessions serving a connection
+// can embed one in place of their own map and locking. Resources
+// implementing io.Closer are closed as their fids are clunked. A FidTable
+// is safe for concurrent use; the zero value is an empty table.
+type FidTable struct {
+	mu   sync.Mutex
+	fids map[Fid]*fidEntry
+}
+
+type fidEntry struct {
+	v        interface{}
+	reserved bool // newfid of a Clone in progress
+}
+
+// NewFidTable returns an empty table.
+func NewFidTable() *FidTable {
+	return &FidTable{}
+}
+
+// Add associates fid with the resource v, as when attaching. If fid is in
+// use, ErrDupfid is returned. NOFID never names a file, so adding it fails
+// with ErrUnknownfid.
+func (t *FidTable) Add(fid Fid, v interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addLocked(fid, &fidEntry{v: v})
+}
+
+func (t *FidTable) addLocked(fid Fid, entry *fidEntry) error {
+	if fid == NOFID {
+		return ErrUnknownfid
+	}
+
+	if _, ok := t.fids[fid]; ok {
+		return ErrDupfid
+	}
+
+	if t.fids == nil {
+		t.fids = map[Fid]*fidEntry{}
+	}
+	t.fids[fid] = entry
+
+	return nil
+}
+
+// Get returns the resource of fid, or ErrUnknownfid if fid is not in use.
+func (t *FidTable) Get(fid Fid) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.fids[fid]
+	if !ok || entry.reserved {
+		return nil, ErrUnknownfid
+	}
+
+	return entry.v, nil
+}
+
+// Clone associates newfid with the resource returned by clone, called with
+// the resource of fid, as when walking. Newfid is reserved while clone runs
+// without holding the table, and is left unused if clone fails. If newfid is
+// fid, its resource is replaced by the result of clone, which is responsible
+// for the old one, as when walking in place. Otherwise, a newfid in use
+// fails with ErrDupfid before clone is called.
+func (t *FidTable) Clone(fid, newfid Fid, clone func(v interface{}) (interface{}, error)) error {
+	t.mu.Lock()
+	entry, ok := t.fids[fid]
+	if !ok || entry.reserved {
+		t.mu.Unlock()
+		return ErrUnknownfid
+	}
+
+	reserved := entry
+	if newfid != fid {
+		reserved = &fidEntry{reserved: true}
+		if err := t.addLocked(newfid, reserved); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	t.mu.Unlock()
+
+	v, err := clone(entry.v)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		if newfid != fid {
+			delete(t.fids, newfid)
+		}
+
+		return err
+	}
+
+	if newfid == fid && t.fids[fid] != entry {
+		// fid was clunked while cloning in place.
+		if closer, ok := v.(io.Closer); ok {
+			closer.Close()
+		}
+
+		return ErrUnknownfid
+	}
+
+	t.fids[newfid] = &fidEntry{v: v}
+	return nil
+}
+
+// Clunk releases fid, closing its resource if it implements io.Closer, and
+// returns the error from closing it. The fid is released even then, as
+// clunk(5) requires, which also suits Tremove. If fid is not in use,
+// ErrUnknownfid is returned.
+func (t *FidTable) Clunk(fid Fid) error {
+	t.mu.Lock()
+	entry, ok := t.fids[fid]
+	if !ok || entry.reserved {
+		t.mu.Unlock()
+		return ErrUnknownfid
+	}
+	delete(t.fids, fid)
+	t.mu.Unlock()
+
+	if closer, ok := entry.v.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Len returns the number of fids in use.
+func (t *FidTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var n int
+	for _, entry := range t.fids {
+		if !entry.reserved {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Range calls fn with each fid in use and its resource, in increasing order
+// of fid, until fn returns false. Fn is called without holding the table,
+// so it may use it, and sees the fids in use when Range was called.
+func (t *FidTable) Range(fn func(fid Fid, v interface{}) bool) {
+	t.mu.Lock()
+	fids := make(fidList, 0, len(t.fids))
+	values := make(map[Fid]interface{}, len(t.fids))
+	for fid, entry := range t.fids {
+		if !entry.reserved {
+			fids = append(fids, fid)
+			values[fid] = entry.v
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Sort(fids)
+	for _, fid := range fids {
+		if !fn(fid, values[fid]) {
+			return
+		}
+	}
+}
+
+// CloseAll clunks every fid in use, as when the connection ends or a
+// Tversion resets the session, returning the first error from closing a
+// resource.
+func (t *FidTable) CloseAll() error {
+	t.mu.Lock()
+	var entries []*fidEntry
+	for fid, entry := range t.fids {
+		if !entry.reserved {
+			entries = append(entries, entry)
+			delete(t.fids, fid)
+		}
+	}
+	t.mu.Unlock()
+
+	var err error
+	for _, entry := range entries {
+		if closer, ok := entry.v.(io.Closer); ok {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+package p9p
+
+import (
+	"errors"
+	"testing"
+)
+
+// testResource counts how often it is closed.
+type testResource struct {
+	name   string
+	closed int
+}
+
+func (r *testResource) Close() error {
+	r.closed++
+	return nil
+}
+
+func TestFidTable(t *testing.T) {
+	var table FidTable
+	root := &testResource{name: "/"}
+	if err := table.Add(1, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		fid Fid
+		err error
+	}{
+		{fid: 1, err: ErrDupfid},
+		{fid: NOFID, err: ErrUnknownfid},
+	} {
+		if err := table.Add(testcase.fid, &testResource{}); err != testcase.err {
+			t.Fatalf("%v: unexpected error: %v", testcase.fid, err)
+		}
+	}
+
+	walk := func(name string) func(v interface{}) (interface{}, error) {
+		return func(v interface{}) (interface{}, error) {
+			return &testResource{name: v.(*testResource).name + name}, nil
+		}
+	}
+
+	if err := table.Clone(1, 2, walk("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.Clone(1, 2, walk("b")); err != ErrDupfid {
+		t.Fatalf("expected ErrDupfid: %v", err)
+	}
+
+	// a failed walk leaves newfid unused.
+	errWalk := errors.New("walk failed")
+	if err := table.Clone(1, 3, func(v interface{}) (interface{}, error) {
+		if _, err := table.Get(3); err != ErrUnknownfid {
+			t.Fatalf("expected reserved fid to be unknown: %v", err)
+		}
+
+		return nil, errWalk
+	}); err != errWalk {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := table.Get(3); err != ErrUnknownfid {
+		t.Fatalf("expected ErrUnknownfid: %v", err)
+	}
+
+	// walking in place replaces the resource.
+	if err := table.Clone(2, 2, walk("/b")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := table.Get(2)
+	if err != nil || v.(*testResource).name != "/a/b" {
+		t.Fatalf("unexpected resource: %v, %v", v, err)
+	}
+
+	if table.Len() != 2 {
+		t.Fatalf("unexpected length: %d", table.Len())
+	}
+
+	var fids []Fid
+	table.Range(func(fid Fid, v interface{}) bool {
+		fids = append(fids, fid)
+		return true
+	})
+
+	if len(fids) != 2 || fids[0] != 1 || fids[1] != 2 {
+		t.Fatalf("unexpected fids: %v", fids)
+	}
+
+	if err := table.Clunk(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.(*testResource).closed != 1 {
+		t.Fatalf("expected resource closed on clunk")
+	}
+
+	if err := table.Clunk(2); err != ErrUnknownfid {
+		t.Fatalf("expected ErrUnknownfid: %v", err)
+	}
+
+	if err := table.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if root.closed != 1 || table.Len() != 0 {
+		t.Fatalf("expected table emptied: %d closes, %d fids", root.closed, table.Len())
+	}
+}
@@ -0,0 +1,506 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	pathpkg "path"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Client provides access to the files of an attach by name, on top of a
+// Session. It allocates and clunks fids from the session's pool, so callers
+// never handle fids themselves. Paths are slash separated and relative to the
+// root of the attach; a leading slash is ignored. A Client is safe for
+// concurrent use.
+type Client struct {
+	session Session
+	fids    *fidPool
+	root    Fid
+	closer  io.Closer // the session, if owned by the client
+	stripes []*Client // attaches on other connections, see WithStripes
+}
+
+// NewClient attaches to aname as uname on session, without authentication
+// unless the session was created WithAuth, and returns a Client for the
+// files of the attach. The session must manage a fid pool, as client
+// sessions do, or ErrNoFidPool is returned.
+func NewClient(ctx context.Context, session Session, uname, aname string) (*Client, error) {
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := fids.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := session.Attach(ctx, root, NOFID, uname, aname); err != nil {
+		fids.put(root)
+		return nil, err
+	}
+
+	return &Client{session: session, fids: fids, root: root}, nil
+}
+
+// Session returns the session of the client.
+func (c *Client) Session() Session {
+	return c.session
+}
+
+// Close clunks the root of the attach. Files already opened remain usable
+// until they are closed. The session is left open, unless the client was
+// returned by DialAddr.
+func (c *Client) Close() error {
+	err := c.session.Clunk(DefaultContext(c.session), c.root)
+	if c.closer != nil {
+		if cerr := c.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	for _, sc := range c.stripes {
+		if cerr := sc.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// walk walks path into a fresh fid. On failure, a *PathError with op is
+// returned and the fid is released.
+func (c *Client) walk(ctx context.Context, op, path string) (Fid, error) {
+	fid, err := c.fids.get()
+	if err != nil {
+		return NOFID, &PathError{Op: op, Path: path, Err: err}
+	}
+
+	names := splitpath(path)
+	qids, err := walkNames(ctx, c.session, c.root, fid, names)
+	if err != nil || len(qids) != len(names) {
+		// the new fid is not established on a failed walk.
+		c.fids.put(fid)
+		if err == nil {
+			err = ErrNotfound
+		}
+
+		return NOFID, &PathError{Op: op, Path: path, Err: err}
+	}
+
+	return fid, nil
+}
+
+// Open opens the file at path with mode.
+func (c *Client) Open(ctx context.Context, path string, mode Flag) (*File, error) {
+	fid, err := c.walk(ctx, "open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	qid, iounit, err := c.session.Open(ctx, fid, mode)
+	if err != nil {
+		c.session.Clunk(ctx, fid)
+		return nil, &PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return newFile(c, fid, path, qid, iounit), nil
+}
+
+// Create creates the file at path with perm and opens it with mode. The
+// parent directory must exist.
+func (c *Client) Create(ctx context.Context, path string, perm uint32, mode Flag) (*File, error) {
+	dir, name := pathpkg.Split(pathpkg.Clean("/" + path))
+	if name == "" {
+		return nil, &PathError{Op: "create", Path: path, Err: ErrExist}
+	}
+
+	fid, err := c.walk(ctx, "create", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// on success, the fid moves to the new file.
+	qid, iounit, err := c.session.Create(ctx, fid, name, perm, mode)
+	if err != nil {
+		c.session.Clunk(ctx, fid)
+		return nil, &PathError{Op: "create", Path: path, Err: err}
+	}
+
+	return newFile(c, fid, path, qid, iounit), nil
+}
+
+// Stat returns the directory entry of the file at path.
+func (c *Client) Stat(ctx context.Context, path string) (Dir, error) {
+	fid, err := c.walk(ctx, "stat", path)
+	if err != nil {
+		return Dir{}, err
+	}
+	defer c.session.Clunk(ctx, fid)
+
+	d, err := c.session.Stat(ctx, fid)
+	if err != nil {
+		return Dir{}, &PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	return d, nil
+}
+
+// Remove removes the file or empty directory at path, as with RemovePath.
+func (c *Client) Remove(ctx context.Context, path string) error {
+	return RemovePath(ctx, c.session, c.root, path)
+}
+
+// Rename renames the file at oldpath to newpath by writing its new name with
+// WStat. The protocol has no way of moving a file to another directory, so
+// ErrCrossDir is returned unless both paths share their parent.
+func (c *Client) Rename(ctx context.Context, oldpath, newpath string) error {
+	olddir, _ := pathpkg.Split(pathpkg.Clean("/" + oldpath))
+	newdir, name := pathpkg.Split(pathpkg.Clean("/" + newpath))
+	switch {
+	case name == "":
+		return &PathError{Op: "rename", Path: newpath, Err: ErrExist}
+	case olddir != newdir:
+		return &PathError{Op: "rename", Path: oldpath, Err: ErrCrossDir}
+	}
+
+	d := syncDir
+	d.Name = name
+	return c.wstat(ctx, "rename", oldpath, d)
+}
+
+// Chmod changes the permission bits of the file at path to those of perm,
+// keeping the other bits of its mode, such as DMDIR, which servers refuse to
+// change.
+func (c *Client) Chmod(ctx context.Context, path string, perm uint32) error {
+	fid, err := c.walk(ctx, "chmod", path)
+	if err != nil {
+		return err
+	}
+	defer c.session.Clunk(ctx, fid)
+
+	dir, err := c.session.Stat(ctx, fid)
+	if err != nil {
+		return &PathError{Op: "chmod", Path: path, Err: err}
+	}
+
+	d := syncDir
+	d.Mode = dir.Mode&^0777 | perm&0777
+	if err := c.session.WStat(ctx, fid, d); err != nil {
+		return &PathError{Op: "chmod", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// Chtimes changes the access and modification times of the file at path. A
+// zero time leaves the corresponding time unchanged, as with os.Chtimes.
+func (c *Client) Chtimes(ctx context.Context, path string, atime, mtime time.Time) error {
+	d := syncDir
+	if !atime.IsZero() {
+		d.AccessTime = atime
+	}
+
+	if !mtime.IsZero() {
+		d.ModTime = mtime
+	}
+
+	return c.wstat(ctx, "chtimes", path, d)
+}
+
+// wstat writes d to the file at path, which is left alone where d holds the
+// values of syncDir. Errors are reported for op.
+func (c *Client) wstat(ctx context.Context, op, path string, d Dir) error {
+	fid, err := c.walk(ctx, op, path)
+	if err != nil {
+		return err
+	}
+	defer c.session.Clunk(ctx, fid)
+
+	if err := c.session.WStat(ctx, fid, d); err != nil {
+		return &PathError{Op: op, Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// ReadDir returns the entries of the directory at path, as with
+// ReaddirPath.
+func (c *Client) ReadDir(ctx context.Context, path string) ([]Dir, error) {
+	return ReaddirPath(ctx, c.session, c.root, path)
+}
+
+// ReadFile returns the contents of the file at path.
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	f, err := c.Open(ctx, path, OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		buf    = new(bytes.Buffer)
+		p      = make([]byte, f.size)
+		offset int64
+	)
+	if len(c.stripes) > 0 {
+		data, err := c.readStriped(ctx, f, path)
+		if err != nil {
+			return nil, &PathError{Op: "read", Path: path, Err: err}
+		}
+
+		buf = bytes.NewBuffer(data)
+		offset = int64(len(data))
+	}
+
+	for {
+		n, err := c.session.Read(ctx, f.fid, p, offset)
+		if err != nil && err != io.EOF {
+			return nil, &PathError{Op: "read", Path: path, Err: err}
+		}
+
+		if n == 0 {
+			return buf.Bytes(), nil
+		}
+
+		buf.Write(p[:n])
+		offset += int64(n)
+	}
+}
+
+// DefaultStreamWindow is the number of reads OpenStream keeps in flight.
+const DefaultStreamWindow = 8
+
+// OpenStream opens the file at path for reading and returns a reader for it
+// that keeps DefaultStreamWindow reads in flight ahead of the caller, as a
+// ReadAhead does. Copying from the stream keeps the link busy without the
+// caller managing concurrency. Closing the stream closes the file.
+func (c *Client) OpenStream(ctx context.Context, path string) (io.ReadCloser, error) {
+	f, err := c.Open(ctx, path, OREAD)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stream{ReadAhead: NewReadAhead(ctx, c.session, f.fid, 0, DefaultStreamWindow), f: f}, nil
+}
+
+// stream is a ReadAhead that owns the file it reads.
+type stream struct {
+	*ReadAhead
+	f *File
+}
+
+func (s *stream) Close() error {
+	if err := s.ReadAhead.Close(); err != nil {
+		return err
+	}
+
+	return s.f.Close()
+}
+
+// WriteFile writes data to the file at path, creating it with perm if it
+// doesn't exist and truncating it otherwise. The parent directory must
+// exist.
+func (c *Client) WriteFile(ctx context.Context, path string, data []byte, perm uint32) error {
+	f, err := c.createTrunc(ctx, path, perm)
+	if err != nil {
+		return err
+	}
+
+	striped := false
+	if len(c.stripes) > 0 {
+		striped, err = c.writeStriped(ctx, f, path, data)
+	}
+
+	if !striped {
+		_, err = writeFrom(ctx, c.session, f.fid, 0, bytes.NewReader(data), f.size)
+	}
+
+	if cerr := c.session.Clunk(ctx, f.fid); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return &PathError{Op: "write", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// createTrunc opens the file at path for writing, truncating it, or creates
+// it with perm if it doesn't exist.
+func (c *Client) createTrunc(ctx context.Context, path string, perm uint32) (*File, error) {
+	dir, name := pathpkg.Split(pathpkg.Clean("/" + path))
+	if name == "" {
+		return nil, &PathError{Op: "open", Path: path, Err: ErrIsdir}
+	}
+
+	fid, err := c.walk(ctx, "open", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the fid refers to the file, or is left to be clunked, either way.
+	qid, iounit, _, err := CreateOrOpen(ctx, c.session, fid, name, perm, OWRITE|OTRUNC)
+	if err != nil {
+		c.session.Clunk(ctx, fid)
+		return nil, &PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return newFile(c, fid, path, qid, iounit), nil
+}
+
+// MkdirAll creates the directory at path with perm, along with any missing
+// parents, like os.MkdirAll. If path is already a directory, MkdirAll does
+// nothing. If a file in the way is not a directory, the returned error holds
+// ErrCreatenondir, or ErrExist if it is the last one.
+func (c *Client) MkdirAll(ctx context.Context, path string, perm uint32) error {
+	names := splitpath(path)
+	fail := func(err error) error {
+		return &PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	// notDir fails for the name at i, which is not a directory.
+	notDir := func(i int) error {
+		if i == len(names)-1 {
+			return fail(ErrExist)
+		}
+
+		return fail(ErrCreatenondir)
+	}
+
+	fid, err := c.fids.get()
+	if err != nil {
+		return fail(err)
+	}
+
+	qids, err := walkNames(ctx, c.session, c.root, fid, names)
+	if err != nil && !IsNotExist(err) {
+		c.fids.put(fid)
+		return fail(err)
+	}
+
+	if existing := len(qids); existing < len(names) {
+		// walk again, as far as the path exists.
+		qids, err = walkNames(ctx, c.session, c.root, fid, names[:existing])
+		if err == nil && len(qids) != existing {
+			err = ErrNotfound // removed since the first walk.
+		}
+
+		if err != nil {
+			c.fids.put(fid)
+			return fail(err)
+		}
+	}
+	defer c.session.Clunk(ctx, fid)
+
+	for i, qid := range qids {
+		if qid.Type&QTDIR == 0 {
+			return notDir(i)
+		}
+	}
+
+	for i := len(qids); i < len(names); i++ {
+		name := names[i]
+
+		// the created directory is opened, so it is created from a clone of
+		// its parent and walked to afterwards.
+		dir, err := c.fids.get()
+		if err != nil {
+			return fail(err)
+		}
+
+		if _, err := c.session.Walk(ctx, fid, dir); err != nil {
+			c.fids.put(dir)
+			return fail(err)
+		}
+
+		// the file may have been created by another since the walk.
+		_, _, err = c.session.Create(ctx, dir, name, perm|DMDIR, OREAD)
+		c.session.Clunk(ctx, dir)
+		if err != nil && !IsExist(err) {
+			return fail(err)
+		}
+
+		qids, err := c.session.Walk(ctx, fid, fid, name)
+		if err != nil {
+			return fail(err)
+		}
+
+		if len(qids) != 1 || qids[0].Type&QTDIR == 0 {
+			return notDir(i)
+		}
+	}
+
+	return nil
+}
+
+// RemoveAll removes path and any children it contains, as with the
+// RemoveAll function.
+func (c *Client) RemoveAll(ctx context.Context, path string) error {
+	return RemoveAll(ctx, c.session, c.root, path)
+}
+
+// File is an open file of a Client. It owns its fid, which is clunked by
+// Close. The data of the file is read and written through the embedded
+// FidIO, so File may be passed to functions such as io.Copy.
+type File struct {
+	*FidIO
+	c    *Client
+	path string
+	qid  Qid
+}
+
+var _ io.ReadWriteCloser = &File{}
+
+func newFile(c *Client, fid Fid, path string, qid Qid, iounit uint32) *File {
+	return &File{FidIO: NewFidIO(c.session, fid, iounit), c: c, path: path, qid: qid}
+}
+
+// Name returns the path the file was opened with.
+func (f *File) Name() string { return f.path }
+
+// Qid returns the qid of the file, as returned when it was opened.
+func (f *File) Qid() Qid { return f.qid }
+
+// Stat returns the directory entry of the file.
+func (f *File) Stat(ctx context.Context) (Dir, error) {
+	if err := f.flush(); err != nil {
+		return Dir{}, err
+	}
+
+	return f.session.Stat(ctx, f.fid)
+}
+
+// Truncate changes the length of the file to size with WStat, after flushing
+// the buffered writes. The offset of the file is left alone.
+func (f *File) Truncate(ctx context.Context, size int64) error {
+	if size < 0 {
+		return ErrBadoffset
+	}
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	d := syncDir
+	d.Length = uint64(size)
+	return f.session.WStat(ctx, f.fid, d)
+}
+
+// Close flushes the buffered writes, if any, and clunks the fid of the file.
+// Later calls return an error.
+func (f *File) Close() error {
+	closed, err := f.close()
+	if closed {
+		return errFileClosed
+	}
+
+	if cerr := f.session.Clunk(f.ctx(), f.fid); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,325 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestClient creates, writes, reads, stats and removes a file through a
+// Client, ensuring that no fids are left behind.
+func TestClient(t *testing.T) {
+	tree := newMemTree("dir/")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.Create(ctx, "/dir/file", 0644, OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("data"), DefaultMSize/2)
+	if n, err := f.Write(data); err != nil || n != len(data) {
+		t.Fatalf("unexpected write of %v bytes: %v", n, err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != errFileClosed {
+		t.Fatalf("expected error closing twice: %v", err)
+	}
+
+	if d, err := c.Stat(ctx, "dir/file"); err != nil || d.Length != uint64(len(data)) {
+		t.Fatalf("unexpected stat: %v %v", d, err)
+	}
+
+	f, err = c.Open(ctx, "dir/file", OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, data) {
+		t.Fatalf("unexpected data read back: %v bytes", len(p))
+	}
+
+	if off, err := f.Seek(-4, io.SeekEnd); err != nil || off != int64(len(data)-4) {
+		t.Fatalf("unexpected seek to %v: %v", off, err)
+	}
+
+	p = make([]byte, 8)
+	if n, err := f.ReadAt(p, 4); err != nil || n != len(p) || string(p) != "datadata" {
+		t.Fatalf("unexpected read at: %q %v", p[:n], err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dirs, err := c.ReadDir(ctx, "dir"); err != nil || len(dirs) != 1 || dirs[0].Name != "file" {
+		t.Fatalf("unexpected entries: %v %v", dirs, err)
+	}
+
+	if err := c.Remove(ctx, "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Open(ctx, "dir/file", OREAD); !IsNotExist(err) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fids := OpenFids(session); len(fids) != 0 {
+		t.Fatalf("fids leaked: %v", fids)
+	}
+}
+
+// TestClientHelpers creates a tree with MkdirAll and WriteFile, reads it back
+// and removes it, ensuring that no fids are left behind.
+func TestClientHelpers(t *testing.T) {
+	tree := newMemTree("file")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.MkdirAll(ctx, "a/b/c", 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d, err := c.Stat(ctx, "a/b/c"); err != nil || d.Qid.Type&QTDIR == 0 {
+		t.Fatalf("expected directory: %v %v", d, err)
+	}
+
+	if err := c.MkdirAll(ctx, "file", 0755); !IsExist(err) {
+		t.Fatalf("expected exist error: %v", err)
+	}
+
+	if err := c.MkdirAll(ctx, "file/dir", 0755); err == nil {
+		t.Fatal("expected error creating in a file")
+	}
+
+	for _, data := range []string{"hello, world", "short"} {
+		if err := c.WriteFile(ctx, "a/b/c/file", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := c.ReadFile(ctx, "a/b/c/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(p) != data {
+			t.Fatalf("unexpected data: %q != %q", p, data)
+		}
+	}
+
+	if _, err := c.ReadFile(ctx, "a/missing"); !IsNotExist(err) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+
+	if err := c.RemoveAll(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Stat(ctx, "a"); !IsNotExist(err) {
+		t.Fatalf("expected tree to be removed: %v", err)
+	}
+
+	// only the root of the client should remain in use.
+	if fids := OpenFids(session); len(fids) != 1 {
+		t.Fatalf("fids leaked: %v", fids)
+	}
+}
+
+// TestRenameTruncate renames files within their directory and truncates
+// them through a File.
+func TestRenameTruncate(t *testing.T) {
+	tree := newMemTree("dir/a", "dir/sub/b", "other/")
+	tree.data["dir/a"] = []byte("hello, world")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Rename(ctx, "dir/a", "/dir/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Rename(ctx, "dir/sub", "dir/sub2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Rename(ctx, "dir/c", "other/c"); err == nil || err.(*PathError).Err != ErrCrossDir {
+		t.Fatalf("expected ErrCrossDir: %v", err)
+	}
+
+	if err := c.Rename(ctx, "dir/c", "dir/sub2"); !IsExist(err) {
+		t.Fatalf("expected exist error: %v", err)
+	}
+
+	if _, err := c.Stat(ctx, "dir/sub2/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.Open(ctx, "dir/c", ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if p, err := c.ReadFile(ctx, "dir/c"); err != nil || string(p) != "hello" {
+		t.Fatalf("unexpected data after truncate: %q, %v", p, err)
+	}
+
+	if fids := OpenFids(session); len(fids) != 1 {
+		t.Fatalf("fids leaked: %v", fids)
+	}
+}
+
+// TestChmodChtimes changes the mode and the times of files with wstat.
+func TestChmodChtimes(t *testing.T) {
+	tree := newMemTree("dir/a", "dir/sub/")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tree.modes["dir/sub"] = DMDIR | 0755
+	if err := c.Chmod(ctx, "dir/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1000000000, 0)
+	if err := c.Chtimes(ctx, "dir/a", time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Chmod(ctx, "dir/missing", 0700); !IsNotExist(err) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+
+	tree.mu.Lock()
+	if tree.modes["dir/sub"] != DMDIR|0700 || !tree.mtimes["dir/a"].Equal(mtime) {
+		t.Fatalf("unexpected mode or time: %o, %v", tree.modes["dir/sub"], tree.mtimes["dir/a"])
+	}
+	tree.mu.Unlock()
+
+	if fids := OpenFids(session); len(fids) != 1 {
+		t.Fatalf("fids leaked: %v", fids)
+	}
+}
+
+// TestOpenStream copies a file through a stream, ensuring that reads are
+// kept in flight and that closing the stream clunks the file.
+func TestOpenStream(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	tree := newMemTree("file")
+	tree.data["file"] = data
+
+	var (
+		mu               sync.Mutex
+		inflight, maxinf int
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		if _, ok := msg.(MessageTread); ok {
+			mu.Lock()
+			inflight++
+			if inflight > maxinf {
+				maxinf = inflight
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}
+
+		return tree.Handle(ctx, msg)
+	}), WithMSize(IOHDRSZ+64))
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, session, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rc, err := c.OpenStream(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, rc); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("unexpected data: %v bytes, expected %v", buf.Len(), len(data))
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rc.Close(); err == nil {
+		t.Fatalf("expected error closing twice")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxinf < 2 {
+		t.Fatalf("expected reads in flight: %v", maxinf)
+	}
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	if len(tree.fids) != 1 {
+		t.Fatalf("fids leaked: %v", tree.fids)
+	}
+}
@@ -0,0 +1,151 @@
+package p9p
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// FrameCompressor compresses frames one at a time, for use with
+// WithFrameCompression. Implementations must be safe for concurrent use.
+// Adapting snappy or zstd takes a few lines, such as snappy.Encode and
+// snappy.Decode after checking snappy.DecodedLen.
+type FrameCompressor interface {
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst, failing if
+	// the result would be longer than max bytes.
+	Decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+// maxFrameSize bounds the size of a decompressed frame, so that a small
+// frame cannot expand without limit. It is far larger than any practical
+// msize.
+const maxFrameSize = 16 << 20
+
+// Frame compression marks each frame with one of these bytes.
+const (
+	frameStored     byte = iota // sent as is, as it did not compress
+	frameCompressed             // compressed with the FrameCompressor
+)
+
+// frameCompressSize is the number of bytes frame compression may add to
+// each frame.
+const frameCompressSize = 1
+
+// frameCompressCodec compresses each marshaled message with a
+// FrameCompressor. Messages that do not shrink are stored uncompressed. It is
+// only suitable for framing messages on a channel, not for encoding
+// directory entries.
+type frameCompressCodec struct {
+	Codec
+	fc FrameCompressor
+}
+
+func newFrameCompressCodec(codec Codec, fc FrameCompressor) Codec {
+	return frameCompressCodec{Codec: codec, fc: fc}
+}
+
+func (c frameCompressCodec) Marshal(v interface{}) ([]byte, error) {
+	p, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := c.fc.Compress([]byte{frameCompressed}, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(z) > len(p) {
+		return append([]byte{frameStored}, p...), nil
+	}
+
+	return z, nil
+}
+
+func (c frameCompressCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < frameCompressSize {
+		return io.ErrUnexpectedEOF
+	}
+
+	switch data[0] {
+	case frameStored:
+		return c.Codec.Unmarshal(data[1:], v)
+	case frameCompressed:
+		p, err := c.fc.Decompress(nil, data[1:], maxFrameSize)
+		if err != nil {
+			return err
+		}
+
+		return c.Codec.Unmarshal(p, v)
+	default:
+		return errors.New("invalid frame compression marker")
+	}
+}
+
+func (c frameCompressCodec) Size(v interface{}) int {
+	return c.Codec.Size(v) + frameCompressSize
+}
+
+// FlateFrames returns a FrameCompressor using compress/flate at the provided
+// level. As every frame starts a new stream, it compresses worse than
+// WithCompression, but it keeps no state between frames.
+func FlateFrames(level int) (FrameCompressor, error) {
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+
+	return &flateFrames{level: level}, nil
+}
+
+type flateFrames struct {
+	level   int
+	writers sync.Pool // *flate.Writer, at level
+}
+
+func (f *flateFrames) Compress(dst, src []byte) ([]byte, error) {
+	b := bytes.NewBuffer(dst)
+
+	zw, _ := f.writers.Get().(*flate.Writer)
+	if zw == nil {
+		var err error
+		if zw, err = flate.NewWriter(b, f.level); err != nil {
+			return nil, err
+		}
+	} else {
+		zw.Reset(b)
+	}
+	defer f.writers.Put(zw)
+
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (f *flateFrames) Decompress(dst, src []byte, max int) ([]byte, error) {
+	b := bytes.NewBuffer(dst)
+	start := b.Len()
+
+	zr := flate.NewReader(bytes.NewReader(src))
+	defer zr.Close()
+
+	if _, err := io.Copy(b, io.LimitReader(zr, int64(max)+1)); err != nil {
+		return nil, err
+	}
+
+	if b.Len()-start > max {
+		return nil, ErrFrameTooLarge
+	}
+
+	return b.Bytes(), nil
+}
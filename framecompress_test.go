@@ -0,0 +1,114 @@
+package p9p
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFrameCompressCodec(t *testing.T) {
+	fc, err := FlateFrames(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := newFrameCompressCodec(codec9p{}, fc)
+
+	random := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		marker byte
+	}{
+		{"compressible", bytes.Repeat([]byte("hello"), 1024), frameCompressed},
+		{"random", random, frameStored},
+	} {
+		fcall := newFcall(1, MessageTwrite{Fid: 1, Data: tc.data})
+		p, err := codec.Marshal(fcall)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p[0] != tc.marker {
+			t.Fatalf("%s: unexpected marker: %v", tc.name, p[0])
+		}
+
+		if len(p) > codec.Size(fcall) {
+			t.Fatalf("%s: frame larger than size: %v > %v", tc.name, len(p), codec.Size(fcall))
+		}
+
+		var decoded Fcall
+		if err := codec.Unmarshal(p, &decoded); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+
+		if !bytes.Equal(decoded.Message.(MessageTwrite).Data, tc.data) {
+			t.Fatalf("%s: unexpected message: %v", tc.name, decoded)
+		}
+	}
+
+	if _, err := fc.Decompress(nil, mustCompress(t, fc, make([]byte, 1024)), 1023); err != ErrFrameTooLarge {
+		t.Fatalf("expected ErrFrameTooLarge: %v", err)
+	}
+}
+
+func mustCompress(t *testing.T, fc FrameCompressor, p []byte) []byte {
+	z, err := fc.Compress(nil, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return z
+}
+
+// TestFrameCompressSession reads a full msize worth of incompressible data
+// over a connection with frame compression and checksums on both ends.
+func TestFrameCompressSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	fc, err := FlateFrames(flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			p := make([]byte, msg.Count)
+			rand.New(rand.NewSource(1)).Read(p)
+			return MessageRread{Data: p}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithServerFrameCompression(fc), WithServerChecksums(nil))
+
+	session, err := NewSession(ctx, cconn, WithFrameCompression(fc), WithChecksums(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msize, _ := session.Version()
+	if msize != DefaultMSize-frameCompressSize-checksumSize {
+		t.Fatalf("unexpected msize: %v", msize)
+	}
+
+	p := make([]byte, msize-IOHDRSZ)
+	n, err := session.Read(ctx, 1, p, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != len(p) {
+		t.Fatalf("short read: %v != %v", n, len(p))
+	}
+}
@@ -0,0 +1,272 @@
+//go:build go1.16
+// +build go1.16
+
+package p9p
+
+import (
+	"io"
+	"io/fs"
+	pathpkg "path"
+	"sort"
+	"time"
+)
+
+// FS returns a file system for the files below root, an attached fid on
+// session, for use with io/fs and the packages built on it, such as
+// http.FS and testing/fstest. The result implements fs.ReadDirFS,
+// fs.ReadFileFS and fs.StatFS, and its files implement io.Seeker and
+// io.ReaderAt. Root is left untouched. Calls use the default context of the
+// session, and fids allocated from its pool, which must exist.
+//
+// Errors are *fs.PathError, matching fs.ErrNotExist, fs.ErrExist and
+// fs.ErrPermission as classified by IsNotExist, IsExist and IsPermission.
+func FS(session Session, root Fid) fs.FS {
+	fids, err := fidpoolOf(session)
+	return &fsys{c: &Client{session: session, fids: fids, root: root}, err: err}
+}
+
+// FS returns a file system for the files of the client, as with FS.
+func (c *Client) FS() fs.FS {
+	return &fsys{c: c}
+}
+
+type fsys struct {
+	c   *Client
+	err error // set if the session has no fid pool
+}
+
+var (
+	_ fs.ReadDirFS  = &fsys{}
+	_ fs.ReadFileFS = &fsys{}
+	_ fs.StatFS     = &fsys{}
+)
+
+// check validates name, returning the error for op if it cannot be used.
+func (fsys *fsys) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if fsys.err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fsys.err}
+	}
+
+	return nil
+}
+
+func (fsys *fsys) Open(name string) (fs.File, error) {
+	if err := fsys.check("open", name); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.c.Open(DefaultContext(fsys.c.session), name, OREAD)
+	if err != nil {
+		return nil, fsError("open", name, err)
+	}
+
+	return &fsFile{File: f, name: name}, nil
+}
+
+func (fsys *fsys) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.check("readdir", name); err != nil {
+		return nil, err
+	}
+
+	dirs, err := fsys.c.ReadDir(DefaultContext(fsys.c.session), name)
+	if err != nil {
+		return nil, fsError("readdir", name, err)
+	}
+
+	return newDirEntries(dirs), nil
+}
+
+func (fsys *fsys) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fsError("read", name, err)
+	}
+
+	return p, nil
+}
+
+func (fsys *fsys) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.check("stat", name); err != nil {
+		return nil, err
+	}
+
+	d, err := fsys.c.Stat(DefaultContext(fsys.c.session), name)
+	if err != nil {
+		return nil, fsError("stat", name, err)
+	}
+
+	return fileInfo{d: d, name: pathpkg.Base(name)}, nil
+}
+
+// fsFile is an open file of an fsys. Directories are listed in full on the
+// first call to ReadDir.
+type fsFile struct {
+	*File
+	name    string
+	entries dirEntries
+	listed  bool
+}
+
+var _ fs.ReadDirFile = &fsFile{}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	d, err := f.File.Stat(f.ctx())
+	if err != nil {
+		return nil, fsError("stat", f.name, err)
+	}
+
+	return fileInfo{d: d, name: pathpkg.Base(f.name)}, nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.Qid().Type&QTDIR == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: ErrWalknodir}
+	}
+
+	if !f.listed {
+		dirs, err := ReaddirAll(f.ctx(), f.c.session, f.fid)
+		if err != nil {
+			return nil, fsError("readdir", f.name, err)
+		}
+
+		f.entries = newDirEntries(dirs)
+		f.listed = true
+	}
+
+	entries := f.entries
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	f.entries = f.entries[len(entries):]
+
+	return entries, nil
+}
+
+// fsError returns err as the *fs.PathError of op on name.
+func fsError(op, name string, err error) error {
+	if perr, ok := err.(*PathError); ok {
+		err = perr.Err
+	}
+
+	var kind error
+	switch {
+	case IsNotExist(err):
+		kind = fs.ErrNotExist
+	case IsExist(err):
+		kind = fs.ErrExist
+	case IsPermission(err):
+		kind = fs.ErrPermission
+	}
+
+	if kind != nil {
+		err = classifiedError{err: err, kind: kind}
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// classifiedError is an error matching kind with errors.Is, such as
+// fs.ErrNotExist, while keeping the message of err.
+type classifiedError struct {
+	err  error
+	kind error
+}
+
+func (e classifiedError) Error() string        { return e.err.Error() }
+func (e classifiedError) Unwrap() error        { return e.err }
+func (e classifiedError) Is(target error) bool { return target == e.kind }
+
+// FileInfo returns the directory entry d as an fs.FileInfo, as returned by
+// the file systems of FS. Sys returns d.
+func FileInfo(d Dir) fs.FileInfo {
+	return fileInfo{d: d, name: d.Name}
+}
+
+// fileInfo describes a file from its directory entry, as fs.FileInfo.
+type fileInfo struct {
+	d    Dir
+	name string
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return int64(fi.d.Length) }
+func (fi fileInfo) ModTime() time.Time { return fi.d.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.d }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.d.Mode & 0777)
+	for _, bit := range []struct {
+		dm   uint32
+		mode fs.FileMode
+	}{
+		{DMDIR, fs.ModeDir},
+		{DMAPPEND, fs.ModeAppend},
+		{DMEXCL, fs.ModeExclusive},
+		{DMTMP, fs.ModeTemporary},
+		{DMSYMLINK, fs.ModeSymlink},
+		{DMDEVICE, fs.ModeDevice},
+		{DMNAMEDPIPE, fs.ModeNamedPipe},
+		{DMSOCKET, fs.ModeSocket},
+		{DMSETUID, fs.ModeSetuid},
+		{DMSETGID, fs.ModeSetgid},
+	} {
+		if fi.d.Mode&bit.dm != 0 {
+			mode |= bit.mode
+		}
+	}
+
+	if fi.d.Qid.Type&QTDIR != 0 {
+		// some servers only mark directories in the qid.
+		mode |= fs.ModeDir
+	}
+
+	return mode
+}
+
+// dirEntries adapts directory entries to fs.DirEntry, sorting by name and
+// dropping "." and "..", which io/fs leaves out.
+type dirEntries []fs.DirEntry
+
+func newDirEntries(dirs []Dir) dirEntries {
+	entries := make(dirEntries, 0, len(dirs))
+	for _, d := range dirs {
+		if d.Name == "." || d.Name == ".." {
+			continue
+		}
+
+		entries = append(entries, dirEntry{fileInfo{d: d, name: d.Name}})
+	}
+
+	sort.Sort(entries)
+	return entries
+}
+
+func (de dirEntries) Len() int           { return len(de) }
+func (de dirEntries) Less(i, j int) bool { return de[i].Name() < de[j].Name() }
+func (de dirEntries) Swap(i, j int)      { de[i], de[j] = de[j], de[i] }
+
+type dirEntry struct {
+	fi fileInfo
+}
+
+func (de dirEntry) Name() string               { return de.fi.name }
+func (de dirEntry) IsDir() bool                { return de.fi.IsDir() }
+func (de dirEntry) Type() fs.FileMode          { return de.fi.Mode().Type() }
+func (de dirEntry) Info() (fs.FileInfo, error) { return de.fi, nil }
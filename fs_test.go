@@ -0,0 +1,41 @@
+//go:build go1.16
+// +build go1.16
+
+package p9p
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/net/context"
+)
+
+func TestFS(t *testing.T) {
+	tree := newMemTree("a/b/file", "a/empty/", "top")
+	tree.data["a/b/file"] = []byte("hello, world\n")
+	tree.data["top"] = []byte("top")
+
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := FS(session, 1)
+	if err := fstest.TestFS(fsys, "a/b/file", "a/empty", "top"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat(fsys, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+
+	// only the root should remain in use.
+	if fids := OpenFids(session); len(fids) != 1 {
+		t.Fatalf("fids leaked: %v", fids)
+	}
+}
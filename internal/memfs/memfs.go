@@ -0,0 +1,280 @@
+// Package memfs serves an in-memory file tree over 9p, for testing the
+// packages built on p9p.Client.
+package memfs
+
+import (
+	"bytes"
+	"net"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+// FS is an in-memory file tree, served over 9p by its Handle method. It
+// supports renames, truncation and changes of modes and times with wstat.
+type FS struct {
+	mu    sync.Mutex
+	files map[string]*File // by path, without a leading slash
+	fids  map[p9p.Fid]string
+	codec p9p.Codec
+}
+
+// File is a file of an FS.
+type File struct {
+	Dir   bool
+	Mode  uint32
+	Mtime time.Time
+	Data  []byte
+}
+
+// New returns an FS holding an empty root directory.
+func New() *FS {
+	return &FS{
+		files: map[string]*File{"": {Dir: true, Mode: p9p.DMDIR | 0777}},
+		fids:  map[p9p.Fid]string{},
+		codec: p9p.NewCodec(),
+	}
+}
+
+// Files returns a copy of the files of the tree, by path without a leading
+// slash. The root is "".
+func (m *FS) Files() map[string]File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make(map[string]File, len(m.files))
+	for p, f := range m.files {
+		files[p] = *f
+	}
+
+	return files
+}
+
+// Fids returns the number of fids in use.
+func (m *FS) Fids() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.fids)
+}
+
+// NewSession serves the tree over a pipe and returns a session connected to
+// it, along with a function tearing both down.
+func (m *FS) NewSession() (p9p.Session, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cconn, sconn := net.Pipe()
+	go p9p.ServeConn(ctx, sconn, m)
+
+	session, err := p9p.NewSession(ctx, cconn, p9p.WithMSize(p9p.IOHDRSZ+1024))
+	if err != nil {
+		cancel()
+		cconn.Close()
+		sconn.Close()
+		return nil, nil, err
+	}
+
+	return session, func() {
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}, nil
+}
+
+func (m *FS) dir(p string) p9p.Dir {
+	f := m.files[p]
+	d := p9p.Dir{Name: pathpkg.Base("/" + p), Mode: f.Mode, ModTime: f.Mtime, Length: uint64(len(f.Data)), Qid: p9p.Qid{Path: uint64(len(p))}}
+	if f.Dir {
+		d.Qid.Type = p9p.QTDIR
+		d.Length = 0
+	}
+
+	return d
+}
+
+func (m *FS) Handle(ctx context.Context, msg p9p.Message) (p9p.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fidPath := func(fid p9p.Fid) (string, *File, error) {
+		p, ok := m.fids[fid]
+		if !ok {
+			return "", nil, p9p.ErrUnknownfid
+		}
+
+		return p, m.files[p], nil
+	}
+
+	switch msg := msg.(type) {
+	case p9p.MessageTattach:
+		m.fids[msg.Fid] = ""
+		return p9p.MessageRattach{Qid: m.dir("").Qid}, nil
+	case p9p.MessageTwalk:
+		p, _, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		var qids []p9p.Qid
+		for _, name := range msg.Wnames {
+			p = strings.TrimPrefix(pathpkg.Join("/"+p, name), "/")
+			if _, ok := m.files[p]; !ok {
+				if len(qids) == 0 {
+					return nil, p9p.ErrNotfound
+				}
+
+				return p9p.MessageRwalk{Qids: qids}, nil
+			}
+			qids = append(qids, m.dir(p).Qid)
+		}
+
+		m.fids[msg.Newfid] = p
+		return p9p.MessageRwalk{Qids: qids}, nil
+	case p9p.MessageTopen:
+		p, f, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Mode&p9p.OTRUNC != 0 {
+			f.Data = nil
+		}
+
+		return p9p.MessageRopen{Qid: m.dir(p).Qid}, nil
+	case p9p.MessageTcreate:
+		dir, _, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		p := strings.TrimPrefix(pathpkg.Join("/"+dir, msg.Name), "/")
+		if _, ok := m.files[p]; ok {
+			return nil, p9p.ErrExist
+		}
+
+		m.files[p] = &File{Dir: msg.Perm&p9p.DMDIR != 0, Mode: msg.Perm}
+		m.fids[msg.Fid] = p
+		return p9p.MessageRcreate{Qid: m.dir(p).Qid}, nil
+	case p9p.MessageTread:
+		p, f, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		data := f.Data
+		if f.Dir {
+			var buf bytes.Buffer
+			for q := range m.files {
+				if q != "" && strings.TrimPrefix(pathpkg.Dir("/"+q), "/") == p {
+					d := m.dir(q)
+					if err := p9p.EncodeDir(m.codec, &buf, &d); err != nil {
+						return nil, err
+					}
+				}
+			}
+			data = buf.Bytes()
+		}
+
+		if msg.Offset >= uint64(len(data)) {
+			return p9p.MessageRread{}, nil
+		}
+
+		data = data[msg.Offset:]
+		if len(data) > int(msg.Count) {
+			if f.Dir {
+				return nil, p9p.ErrBadcount // entries must fit in one read
+			}
+			data = data[:msg.Count]
+		}
+
+		return p9p.MessageRread{Data: data}, nil
+	case p9p.MessageTwrite:
+		_, f, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		if end := int(msg.Offset) + len(msg.Data); end > len(f.Data) {
+			f.Data = append(f.Data, make([]byte, end-len(f.Data))...)
+		}
+		copy(f.Data[msg.Offset:], msg.Data)
+
+		return p9p.MessageRwrite{Count: uint32(len(msg.Data))}, nil
+	case p9p.MessageTstat:
+		p, _, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		return p9p.MessageRstat{Stat: m.dir(p)}, nil
+	case p9p.MessageTwstat:
+		p, f, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Stat.Mode != ^uint32(0) {
+			f.Mode = msg.Stat.Mode
+		}
+
+		if msg.Stat.ModTime.Unix() != int64(^uint32(0)) {
+			f.Mtime = msg.Stat.ModTime
+		}
+
+		if msg.Stat.Length != ^uint64(0) {
+			data := make([]byte, msg.Stat.Length)
+			copy(data, f.Data)
+			f.Data = data
+		}
+
+		if msg.Stat.Name != "" {
+			np := strings.TrimPrefix(pathpkg.Join(pathpkg.Dir("/"+p), msg.Stat.Name), "/")
+			if _, ok := m.files[np]; ok {
+				return nil, p9p.ErrExist
+			}
+
+			for q, qf := range m.files {
+				if q == p || strings.HasPrefix(q, p+"/") {
+					delete(m.files, q)
+					m.files[np+strings.TrimPrefix(q, p)] = qf
+				}
+			}
+
+			for fid, q := range m.fids {
+				if q == p || strings.HasPrefix(q, p+"/") {
+					m.fids[fid] = np + strings.TrimPrefix(q, p)
+				}
+			}
+		}
+
+		return p9p.MessageRwstat{}, nil
+	case p9p.MessageTremove:
+		p, f, err := fidPath(msg.Fid)
+		if err != nil {
+			return nil, err
+		}
+		delete(m.fids, msg.Fid)
+
+		if f.Dir {
+			for q := range m.files {
+				if strings.HasPrefix(q, p+"/") {
+					return nil, p9p.MessageRerror{Ename: "directory not empty"}
+				}
+			}
+		}
+		delete(m.files, p)
+
+		return p9p.MessageRremove{}, nil
+	case p9p.MessageTclunk:
+		if _, ok := m.fids[msg.Fid]; !ok {
+			return nil, p9p.ErrUnknownfid
+		}
+		delete(m.fids, msg.Fid)
+
+		return p9p.MessageRclunk{}, nil
+	}
+
+	return nil, p9p.ErrUnknownMsg
+}
@@ -0,0 +1,32 @@
+package p9p
+
+// IOUnit returns the number of bytes of data that may be read from or written
+// to fid in a single message on session. This is the iounit returned when fid
+// was opened, unless it is zero, meaning the server has no atomic unit, or
+// larger than the msize allows, in which case msize-IOHDRSZ is returned.
+//
+// Helpers that chunk reads and writes use IOUnit, so it is never zero.
+func IOUnit(session Session, fid Fid) int {
+	var iounit uint32
+	if fids, err := fidpoolOf(session); err == nil {
+		iounit = fids.iounit(fid)
+	}
+
+	msize, _ := session.Version()
+	return iosize(msize, iounit)
+}
+
+// iosize resolves the size of data for a message, given the msize and the
+// iounit of the fid, which may be zero.
+func iosize(msize int, iounit uint32) int {
+	if msize <= IOHDRSZ {
+		msize = DefaultMSize // unknown or bogus msize.
+	}
+
+	size := msize - IOHDRSZ
+	if iounit > 0 && int(iounit) < size {
+		size = int(iounit)
+	}
+
+	return size
+}
@@ -0,0 +1,67 @@
+package p9p
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrKeepaliveTimeout is passed to the callback of WithKeepalive when the
+// server does not answer a probe in time.
+var ErrKeepaliveTimeout = errors.New("keepalive timeout")
+
+// keepalive probes the server of c every interval until the session closes.
+// A probe is a Tflush of NOTAG, which names no request and so has no effect.
+// Any answer, even an error, shows that the server is alive. If the server
+// fails to answer within timeout, or the probe fails, the session is closed
+// and dead is called with the reason.
+func (c *client) keepalive(interval, timeout time.Duration, dead func(err error)) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		if lt, ok := c.transport.(*lazyTransport); ok && lt.established() == nil {
+			continue // don't dial just to probe.
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.transport.send(c.ctx, MessageTflush{Oldtag: NOTAG})
+			errs <- err
+		}()
+
+		var err error
+		select {
+		case err = <-errs:
+		case <-time.After(timeout):
+			err = ErrKeepaliveTimeout
+		case <-c.ctx.Done():
+			return
+		}
+
+		switch err.(type) {
+		case nil, MessageRerror, MessageRlerror:
+			continue // the server answered.
+		}
+
+		if err == ErrClosed || err == ErrSessionDone {
+			return // the session is over.
+		}
+
+		// closing fails the probe, if it is still waiting.
+		c.Close()
+		if dead != nil {
+			dead(err)
+		}
+		return
+	}
+}
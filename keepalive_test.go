@@ -0,0 +1,52 @@
+package p9p
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestKeepalive answers the first keepalive probe and then goes silent,
+// ensuring that the session is declared dead and closed.
+func TestKeepalive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	dead := make(chan error, 1)
+	so := newSessionOptions([]SessionOption{
+		WithKeepalive(10*time.Millisecond, 50*time.Millisecond, func(err error) {
+			dead <- err
+		}),
+	})
+	session := newClient(ctx, newTransport(ctx, ch, so), DefaultVersion, DefaultMSize, so)
+
+	probe := <-ch.outgoing
+	if flush, ok := probe.Message.(MessageTflush); !ok || flush.Oldtag != NOTAG {
+		t.Fatalf("unexpected probe: %v", probe)
+	}
+	ch.incoming <- newErrorFcall(probe.Tag, ErrUnknownTag)
+
+	select {
+	case err := <-dead:
+		t.Fatalf("declared dead after answered probe: %v", err)
+	default:
+	}
+
+	// drop the next probe on the floor.
+	<-ch.outgoing
+
+	select {
+	case err := <-dead:
+		if err != ErrKeepaliveTimeout {
+			t.Fatalf("expected ErrKeepaliveTimeout: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not declared dead")
+	}
+
+	if _, err := session.Stat(ctx, 1); err != ErrClosed {
+		t.Fatalf("expected closed session: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package p9p
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// lazyTransport establishes a transport on first use. Establishment is
+// attempted once. If it fails, every request fails with the same error.
+type lazyTransport struct {
+	ctx     context.Context
+	so      sessionOptions
+	connect func() (Channel, string, int, error)
+
+	once    sync.Once
+	mu      sync.Mutex // protects t
+	t       roundTripper
+	msize   int
+	version string
+	err     error
+}
+
+var _ roundTripper = &lazyTransport{}
+var _ flushAller = &lazyTransport{}
+var _ readIntoer = &lazyTransport{}
+var _ requestLister = &lazyTransport{}
+var _ tagFlusher = &lazyTransport{}
+var _ shutdowner = &lazyTransport{}
+
+func newLazyTransport(ctx context.Context, so sessionOptions, connect func() (Channel, string, int, error)) *lazyTransport {
+	return &lazyTransport{
+		ctx:     ctx,
+		so:      so,
+		connect: connect,
+	}
+}
+
+// establish connects the transport, if that has not been attempted yet.
+func (lt *lazyTransport) establish() (roundTripper, error) {
+	lt.once.Do(func() {
+		ch, version, msize, err := lt.connect()
+		if err != nil {
+			lt.err = err
+			return
+		}
+
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		lt.t = newTransport(lt.ctx, ch, lt.so)
+		lt.msize, lt.version = msize, version
+	})
+
+	return lt.t, lt.err
+}
+
+// established returns the transport, if it has been established.
+func (lt *lazyTransport) established() roundTripper {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return lt.t
+}
+
+// negotiated establishes the transport, returning the negotiated msize and
+// version. If establishment fails, zero values are returned.
+func (lt *lazyTransport) negotiated() (int, string) {
+	lt.establish()
+	return lt.msize, lt.version
+}
+
+func (lt *lazyTransport) send(ctx context.Context, msg Message) (Message, error) {
+	t, err := lt.establish()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.send(ctx, msg)
+}
+
+func (lt *lazyTransport) sendInto(ctx context.Context, msg Message, rbuf []byte) (Message, error) {
+	t, err := lt.establish()
+	if err != nil {
+		return nil, err
+	}
+
+	if ri, ok := t.(readIntoer); ok {
+		return ri.sendInto(ctx, msg, rbuf)
+	}
+
+	return t.send(ctx, msg)
+}
+
+// flushAll flushes the established transport. If the transport was never
+// established, there is nothing to flush.
+func (lt *lazyTransport) flushAll(ctx context.Context) error {
+	if fa, ok := lt.established().(flushAller); ok {
+		return fa.flushAll(ctx)
+	}
+
+	return nil
+}
+
+func (lt *lazyTransport) outstanding() []RequestInfo {
+	if rl, ok := lt.established().(requestLister); ok {
+		return rl.outstanding()
+	}
+
+	return nil
+}
+
+// flush flushes tag on the established transport. If the transport was
+// never established, no tag is outstanding.
+func (lt *lazyTransport) flush(ctx context.Context, tag Tag) error {
+	if tf, ok := lt.established().(tagFlusher); ok {
+		return tf.flush(ctx, tag)
+	}
+
+	return nil
+}
+
+// shutdown shuts down the established transport. If the transport has not
+// been established, it is closed.
+func (lt *lazyTransport) shutdown(ctx context.Context) error {
+	var unused bool
+	lt.once.Do(func() {
+		lt.err = ErrClosed
+		unused = true
+	})
+
+	if unused {
+		return nil
+	}
+
+	if sd, ok := lt.established().(shutdowner); ok {
+		return sd.shutdown(ctx)
+	}
+
+	return lt.Close()
+}
+
+// Close closes the established transport. If the transport has not been
+// established, it never will be, and requests fail with ErrClosed.
+func (lt *lazyTransport) Close() error {
+	var unused bool
+	lt.once.Do(func() {
+		lt.err = ErrClosed
+		unused = true
+	})
+
+	if unused {
+		return nil
+	}
+
+	if closer, ok := lt.established().(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil // establishment failed, nothing to close.
+}
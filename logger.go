@@ -0,0 +1,63 @@
+package p9p
+
+import "log"
+
+// LogLevel orders the severity of log messages.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota // lifecycle and protocol details
+	LogInfo
+	LogWarn  // recoverable problems, such as a misbehaving peer
+	LogError // errors that end a connection
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger receives the diagnostic output of sessions and servers. Logf may be
+// called concurrently.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// LoggerFunc is a convenience type for defining inline loggers.
+type LoggerFunc func(level LogLevel, format string, args ...interface{})
+
+func (fn LoggerFunc) Logf(level LogLevel, format string, args ...interface{}) {
+	fn(level, format, args...)
+}
+
+// StdLogger returns a Logger that writes messages at level or above to the
+// standard logger.
+func StdLogger(level LogLevel) Logger {
+	return LoggerFunc(func(l LogLevel, format string, args ...interface{}) {
+		if l >= level {
+			log.Printf(format, args...)
+		}
+	})
+}
+
+// defaultLogger is used by sessions and servers configured without a logger.
+var defaultLogger = StdLogger(LogWarn)
+
+// logf logs to l, or to the default logger if l is nil.
+func logf(l Logger, level LogLevel, format string, args ...interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+
+	l.Logf(level, format, args...)
+}
@@ -1,77 +1,96 @@
-// +build ignore
-
 package p9p
 
-import (
-	"log"
-	"os"
-)
+import "golang.org/x/net/context"
+
+// LogCalls returns a Middleware logging each call on the session, with its
+// arguments and results, to logger at LogDebug.
+func LogCalls(logger Logger) Middleware {
+	return func(next Session) Session {
+		return &logging{session: next, logger: logger}
+	}
+}
 
 type logging struct {
 	session Session
-	logger  log.Logger
+	logger  Logger
 }
 
 var _ Session = &logging{}
 
-func NewLogger(prefix string, session Session) Session {
-	return &logging{
-		session: session,
-		logger:  *log.New(os.Stdout, prefix, 0),
-	}
+func (l *logging) logf(format string, args ...interface{}) {
+	logf(l.logger, LogDebug, format, args...)
+}
+
+func (l *logging) Unwrap() Session {
+	return l.session
 }
 
-func (l *logging) Auth(afid Fid, uname, aname string) (Qid, error) {
-	qid, err := l.session.Auth(afid, uname, aname)
-	l.logger.Printf("Auth(%v, %s, %s) -> (%v, %v)", afid, uname, aname, qid, err)
+func (l *logging) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid, error) {
+	qid, err := l.session.Auth(ctx, afid, uname, aname)
+	l.logf("Auth(%v, %s, %s) -> (%v, %v)", afid, uname, aname, qid, err)
 	return qid, err
 }
 
-func (l *logging) Attach(fid, afid Fid, uname, aname string) (Qid, error) {
-	qid, err := l.session.Attach(fid, afid, uname, aname)
-	l.logger.Printf("Attach(%v, %v, %s, %s) -> (%v, %v)", fid, afid, uname, aname, qid, err)
+func (l *logging) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	qid, err := l.session.Attach(ctx, fid, afid, uname, aname)
+	l.logf("Attach(%v, %v, %s, %s) -> (%v, %v)", fid, afid, uname, aname, qid, err)
 	return qid, err
 }
 
-func (l *logging) Clunk(fid Fid) error {
-	return l.session.Clunk(fid)
+func (l *logging) Clunk(ctx context.Context, fid Fid) error {
+	err := l.session.Clunk(ctx, fid)
+	l.logf("Clunk(%v) -> %v", fid, err)
+	return err
 }
 
-func (l *logging) Remove(fid Fid) (err error) {
-	defer func() {
-		l.logger.Printf("Remove(%v) -> %v", fid, err)
-	}()
-	return l.session.Remove(fid)
+func (l *logging) Remove(ctx context.Context, fid Fid) error {
+	err := l.session.Remove(ctx, fid)
+	l.logf("Remove(%v) -> %v", fid, err)
+	return err
 }
 
-func (l *logging) Walk(fid Fid, newfid Fid, names ...string) ([]Qid, error) {
-	return l.session.Walk(fid, newfid, names...)
+func (l *logging) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) ([]Qid, error) {
+	qids, err := l.session.Walk(ctx, fid, newfid, names...)
+	l.logf("Walk(%v, %v, %q) -> (%v, %v)", fid, newfid, names, qids, err)
+	return qids, err
 }
 
-func (l *logging) Read(fid Fid, p []byte, offset int64) (n int, err error) {
-	return l.session.Read(fid, p, offset)
+func (l *logging) Read(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	n, err := l.session.Read(ctx, fid, p, offset)
+	l.logf("Read(%v, [%d], %d) -> (%d, %v)", fid, len(p), offset, n, err)
+	return n, err
 }
 
-func (l *logging) Write(fid Fid, p []byte, offset int64) (n int, err error) {
-	return l.session.Write(fid, p, offset)
+func (l *logging) Write(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	n, err := l.session.Write(ctx, fid, p, offset)
+	l.logf("Write(%v, [%d], %d) -> (%d, %v)", fid, len(p), offset, n, err)
+	return n, err
 }
 
-func (l *logging) Open(fid Fid, mode int32) (Qid, error) {
-	return l.session.Open(fid, mode)
+func (l *logging) Open(ctx context.Context, fid Fid, mode Flag) (Qid, uint32, error) {
+	qid, iounit, err := l.session.Open(ctx, fid, mode)
+	l.logf("Open(%v, %v) -> (%v, %d, %v)", fid, mode, qid, iounit, err)
+	return qid, iounit, err
 }
 
-func (l *logging) Create(parent Fid, name string, perm uint32, mode uint32) (Qid, error) {
-	return l.session.Create(parent, name, perm, mode)
+func (l *logging) Create(ctx context.Context, parent Fid, name string, perm uint32, mode Flag) (Qid, uint32, error) {
+	qid, iounit, err := l.session.Create(ctx, parent, name, perm, mode)
+	l.logf("Create(%v, %s, %o, %v) -> (%v, %d, %v)", parent, name, perm, mode, qid, iounit, err)
+	return qid, iounit, err
 }
 
-func (l *logging) Stat(fid Fid) (Dir, error) {
-	return l.session.Stat(fid)
+func (l *logging) Stat(ctx context.Context, fid Fid) (Dir, error) {
+	dir, err := l.session.Stat(ctx, fid)
+	l.logf("Stat(%v) -> (%v, %v)", fid, dir, err)
+	return dir, err
 }
 
-func (l *logging) WStat(fid Fid, dir Dir) error {
-	return l.session.WStat(fid, dir)
+func (l *logging) WStat(ctx context.Context, fid Fid, dir Dir) error {
+	err := l.session.WStat(ctx, fid, dir)
+	l.logf("WStat(%v, %v) -> %v", fid, dir, err)
+	return err
 }
 
-func (l *logging) Version(msize int32, version string) (int32, string, error) {
-	return l.session.Version(msize, version)
+func (l *logging) Version() (int, string) {
+	return l.session.Version()
 }
@@ -1,6 +1,12 @@
 package p9p
 
-import "fmt"
+import (
+	"encoding"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
 
 // Message represents the target of an fcall.
 type Message interface {
@@ -8,66 +14,104 @@ type Message interface {
 	Type() FcallType
 }
 
+// ExtensionMessage is implemented by messages registered with
+// RegisterMessage that are not part of the standard protocol. Rather than
+// being encoded field by field, the message body is produced by MarshalBinary
+// and consumed by UnmarshalBinary, which receives the remainder of the frame
+// following the type and tag. The constructor passed to RegisterMessage
+// should return a pointer, so that UnmarshalBinary can modify the message.
+type ExtensionMessage interface {
+	Message
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+var (
+	messagesMu sync.RWMutex
+	messages   = map[FcallType]func() Message{
+		Tversion: func() Message { return MessageTversion{} },
+		Rversion: func() Message { return MessageRversion{} },
+		Tauth:    func() Message { return MessageTauth{} },
+		Rauth:    func() Message { return MessageRauth{} },
+		Tattach:  func() Message { return MessageTattach{} },
+		Rattach:  func() Message { return MessageRattach{} },
+		Rerror:   func() Message { return MessageRerror{} },
+		Tflush:   func() Message { return MessageTflush{} },
+		Rflush:   func() Message { return MessageRflush{} },
+		Twalk:    func() Message { return MessageTwalk{} },
+		Rwalk:    func() Message { return MessageRwalk{} },
+		Topen:    func() Message { return MessageTopen{} },
+		Ropen:    func() Message { return MessageRopen{} },
+		Tcreate:  func() Message { return MessageTcreate{} },
+		Rcreate:  func() Message { return MessageRcreate{} },
+		Tread:    func() Message { return MessageTread{} },
+		Rread:    func() Message { return MessageRread{} },
+		Twrite:   func() Message { return MessageTwrite{} },
+		Rwrite:   func() Message { return MessageRwrite{} },
+		Tclunk:   func() Message { return MessageTclunk{} },
+		Rclunk:   func() Message { return MessageRclunk{} },
+		Tremove:  func() Message { return MessageTremove{} },
+		Rremove:  func() Message { return MessageRremove{} },
+		Tstat:    func() Message { return MessageTstat{} },
+		Rstat:    func() Message { return MessageRstat{} },
+		Twstat:   func() Message { return MessageTwstat{} },
+		Rwstat:   func() Message { return MessageRwstat{} },
+
+		// 9P2000.L
+		Rlerror:   func() Message { return MessageRlerror{} },
+		Treadlink: func() Message { return MessageTreadlink{} },
+		Rreadlink: func() Message { return MessageRreadlink{} },
+		Tgetattr:  func() Message { return MessageTgetattr{} },
+		Rgetattr:  func() Message { return MessageRgetattr{} },
+		Tsetattr:  func() Message { return MessageTsetattr{} },
+		Rsetattr:  func() Message { return MessageRsetattr{} },
+	}
+)
+
+// RegisterMessage registers a constructor for messages of type typ, allowing
+// the codec to decode message types that are not part of the protocol. The
+// messages returned by fn must implement ExtensionMessage. Each type may only
+// be registered once and the standard types are registered by default.
+func RegisterMessage(typ FcallType, fn func() Message) error {
+	if _, ok := fn().(ExtensionMessage); !ok {
+		return fmt.Errorf("message type %d does not implement ExtensionMessage", typ)
+	}
+
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	if _, ok := messages[typ]; ok {
+		return fmt.Errorf("message type %d already registered", typ)
+	}
+
+	messages[typ] = fn
+	return nil
+}
+
+// Call sends the extension message msg on session and returns the response.
+// The types of msg and of the response must be registered with
+// RegisterMessage. If the session cannot send arbitrary messages,
+// ErrUnsupported is returned.
+func Call(ctx context.Context, session Session, msg ExtensionMessage) (Message, error) {
+	s, ok := senderOf(session)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	return s.send(ctx, msg)
+}
+
 // newMessage returns a new instance of the message based on the Fcall type.
 func newMessage(typ FcallType) (Message, error) {
-	switch typ {
-	case Tversion:
-		return MessageTversion{}, nil
-	case Rversion:
-		return MessageRversion{}, nil
-	case Tauth:
-		return MessageTauth{}, nil
-	case Rauth:
-		return MessageRauth{}, nil
-	case Tattach:
-		return MessageTattach{}, nil
-	case Rattach:
-		return MessageRattach{}, nil
-	case Rerror:
-		return MessageRerror{}, nil
-	case Tflush:
-		return MessageTflush{}, nil
-	case Rflush:
-		return MessageRflush{}, nil // No message body for this response.
-	case Twalk:
-		return MessageTwalk{}, nil
-	case Rwalk:
-		return MessageRwalk{}, nil
-	case Topen:
-		return MessageTopen{}, nil
-	case Ropen:
-		return MessageRopen{}, nil
-	case Tcreate:
-		return MessageTcreate{}, nil
-	case Rcreate:
-		return MessageRcreate{}, nil
-	case Tread:
-		return MessageTread{}, nil
-	case Rread:
-		return MessageRread{}, nil
-	case Twrite:
-		return MessageTwrite{}, nil
-	case Rwrite:
-		return MessageRwrite{}, nil
-	case Tclunk:
-		return MessageTclunk{}, nil
-	case Rclunk:
-		return MessageRclunk{}, nil // no response body
-	case Tremove:
-		return MessageTremove{}, nil
-	case Rremove:
-		return MessageRremove{}, nil
-	case Tstat:
-		return MessageTstat{}, nil
-	case Rstat:
-		return MessageRstat{}, nil
-	case Twstat:
-		return MessageTwstat{}, nil
-	case Rwstat:
-		return MessageRwstat{}, nil
+	messagesMu.RLock()
+	fn, ok := messages[typ]
+	messagesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown message type")
 	}
 
-	return nil, fmt.Errorf("unknown message type")
+	return fn(), nil
 }
 
 // MessageVersion encodes the message body for Tversion and Rversion RPC
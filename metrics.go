@@ -0,0 +1,166 @@
+package p9p
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Metrics receives measurements from a client session, configured with
+// WithMetrics. Methods are called synchronously, so implementations must be
+// safe for concurrent use and should not block.
+type Metrics interface {
+	// Dialed reports the time Dial spent connecting to address and then
+	// negotiating the session, which tells network latency apart from a
+	// slow server handshake.
+	Dialed(network, address string, connect, negotiate time.Duration)
+}
+
+// WithMetrics reports measurements from the session to m. If m implements
+// RequestMetrics or WireMetrics, it also receives those measurements.
+func WithMetrics(m Metrics) SessionOption {
+	return func(so *sessionOptions) {
+		so.metrics = m
+	}
+}
+
+// RequestMetrics may be implemented by the Metrics of a session to observe
+// each request made on it.
+type RequestMetrics interface {
+	// RequestSent reports that a request of type typ has been written,
+	// leaving inflight requests outstanding, including this one.
+	RequestSent(typ FcallType, inflight int)
+
+	// RequestDone reports the outcome of a request of type typ, latency
+	// after it was sent. The error is nil for a successful response, the
+	// error returned by the server or a CancelError if the request was
+	// flushed. RequestDone is called once for each call to RequestSent,
+	// unless the session closes first.
+	RequestDone(typ FcallType, latency time.Duration, inflight int, err error)
+}
+
+// WireMetrics may be implemented by the Metrics of a session to count the
+// traffic on its connection.
+type WireMetrics interface {
+	// FrameRead reports a frame of n bytes read from the connection,
+	// including the size header.
+	FrameRead(n int)
+
+	// FrameWritten reports a frame of n bytes written to the connection.
+	FrameWritten(n int)
+}
+
+// MeasureCalls returns a Middleware reporting each call on the session to m
+// as a request of the matching type. Unlike WithMetrics, which measures the
+// requests of a client on the wire, it measures calls on any session, such
+// as one being served, and its latency includes the time spent in the
+// session.
+func MeasureCalls(m RequestMetrics) Middleware {
+	return func(next Session) Session {
+		return &measuring{session: next, metrics: m}
+	}
+}
+
+type measuring struct {
+	session  Session
+	metrics  RequestMetrics
+	inflight int32
+}
+
+var _ Session = &measuring{}
+
+// measure reports a call of type typ as sent, returning a function that
+// reports it done with its error.
+func (m *measuring) measure(typ FcallType) func(err error) {
+	m.metrics.RequestSent(typ, int(atomic.AddInt32(&m.inflight, 1)))
+	start := time.Now()
+	return func(err error) {
+		m.metrics.RequestDone(typ, time.Since(start), int(atomic.AddInt32(&m.inflight, -1)), err)
+	}
+}
+
+func (m *measuring) Unwrap() Session {
+	return m.session
+}
+
+func (m *measuring) Auth(ctx context.Context, afid Fid, uname, aname string) (Qid, error) {
+	done := m.measure(Tauth)
+	qid, err := m.session.Auth(ctx, afid, uname, aname)
+	done(err)
+	return qid, err
+}
+
+func (m *measuring) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	done := m.measure(Tattach)
+	qid, err := m.session.Attach(ctx, fid, afid, uname, aname)
+	done(err)
+	return qid, err
+}
+
+func (m *measuring) Clunk(ctx context.Context, fid Fid) error {
+	done := m.measure(Tclunk)
+	err := m.session.Clunk(ctx, fid)
+	done(err)
+	return err
+}
+
+func (m *measuring) Remove(ctx context.Context, fid Fid) error {
+	done := m.measure(Tremove)
+	err := m.session.Remove(ctx, fid)
+	done(err)
+	return err
+}
+
+func (m *measuring) Walk(ctx context.Context, fid Fid, newfid Fid, names ...string) ([]Qid, error) {
+	done := m.measure(Twalk)
+	qids, err := m.session.Walk(ctx, fid, newfid, names...)
+	done(err)
+	return qids, err
+}
+
+func (m *measuring) Read(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	done := m.measure(Tread)
+	n, err := m.session.Read(ctx, fid, p, offset)
+	done(err)
+	return n, err
+}
+
+func (m *measuring) Write(ctx context.Context, fid Fid, p []byte, offset int64) (int, error) {
+	done := m.measure(Twrite)
+	n, err := m.session.Write(ctx, fid, p, offset)
+	done(err)
+	return n, err
+}
+
+func (m *measuring) Open(ctx context.Context, fid Fid, mode Flag) (Qid, uint32, error) {
+	done := m.measure(Topen)
+	qid, iounit, err := m.session.Open(ctx, fid, mode)
+	done(err)
+	return qid, iounit, err
+}
+
+func (m *measuring) Create(ctx context.Context, parent Fid, name string, perm uint32, mode Flag) (Qid, uint32, error) {
+	done := m.measure(Tcreate)
+	qid, iounit, err := m.session.Create(ctx, parent, name, perm, mode)
+	done(err)
+	return qid, iounit, err
+}
+
+func (m *measuring) Stat(ctx context.Context, fid Fid) (Dir, error) {
+	done := m.measure(Tstat)
+	dir, err := m.session.Stat(ctx, fid)
+	done(err)
+	return dir, err
+}
+
+func (m *measuring) WStat(ctx context.Context, fid Fid, dir Dir) error {
+	done := m.measure(Twstat)
+	err := m.session.WStat(ctx, fid, dir)
+	done(err)
+	return err
+}
+
+func (m *measuring) Version() (int, string) {
+	return m.session.Version()
+}
@@ -0,0 +1,97 @@
+package p9p
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type requestMetrics struct {
+	mu                    sync.Mutex
+	sent                  map[FcallType]int
+	errs                  map[FcallType]int
+	done                  int
+	read, written         int
+	framesRead, framesOut int
+}
+
+func (m *requestMetrics) Dialed(network, address string, connect, negotiate time.Duration) {}
+
+func (m *requestMetrics) RequestSent(typ FcallType, inflight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[typ]++
+}
+
+func (m *requestMetrics) RequestDone(typ FcallType, latency time.Duration, inflight int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done++
+	if err != nil {
+		m.errs[typ]++
+	}
+}
+
+func (m *requestMetrics) FrameRead(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.framesRead++
+	m.read += n
+}
+
+func (m *requestMetrics) FrameWritten(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.framesOut++
+	m.written += n
+}
+
+// TestRequestMetrics ensures that a Metrics implementing RequestMetrics and
+// WireMetrics observes every request and frame of a session.
+func TestRequestMetrics(t *testing.T) {
+	metrics := &requestMetrics{
+		sent: map[FcallType]int{},
+		errs: map[FcallType]int{},
+	}
+
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTstat:
+			return MessageRstat{}, nil
+		}
+
+		return nil, ErrUnknownfid
+	}), WithMetrics(metrics))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Stat(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.Clunk(ctx, 1); err != ErrUnknownfid {
+		t.Fatalf("expected ErrUnknownfid: %v", err)
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	if metrics.sent[Tstat] != 1 || metrics.sent[Tclunk] != 1 || metrics.done != 2 {
+		t.Fatalf("unexpected requests: sent %v, %d done", metrics.sent, metrics.done)
+	}
+
+	if metrics.errs[Tstat] != 0 || metrics.errs[Tclunk] != 1 {
+		t.Fatalf("unexpected errors: %v", metrics.errs)
+	}
+
+	// the version, stat and clunk exchanges.
+	if metrics.framesOut != 3 || metrics.framesRead != 3 {
+		t.Fatalf("unexpected frames: %d written, %d read", metrics.framesOut, metrics.framesRead)
+	}
+
+	if metrics.written <= 3*7 || metrics.read <= 3*7 {
+		t.Fatalf("unexpected bytes: %d written, %d read", metrics.written, metrics.read)
+	}
+}
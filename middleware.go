@@ -0,0 +1,72 @@
+package p9p
+
+import "io"
+
+// Middleware wraps a Session to add behavior around its calls, such as
+// logging, metrics or authentication, returning the wrapped session.
+type Middleware func(next Session) Session
+
+// Chain returns a Middleware applying mws in order, so the first is
+// outermost and sees each call first: Chain(a, b)(session) is
+// a(b(session)). Chain with no middleware returns the session as is.
+func Chain(mws ...Middleware) Middleware {
+	return func(session Session) Session {
+		for i := len(mws) - 1; i >= 0; i-- {
+			session = mws[i](session)
+		}
+
+		return session
+	}
+}
+
+// Unwrapper is implemented by the sessions returned by middleware to expose
+// the session they wrap. Helpers that depend on the session underneath,
+// such as NewClient, DefaultContext, Shutdown, Flush, Call and CloseAll,
+// find it through the wrappers.
+//
+// Only calls of the Session interface pass through middleware. Messages
+// outside it, such as those of 9P2000.L and extensions sent with Call, go
+// directly to the first session that can send them.
+type Unwrapper interface {
+	Unwrap() Session
+}
+
+// walkSessions calls fn with session, then with each session it wraps,
+// until fn returns true or there are no more.
+func walkSessions(session Session, fn func(session Session) bool) {
+	for session != nil {
+		if fn(session) {
+			return
+		}
+
+		u, ok := session.(Unwrapper)
+		if !ok {
+			return
+		}
+		session = u.Unwrap()
+	}
+}
+
+// clientOf returns the client session under any middleware wrapping
+// session.
+func clientOf(session Session) (*client, bool) {
+	var c *client
+	walkSessions(session, func(session Session) bool {
+		c, _ = session.(*client)
+		return c != nil
+	})
+
+	return c, c != nil
+}
+
+// closerOf returns the outermost of session and the sessions it wraps that
+// can be closed.
+func closerOf(session Session) (io.Closer, bool) {
+	var closer io.Closer
+	walkSessions(session, func(session Session) bool {
+		closer, _ = session.(io.Closer)
+		return closer != nil
+	})
+
+	return closer, closer != nil
+}
@@ -0,0 +1,138 @@
+package p9p
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// recording records the calls to Stat passing through it.
+type recording struct {
+	Session
+	name  string
+	calls *[]string
+}
+
+func (r recording) Unwrap() Session {
+	return r.Session
+}
+
+func (r recording) Stat(ctx context.Context, fid Fid) (Dir, error) {
+	*r.calls = append(*r.calls, r.name)
+	return r.Session.Stat(ctx, fid)
+}
+
+// testRequestMetrics counts the requests reported to it by type.
+type testRequestMetrics struct {
+	mu   sync.Mutex
+	sent map[FcallType]int
+	done map[FcallType]int
+}
+
+func (m *testRequestMetrics) RequestSent(typ FcallType, inflight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[typ]++
+}
+
+func (m *testRequestMetrics) RequestDone(typ FcallType, latency time.Duration, inflight int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done[typ]++
+}
+
+// TestChain ensures that middleware applies in order and that the helpers
+// depending on the client session find it through the wrappers.
+func TestChain(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		secret string
+		logged []string
+		calls  []string
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch msg := msg.(type) {
+		case MessageTauth:
+			return MessageRauth{Qid: Qid{Type: QTAUTH}}, nil
+		case MessageTwrite:
+			secret = string(msg.Data)
+			return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+		case MessageTattach:
+			if msg.Afid == NOFID || secret != "secret" {
+				return nil, ErrPerm
+			}
+
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTwalk:
+			return MessageRwalk{}, nil
+		case MessageTstat:
+			return MessageRstat{Stat: Dir{Name: "/", Mode: DMDIR}}, nil
+		case MessageTclunk:
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	metrics := &testRequestMetrics{sent: map[FcallType]int{}, done: map[FcallType]int{}}
+	record := func(name string) Middleware {
+		return func(next Session) Session {
+			return recording{Session: next, name: name, calls: &calls}
+		}
+	}
+
+	wrapped := Chain(
+		record("outer"),
+		LogCalls(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		})),
+		MeasureCalls(metrics),
+		Authenticate(func(ctx context.Context, session Session, afid Fid, uname, aname string) error {
+			_, err := session.Write(ctx, afid, []byte("secret"), 0)
+			return err
+		}),
+		record("inner"),
+	)(session)
+
+	ctx := context.Background()
+	c, err := NewClient(ctx, wrapped, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Stat(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 || calls[0] != "outer" || calls[1] != "inner" {
+		t.Fatalf("unexpected order: %v", calls)
+	}
+
+	if !strings.HasPrefix(logged[0], "Attach(") || metrics.sent[Tattach] != 1 || metrics.done[Tstat] != 1 {
+		t.Fatalf("unexpected measurements: %v, %v", logged, metrics.done)
+	}
+
+	if fids := OpenFids(wrapped); len(fids) != 1 {
+		t.Fatalf("unexpected fids: %v", fids)
+	}
+
+	if reqs := OutstandingRequests(wrapped); reqs == nil {
+		t.Fatalf("requests not tracked through the wrappers")
+	}
+
+	if err := Shutdown(ctx, wrapped); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != ErrClosed {
+		t.Fatalf("expected session closed: %v", err)
+	}
+}
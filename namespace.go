@@ -0,0 +1,282 @@
+package p9p
+
+import (
+	pathpkg "path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// BindFlag controls how Mount and Bind change a Namespace, as in bind(2).
+type BindFlag int
+
+const (
+	MREPL   BindFlag = 0x0000 // replace what is at the mount point
+	MBEFORE BindFlag = 0x0001 // add to the front of the union
+	MAFTER  BindFlag = 0x0002 // add to the end of the union
+	MCREATE BindFlag = 0x0004 // permit creation in the member
+)
+
+// Namespace composes the trees of several Clients into one, as a Plan 9
+// namespace does with mount and bind. Paths are looked up through the mount
+// points of the namespace: the longest mount point that prefixes a path
+// holds the union of directories the rest of the path is looked up in.
+//
+// Each directory of a union is tried in order, and a file is found in the
+// first that holds it. Reading a union directory returns the entries of
+// every member, an entry of an earlier member hiding those of later ones
+// with the same name. Files are created in the first member bound with
+// MCREATE, or in the only member of a directory that is not a union.
+//
+// Mount points need not exist in the trees beneath them, and are not listed
+// when reading their parent. A Namespace is safe for concurrent use.
+type Namespace struct {
+	mu     sync.RWMutex
+	mounts map[string][]nsMember // by mount point, in lookup order
+}
+
+// nsMember is a directory of a union: a path within the tree of a client.
+type nsMember struct {
+	c      *Client
+	path   string
+	create bool
+}
+
+// NewNamespace returns an empty namespace, in which every lookup fails until
+// a tree is mounted.
+func NewNamespace() *Namespace {
+	return &Namespace{mounts: map[string][]nsMember{}}
+}
+
+// Mount makes the tree of c visible at old, as with bind(2). Flag is MREPL to
+// replace what is at old, or MBEFORE or MAFTER to add the tree to the union
+// at old, optionally with MCREATE.
+func (ns *Namespace) Mount(c *Client, old string, flag BindFlag) error {
+	return ns.bind(nsMember{c: c, path: "/"}, old, flag)
+}
+
+// Bind makes the file at name, as looked up in the namespace, visible at
+// old too, as with bind(2). Adding to a union with MBEFORE or MAFTER
+// requires name to be a directory.
+func (ns *Namespace) Bind(ctx context.Context, name, old string, flag BindFlag) error {
+	var found nsMember
+	err := ns.lookup("bind", name, func(m nsMember) error {
+		dir, err := m.c.Stat(ctx, m.path)
+		if err != nil {
+			return err
+		}
+
+		if flag&(MBEFORE|MAFTER) != 0 && dir.Qid.Type&QTDIR == 0 {
+			return ErrWalknodir
+		}
+
+		found = m
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return ns.bind(found, old, flag)
+}
+
+func (ns *Namespace) bind(m nsMember, old string, flag BindFlag) error {
+	old = pathpkg.Clean("/" + old)
+	m.create = flag&MCREATE != 0
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	union, ok := ns.mounts[old]
+	if !ok && flag&(MBEFORE|MAFTER) != 0 {
+		// the union starts with what old resolves to now.
+		union = ns.resolveLocked(old)
+	}
+
+	switch {
+	case flag&MBEFORE != 0:
+		union = append([]nsMember{m}, union...)
+	case flag&MAFTER != 0:
+		union = append(union[:len(union):len(union)], m)
+	default:
+		union = []nsMember{m}
+	}
+
+	ns.mounts[old] = union
+	return nil
+}
+
+// Unmount removes the mount point at old, along with everything mounted or
+// bound on it.
+func (ns *Namespace) Unmount(old string) error {
+	old = pathpkg.Clean("/" + old)
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if _, ok := ns.mounts[old]; !ok {
+		return &PathError{Op: "unmount", Path: old, Err: ErrNotfound}
+	}
+	delete(ns.mounts, old)
+
+	return nil
+}
+
+// resolve returns the members of the union that path is looked up in, with
+// the rest of the path joined to each.
+func (ns *Namespace) resolve(path string) []nsMember {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.resolveLocked(pathpkg.Clean("/" + path))
+}
+
+func (ns *Namespace) resolveLocked(path string) []nsMember {
+	for mp := path; ; mp = pathpkg.Dir(mp) {
+		if union, ok := ns.mounts[mp]; ok {
+			rest := strings.TrimPrefix(path, mp)
+			members := make([]nsMember, len(union))
+			for i, m := range union {
+				m.path = pathpkg.Join(m.path, rest)
+				members[i] = m
+			}
+
+			return members
+		}
+
+		if mp == "/" {
+			return nil
+		}
+	}
+}
+
+// lookup calls fn with each member path resolves to, in order, until one
+// holds the file. Errors are reported against path in the namespace.
+func (ns *Namespace) lookup(op, path string, fn func(m nsMember) error) error {
+	err := error(ErrNotfound)
+	for _, m := range ns.resolve(path) {
+		if err = fn(m); !IsNotExist(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nsError(op, path, err)
+	}
+
+	return nil
+}
+
+// nsError reports err, possibly a *PathError from a member, against path in
+// the namespace.
+func nsError(op, path string, err error) error {
+	if perr, ok := err.(*PathError); ok {
+		op, err = perr.Op, perr.Err
+	}
+
+	return &PathError{Op: op, Path: path, Err: err}
+}
+
+// Open opens the file at path with mode.
+func (ns *Namespace) Open(ctx context.Context, path string, mode Flag) (*File, error) {
+	var f *File
+	err := ns.lookup("open", path, func(m nsMember) (err error) {
+		f, err = m.c.Open(ctx, m.path, mode)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f.path = path
+	return f, nil
+}
+
+// Create creates the file at path with perm and opens it with mode, in the
+// member of its parent directory that permits creation.
+func (ns *Namespace) Create(ctx context.Context, path string, perm uint32, mode Flag) (*File, error) {
+	dir, name := pathpkg.Split(pathpkg.Clean("/" + path))
+	if name == "" {
+		return nil, &PathError{Op: "create", Path: path, Err: ErrExist}
+	}
+
+	members := ns.resolve(dir)
+	if len(members) == 0 {
+		return nil, &PathError{Op: "create", Path: path, Err: ErrNotfound}
+	}
+
+	target := members[0]
+	if len(members) > 1 {
+		var ok bool
+		for _, m := range members {
+			if m.create {
+				target, ok = m, true
+				break
+			}
+		}
+
+		if !ok {
+			return nil, &PathError{Op: "create", Path: path, Err: ErrNocreate}
+		}
+	}
+
+	f, err := target.c.Create(ctx, pathpkg.Join(target.path, name), perm, mode)
+	if err != nil {
+		return nil, nsError("create", path, err)
+	}
+
+	f.path = path
+	return f, nil
+}
+
+// Stat returns the directory entry of the file at path.
+func (ns *Namespace) Stat(ctx context.Context, path string) (Dir, error) {
+	var dir Dir
+	err := ns.lookup("stat", path, func(m nsMember) (err error) {
+		dir, err = m.c.Stat(ctx, m.path)
+		return err
+	})
+
+	return dir, err
+}
+
+// Remove removes the file at path from the first member that holds it.
+func (ns *Namespace) Remove(ctx context.Context, path string) error {
+	return ns.lookup("remove", path, func(m nsMember) error {
+		return m.c.Remove(ctx, m.path)
+	})
+}
+
+// ReadDir reads the directory at path, merging the entries of each member
+// of a union in order. An entry hides the later entries with its name.
+func (ns *Namespace) ReadDir(ctx context.Context, path string) ([]Dir, error) {
+	var (
+		dirs  []Dir
+		seen  = map[string]bool{}
+		found bool
+	)
+	for _, m := range ns.resolve(path) {
+		entries, err := m.c.ReadDir(ctx, m.path)
+		if IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, nsError("readdir", path, err)
+		}
+		found = true
+
+		for _, d := range entries {
+			if !seen[d.Name] {
+				seen[d.Name] = true
+				dirs = append(dirs, d)
+			}
+		}
+	}
+
+	if !found {
+		return nil, &PathError{Op: "readdir", Path: path, Err: ErrNotfound}
+	}
+
+	return dirs, nil
+}
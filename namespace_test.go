@@ -0,0 +1,109 @@
+package p9p
+
+import (
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestNamespace composes two trees with mounts, binds and a union
+// directory, ensuring that lookups, listings and creation go to the right
+// tree.
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	treeA := newMemTree("bin/ls", "etc/passwd")
+	treeB := newMemTree("ls", "cat", "sub/")
+
+	clients := make([]*Client, 2)
+	for i, tree := range []*memTree{treeA, treeB} {
+		session, cleanup := newTestSession(t, tree)
+		defer cleanup()
+
+		c, err := NewClient(ctx, session, "test", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	ns := NewNamespace()
+	if _, err := ns.Stat(ctx, "/bin"); !IsNotExist(err) {
+		t.Fatalf("expected not found in an empty namespace: %v", err)
+	}
+
+	if err := ns.Mount(clients[0], "/", MREPL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ns.Mount(clients[1], "/bin", MAFTER|MCREATE); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := ns.ReadDir(ctx, "/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "cat" || names[1] != "ls" || names[2] != "sub" {
+		t.Fatalf("unexpected union listing: %v", names)
+	}
+
+	// ls is found first in the tree mounted at the root.
+	if dir, err := ns.Stat(ctx, "/bin/ls"); err != nil || dir.Qid.Path != uint64(len("bin/ls")) {
+		t.Fatalf("unexpected stat of /bin/ls: %v, %v", dir, err)
+	}
+
+	if _, err := ns.Stat(ctx, "/bin/cat"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ns.Create(ctx, "/bin/new", 0644, OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "/bin/new" {
+		t.Fatalf("unexpected name: %v", f.Name())
+	}
+	f.Close()
+
+	if _, ok := treeB.files["new"]; !ok {
+		t.Fatalf("expected the file created in the member bound with MCREATE")
+	}
+
+	if err := ns.Bind(ctx, "/etc", "/cfg", MREPL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ns.Stat(ctx, "/cfg/passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ns.Bind(ctx, "/etc/passwd", "/bin", MBEFORE); err == nil {
+		t.Fatalf("expected error adding a file to a union")
+	}
+
+	_, err = ns.Stat(ctx, "/missing")
+	if perr, ok := err.(*PathError); !ok || perr.Path != "/missing" || perr.Err != ErrNotfound {
+		t.Fatalf("expected not found error for /missing: %v", err)
+	}
+
+	if err := ns.Unmount("/bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ns.Stat(ctx, "/bin/cat"); !IsNotExist(err) {
+		t.Fatalf("expected not found after unmount: %v", err)
+	}
+
+	if _, err := ns.Create(ctx, "/bin/other", 0644, OWRITE); err != nil {
+		t.Fatalf("expected creation in a directory that is not a union: %v", err)
+	}
+}
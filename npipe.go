@@ -0,0 +1,48 @@
+package p9p
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNamedPipeUnsupported is returned when dialing or listening on a named
+// pipe on a platform other than Windows.
+var ErrNamedPipeUnsupported = errors.New("named pipes not supported on this platform")
+
+// NamedPipeAddr is the path of a Windows named pipe, such as
+// `\\.\pipe\9p`.
+type NamedPipeAddr string
+
+var _ net.Addr = NamedPipeAddr("")
+
+func (a NamedPipeAddr) Network() string { return "npipe" }
+func (a NamedPipeAddr) String() string  { return string(a) }
+
+// DialNamedPipe connects to the Windows named pipe at path and returns a
+// session over the connection, as with Dial. Dial also accepts the "npipe"
+// network, with the path as the address. If every instance of the pipe is
+// busy, DialNamedPipe waits for one until ctx is done.
+func DialNamedPipe(ctx context.Context, path string, opts ...SessionOption) (Session, error) {
+	return Dial(ctx, "npipe", path, opts...)
+}
+
+// ListenNamedPipe creates the Windows named pipe at path and listens for
+// connections on it. Only local clients may connect, and the pipe takes the
+// default security descriptor of the process. Creating the pipe fails if
+// another process already serves it. The listener is closed once ctx is
+// done.
+func ListenNamedPipe(ctx context.Context, path string) (net.Listener, error) {
+	l, err := listenNamedPipe(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	return l, nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package p9p
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+func dialNamedPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, ErrNamedPipeUnsupported
+}
+
+func listenNamedPipe(path string) (net.Listener, error) {
+	return nil, ErrNamedPipeUnsupported
+}
@@ -0,0 +1,446 @@
+package p9p
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/context"
+)
+
+// Named pipes are opened for overlapped I/O, so that a read and a write may
+// be pending at once and a pending operation can be canceled by a deadline
+// or Close. Each operation waits on its own event.
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = modkernel32.NewProc("DisconnectNamedPipe")
+	procWaitNamedPipeW      = modkernel32.NewProc("WaitNamedPipeW")
+	procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+	procCreateEventW        = modkernel32.NewProc("CreateEventW")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagOverlapped        = 0x40000000
+	fileFlagFirstPipeInstance = 0x00080000
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	securitySQOSPresent       = 0x00100000
+	securityIdentification    = 0x00010000
+
+	errorPipeBusy         syscall.Errno = 231
+	errorNoData           syscall.Errno = 232
+	errorPipeConnected    syscall.Errno = 535
+	errorOperationAborted syscall.Errno = 995
+	errorIOPending        syscall.Errno = 997
+)
+
+// pipeTimeoutError is returned when an operation on a named pipe passes its
+// deadline.
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = pipeTimeoutError{}
+
+func createEvent() (syscall.Handle, error) {
+	// manual reset, initially unsignaled.
+	r, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+
+	return syscall.Handle(r), nil
+}
+
+// overlappedOp is a pending or completed overlapped operation on h.
+type overlappedOp struct {
+	h syscall.Handle
+	o syscall.Overlapped
+}
+
+func newOverlappedOp(h syscall.Handle) (*overlappedOp, error) {
+	event, err := createEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	op := &overlappedOp{h: h}
+	op.o.HEvent = event
+	return op, nil
+}
+
+func (op *overlappedOp) close() {
+	syscall.CloseHandle(op.o.HEvent)
+}
+
+// wait waits for the operation, started with the result err, to complete,
+// canceling it at deadline. The number of bytes transferred is returned.
+func (op *overlappedOp) wait(err error, deadline time.Time) (int, error) {
+	if err != nil && err != errorIOPending {
+		return 0, err
+	}
+
+	timeout := uint32(syscall.INFINITE)
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d < 0 {
+			d = 0
+		}
+		timeout = uint32(d / time.Millisecond)
+	}
+
+	timedout := false
+	if event, _ := syscall.WaitForSingleObject(op.o.HEvent, timeout); event == syscall.WAIT_TIMEOUT {
+		syscall.CancelIoEx(op.h, &op.o)
+		timedout = true
+	}
+
+	var n uint32
+	r, _, err := procGetOverlappedResult.Call(uintptr(op.h), uintptr(unsafe.Pointer(&op.o)), uintptr(unsafe.Pointer(&n)), 1)
+	if r == 0 {
+		if err == errorOperationAborted && timedout {
+			return int(n), pipeTimeoutError{}
+		}
+
+		return int(n), err
+	}
+
+	return int(n), nil
+}
+
+// pipeConn is a connected instance of a named pipe.
+type pipeConn struct {
+	h      syscall.Handle
+	addr   NamedPipeAddr
+	server bool // disconnect the instance on close
+
+	mu        sync.Mutex // protects deadlines and closed
+	rdeadline time.Time
+	wdeadline time.Time
+	closed    bool
+	pending   sync.WaitGroup // operations started, waited for by Close
+
+	rmu, wmu  sync.Mutex // serialize reads and writes
+	closeOnce sync.Once
+}
+
+var _ net.Conn = &pipeConn{}
+
+// start starts an operation by calling fn, returning the deadline for it and
+// the result of fn. Operations are started under the lock, so that each is
+// either canceled by Close or fails with ErrClosed. Unless ErrClosed is
+// returned, the caller must call pending.Done once the operation completes.
+func (c *pipeConn) start(deadline *time.Time, fn func() error) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return time.Time{}, ErrClosed
+	}
+
+	c.pending.Add(1)
+	return *deadline, fn()
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	op, err := newOverlappedOp(c.h)
+	if err != nil {
+		return 0, err
+	}
+	defer op.close()
+
+	deadline, err := c.start(&c.rdeadline, func() error {
+		return syscall.ReadFile(c.h, p, nil, &op.o)
+	})
+	if err == ErrClosed {
+		return 0, err
+	}
+	defer c.pending.Done()
+
+	n, err := op.wait(err, deadline)
+	switch err {
+	case nil:
+		return n, nil
+	case syscall.ERROR_BROKEN_PIPE, errorNoData:
+		return n, io.EOF
+	case errorOperationAborted:
+		return n, ErrClosed
+	}
+
+	return n, err
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var written int
+	for written < len(p) {
+		n, err := c.write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// write makes a single write of p, which may be short.
+func (c *pipeConn) write(p []byte) (int, error) {
+	op, err := newOverlappedOp(c.h)
+	if err != nil {
+		return 0, err
+	}
+	defer op.close()
+
+	deadline, err := c.start(&c.wdeadline, func() error {
+		return syscall.WriteFile(c.h, p, nil, &op.o)
+	})
+	if err == ErrClosed {
+		return 0, err
+	}
+	defer c.pending.Done()
+
+	n, err := op.wait(err, deadline)
+	if err == errorOperationAborted {
+		return n, ErrClosed
+	}
+
+	return n, err
+}
+
+// Close cancels pending operations and closes the pipe, once they have
+// completed.
+func (c *pipeConn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		syscall.CancelIoEx(c.h, nil)
+		c.mu.Unlock()
+
+		c.pending.Wait()
+
+		if c.server {
+			procDisconnectNamedPipe.Call(uintptr(c.h))
+		}
+		err = syscall.CloseHandle(c.h)
+	})
+
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// SetDeadline sets the deadlines of the next reads and writes. Unlike a
+// net.Conn, pending operations keep the deadline they started with.
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline, c.wdeadline = t, t
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline = t
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdeadline = t
+	return nil
+}
+
+func dialNamedPipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		h, err := syscall.CreateFile(name,
+			syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+			0, nil, syscall.OPEN_EXISTING,
+			fileFlagOverlapped|securitySQOSPresent|securityIdentification, 0)
+		if err == nil {
+			return &pipeConn{h: h, addr: NamedPipeAddr(path)}, nil
+		}
+
+		if err != errorPipeBusy {
+			return nil, &net.OpError{Op: "dial", Net: "npipe", Addr: NamedPipeAddr(path), Err: err}
+		}
+
+		// every instance is busy. Wait a little for one to free up.
+		procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(name)), 50)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+	}
+}
+
+// pipeListener accepts connections on the instances of a named pipe. An
+// instance is always waiting, so that clients do not find the pipe missing
+// between calls to Accept.
+type pipeListener struct {
+	path NamedPipeAddr
+	name *uint16
+
+	amu sync.Mutex // serializes Accept
+
+	mu        sync.Mutex // protects next, accepting and closed
+	next      syscall.Handle
+	accepting bool
+	closed    bool
+}
+
+var _ net.Listener = &pipeListener{}
+
+func listenNamedPipe(path string) (net.Listener, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &pipeListener{path: NamedPipeAddr(path), name: name}
+	h, err := l.create(true)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "npipe", Addr: l.path, Err: err}
+	}
+	l.next = h
+
+	return l, nil
+}
+
+// create creates an instance of the pipe. The first instance fails if the
+// pipe already exists, so that another process cannot serve it too.
+func (l *pipeListener) create(first bool) (syscall.Handle, error) {
+	mode := uint32(pipeAccessDuplex | fileFlagOverlapped)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+
+	r, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(l.name)),
+		uintptr(mode),
+		pipeRejectRemoteClients, // byte stream, blocking mode
+		pipeUnlimitedInstances,
+		uintptr(DefaultMSize), uintptr(DefaultMSize),
+		0, 0)
+	if syscall.Handle(r) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+
+	return syscall.Handle(r), nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.amu.Lock()
+	defer l.amu.Unlock()
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	if l.next == syscall.InvalidHandle {
+		// replacing the last instance failed.
+		h, err := l.create(false)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, &net.OpError{Op: "accept", Net: "npipe", Addr: l.path, Err: err}
+		}
+		l.next = h
+	}
+
+	h := l.next
+	l.accepting = true
+	l.mu.Unlock()
+
+	op, err := newOverlappedOp(h)
+	if err == nil {
+		defer op.close()
+
+		r, _, cerr := procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(&op.o)))
+		switch {
+		case r != 0, cerr == errorPipeConnected:
+			err = nil
+		default:
+			_, err = op.wait(cerr, time.Time{})
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepting = false
+
+	if l.closed {
+		// Close left the instance to be closed here.
+		syscall.CloseHandle(h)
+		return nil, ErrClosed
+	}
+
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "npipe", Addr: l.path, Err: err}
+	}
+
+	// leave an instance waiting for the next client.
+	l.next, err = l.create(false)
+	if err != nil {
+		l.next = syscall.InvalidHandle
+	}
+
+	return &pipeConn{h: h, addr: l.path, server: true}, nil
+}
+
+// Close closes the waiting instance of the pipe. Connections already
+// accepted are unaffected.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	l.closed = true
+
+	if l.accepting {
+		// the pending Accept closes the instance.
+		syscall.CancelIoEx(l.next, nil)
+		return nil
+	}
+
+	if l.next == syscall.InvalidHandle {
+		return nil
+	}
+
+	return syscall.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr { return l.path }
@@ -0,0 +1,63 @@
+package p9p
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestNamedPipe attaches over a named pipe and ensures that a second
+// listener cannot serve the same pipe.
+func TestNamedPipe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := fmt.Sprintf(`\\.\pipe\p9p-test-%d`, os.Getpid())
+	l, err := ListenNamedPipe(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ListenNamedPipe(ctx, path); err == nil {
+		t.Fatalf("expected error listening on a pipe in use")
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+					return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+				}))
+			}()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		session, err := DialNamedPipe(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+
+		// the session outlives the default read timeout of the channel.
+		time.Sleep(1500 * time.Millisecond)
+		if _, err := session.Attach(ctx, 2, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+
+		session.(io.Closer).Close()
+	}
+}
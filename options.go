@@ -0,0 +1,522 @@
+package p9p
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SessionOption configures a client session created with NewSession.
+type SessionOption func(*sessionOptions)
+
+// sessionOptions holds the configuration applied by SessionOptions.
+type sessionOptions struct {
+	compress      bool
+	compressLevel int
+	flushTimeout  time.Duration
+	clunkTimeout  time.Duration
+	fidPaths      bool
+	maxDirReads   int
+	metrics       Metrics
+	qidChecks     bool
+	statTTL       time.Duration
+	retries       *RetryPolicy
+	msize         int
+	handshake     time.Duration
+	auth          AuthFunc
+	drainTimeout  time.Duration
+	defaultctx    func(context.Context) context.Context
+	checksums     bool
+	newHash       func() hash.Hash32
+	frameCompress FrameCompressor
+	encryptKey    []byte
+	lazy          bool
+	parallelDial  bool
+	stripes       int
+
+	// keepalive probing, see WithKeepalive.
+	keepalive        time.Duration
+	keepaliveTimeout time.Duration
+	keepaliveDead    func(err error)
+	reconnect        bool
+	restoreFids      bool
+	versions         []string
+	strictTags       bool
+	logger           Logger
+
+	// bound on outstanding requests, see WithMaxOutstanding.
+	maxOutstanding       int
+	maxOutstandingNoWait bool
+
+	// tag pool watermarks, see WithTagWatermarks.
+	tagLow, tagHigh int
+	tagPressure     func(inuse int, pressured bool)
+
+	trace io.Writer
+
+	// set by DialTLS.
+	tlsConfig *tls.Config
+}
+
+func newSessionOptions(opts []SessionOption) sessionOptions {
+	var so sessionOptions
+	for _, opt := range opts {
+		opt(&so)
+	}
+
+	return so
+}
+
+// handshakeContext returns the context bounding the establishment of the
+// session, derived from ctx.
+func (so sessionOptions) handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if so.handshake > 0 {
+		return context.WithTimeout(ctx, so.handshake)
+	}
+
+	return ctx, func() {}
+}
+
+// offers returns the versions to offer when negotiating, in order of
+// preference, checking that each is implemented and that the msize fits a
+// message.
+func (so sessionOptions) offers() ([]string, error) {
+	versions := so.versions
+	if len(versions) == 0 {
+		versions = []string{DefaultVersion}
+	}
+
+	for _, version := range versions {
+		if !implemented(version) {
+			return nil, fmt.Errorf("unsupported version: %v", version)
+		}
+	}
+
+	if so.msize > 0 && so.msize <= IOHDRSZ+so.frameOverhead() {
+		return nil, fmt.Errorf("msize too small: %v", so.msize)
+	}
+
+	return versions, nil
+}
+
+// frameOverhead returns the number of bytes of each frame taken by the codec
+// configured by so.
+func (so sessionOptions) frameOverhead() int {
+	var n int
+	if so.frameCompress != nil {
+		n += frameCompressSize
+	}
+
+	if so.checksums {
+		n += checksumSize
+	}
+
+	return n
+}
+
+// WithCompression compresses the connection at the provided compress/flate
+// level. The server must also compress the connection. See CompressConn for
+// the tradeoffs.
+func WithCompression(level int) SessionOption {
+	return func(so *sessionOptions) {
+		so.compress = true
+		so.compressLevel = level
+	}
+}
+
+// WithEncryption encrypts the connection with key, a secret shared with the
+// server. The server must also encrypt the connection, with the same key.
+// See EncryptConn for the guarantees provided.
+func WithEncryption(key []byte) SessionOption {
+	return func(so *sessionOptions) {
+		so.encryptKey = key
+	}
+}
+
+// WithFlushOnClose makes Close flush all outstanding requests, waiting up to
+// timeout for the server to acknowledge the flushes, before closing the
+// session. This gives the server a chance to abandon work and release
+// resources held for each request.
+func WithFlushOnClose(timeout time.Duration) SessionOption {
+	return func(so *sessionOptions) {
+		so.flushTimeout = timeout
+	}
+}
+
+// WithClunkOnClose makes Close clunk every fid in use on the session, waiting
+// up to timeout for the server to answer, before closing the session. This
+// releases the files held by the server on behalf of fids left open by the
+// program. Fids that fail to clunk are logged; use CloseAll to collect them.
+func WithClunkOnClose(timeout time.Duration) SessionOption {
+	return func(so *sessionOptions) {
+		so.clunkTimeout = timeout
+	}
+}
+
+// WithFidPaths records the path walked to reach each fid, reported by
+// OpenFids. This is a debugging aid and costs a string per fid.
+func WithFidPaths() SessionOption {
+	return func(so *sessionOptions) {
+		so.fidPaths = true
+	}
+}
+
+// WithMaxDirReads limits the number of reads ReaddirAll issues for a single
+// directory, guarding against servers that never end a listing. The default
+// is DefaultMaxDirReads.
+func WithMaxDirReads(n int) SessionOption {
+	return func(so *sessionOptions) {
+		so.maxDirReads = n
+	}
+}
+
+// WithQidChecks logs a warning when an operation on a fid returns a qid with a
+// different path than the one recorded for the fid. A fid's identity never
+// changes, so this points to a server bug. This is a debugging aid.
+func WithQidChecks() SessionOption {
+	return func(so *sessionOptions) {
+		so.qidChecks = true
+	}
+}
+
+// WithStatCache caches the result of Stat for each file, by qid path, for up
+// to ttl. Write, WStat and Remove through the session drop the entry of the
+// file, as do Open with OTRUNC and Create for the parent directory, but
+// changes made by other clients are only seen once the entry expires.
+func WithStatCache(ttl time.Duration) SessionOption {
+	return func(so *sessionOptions) {
+		so.statTTL = ttl
+	}
+}
+
+// WithRetry retries walks, stats and reads that fail with a transient error,
+// as configured by policy.
+func WithRetry(policy RetryPolicy) SessionOption {
+	return func(so *sessionOptions) {
+		so.retries = &policy
+	}
+}
+
+// WithMSize offers msize as the maximum size of a message when negotiating
+// the session, rather than DefaultMSize. The server may answer with a
+// smaller msize, which is used instead. A larger msize allows more data in
+// each read and write.
+func WithMSize(msize int) SessionOption {
+	return func(so *sessionOptions) {
+		so.msize = msize
+	}
+}
+
+// WithHandshakeTimeout bounds the time taken to establish the session: dialing,
+// handshakes such as TLS and encryption, and version negotiation. Without
+// it, dialing is bounded by ctx and each negotiation message waits up to the
+// deadline of ctx, or a second if it has none.
+func WithHandshakeTimeout(timeout time.Duration) SessionOption {
+	return func(so *sessionOptions) {
+		so.handshake = timeout
+	}
+}
+
+// AuthFunc runs an authentication protocol with the server over afid, as
+// returned by Tauth, by reading and writing afid on session. Once it returns
+// nil, afid is used to attach as uname to aname.
+type AuthFunc func(ctx context.Context, session Session, afid Fid, uname, aname string) error
+
+// WithAuth authenticates each call to Attach with NOFID as afid using fn,
+// with an afid allocated from the pool of the session and clunked after the
+// attach. If the server refuses the Tauth, such as when it requires no
+// authentication, the attach proceeds without it. Fids attached this way are
+// not restored after a reconnect.
+func WithAuth(fn AuthFunc) SessionOption {
+	return func(so *sessionOptions) {
+		so.auth = fn
+	}
+}
+
+// WithDrainOnDone keeps the session delivering responses to requests already
+// sent for up to timeout after the context passed to NewSession is done. By
+// default, the session shuts down immediately and those requests fail.
+//
+// No new requests are sent while draining, and the session shuts down as soon
+// as the last outstanding request completes. Draining lets calls in flight
+// complete during a shutdown, at the cost of delaying it by up to timeout for
+// a slow or unresponsive server.
+func WithDrainOnDone(timeout time.Duration) SessionOption {
+	return func(so *sessionOptions) {
+		so.drainTimeout = timeout
+	}
+}
+
+// WithDefaultContext sets the default context of the session, returned by
+// DefaultContext, to the result of fn applied to the context passed to
+// NewSession. The result should be derived from its argument, so that it is
+// done when the session is.
+func WithDefaultContext(fn func(ctx context.Context) context.Context) SessionOption {
+	return func(so *sessionOptions) {
+		so.defaultctx = fn
+	}
+}
+
+// WithChecksums appends a checksum, computed by newHash, to every frame and
+// verifies it on read. If newHash is nil, CRC-32C is used. A frame failing
+// verification closes the session with ErrChecksum. This helps diagnose links
+// that corrupt data.
+//
+// Checksums are not part of 9p and break wire compatibility. The server must
+// be served WithServerChecksums, with the same hash. The checksum takes 4
+// bytes from each message, which the msize reported by the session accounts
+// for.
+func WithChecksums(newHash func() hash.Hash32) SessionOption {
+	return func(so *sessionOptions) {
+		so.checksums = true
+		so.newHash = newHash
+	}
+}
+
+// WithFrameCompression compresses each frame with fc, leaving frames that do
+// not shrink uncompressed. Unlike WithCompression, frames are compressed
+// independently, so the ratio is worse, but no state is carried between
+// frames and compressors such as snappy or zstd may be plugged in.
+//
+// Frame compression is not part of 9p and breaks wire compatibility. The
+// server must be served WithServerFrameCompression, with a compatible
+// compressor. Compression takes a byte from each message, which the msize
+// reported by the session accounts for.
+func WithFrameCompression(fc FrameCompressor) SessionOption {
+	return func(so *sessionOptions) {
+		so.frameCompress = fc
+	}
+}
+
+// WithKeepalive probes the server every interval while the session is open,
+// so that a connection that dies silently, such as one dropped by a NAT, is
+// noticed before the next call hangs. If the server does not answer a probe
+// within timeout, the session is closed and dead, if not nil, is called with
+// ErrKeepaliveTimeout. If a probe fails for another reason, dead is called
+// with that error. If timeout is zero, interval is used. A probe is a flush
+// of no request, which every server answers without side effects.
+func WithKeepalive(interval, timeout time.Duration, dead func(err error)) SessionOption {
+	return func(so *sessionOptions) {
+		so.keepalive = interval
+		so.keepaliveTimeout = timeout
+		so.keepaliveDead = dead
+	}
+}
+
+// WithLazyDial defers connecting and negotiating a session created with
+// Dial until it is first used, such as by a request or a call to Version.
+// Connecting is attempted once, with the context passed to Dial. If it fails,
+// the error is returned from every call on the session. Closing a session
+// that was never used doesn't connect.
+//
+// The first call on the session pays the latency of connecting and
+// negotiating, which is otherwise paid by Dial.
+func WithLazyDial() SessionOption {
+	return func(so *sessionOptions) {
+		so.lazy = true
+	}
+}
+
+// WithParallelDial makes DialAny and DialSRV dial every candidate address at
+// once, keeping the first session negotiated, rather than trying them one
+// after another. It trades extra connections for the latency of waiting on
+// unreachable servers.
+func WithParallelDial() SessionOption {
+	return func(so *sessionOptions) {
+		so.parallelDial = true
+	}
+}
+
+// WithStripes makes DialAddr open n connections to the server, each attached
+// to the tree, rather than one. ReadFile and WriteFile stripe the messages of
+// a file larger than one message across the connections, which lifts the
+// limit a single connection puts on throughput over links with a high
+// bandwidth and latency. Other calls use the first connection.
+func WithStripes(n int) SessionOption {
+	return func(so *sessionOptions) {
+		so.stripes = n
+	}
+}
+
+// WithReconnect makes a session created with Dial dial again when its
+// connection is lost, rather than failing every call with ErrClosed. Calls in
+// flight when the connection drops are sent again on the new connection if
+// they are idempotent, such as Stat or Read, and fail with ErrInterrupted
+// otherwise. WithLazyDial has no effect on a reconnecting session.
+//
+// If restoreFids is set, the fids of the session are attached, walked and
+// opened again on the new connection before calls proceed. Fids established
+// with authentication are not restored. Otherwise, fids from the lost
+// connection are invalid on the new one and must be established again by the
+// caller.
+func WithReconnect(restoreFids bool) SessionOption {
+	return func(so *sessionOptions) {
+		so.reconnect = true
+		so.restoreFids = restoreFids
+	}
+}
+
+// WithVersion negotiates one of versions, such as Version9P2000L, in place of
+// DefaultVersion. Versions are listed in order of preference. The server may
+// answer the most preferred version with a less capable one, which is used if
+// it is listed. Otherwise, the next version is offered. Creating the session
+// fails if the server accepts none of the versions. Use Supports to check the
+// messages available on the resulting session.
+func WithVersion(versions ...string) SessionOption {
+	return func(so *sessionOptions) {
+		so.versions = versions
+	}
+}
+
+// WithStrictTags closes the session when the server sends a response with a
+// tag that is not outstanding, including a second response to a request.
+// Calls waiting on a response fail with ErrUnknownTag. By default, such
+// responses are logged and dropped, tolerating servers that answer a request
+// after it has been flushed. Strict handling guards against a server that
+// may have confused the responses to other requests.
+func WithStrictTags() SessionOption {
+	return func(so *sessionOptions) {
+		so.strictTags = true
+	}
+}
+
+// WithLogger sends the diagnostic output of the session to logger. By
+// default, warnings and errors go to the standard logger.
+func WithLogger(logger Logger) SessionOption {
+	return func(so *sessionOptions) {
+		so.logger = logger
+	}
+}
+
+// WithMaxOutstanding limits the session to n requests in flight at once.
+// Further calls wait until an outstanding request is answered or their
+// context is done. If nowait is set, they fail with ErrTooManyRequests
+// instead. A canceled request counts against the limit until its flush is
+// answered.
+func WithMaxOutstanding(n int, nowait bool) SessionOption {
+	return func(so *sessionOptions) {
+		so.maxOutstanding = n
+		so.maxOutstandingNoWait = nowait
+	}
+}
+
+// WithTagWatermarks calls fn with pressured true when the number of tags in
+// use by outstanding requests reaches high, and with pressured false once it
+// falls back to low. A session has 65535 tags to allocate, one for each
+// outstanding request or flush. This gives an application a chance to slow
+// down before requests fail with ErrNomem.
+//
+// The callback runs on the goroutine handling the session and must not block.
+// In particular, it must not make calls on the session.
+func WithTagWatermarks(low, high int, fn func(inuse int, pressured bool)) SessionOption {
+	return func(so *sessionOptions) {
+		so.tagLow, so.tagHigh = low, high
+		so.tagPressure = fn
+	}
+}
+
+// WithTrace writes each fcall sent and received by the session to w,
+// including those negotiating the version. See TraceChannel for the format.
+func WithTrace(w io.Writer) SessionOption {
+	return func(so *sessionOptions) {
+		so.trace = w
+	}
+}
+
+// ServerOption configures the serving of a connection with ServeConn.
+type ServerOption func(*serverOptions)
+
+// serverOptions holds the configuration applied by ServerOptions.
+type serverOptions struct {
+	checksums     bool
+	newHash       func() hash.Hash32
+	frameCompress FrameCompressor
+	logger        Logger
+	trace         io.Writer
+	workers       int
+	maxRequests   int
+	requestPolicy BusyPolicy
+	server        *Server // tracking the connection, if any
+	busy          bool    // over the connection limit of server
+	sessions      SessionFactory
+	info          ConnInfo // of the connection, completed once negotiated
+}
+
+func newServerOptions(opts []ServerOption) serverOptions {
+	var so serverOptions
+	for _, opt := range opts {
+		opt(&so)
+	}
+
+	return so
+}
+
+// WithServerChecksums verifies and appends frame checksums, the server side of
+// WithChecksums.
+func WithServerChecksums(newHash func() hash.Hash32) ServerOption {
+	return func(so *serverOptions) {
+		so.checksums = true
+		so.newHash = newHash
+	}
+}
+
+// WithServerFrameCompression compresses each frame with fc, the server side
+// of WithFrameCompression.
+func WithServerFrameCompression(fc FrameCompressor) ServerOption {
+	return func(so *serverOptions) {
+		so.frameCompress = fc
+	}
+}
+
+// WithServerLogger sends the diagnostic output of the server to logger, the
+// server side of WithLogger.
+func WithServerLogger(logger Logger) ServerOption {
+	return func(so *serverOptions) {
+		so.logger = logger
+	}
+}
+
+// WithServerTrace writes each fcall received and sent by the server to w, the
+// server side of WithTrace.
+func WithServerTrace(w io.Writer) ServerOption {
+	return func(so *serverOptions) {
+		so.trace = w
+	}
+}
+
+// WithServerWorkers handles requests with a pool of n workers, so that at
+// most n handlers run at once. Requests naming the same fid are handled one
+// at a time, in the order received, while those on other fids proceed. By
+// default, each request is handled as it arrives, without ordering.
+func WithServerWorkers(n int) ServerOption {
+	return func(so *serverOptions) {
+		so.workers = n
+	}
+}
+
+// BusyPolicy selects what a server does with work beyond its limits.
+type BusyPolicy int
+
+const (
+	// BusyWait holds the work until there is room for it.
+	BusyWait BusyPolicy = iota
+
+	// BusyReject fails the work with ErrBusy at once.
+	BusyReject
+)
+
+// WithMaxRequests limits the requests handled at once on each connection to
+// n, protecting the handler from a client sending many requests at once.
+// Requests beyond the limit are held in the order received, under
+// BusyWait, or failed with ErrBusy, under BusyReject. Held requests are
+// still read, so that they can be flushed. Flushes are not limited.
+func WithMaxRequests(n int, policy BusyPolicy) ServerOption {
+	return func(so *serverOptions) {
+		so.maxRequests = n
+		so.requestPolicy = policy
+	}
+}
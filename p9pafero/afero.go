@@ -0,0 +1,293 @@
+// Package p9pafero exposes the files of a 9p attach as an afero.Fs, so that
+// tools written against afero can work on the files of a 9p server.
+//
+// The filesystem behaves like afero.OsFs where the protocol allows: Rename
+// replaces the file at the new name, and Chmod and Chtimes change files
+// with wstat. Calls use the default context of the session of the client.
+// Errors are *os.PathError, or *os.LinkError for Rename. Those classified
+// by p9p.IsNotExist, p9p.IsExist and p9p.IsPermission hold os.ErrNotExist,
+// os.ErrExist and os.ErrPermission, so that the checks of the os package
+// work.
+package p9pafero
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/docker/go-p9p"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+type filesystem struct {
+	c *p9p.Client
+}
+
+var _ afero.Fs = &filesystem{}
+
+// New returns an afero.Fs for the files of c. Paths are slash separated and
+// relative to the root of the attach, as with p9p.Client. Use
+// afero.NewBasePathFs to confine callers to a directory.
+func New(c *p9p.Client) afero.Fs {
+	return &filesystem{c: c}
+}
+
+func (afs *filesystem) ctx() context.Context {
+	return p9p.DefaultContext(afs.c.Session())
+}
+
+// rel returns the path of name for the io/fs view of the client.
+func rel(name string) string {
+	if p := strings.TrimPrefix(pathpkg.Clean("/"+name), "/"); p != "" {
+		return p
+	}
+
+	return "."
+}
+
+func (afs *filesystem) Name() string { return "p9p" }
+
+func (afs *filesystem) Create(name string) (afero.File, error) {
+	return afs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (afs *filesystem) Open(name string) (afero.File, error) {
+	return afs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the file with flag, as os.OpenFile does. With O_APPEND,
+// writes start at the end of the file, as it was when opened.
+func (afs *filesystem) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	ctx := afs.ctx()
+
+	var mode p9p.Flag
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		mode = p9p.OWRITE
+	case os.O_RDWR:
+		mode = p9p.ORDWR
+	default:
+		mode = p9p.OREAD
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		mode |= p9p.OTRUNC
+	}
+
+	var (
+		f   *p9p.File
+		err error
+	)
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		f, err = afs.c.Create(ctx, name, uint32(perm.Perm()), mode)
+	} else {
+		f, err = afs.c.Open(ctx, name, mode)
+		if p9p.IsNotExist(err) && flag&os.O_CREATE != 0 {
+			f, err = afs.c.Create(ctx, name, uint32(perm.Perm()), mode)
+		}
+	}
+
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	if flag&os.O_APPEND != 0 {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, pathError("open", name, err)
+		}
+	}
+
+	return &file{File: f, ctx: ctx, session: afs.c.Session(), name: name}, nil
+}
+
+func (afs *filesystem) Mkdir(name string, perm os.FileMode) error {
+	f, err := afs.c.Create(afs.ctx(), name, p9p.DMDIR|uint32(perm.Perm()), p9p.OREAD)
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+
+	return f.Close()
+}
+
+func (afs *filesystem) MkdirAll(path string, perm os.FileMode) error {
+	return pathError("mkdir", path, afs.c.MkdirAll(afs.ctx(), path, uint32(perm.Perm())))
+}
+
+func (afs *filesystem) Remove(name string) error {
+	return pathError("remove", name, afs.c.Remove(afs.ctx(), name))
+}
+
+func (afs *filesystem) RemoveAll(path string) error {
+	return pathError("removeall", path, afs.c.RemoveAll(afs.ctx(), path))
+}
+
+// Rename renames the file at oldname to newname, replacing a file at
+// newname as os.Rename does. The protocol only renames files within their
+// directory, so files moving to another directory are copied, then removed.
+func (afs *filesystem) Rename(oldname, newname string) error {
+	ctx := afs.ctx()
+	err := afs.rename(ctx, oldname, newname)
+	if p9p.IsExist(err) {
+		if d, serr := afs.c.Stat(ctx, newname); serr == nil && d.Qid.Type&p9p.QTDIR == 0 {
+			if err = afs.c.Remove(ctx, newname); err == nil {
+				err = afs.rename(ctx, oldname, newname)
+			}
+		}
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: osError(err)}
+	}
+
+	return nil
+}
+
+func (afs *filesystem) rename(ctx context.Context, from, to string) error {
+	err := afs.c.Rename(ctx, from, to)
+	if perr, ok := err.(*p9p.PathError); !ok || perr.Err != p9p.ErrCrossDir {
+		return err
+	}
+
+	if _, err := afs.c.Stat(ctx, to); err == nil {
+		return &p9p.PathError{Op: "rename", Path: to, Err: p9p.ErrExist}
+	}
+
+	if err := p9p.Copy(ctx, afs.c, to, afs.c, from); err != nil {
+		return err
+	}
+
+	return afs.c.RemoveAll(ctx, from)
+}
+
+func (afs *filesystem) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.Stat(afs.c.FS(), rel(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return fi, nil
+}
+
+func (afs *filesystem) Chmod(name string, mode os.FileMode) error {
+	return pathError("chmod", name, afs.c.Chmod(afs.ctx(), name, uint32(mode.Perm())))
+}
+
+// Chown returns p9p.ErrUnsupported: files are owned by user names, not
+// numeric ids, in 9p.
+func (afs *filesystem) Chown(name string, uid, gid int) error {
+	return pathError("chown", name, p9p.ErrUnsupported)
+}
+
+func (afs *filesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return pathError("chtimes", name, afs.c.Chtimes(afs.ctx(), name, atime, mtime))
+}
+
+// file is an open file of the filesystem, named as it was opened.
+type file struct {
+	*p9p.File
+	ctx     context.Context
+	session p9p.Session
+	name    string
+	dr      *p9p.DirReader // set once the directory is read
+}
+
+func (f *file) Name() string { return f.name }
+
+// Readdir reads the entries of the directory, as os.File.Readdir does.
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	if f.Qid().Type&p9p.QTDIR == 0 {
+		return nil, pathError("readdir", f.name, p9p.ErrWalknodir)
+	}
+
+	if f.dr == nil {
+		f.dr = p9p.NewDirReader(f.session, f.Fid())
+	}
+
+	var fis []os.FileInfo
+	for count <= 0 || len(fis) < count {
+		d, err := f.dr.Next(f.ctx)
+		if err == io.EOF {
+			if count > 0 && len(fis) == 0 {
+				return nil, io.EOF
+			}
+
+			break
+		}
+
+		if err != nil {
+			return fis, pathError("readdir", f.name, err)
+		}
+
+		if d.Name == "." || d.Name == ".." {
+			continue
+		}
+		fis = append(fis, p9p.FileInfo(d))
+	}
+
+	return fis, nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+
+	return names, err
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	d, err := f.File.Stat(f.ctx)
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+
+	return p9p.FileInfo(d), nil
+}
+
+func (f *file) Truncate(size int64) error {
+	return pathError("truncate", f.name, f.File.Truncate(f.ctx, size))
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// pathError returns err as the *os.PathError of op on name, as with
+// osError. It returns nil if err is nil.
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: osError(err)}
+}
+
+// osError returns the error held by err, replacing classified errors with
+// those of the os package.
+func osError(err error) error {
+	switch perr := err.(type) {
+	case *p9p.PathError:
+		err = perr.Err
+	case *fs.PathError:
+		err = perr.Err
+	}
+
+	switch {
+	case p9p.IsNotExist(err) || errors.Is(err, fs.ErrNotExist):
+		return os.ErrNotExist
+	case p9p.IsExist(err) || errors.Is(err, fs.ErrExist):
+		return os.ErrExist
+	case p9p.IsPermission(err) || errors.Is(err, fs.ErrPermission):
+		return os.ErrPermission
+	}
+
+	return err
+}
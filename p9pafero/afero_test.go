@@ -0,0 +1,166 @@
+package p9pafero
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/go-p9p"
+	"github.com/docker/go-p9p/internal/memfs"
+	"golang.org/x/net/context"
+)
+
+// newTestClient returns a client attached to m, along with a function tearing
+// it down.
+func newTestClient(t *testing.T, m *memfs.FS) (*p9p.Client, func()) {
+	session, cleanup, err := m.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := p9p.NewClient(context.Background(), session, "test", "/")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return c, func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+// TestFs writes, reads, lists, renames and changes files through the
+// adapter, with the semantics of the os package.
+func TestFs(t *testing.T) {
+	m := memfs.New()
+	c, cleanup := newTestClient(t, m)
+	defer cleanup()
+	fs := New(c)
+
+	if _, err := fs.Create("dir/file"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error creating in a missing directory: %v", err)
+	}
+
+	if err := fs.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("dir", 0755); !os.IsExist(err) {
+		t.Fatalf("expected exist error: %v", err)
+	}
+
+	for _, name := range []string{"dir/a", "dir/b", "dir/c"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.WriteString(name); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	f, err := fs.OpenFile("dir/a", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(" appended")
+	f.Close()
+
+	f, err = fs.Open("dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := ioutil.ReadAll(f); err != nil || string(p) != "dir/a appended" {
+		t.Fatalf("unexpected data: %q, %v", p, err)
+	}
+
+	if fi, err := f.Stat(); err != nil || fi.Name() != "a" || fi.Size() != int64(len("dir/a appended")) {
+		t.Fatalf("unexpected stat: %v, %v", fi, err)
+	}
+	f.Close()
+
+	// the directory is read two entries at a time.
+	dir, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(2)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil || len(batch) > 2 {
+			t.Fatalf("unexpected entries: %v, %v", batch, err)
+		}
+		names = append(names, batch...)
+	}
+	dir.Close()
+
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "a" || names[2] != "c" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+
+	// replaces the file at the new name, as os.Rename does.
+	if err := fs.Rename("dir/a", "dir/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.MkdirAll("other/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("dir/b", "other/sub/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename("dir/missing", "dir/d")
+	if lerr, ok := err.(*os.LinkError); !ok || !os.IsNotExist(lerr) {
+		t.Fatalf("expected not exist link error: %#v", err)
+	}
+
+	mtime := time.Unix(1000000000, 0)
+	if err := fs.Chtimes("other/sub/b", time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Chmod("other", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Chown("other", 0, 0); err == nil {
+		t.Fatal("expected error changing owner to a numeric id")
+	}
+
+	fi, err := fs.Stat("other/sub/b")
+	if err != nil || !fi.ModTime().Equal(mtime) || fi.Size() != int64(len("dir/a appended")) {
+		t.Fatalf("unexpected stat: %v, %v", fi, err)
+	}
+
+	if fi, err := fs.Stat("other"); err != nil || fi.Mode() != os.ModeDir|0700 {
+		t.Fatalf("unexpected mode: %v, %v", fi.Mode(), err)
+	}
+
+	if err := fs.RemoveAll("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := m.Files()
+	if _, ok := files["other"]; ok || len(files) != 3 {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	if n := m.Fids(); n != 1 {
+		t.Fatalf("fids leaked: %d in use", n)
+	}
+}
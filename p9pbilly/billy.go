@@ -0,0 +1,292 @@
+// Package p9pbilly exposes the files of a 9p attach as a billy.Filesystem, so
+// that go-git and other packages built on go-billy can work on the files of
+// a 9p server directly, without mounting them.
+//
+// Calls use the default context of the session of the client. Errors are
+// *os.PathError. Those classified by p9p.IsNotExist, p9p.IsExist and
+// p9p.IsPermission hold os.ErrNotExist, os.ErrExist and os.ErrPermission,
+// so that the checks of the os package, which go-git relies on, work.
+package p9pbilly
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-p9p"
+	"github.com/go-git/go-billy/v5"
+	"golang.org/x/net/context"
+)
+
+// maxTempTries bounds the names tried by TempFile, as with ioutil.TempFile.
+const maxTempTries = 10000
+
+type filesystem struct {
+	c    *p9p.Client
+	root string // slash separated, with a leading slash
+}
+
+var (
+	_ billy.Filesystem = &filesystem{}
+	_ billy.Capable    = &filesystem{}
+)
+
+// New returns a billy.Filesystem for the files of c. The protocol has no
+// symbolic links or locks: Lstat is Stat, Symlink and Readlink return
+// billy.ErrNotSupported, and locking files does nothing.
+func New(c *p9p.Client) billy.Filesystem {
+	return &filesystem{c: c, root: "/"}
+}
+
+func (fsys *filesystem) ctx() context.Context {
+	return p9p.DefaultContext(fsys.c.Session())
+}
+
+// abs returns the path of name on the client, confined to the root.
+func (fsys *filesystem) abs(name string) string {
+	return pathpkg.Join(fsys.root, pathpkg.Clean("/"+name))
+}
+
+// rel returns the path of name for the io/fs view of the client.
+func (fsys *filesystem) rel(name string) string {
+	if p := strings.TrimPrefix(fsys.abs(name), "/"); p != "" {
+		return p
+	}
+
+	return "."
+}
+
+func (fsys *filesystem) Create(filename string) (billy.File, error) {
+	return fsys.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fsys *filesystem) Open(filename string) (billy.File, error) {
+	return fsys.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the file with flag, as os.OpenFile does. With O_CREATE,
+// missing parent directories are created. With O_APPEND, writes start at
+// the end of the file, as it was when opened.
+func (fsys *filesystem) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	ctx := fsys.ctx()
+	p := fsys.abs(filename)
+
+	var mode p9p.Flag
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		mode = p9p.OWRITE
+	case os.O_RDWR:
+		mode = p9p.ORDWR
+	default:
+		mode = p9p.OREAD
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		mode |= p9p.OTRUNC
+	}
+
+	var (
+		f   *p9p.File
+		err error
+	)
+	if flag&os.O_CREATE != 0 {
+		f, err = fsys.create(ctx, p, uint32(perm.Perm()), mode, flag&os.O_EXCL != 0)
+	} else {
+		f, err = fsys.c.Open(ctx, p, mode)
+	}
+
+	if err != nil {
+		return nil, pathError("open", filename, err)
+	}
+
+	if flag&os.O_APPEND != 0 {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, pathError("open", filename, err)
+		}
+	}
+
+	return &file{File: f, ctx: ctx, name: filename}, nil
+}
+
+// create opens the file at p, creating it with perm if it doesn't exist or
+// failing if it does and excl is set.
+func (fsys *filesystem) create(ctx context.Context, p string, perm uint32, mode p9p.Flag, excl bool) (*p9p.File, error) {
+	if !excl {
+		f, err := fsys.c.Open(ctx, p, mode)
+		if !p9p.IsNotExist(err) {
+			return f, err
+		}
+	}
+
+	if err := fsys.c.MkdirAll(ctx, pathpkg.Dir(p), 0777); err != nil {
+		return nil, err
+	}
+
+	return fsys.c.Create(ctx, p, perm, mode)
+}
+
+func (fsys *filesystem) Stat(filename string) (os.FileInfo, error) {
+	fi, err := fs.Stat(fsys.c.FS(), fsys.rel(filename))
+	if err != nil {
+		return nil, pathError("stat", filename, err)
+	}
+
+	return fi, nil
+}
+
+// Rename renames the file at oldpath to newpath, replacing a file at newpath
+// and creating missing parent directories, as os.Rename does. The protocol
+// only renames files within their directory, so files moving to another
+// directory are copied, then removed.
+func (fsys *filesystem) Rename(oldpath, newpath string) error {
+	ctx := fsys.ctx()
+	from, to := fsys.abs(oldpath), fsys.abs(newpath)
+	if err := fsys.c.MkdirAll(ctx, pathpkg.Dir(to), 0777); err != nil {
+		return pathError("rename", oldpath, err)
+	}
+
+	err := fsys.rename(ctx, from, to)
+	if p9p.IsExist(err) {
+		if d, serr := fsys.c.Stat(ctx, to); serr == nil && d.Qid.Type&p9p.QTDIR == 0 {
+			if err = fsys.c.Remove(ctx, to); err == nil {
+				err = fsys.rename(ctx, from, to)
+			}
+		}
+	}
+
+	return pathError("rename", oldpath, err)
+}
+
+func (fsys *filesystem) rename(ctx context.Context, from, to string) error {
+	err := fsys.c.Rename(ctx, from, to)
+	if perr, ok := err.(*p9p.PathError); !ok || perr.Err != p9p.ErrCrossDir {
+		return err
+	}
+
+	if _, err := fsys.c.Stat(ctx, to); err == nil {
+		return &p9p.PathError{Op: "rename", Path: to, Err: p9p.ErrExist}
+	}
+
+	if err := p9p.Copy(ctx, fsys.c, to, fsys.c, from); err != nil {
+		return err
+	}
+
+	return fsys.c.RemoveAll(ctx, from)
+}
+
+func (fsys *filesystem) Remove(filename string) error {
+	return pathError("remove", filename, fsys.c.Remove(fsys.ctx(), fsys.abs(filename)))
+}
+
+func (fsys *filesystem) Join(elem ...string) string {
+	return pathpkg.Join(elem...)
+}
+
+// TempFile creates a file with a new name, made of prefix and a random
+// number, in dir, creating dir if needed.
+func (fsys *filesystem) TempFile(dir, prefix string) (billy.File, error) {
+	for i := 0; ; i++ {
+		name := pathpkg.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) || i == maxTempTries {
+			return f, err
+		}
+	}
+}
+
+func (fsys *filesystem) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(fsys.c.FS(), fsys.rel(path))
+	if err != nil {
+		return nil, pathError("readdir", path, err)
+	}
+
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, pathError("readdir", path, err)
+		}
+		fis = append(fis, fi)
+	}
+
+	return fis, nil
+}
+
+func (fsys *filesystem) MkdirAll(filename string, perm os.FileMode) error {
+	return pathError("mkdir", filename, fsys.c.MkdirAll(fsys.ctx(), fsys.abs(filename), uint32(perm.Perm())))
+}
+
+func (fsys *filesystem) Lstat(filename string) (os.FileInfo, error) {
+	return fsys.Stat(filename)
+}
+
+func (fsys *filesystem) Symlink(target, link string) error {
+	return billy.ErrNotSupported
+}
+
+func (fsys *filesystem) Readlink(link string) (string, error) {
+	return "", billy.ErrNotSupported
+}
+
+// Chroot returns a filesystem for the files below path, which cannot be
+// escaped with "..".
+func (fsys *filesystem) Chroot(path string) (billy.Filesystem, error) {
+	return &filesystem{c: fsys.c, root: fsys.abs(path)}, nil
+}
+
+func (fsys *filesystem) Root() string {
+	return fsys.root
+}
+
+func (fsys *filesystem) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities &^ billy.LockCapability
+}
+
+// file is an open file of the filesystem, named as it was opened.
+type file struct {
+	*p9p.File
+	ctx  context.Context
+	name string
+}
+
+func (f *file) Name() string { return f.name }
+
+func (f *file) Lock() error   { return nil }
+func (f *file) Unlock() error { return nil }
+
+func (f *file) Truncate(size int64) error {
+	return pathError("truncate", f.name, f.File.Truncate(f.ctx, size))
+}
+
+// pathError returns err as the *os.PathError of op on name, replacing
+// classified errors with those of the os package. It returns nil if err is
+// nil.
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch perr := err.(type) {
+	case *p9p.PathError:
+		err = perr.Err
+	case *fs.PathError:
+		err = perr.Err
+	}
+
+	switch {
+	case p9p.IsNotExist(err) || errors.Is(err, fs.ErrNotExist):
+		err = os.ErrNotExist
+	case p9p.IsExist(err) || errors.Is(err, fs.ErrExist):
+		err = os.ErrExist
+	case p9p.IsPermission(err) || errors.Is(err, fs.ErrPermission):
+		err = os.ErrPermission
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
@@ -0,0 +1,174 @@
+package p9pbilly
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-p9p"
+	"github.com/docker/go-p9p/internal/memfs"
+	"github.com/go-git/go-billy/v5"
+	"golang.org/x/net/context"
+)
+
+// newTestFilesystem returns a filesystem over a client attached to m, along
+// with a function tearing it down.
+func newTestFilesystem(t *testing.T, m *memfs.FS) (billy.Filesystem, func()) {
+	session, cleanup, err := m.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := p9p.NewClient(context.Background(), session, "test", "/")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return New(c), func() {
+		c.Close()
+		cleanup()
+	}
+}
+
+// TestFilesystem creates, reads, renames and removes files through the
+// adapter, as go-git does when writing objects.
+func TestFilesystem(t *testing.T) {
+	m := memfs.New()
+	fs, cleanup := newTestFilesystem(t, m)
+	defer cleanup()
+
+	f, err := fs.Create("repo/objects/tmp_obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name() != "repo/objects/tmp_obj" {
+		t.Fatalf("unexpected name: %v", f.Name())
+	}
+	f.Close()
+
+	if _, err := fs.OpenFile("repo/objects/tmp_obj", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("expected exist error: %v", err)
+	}
+
+	// moved to another directory, created along the way.
+	if err := fs.Rename("repo/objects/tmp_obj", fs.Join("repo", "objects", "ab", "cdef")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("repo/objects/tmp_obj"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+
+	f, err = fs.Open("/repo/objects/ab/cdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ioutil.ReadAll(f)
+	if err != nil || string(p) != "hello" {
+		t.Fatalf("unexpected data: %q, %v", p, err)
+	}
+	f.Close()
+
+	// moved again, replacing the file at the new name.
+	tmp, err := fs.TempFile("repo", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Write([]byte("new"))
+	tmp.Close()
+
+	if err := fs.Rename(tmp.Name(), "repo/objects/ab/cdef"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = fs.OpenFile("repo/objects/ab/cdef", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" data"))
+	f.Close()
+
+	fi, err := fs.Stat("repo/objects/ab/cdef")
+	if err != nil || fi.Size() != int64(len("new data")) || fi.IsDir() {
+		t.Fatalf("unexpected stat: %v, %v", fi, err)
+	}
+
+	fis, err := fs.ReadDir("repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fis) != 1 || fis[0].Name() != "objects" || !fis[0].IsDir() {
+		t.Fatalf("unexpected entries: %v", fis)
+	}
+
+	if err := fs.Remove("repo/objects"); err == nil {
+		t.Fatal("expected error removing a directory that is not empty")
+	}
+
+	if _, err := fs.Readlink("repo"); err != billy.ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported: %v", err)
+	}
+
+	var paths []string
+	for p := range m.Files() {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	if strings.Join(paths, ",") != ",repo,repo/objects,repo/objects/ab,repo/objects/ab/cdef" {
+		t.Fatalf("unexpected files: %v", paths)
+	}
+
+	if n := m.Fids(); n != 1 {
+		t.Fatalf("fids leaked: %d in use", n)
+	}
+}
+
+// TestChroot ensures that a chrooted filesystem cannot reach files outside
+// its root.
+func TestChroot(t *testing.T) {
+	m := memfs.New()
+	fs, cleanup := newTestFilesystem(t, m)
+	defer cleanup()
+
+	if err := fs.MkdirAll("outside", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	chroot, err := fs.Chroot("jail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chroot.Root() != "/jail" {
+		t.Fatalf("unexpected root: %v", chroot.Root())
+	}
+
+	f, err := chroot.Create("../../escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := fs.Stat("jail/escape"); err != nil {
+		t.Fatalf("expected the file confined to the root: %v", err)
+	}
+
+	if _, err := chroot.Stat("../outside"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error: %v", err)
+	}
+}
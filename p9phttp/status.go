@@ -0,0 +1,45 @@
+// Package p9phttp helps build HTTP gateways in front of 9p servers.
+package p9phttp
+
+import (
+	"net/http"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+// HTTPStatus returns the HTTP status code best describing err, returned from
+// a 9p session. Errors are classified with p9p.IsNotExist and friends, so
+// servers with differently worded errors are handled. Unclassified errors
+// map to http.StatusInternalServerError. A nil error maps to http.StatusOK.
+func HTTPStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	if cerr, ok := err.(p9p.CancelError); ok && cerr.Err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+
+	switch err {
+	case p9p.ErrTimeout:
+		return http.StatusGatewayTimeout
+	case p9p.ErrClosed, p9p.ErrSessionDone:
+		return http.StatusBadGateway
+	case p9p.ErrNowrite, p9p.ErrNocreate, p9p.ErrNoremove:
+		return http.StatusForbidden
+	case p9p.ErrBadoffset:
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+
+	switch {
+	case p9p.IsNotExist(err):
+		return http.StatusNotFound
+	case p9p.IsPermission(err):
+		return http.StatusForbidden
+	case p9p.IsExist(err):
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,33 @@
+package p9phttp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	for _, testcase := range []struct {
+		err    error
+		status int
+	}{
+		{err: nil, status: http.StatusOK},
+		{err: p9p.ErrNotfound, status: http.StatusNotFound},
+		{err: p9p.MessageRerror{Ename: "No such file or directory"}, status: http.StatusNotFound},
+		{err: &p9p.PathError{Op: "walk", Path: "a/b", Err: p9p.ErrNotfound}, status: http.StatusNotFound},
+		{err: p9p.ErrPerm, status: http.StatusForbidden},
+		{err: p9p.ErrNowrite, status: http.StatusForbidden},
+		{err: p9p.ErrExist, status: http.StatusConflict},
+		{err: p9p.ErrBadoffset, status: http.StatusRequestedRangeNotSatisfiable},
+		{err: p9p.CancelError{Err: context.DeadlineExceeded}, status: http.StatusGatewayTimeout},
+		{err: p9p.ErrSessionDone, status: http.StatusBadGateway},
+		{err: errors.New("something else"), status: http.StatusInternalServerError},
+	} {
+		if status := HTTPStatus(testcase.err); status != testcase.status {
+			t.Errorf("%v: %v != %v", testcase.err, status, testcase.status)
+		}
+	}
+}
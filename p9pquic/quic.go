@@ -0,0 +1,130 @@
+// Package p9pquic carries 9p sessions over QUIC connections.
+//
+// The package is not tied to a QUIC implementation. Connections and streams
+// are described by the Conn and Stream interfaces, which take a few lines to
+// implement over any QUIC library. QUIC provides TLS, connection migration
+// and loss recovery, and the package offers two ways of using it:
+//
+// In single stream mode, set up with NewSession and ServeConn, the session
+// runs over one bidirectional stream, as it would over TCP.
+//
+// In stream per request mode, set up with NewStreamSession and
+// ServeStreams, each request and its response travel on their own stream,
+// so that a lost packet only holds up the request it belongs to. Canceling
+// a request aborts its stream instead of sending a Tflush.
+package p9pquic
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+// Stream is a bidirectional QUIC stream.
+type Stream interface {
+	io.Reader
+	io.Writer
+
+	// Close closes the sending side of the stream, once the data written
+	// has been sent. The peer reads io.EOF after the data.
+	Close() error
+
+	// Abort abandons the stream in both directions. Pending and future
+	// reads and writes fail, on both ends.
+	Abort()
+}
+
+// Conn is a QUIC connection.
+type Conn interface {
+	// OpenStream opens a new bidirectional stream.
+	OpenStream(ctx context.Context) (Stream, error)
+
+	// AcceptStream waits for and returns the next stream opened by the
+	// peer.
+	AcceptStream(ctx context.Context) (Stream, error)
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// deadliner is implemented by streams supporting deadlines, such as those of
+// quic-go.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamConn adapts a Stream to net.Conn, for use with the p9p package.
+// Deadlines are passed to the stream if it supports them and are ignored
+// otherwise. Close aborts the stream.
+type streamConn struct {
+	Stream
+	conn Conn
+}
+
+var _ net.Conn = streamConn{}
+
+func (sc streamConn) LocalAddr() net.Addr  { return sc.conn.LocalAddr() }
+func (sc streamConn) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+
+func (sc streamConn) Close() error {
+	sc.Abort()
+	return nil
+}
+
+func (sc streamConn) SetDeadline(t time.Time) error {
+	if err := sc.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := sc.Stream.(deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+
+	return nil
+}
+
+func (sc streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := sc.Stream.(deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+
+	return nil
+}
+
+// NewSession opens a stream on conn and returns a session over it, in
+// single stream mode. The context ctx and options are used as with
+// p9p.NewSession.
+func NewSession(ctx context.Context, conn Conn, opts ...p9p.SessionOption) (p9p.Session, error) {
+	stream, err := conn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := p9p.NewSession(ctx, streamConn{Stream: stream, conn: conn}, opts...)
+	if err != nil {
+		stream.Abort()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ServeConn accepts the stream of a session in single stream mode from conn
+// and serves handler over it, as with p9p.ServeConn.
+func ServeConn(ctx context.Context, conn Conn, handler p9p.Handler, opts ...p9p.ServerOption) error {
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Abort()
+
+	return p9p.ServeConn(ctx, streamConn{Stream: stream, conn: conn}, handler, opts...)
+}
@@ -0,0 +1,294 @@
+package p9pquic
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+var errAborted = errors.New("stream aborted")
+
+// pipeStream is one end of an in-memory stream, made of a pipe in each
+// direction. Reads honor deadlines, as those of quic-go do, if r is a
+// net.Conn.
+type pipeStream struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (s pipeStream) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s pipeStream) Write(p []byte) (int, error) { return s.w.Write(p) }
+func (s pipeStream) Close() error                { return s.w.Close() }
+
+func (s pipeStream) Abort() {
+	abort(s.r)
+	abort(s.w)
+}
+
+func (s pipeStream) SetReadDeadline(t time.Time) error {
+	if c, ok := s.r.(net.Conn); ok {
+		return c.SetReadDeadline(t)
+	}
+
+	return nil
+}
+
+func (s pipeStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// abort closes the end of a pipe with errAborted, if it is an io.Pipe.
+func abort(c io.Closer) {
+	switch c := c.(type) {
+	case *io.PipeReader:
+		c.CloseWithError(errAborted)
+	case *io.PipeWriter:
+		c.CloseWithError(errAborted)
+	default:
+		c.Close()
+	}
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is one end of an in-memory connection, delivering the streams it
+// opens to its peer. With deadlines, reads of the streams it opens honor
+// deadlines.
+type pipeConn struct {
+	name      string
+	incoming  chan Stream
+	peer      *pipeConn
+	deadlines bool
+}
+
+func newPipeConns() (*pipeConn, *pipeConn) {
+	a := &pipeConn{name: "a", incoming: make(chan Stream)}
+	b := &pipeConn{name: "b", incoming: make(chan Stream), peer: a}
+	a.peer = b
+	return a, b
+}
+
+func (c *pipeConn) OpenStream(ctx context.Context) (Stream, error) {
+	var (
+		r1     io.ReadCloser
+		w1     io.WriteCloser
+		r2, w2 = io.Pipe()
+	)
+	if c.deadlines {
+		r1, w1 = net.Pipe()
+	} else {
+		r1, w1 = io.Pipe()
+	}
+
+	select {
+	case c.peer.incoming <- pipeStream{r: r2, w: w1}:
+		return pipeStream{r: r1, w: w2}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipeConn) AcceptStream(ctx context.Context) (Stream, error) {
+	select {
+	case s := <-c.incoming:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.name) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.peer.name) }
+
+// testHandler attaches any fid and blocks reads until their context is
+// done, reporting the cancellation on canceled.
+func testHandler(canceled chan<- error) p9p.Handler {
+	return p9p.HandlerFunc(func(ctx context.Context, msg p9p.Message) (p9p.Message, error) {
+		switch msg.(type) {
+		case p9p.MessageTattach:
+			return p9p.MessageRattach{Qid: p9p.Qid{Type: p9p.QTDIR}}, nil
+		case p9p.MessageTread:
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return nil, ctx.Err()
+		}
+
+		return nil, p9p.ErrUnknownMsg
+	})
+}
+
+func TestSingleStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := newPipeConns()
+	go ServeConn(ctx, sconn, testHandler(nil))
+
+	session, err := NewSession(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Attach(ctx, 1, p9p.NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != p9p.ErrUnknownMsg {
+		t.Fatalf("expected ErrUnknownMsg: %v", err)
+	}
+}
+
+func TestStreamSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := newPipeConns()
+	canceled := make(chan error, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeStreams(ctx, sconn, testHandler(canceled))
+	}()
+
+	session, err := NewStreamSession(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msize, version := session.Version(); msize != p9p.DefaultMSize || version != p9p.DefaultVersion {
+		t.Fatalf("unexpected version: %v %v", msize, version)
+	}
+
+	if _, err := session.Attach(ctx, 1, p9p.NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != p9p.ErrUnknownMsg {
+		t.Fatalf("expected ErrUnknownMsg: %v", err)
+	}
+
+	// canceling a request aborts its stream, canceling the handler.
+	rctx, rcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer rcancel()
+	if _, err := session.Read(rctx, 1, make([]byte, 8), 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded: %v", err)
+	}
+
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("unexpected handler error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler not canceled")
+	}
+
+	cancel()
+	if err := <-served; err != context.Canceled {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+}
+
+// TestStreamSessionSlow ensures that a request outlasting the read timeout
+// of the channel is awaited on a stream supporting deadlines, as long as
+// its context has none.
+func TestStreamSessionSlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := newPipeConns()
+	cconn.deadlines = true
+	go ServeStreams(ctx, sconn, p9p.HandlerFunc(func(ctx context.Context, msg p9p.Message) (p9p.Message, error) {
+		switch msg.(type) {
+		case p9p.MessageTread:
+			time.Sleep(1500 * time.Millisecond)
+			return p9p.MessageRread{Data: []byte("slow")}, nil
+		}
+
+		return nil, p9p.ErrUnknownMsg
+	}))
+
+	session, err := NewStreamSession(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 8)
+	n, err := session.Read(ctx, 1, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p[:n]) != "slow" {
+		t.Fatalf("unexpected data: %q", p[:n])
+	}
+}
+
+// TestStreamSessionOptions ensures that the msize and versions offered come
+// from the options.
+func TestStreamSessionOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := newPipeConns()
+	go ServeStreams(ctx, sconn, testHandler(nil))
+
+	session, err := NewStreamSession(ctx, cconn, p9p.WithMSize(8192), p9p.WithVersion(p9p.Version9P2000L, p9p.DefaultVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msize, version := session.Version(); msize != 8192 || version != p9p.DefaultVersion {
+		t.Fatalf("unexpected version: %v %v", msize, version)
+	}
+
+	if _, err := NewStreamSession(ctx, cconn, p9p.WithVersion(p9p.Version9P2000L)); err == nil {
+		t.Fatal("expected negotiation to fail without a version of the server")
+	}
+}
+
+// TestStreamSessionRlerror ensures that an Rlerror is returned as an error.
+func TestStreamSessionRlerror(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := newPipeConns()
+	go func() {
+		for {
+			stream, err := sconn.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+
+			ch := p9p.NewChannel(streamConn{Stream: stream, conn: sconn}, p9p.DefaultMSize)
+			req := new(p9p.Fcall)
+			if err := ch.ReadFcall(ctx, req); err != nil {
+				return
+			}
+
+			var resp p9p.Message = p9p.MessageRlerror{Ecode: 2}
+			if mv, ok := req.Message.(p9p.MessageTversion); ok {
+				resp = p9p.MessageRversion{MSize: mv.MSize, Version: mv.Version}
+			}
+
+			ch.WriteFcall(ctx, &p9p.Fcall{Type: resp.Type(), Tag: req.Tag, Message: resp})
+			stream.Close()
+		}
+	}()
+
+	session, err := NewStreamSession(ctx, cconn, p9p.WithVersion(p9p.Version9P2000L))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p9p.ReadLink(ctx, session, 1); err != (p9p.MessageRlerror{Ecode: 2}) {
+		t.Fatalf("expected Rlerror: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package p9pquic
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+// NewStreamSession negotiates the protocol version on conn and returns a
+// session sending each request on a stream of its own, in stream per request
+// mode. The context ctx and options are used as with
+// p9p.NewRoundTripperSession, and the msize and versions offered are
+// configured as with p9p.NewSession. Closing the session leaves conn open.
+func NewStreamSession(ctx context.Context, conn Conn, opts ...p9p.SessionOption) (p9p.Session, error) {
+	// the Tversion and its response are small enough for any msize.
+	rt := &streamRoundTripper{conn: conn, msize: p9p.DefaultMSize}
+
+	msize, version, err := p9p.NegotiateRoundTripper(ctx, rt, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rt.msize = msize
+
+	return p9p.NewRoundTripperSession(ctx, rt, msize, version, opts...), nil
+}
+
+// streamRoundTripper sends each request on a new stream of conn. As every
+// stream carries a single request, tags are never reused concurrently and
+// all requests go out with tag 0.
+type streamRoundTripper struct {
+	conn  Conn
+	msize int // fixed once negotiated
+}
+
+func (rt *streamRoundTripper) RoundTrip(ctx context.Context, msg p9p.Message) (p9p.Message, error) {
+	stream, err := rt.conn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// abandons the request on the server, in place of a flush.
+			stream.Abort()
+		case <-done:
+		}
+	}()
+
+	ch := p9p.NewChannel(streamConn{Stream: stream, conn: rt.conn}, rt.msize)
+	req := p9p.Fcall{Type: msg.Type(), Message: msg}
+	if req.Type == p9p.Tversion {
+		req.Tag = p9p.NOTAG
+	}
+
+	if err := rt.exchange(ctx, stream, ch, &req); err != nil {
+		stream.Abort()
+		return nil, err
+	}
+
+	switch msg := req.Message.(type) {
+	case p9p.MessageRerror:
+		return nil, msg
+	case p9p.MessageRlerror:
+		return nil, msg
+	}
+
+	return req.Message, nil
+}
+
+// exchange writes fcall on ch and reads the response over it. The sending
+// side of stream is only closed once the response is in, so that the server
+// can tell an aborted request from a completed one.
+func (rt *streamRoundTripper) exchange(ctx context.Context, stream Stream, ch p9p.Channel, fcall *p9p.Fcall) error {
+	if err := ch.WriteFcall(ctx, fcall); err != nil {
+		return rt.ctxErr(ctx, err)
+	}
+
+	for {
+		err := ch.ReadFcall(ctx, fcall)
+		if err == nil {
+			break
+		}
+
+		if !retryable(err) || ctx.Err() != nil {
+			return rt.ctxErr(ctx, err)
+		}
+
+		// without a deadline on ctx, reads of the channel time out after
+		// a while. The response is awaited until ctx is done, and the
+		// channel resumes the frame if part of it was read.
+	}
+
+	return stream.Close()
+}
+
+// retryable reports whether err is a timeout of the channel after which the
+// read can be retried, as for the transports of the p9p package.
+func retryable(err error) bool {
+	if perr, ok := err.(p9p.PartialReadError); ok {
+		err = perr.Err
+	}
+
+	nerr, ok := err.(net.Error)
+	return ok && (nerr.Timeout() || nerr.Temporary())
+}
+
+// ctxErr reports the context error in place of err once ctx is done, since
+// the stream was then aborted on its account.
+func (rt *streamRoundTripper) ctxErr(ctx context.Context, err error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return err
+	}
+}
+
+// ServeStreams serves handler over conn in stream per request mode, reading
+// a request from each stream the peer opens and answering it on the same
+// stream. The context passed to handler is canceled if the peer aborts the
+// stream. ServeStreams returns once accepting a stream fails, such as when
+// ctx is done or conn is closed.
+func ServeStreams(ctx context.Context, conn Conn, handler p9p.Handler) error {
+	s := &streamServer{conn: conn, handler: handler, msize: p9p.DefaultMSize}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, stream)
+		}()
+	}
+}
+
+type streamServer struct {
+	conn    Conn
+	handler p9p.Handler
+
+	mu    sync.Mutex
+	msize int
+}
+
+func (s *streamServer) serve(ctx context.Context, stream Stream) {
+	if err := s.answer(ctx, stream); err != nil {
+		stream.Abort()
+		return
+	}
+
+	stream.Close()
+}
+
+// answer reads the request on stream and writes the response.
+func (s *streamServer) answer(ctx context.Context, stream Stream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	ch := p9p.NewChannel(streamConn{Stream: stream, conn: s.conn}, s.msize)
+	s.mu.Unlock()
+
+	req := new(p9p.Fcall)
+	if err := ch.ReadFcall(ctx, req); err != nil {
+		return err
+	}
+
+	// The client sends nothing after its request and closes the stream
+	// once it has the response, so anything other than io.EOF means that
+	// the stream was aborted.
+	go func() {
+		var p [1]byte
+		if _, err := stream.Read(p[:]); err != io.EOF {
+			cancel()
+		}
+	}()
+
+	var resp p9p.Message
+	if mv, ok := req.Message.(p9p.MessageTversion); ok {
+		resp = s.version(mv)
+	} else {
+		msg, err := s.handler.Handle(ctx, req.Message)
+		if err != nil {
+			rerr, ok := err.(p9p.MessageRerror)
+			if !ok {
+				rerr = p9p.MessageRerror{Ename: err.Error()}
+			}
+			msg = rerr
+		}
+		resp = msg
+	}
+
+	return ch.WriteFcall(ctx, &p9p.Fcall{Type: resp.Type(), Tag: req.Tag, Message: resp})
+}
+
+// version answers mv and adopts the negotiated msize for later streams.
+func (s *streamServer) version(mv p9p.MessageTversion) p9p.MessageRversion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if int(mv.MSize) < s.msize {
+		s.msize = int(mv.MSize)
+	}
+
+	resp := p9p.MessageRversion{MSize: uint32(s.msize), Version: p9p.DefaultVersion}
+	if !strings.HasPrefix(mv.Version, p9p.DefaultVersion) {
+		resp.Version = "unknown"
+	}
+
+	return resp
+}
@@ -0,0 +1,115 @@
+// Package p9pws carries 9p sessions over WebSocket connections, so that they
+// can traverse HTTP infrastructure and be served to browser clients.
+//
+// Each fcall is sent as one binary WebSocket message, holding the 9p frame
+// as it would be sent over a stream connection, size prefix included.
+package p9pws
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// NewChannel returns a p9p.Channel framing fcalls as binary messages on ws,
+// with messages limited to msize. The channel implements io.Closer, closing
+// ws.
+func NewChannel(ws *websocket.Conn, msize int) p9p.Channel {
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = msize
+
+	return &channel{
+		ws:    ws,
+		codec: p9p.NewCodec(),
+		msize: msize,
+	}
+}
+
+// channel frames fcalls over a WebSocket connection. Reads and writes may be
+// carried out concurrently, but SetMSize must not be called concurrently
+// with either.
+type channel struct {
+	ws    *websocket.Conn
+	codec p9p.Codec
+	msize int
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (ch *channel) ReadFcall(ctx context.Context, fcall *p9p.Fcall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	// there is no way to resume a message after a timeout, so reads only
+	// time out if ctx has a deadline.
+	deadline, _ := ctx.Deadline()
+	ch.ws.SetReadDeadline(deadline)
+
+	var p []byte
+	if err := websocket.Message.Receive(ch.ws, &p); err != nil {
+		return err
+	}
+
+	if len(p) < 4 {
+		return fmt.Errorf("p9pws: short message: %v bytes", len(p))
+	}
+
+	if size := binary.LittleEndian.Uint32(p[:4]); int(size) != len(p) {
+		return fmt.Errorf("p9pws: message of %v bytes holds a frame of %v bytes", len(p), size)
+	}
+
+	*fcall = p9p.Fcall{}
+	return ch.codec.Unmarshal(p[4:], fcall)
+}
+
+func (ch *channel) WriteFcall(ctx context.Context, fcall *p9p.Fcall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	p, err := ch.codec.Marshal(fcall)
+	if err != nil {
+		return err
+	}
+
+	if len(p)+4 > ch.msize {
+		return p9p.MessageTooLargeError{Type: fcall.Type, Tag: fcall.Tag, Size: len(p) + 4, MSize: ch.msize}
+	}
+
+	frame := make([]byte, 4, len(p)+4)
+	binary.LittleEndian.PutUint32(frame, uint32(len(p)+4))
+	frame = append(frame, p...)
+
+	deadline, _ := ctx.Deadline()
+	ch.ws.SetWriteDeadline(deadline)
+
+	return websocket.Message.Send(ch.ws, frame)
+}
+
+func (ch *channel) MSize() int {
+	return ch.msize
+}
+
+func (ch *channel) SetMSize(msize int) {
+	ch.msize = msize
+	ch.ws.MaxPayloadBytes = msize
+}
+
+// Close closes the WebSocket connection. Once closed, reads and writes fail.
+func (ch *channel) Close() error {
+	ch.closeOnce.Do(func() {
+		ch.closeErr = ch.ws.Close()
+	})
+
+	return ch.closeErr
+}
@@ -0,0 +1,52 @@
+package p9pws
+
+import (
+	"net/http"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// Dial connects to the WebSocket endpoint at url, sending origin as the
+// origin of the connection, and returns a session over it. The context ctx
+// and options are used as with p9p.NewChannelSession. Closing the session
+// closes the WebSocket connection.
+func Dial(ctx context.Context, url, origin string, opts ...p9p.SessionOption) (p9p.Session, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	return DialConfig(ctx, config, opts...)
+}
+
+// DialConfig connects to the WebSocket endpoint described by config and
+// returns a session over it, as with Dial.
+func DialConfig(ctx context.Context, config *websocket.Config, opts ...p9p.SessionOption) (p9p.Session, error) {
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := p9p.NewChannelSession(ctx, NewChannel(ws, p9p.DefaultMSize), opts...)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Handler returns an http.Handler serving handler over each WebSocket
+// connection made to it, with options used as with p9p.ServeChannel. Serving
+// stops when the request context is done or the connection fails. As with
+// websocket.Handler, requests must carry a valid Origin header.
+func Handler(handler p9p.Handler, opts ...p9p.ServerOption) http.Handler {
+	return websocket.Handler(func(ws *websocket.Conn) {
+		ch := NewChannel(ws, p9p.DefaultMSize)
+		defer ch.(*channel).Close()
+
+		p9p.ServeChannel(ws.Request().Context(), ch, handler, opts...)
+	})
+}
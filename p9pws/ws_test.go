@@ -0,0 +1,63 @@
+package p9pws
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-p9p"
+	"golang.org/x/net/context"
+)
+
+// TestSession attaches and reads over a WebSocket connection to Handler.
+func TestSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := bytes.Repeat([]byte("9p over websocket "), 1000)
+	server := httptest.NewServer(Handler(p9p.HandlerFunc(func(ctx context.Context, msg p9p.Message) (p9p.Message, error) {
+		switch msg := msg.(type) {
+		case p9p.MessageTattach:
+			return p9p.MessageRattach{Qid: p9p.Qid{Type: p9p.QTDIR}}, nil
+		case p9p.MessageTread:
+			if msg.Offset >= uint64(len(data)) {
+				return p9p.MessageRread{}, nil
+			}
+			p := data[msg.Offset:]
+			if len(p) > int(msg.Count) {
+				p = p[:msg.Count]
+			}
+			return p9p.MessageRread{Data: p}, nil
+		}
+
+		return nil, p9p.ErrUnknownMsg
+	})))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	session, err := Dial(ctx, url, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, p9p.NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, len(data))
+	n, err := session.Read(ctx, 1, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p[:n], data) {
+		t.Fatalf("unexpected data: %d bytes", n)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != p9p.ErrUnknownMsg {
+		t.Fatalf("expected ErrUnknownMsg: %v", err)
+	}
+}
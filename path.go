@@ -0,0 +1,288 @@
+package p9p
+
+import (
+	"fmt"
+	pathpkg "path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// PathError records an error and the operation and path that caused it,
+// much like os.PathError. Op identifies the step that failed, such as "walk"
+// or "remove", so callers can tell a missing file from a refused operation.
+type PathError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// maxWalkNames is the number of names a single Twalk may carry, MAXWELEM in
+// walk(5).
+const maxWalkNames = 16
+
+// WalkPath walks newfid to path, relative to fid, as with Session.Walk but
+// without the limit of 16 names per walk. Longer paths are walked 16 names
+// at a time, the first walk establishing newfid and later ones moving it in
+// place, so no other fids are used.
+//
+// As with a single walk, the qids of the names walked are returned and
+// newfid is only established if all of them are. If a later walk comes up
+// short, newfid is clunked and the partial result is returned without an
+// error. A path of more than 16 names cannot be walked in place, with newfid
+// equal to fid, since fid would be lost on a partial walk; ErrWalkLimit is
+// returned instead.
+func WalkPath(ctx context.Context, session Session, fid, newfid Fid, path string) ([]Qid, error) {
+	return walkNames(ctx, session, fid, newfid, splitpath(path))
+}
+
+// walkNames walks newfid to names from fid, as WalkPath does.
+func walkNames(ctx context.Context, session Session, fid, newfid Fid, names []string) ([]Qid, error) {
+	if len(names) <= maxWalkNames {
+		return session.Walk(ctx, fid, newfid, names...)
+	}
+
+	if newfid == fid {
+		return nil, ErrWalkLimit
+	}
+
+	var qids []Qid
+	for from := fid; len(qids) < len(names); from = newfid {
+		chunk := names[len(qids):]
+		if len(chunk) > maxWalkNames {
+			chunk = chunk[:maxWalkNames]
+		}
+
+		walked, err := session.Walk(ctx, from, newfid, chunk...)
+		qids = append(qids, walked...)
+		if err == nil && len(walked) == len(chunk) {
+			continue
+		}
+
+		if from == fid {
+			// nothing is established yet, as with a single walk.
+			return qids, err
+		}
+
+		// newfid is left at an intermediate directory.
+		if ctx.Err() != nil {
+			go session.Clunk(context.Background(), newfid)
+		} else {
+			session.Clunk(ctx, newfid)
+		}
+
+		if _, ok := err.(MessageRerror); err != nil && !ok {
+			return nil, err
+		}
+
+		// an error walking the first name of a later walk is a partial
+		// walk of the path.
+		return qids, nil
+	}
+
+	return qids, nil
+}
+
+// RemovePath removes the file or empty directory at path, relative to root.
+// The path is walked into a fresh fid from the session's pool, which is
+// consumed by the remove. The root fid is left untouched.
+//
+// A path naming root itself, such as "", "/", "." or "dir/..", is refused
+// with a *PathError with Op "remove" and ErrNoremove, rather than removing
+// the root of the attach. If the path cannot be walked, a *PathError with
+// Op "walk" is returned. If the server refuses the remove, such as for a
+// permission error or a non-empty directory, a *PathError with Op "remove"
+// is returned.
+func RemovePath(ctx context.Context, session Session, root Fid, path string) error {
+	if isRootPath(path) {
+		return &PathError{Op: "remove", Path: path, Err: ErrNoremove}
+	}
+
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return err
+	}
+
+	fid, err := fids.get()
+	if err != nil {
+		return err
+	}
+
+	names := splitpath(path)
+	qids, err := walkNames(ctx, session, root, fid, names)
+	if err != nil {
+		// the new fid is not established on a failed walk.
+		fids.put(fid)
+		return &PathError{Op: "walk", Path: path, Err: err}
+	}
+
+	if len(qids) != len(names) {
+		// partial walk, also leaves the new fid unestablished.
+		fids.put(fid)
+		return &PathError{Op: "walk", Path: path, Err: ErrNotfound}
+	}
+
+	// remove clunks the fid, even if it fails.
+	if err := session.Remove(ctx, fid); err != nil {
+		return &PathError{Op: "remove", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// RemoveAll removes path, relative to root, and any children it contains,
+// like os.RemoveAll. It removes everything it can, returning a
+// *RemoveAllError describing each file that could not be removed. If path
+// does not exist, RemoveAll returns nil. As with RemovePath, a path naming
+// root itself is refused with ErrNoremove.
+//
+// Directories are removed depth first. At most two fids from the session's
+// pool are used for each level of the tree, all of which are clunked or
+// consumed by the time RemoveAll returns. The root fid is left untouched.
+func RemoveAll(ctx context.Context, session Session, root Fid, path string) error {
+	if isRootPath(path) {
+		return &PathError{Op: "remove", Path: path, Err: ErrNoremove}
+	}
+
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return err
+	}
+
+	fid, err := fids.get()
+	if err != nil {
+		return err
+	}
+
+	names := splitpath(path)
+	qids, err := walkNames(ctx, session, root, fid, names)
+	if err != nil || len(qids) != len(names) {
+		fids.put(fid)
+		if err == nil || IsNotExist(err) {
+			return nil // nothing to remove.
+		}
+
+		return &PathError{Op: "walk", Path: path, Err: err}
+	}
+
+	var rerr RemoveAllError
+	removeAll(ctx, session, fids, fid, qids[len(qids)-1], path, &rerr)
+	if len(rerr.Errs) > 0 {
+		return &rerr
+	}
+
+	return nil
+}
+
+// RemoveAllError is returned by RemoveAll when some files could not be
+// removed. Each error is a *PathError naming the file.
+type RemoveAllError struct {
+	Errs []error
+}
+
+func (e *RemoveAllError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+
+	return fmt.Sprintf("%v (and %d more errors)", e.Errs[0], len(e.Errs)-1)
+}
+
+// removeAll removes the children of fid, if it is a directory, then fid
+// itself. The fid is consumed either way.
+func removeAll(ctx context.Context, session Session, fids *fidPool, fid Fid, qid Qid, path string, rerr *RemoveAllError) {
+	fail := func(op, path string, err error) {
+		rerr.Errs = append(rerr.Errs, &PathError{Op: op, Path: path, Err: err})
+	}
+
+	if qid.Type&QTDIR != 0 {
+		dirs, err := readdirClone(ctx, session, fids, fid)
+		if err != nil {
+			fail("readdir", path, err)
+			session.Clunk(ctx, fid)
+			return
+		}
+
+		nerrs := len(rerr.Errs)
+		for _, d := range dirs {
+			if d.Name == "." || d.Name == ".." {
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				fail("remove", path, err)
+				break
+			}
+
+			child := pathpkg.Join(path, d.Name)
+			childfid, err := fids.get()
+			if err != nil {
+				fail("walk", child, err)
+				continue
+			}
+
+			if _, err := session.Walk(ctx, fid, childfid, d.Name); err != nil {
+				fids.put(childfid)
+				fail("walk", child, err)
+				continue
+			}
+
+			removeAll(ctx, session, fids, childfid, d.Qid, child, rerr)
+		}
+
+		if len(rerr.Errs) > nerrs {
+			// the directory is not empty, so removing it would fail.
+			session.Clunk(ctx, fid)
+			return
+		}
+	}
+
+	if err := session.Remove(ctx, fid); err != nil {
+		fail("remove", path, err)
+	}
+}
+
+// readdirClone reads the entries of the directory fid through a clone, since
+// fid must remain unopened to walk to the entries.
+func readdirClone(ctx context.Context, session Session, fids *fidPool, fid Fid) ([]Dir, error) {
+	clone, err := fids.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := session.Walk(ctx, fid, clone); err != nil {
+		fids.put(clone)
+		return nil, err
+	}
+	defer session.Clunk(ctx, clone)
+
+	if _, _, err := session.Open(ctx, clone, OREAD); err != nil {
+		return nil, err
+	}
+
+	return ReaddirAll(ctx, session, clone)
+}
+
+// isRootPath reports whether p resolves to no names, naming the fid it is
+// relative to.
+func isRootPath(p string) bool {
+	return len(splitpath(pathpkg.Clean("/"+p))) == 0
+}
+
+// splitpath breaks p into walk names, dropping empty and "." elements.
+func splitpath(p string) []string {
+	var names []string
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,488 @@
+package p9p
+
+import (
+	"fmt"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRemovePath(t *testing.T) {
+	var removed []Fid
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTwalk:
+			switch strings.Join(msg.Wnames, "/") {
+			case "missing":
+				return nil, ErrNotfound
+			case "dir/missing":
+				return MessageRwalk{Qids: []Qid{{Type: QTDIR}}}, nil
+			}
+
+			return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+		case MessageTremove:
+			removed = append(removed, msg.Fid)
+			if msg.Fid != 2 {
+				return nil, ErrPerm
+			}
+
+			return MessageRremove{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemovePath(ctx, session, 1, "dir/file"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, testcase := range []struct {
+		path string
+		op   string
+		err  error
+	}{
+		{path: "missing", op: "walk", err: ErrNotfound},
+		{path: "dir/missing", op: "walk", err: ErrNotfound},
+		{path: "dir/locked", op: "remove", err: ErrPerm},
+		{path: "", op: "remove", err: ErrNoremove},
+		{path: "/", op: "remove", err: ErrNoremove},
+		{path: ".", op: "remove", err: ErrNoremove},
+		{path: "dir/..", op: "remove", err: ErrNoremove},
+	} {
+		err := RemovePath(ctx, session, 1, testcase.path)
+		perr, ok := err.(*PathError)
+		if !ok {
+			t.Fatalf("%v: expected path error: %v", testcase.path, err)
+		}
+
+		if perr.Op != testcase.op || perr.Path != testcase.path || perr.Err != testcase.err {
+			t.Fatalf("%v: unexpected error: %#v", testcase.path, perr)
+		}
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("unexpected removes: %v", removed)
+	}
+
+	// only the root should remain in use.
+	fids := session.(*client).fids
+	if len(fids.inuse) != 1 {
+		t.Fatalf("fids leaked: %v", fids.inuse)
+	}
+}
+
+// TestWalkPath walks paths longer than a single walk allows, ensuring that
+// partial walks are reported as such and leave no fids behind.
+func TestWalkPath(t *testing.T) {
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("d%d", i))
+	}
+	deep := strings.Join(names, "/")
+
+	tree := newMemTree(deep)
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	qids, err := WalkPath(ctx, session, 1, 2, deep)
+	if err != nil || len(qids) != len(names) {
+		t.Fatalf("unexpected walk of %v names: %v", len(qids), err)
+	}
+
+	if p := tree.fids[2]; p != deep {
+		t.Fatalf("walked to unexpected path: %v", p)
+	}
+
+	if err := session.Clunk(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, missing := range []int{3, 16, 19, 35} {
+		// the path continues well past the missing name.
+		path := strings.Join(append(names[:missing:missing], "missing"), "/") + "/" + deep
+		qids, err := WalkPath(ctx, session, 1, 2, path)
+		if err != nil || len(qids) != missing {
+			t.Fatalf("%v: unexpected walk of %v names: %v", missing, len(qids), err)
+		}
+
+		if _, ok := tree.fids[2]; ok {
+			t.Fatalf("%v: newfid left established after partial walk", missing)
+		}
+	}
+
+	if _, err := WalkPath(ctx, session, 1, 1, deep); err != ErrWalkLimit {
+		t.Fatalf("expected ErrWalkLimit walking in place: %v", err)
+	}
+
+	// only the root should remain in use.
+	if len(tree.fids) != 1 {
+		t.Fatalf("fids leaked: %v", tree.fids)
+	}
+}
+
+// memTree is a minimal in-memory file tree served over 9p, for testing
+// helpers that traverse directories.
+type memTree struct {
+	mu      sync.Mutex
+	files   map[string]bool // path to whether it is a directory
+	locked  map[string]bool // paths that refuse removal
+	data    map[string][]byte
+	modes   map[string]uint32    // by path, as created or set by wstat
+	mtimes  map[string]time.Time // by path, as set by wstat
+	fids    map[Fid]string
+	maxfids int
+	codec   Codec
+}
+
+func newMemTree(paths ...string) *memTree {
+	tree := &memTree{
+		files:  map[string]bool{"": true},
+		locked: map[string]bool{},
+		data:   map[string][]byte{},
+		modes:  map[string]uint32{},
+		mtimes: map[string]time.Time{},
+		fids:   map[Fid]string{},
+		codec:  NewCodec(),
+	}
+
+	for _, p := range paths {
+		dir := strings.HasSuffix(p, "/")
+		p = strings.Trim(p, "/")
+		tree.files[p] = dir
+		for parent := pathpkg.Dir(p); parent != "."; parent = pathpkg.Dir(parent) {
+			tree.files[parent] = true
+		}
+	}
+
+	return tree
+}
+
+func (tree *memTree) qid(p string) Qid {
+	if tree.files[p] {
+		return Qid{Type: QTDIR, Path: uint64(len(p))}
+	}
+
+	return Qid{Path: uint64(len(p))}
+}
+
+func (tree *memTree) list(dir string) []Dir {
+	var dirs []Dir
+	for p := range tree.files {
+		parent := pathpkg.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+
+		if p != "" && parent == dir {
+			dirs = append(dirs, Dir{Name: pathpkg.Base(p), Qid: tree.qid(p), Length: uint64(len(tree.data[p]))})
+		}
+	}
+
+	return dirs
+}
+
+// rename moves the file at p, and everything below it, to np.
+func (tree *memTree) rename(p, np string) {
+	for q, dir := range tree.files {
+		if q != p && !strings.HasPrefix(q, p+"/") {
+			continue
+		}
+
+		nq := np + strings.TrimPrefix(q, p)
+		tree.files[nq] = dir
+		tree.data[nq], tree.modes[nq], tree.mtimes[nq] = tree.data[q], tree.modes[q], tree.mtimes[q]
+		delete(tree.files, q)
+		delete(tree.data, q)
+		delete(tree.modes, q)
+		delete(tree.mtimes, q)
+	}
+
+	for fid, q := range tree.fids {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			tree.fids[fid] = np + strings.TrimPrefix(q, p)
+		}
+	}
+}
+
+func (tree *memTree) Handle(ctx context.Context, msg Message) (Message, error) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	defer func() {
+		if len(tree.fids) > tree.maxfids {
+			tree.maxfids = len(tree.fids)
+		}
+	}()
+
+	switch msg := msg.(type) {
+	case MessageTattach:
+		tree.fids[msg.Fid] = ""
+		return MessageRattach{Qid: tree.qid("")}, nil
+	case MessageTwalk:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		var qids []Qid
+		for _, name := range msg.Wnames {
+			p = strings.TrimPrefix(pathpkg.Join(p, name), "/")
+			if _, ok := tree.files[p]; !ok {
+				if len(qids) == 0 {
+					return nil, ErrNotfound
+				}
+
+				return MessageRwalk{Qids: qids}, nil
+			}
+
+			qids = append(qids, tree.qid(p))
+		}
+
+		tree.fids[msg.Newfid] = p
+		return MessageRwalk{Qids: qids}, nil
+	case MessageTstat:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		return MessageRstat{Stat: Dir{
+			Name:    pathpkg.Base(p),
+			Qid:     tree.qid(p),
+			Mode:    tree.modes[p],
+			ModTime: tree.mtimes[p],
+			Length:  uint64(len(tree.data[p])),
+		}}, nil
+	case MessageTwstat:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		if msg.Stat.Length != syncDir.Length && !tree.files[p] {
+			data := make([]byte, msg.Stat.Length)
+			copy(data, tree.data[p])
+			tree.data[p] = data
+		}
+
+		if msg.Stat.Name != "" {
+			np := strings.TrimPrefix(pathpkg.Join(pathpkg.Dir("/"+p), msg.Stat.Name), "/")
+			if _, ok := tree.files[np]; ok {
+				return nil, ErrExist
+			}
+
+			tree.rename(p, np)
+			p = np
+		}
+
+		if msg.Stat.Mode != syncDir.Mode {
+			tree.modes[p] = msg.Stat.Mode
+		}
+
+		if !msg.Stat.ModTime.Equal(syncDir.ModTime) {
+			tree.mtimes[p] = msg.Stat.ModTime
+		}
+
+		return MessageRwstat{}, nil
+	case MessageTopen:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		if msg.Mode&OTRUNC != 0 {
+			delete(tree.data, p)
+		}
+
+		return MessageRopen{Qid: tree.qid(p)}, nil
+	case MessageTcreate:
+		dir, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		p := strings.TrimPrefix(pathpkg.Join(dir, msg.Name), "/")
+		if _, ok := tree.files[p]; ok {
+			return nil, ErrExist
+		}
+
+		tree.files[p] = msg.Perm&DMDIR != 0
+		tree.modes[p] = msg.Perm
+		tree.fids[msg.Fid] = p
+		return MessageRcreate{Qid: tree.qid(p)}, nil
+	case MessageTwrite:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		data := tree.data[p]
+		if end := int(msg.Offset) + len(msg.Data); end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[msg.Offset:], msg.Data)
+		tree.data[p] = data
+
+		return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+	case MessageTread:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+
+		if !tree.files[p] {
+			data := tree.data[p]
+			if msg.Offset >= uint64(len(data)) {
+				return MessageRread{}, nil
+			}
+
+			data = data[msg.Offset:]
+			if len(data) > int(msg.Count) {
+				data = data[:msg.Count]
+			}
+
+			return MessageRread{Data: data}, nil
+		}
+
+		var data []byte
+		for _, d := range tree.list(p) {
+			dp, err := tree.codec.Marshal(d)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, dp...)
+		}
+
+		if msg.Offset >= uint64(len(data)) {
+			return MessageRread{}, nil
+		}
+
+		data = data[msg.Offset:]
+		if len(data) > int(msg.Count) {
+			return nil, ErrBadcount // entries must fit in one read
+		}
+
+		return MessageRread{Data: data}, nil
+	case MessageTclunk:
+		if _, ok := tree.fids[msg.Fid]; !ok {
+			return nil, ErrUnknownfid
+		}
+
+		delete(tree.fids, msg.Fid)
+		return MessageRclunk{}, nil
+	case MessageTremove:
+		p, ok := tree.fids[msg.Fid]
+		if !ok {
+			return nil, ErrUnknownfid
+		}
+		delete(tree.fids, msg.Fid)
+
+		if tree.locked[p] {
+			return nil, ErrPerm
+		}
+
+		if len(tree.list(p)) > 0 {
+			return nil, MessageRerror{Ename: "directory not empty"}
+		}
+
+		delete(tree.files, p)
+		return MessageRremove{}, nil
+	}
+
+	return nil, ErrUnknownMsg
+}
+
+func TestRemoveAll(t *testing.T) {
+	tree := newMemTree(
+		"a/b/c/d/e/file",
+		"a/b/c/other",
+		"a/b/empty/",
+		"a/b/file",
+		"a/locked/file",
+		"a/x",
+		"keep",
+	)
+	tree.locked["a/locked/file"] = true
+
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveAll(ctx, session, 1, "a/b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for p := range tree.files {
+		if strings.HasPrefix(p, "a/b") {
+			t.Fatalf("%v not removed", p)
+		}
+	}
+
+	// the deepest path is 6 levels below the root.
+	if tree.maxfids > 1+2*6 {
+		t.Fatalf("too many fids in use at once: %v", tree.maxfids)
+	}
+
+	err := RemoveAll(ctx, session, 1, "a")
+	rerr, ok := err.(*RemoveAllError)
+	if !ok {
+		t.Fatalf("expected remove all error: %v", err)
+	}
+
+	if len(rerr.Errs) != 1 {
+		t.Fatalf("unexpected errors: %v", rerr.Errs)
+	}
+
+	if perr := rerr.Errs[0].(*PathError); perr.Op != "remove" || perr.Path != "a/locked/file" || perr.Err != ErrPerm {
+		t.Fatalf("unexpected error: %#v", perr)
+	}
+
+	for p, expected := range map[string]bool{"a": true, "a/locked": true, "a/locked/file": true, "a/x": false, "keep": true} {
+		if _, ok := tree.files[p]; ok != expected {
+			t.Fatalf("%v: exists %v, expected %v", p, ok, expected)
+		}
+	}
+
+	if err := RemoveAll(ctx, session, 1, "missing/path"); err != nil {
+		t.Fatalf("unexpected error removing missing path: %v", err)
+	}
+
+	for _, path := range []string{"", "/", ".", "a/.."} {
+		err := RemoveAll(ctx, session, 1, path)
+		if perr, ok := err.(*PathError); !ok || perr.Op != "remove" || perr.Err != ErrNoremove {
+			t.Fatalf("%q: expected the root refused: %v", path, err)
+		}
+	}
+
+	if _, ok := tree.files["keep"]; !ok {
+		t.Fatalf("root removed")
+	}
+
+	if len(tree.fids) != 1 {
+		t.Fatalf("fids leaked on the server: %v", tree.fids)
+	}
+
+	if fids := OpenFids(session); len(fids) != 1 {
+		t.Fatalf("fids leaked on the client: %v", fids)
+	}
+}
@@ -0,0 +1,103 @@
+package p9p
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Pipe returns a connected pair of in-memory channels, each with an msize of
+// msize. Fcalls written to one end are read from the other, encoded and
+// decoded as they would be on a connection, so that a client and server can
+// be wired together with NewChannelSession and ServeChannel without
+// networking. Like net.Pipe, writes block until the other end reads them.
+//
+// Each end enforces its own msize: a write of a frame larger than the msize
+// of the writer fails, as does a read of a frame larger than the msize of
+// the reader. Both ends implement io.Closer. Once either end is closed,
+// reads and writes on both fail with ErrClosed.
+func Pipe(msize int) (Channel, Channel) {
+	var (
+		ab     = make(chan []byte)
+		ba     = make(chan []byte)
+		closed = make(chan struct{})
+		once   = new(sync.Once)
+	)
+
+	a := &pipeChannel{rd: ba, wr: ab, closed: closed, once: once, msize: msize}
+	b := &pipeChannel{rd: ab, wr: ba, closed: closed, once: once, msize: msize}
+	return a, b
+}
+
+// pipeChannel is one end of a Pipe.
+type pipeChannel struct {
+	rd     <-chan []byte
+	wr     chan<- []byte
+	closed chan struct{} // shared by both ends
+	once   *sync.Once
+	msize  int
+}
+
+var _ io.Closer = &pipeChannel{}
+
+func (pc *pipeChannel) ReadFcall(ctx context.Context, fcall *Fcall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pc.closed:
+		return ErrClosed
+	case p := <-pc.rd:
+		if len(p)+4 > pc.msize {
+			return MessageTooLargeError{
+				Type:  FcallType(p[0]),
+				Tag:   Tag(binary.LittleEndian.Uint16(p[1:3])),
+				Size:  len(p) + 4,
+				MSize: pc.msize,
+			}
+		}
+
+		*fcall = Fcall{}
+		return codec9p{}.Unmarshal(p, fcall)
+	}
+}
+
+func (pc *pipeChannel) WriteFcall(ctx context.Context, fcall *Fcall) error {
+	p, err := codec9p{}.Marshal(fcall)
+	if err != nil {
+		return err
+	}
+
+	if len(p)+4 > pc.msize {
+		return MessageTooLargeError{Type: fcall.Type, Tag: fcall.Tag, Size: len(p) + 4, MSize: pc.msize}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pc.closed:
+		return ErrClosed
+	case pc.wr <- p:
+		return nil
+	}
+}
+
+func (pc *pipeChannel) MSize() int {
+	return pc.msize
+}
+
+func (pc *pipeChannel) SetMSize(msize int) {
+	pc.msize = msize
+}
+
+// Close closes both ends of the pipe.
+func (pc *pipeChannel) Close() error {
+	err := ErrClosed
+	pc.once.Do(func() {
+		close(pc.closed)
+		err = nil
+	})
+
+	return err
+}
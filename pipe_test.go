@@ -0,0 +1,90 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestPipe wires a session to a server over a Pipe and ensures that msize is
+// negotiated and that closing the session stops the server.
+func TestPipe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const msize = 8192
+	cch, sch := Pipe(msize)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeChannel(ctx, sch, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			switch msg := msg.(type) {
+			case MessageTattach:
+				return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+			case MessageTwrite:
+				return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}))
+	}()
+
+	session, err := NewChannelSession(ctx, cch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msize, _ := session.Version(); msize != 8192 {
+		t.Fatalf("unexpected msize: %v", msize)
+	}
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := bytes.Repeat([]byte("x"), msize-IOHDRSZ)
+	if n, err := session.Write(ctx, 1, p, 0); err != nil || n != len(p) {
+		t.Fatalf("unexpected write of %v bytes: %v", n, err)
+	}
+
+	if err := session.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; err == nil {
+		t.Fatalf("expected server to stop with an error")
+	}
+
+	if err := sch.WriteFcall(ctx, newFcall(1, MessageRclunk{})); err != ErrClosed {
+		t.Fatalf("expected ErrClosed: %v", err)
+	}
+}
+
+// TestPipeMSize ensures that each end of a Pipe enforces its msize.
+func TestPipeMSize(t *testing.T) {
+	ctx := context.Background()
+	a, b := Pipe(64)
+	defer a.(io.Closer).Close()
+
+	large := newFcall(1, MessageTwrite{Fid: 1, Data: make([]byte, 64)})
+	if err := a.WriteFcall(ctx, large); err == nil {
+		t.Fatalf("expected error writing a frame larger than msize")
+	}
+
+	b.SetMSize(32)
+	errs := make(chan error, 1)
+	go func() {
+		var fcall Fcall
+		errs <- b.ReadFcall(ctx, &fcall)
+	}()
+
+	if err := a.WriteFcall(ctx, newFcall(1, MessageTwrite{Fid: 1, Data: make([]byte, 32)})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err == nil {
+		t.Fatalf("expected error reading a frame larger than msize")
+	}
+}
@@ -0,0 +1,107 @@
+package p9p
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// requestQueue holds the requests waiting to be sent by a transport. Requests
+// are ordered by the priority of their context, then by arrival. The queue is
+// safe for concurrent use.
+type requestQueue struct {
+	mu    sync.Mutex
+	items requestHeap
+	seq   uint64
+	ready chan struct{} // signaled while requests are queued
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues req for sending.
+func (q *requestQueue) push(req *fcallRequest) {
+	q.mu.Lock()
+	req.priority = GetPriority(req.ctx)
+	req.seq = q.seq
+	q.seq++
+	heap.Push(&q.items, req)
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// pop removes the next request to send. If the queue is empty, nil is
+// returned.
+func (q *requestQueue) pop() *fcallRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+
+	req := heap.Pop(&q.items).(*fcallRequest)
+	if len(q.items) > 0 {
+		q.signal()
+	}
+
+	return req
+}
+
+// remove takes req out of the queue. If req has already been popped, false
+// is returned.
+func (q *requestQueue) remove(req *fcallRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if req.index < 0 {
+		return false
+	}
+
+	heap.Remove(&q.items, req.index)
+	return true
+}
+
+func (q *requestQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// requestHeap implements heap.Interface for requestQueue.
+type requestHeap []*fcallRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	req := x.(*fcallRequest)
+	req.index = len(*h)
+	*h = append(*h, req)
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	req.index = -1
+	*h = old[:len(old)-1]
+	return req
+}
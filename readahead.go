@@ -0,0 +1,190 @@
+package p9p
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// ReadAhead reads a file sequentially, keeping up to a window of Treads in
+// flight ahead of the consumer to hide the latency of each round trip. It
+// suits streaming a large file over a slow link, where reading one message at
+// a time leaves the connection idle.
+//
+// Data is read ahead in chunks of the IOUnit of the fid. Since the reads
+// ahead assume the file is read in full chunks, a short read discards them
+// and the reads resume after the data returned, one at a time until a full
+// chunk is read again. Writes to the file while it is read, through any fid,
+// may or may not be seen.
+//
+// A ReadAhead is not safe for concurrent use. It does not own the fid, which
+// the caller must clunk once done, after calling Close.
+type ReadAhead struct {
+	parent  context.Context
+	session Session
+	fid     Fid
+	size    int // data per message
+	window  int
+
+	next    int64 // offset of the next read to issue
+	pending []*readAheadChunk
+	probing bool            // issue one read at a time, after a short read
+	ctx     context.Context // governs the reads in flight
+	cancel  context.CancelFunc
+
+	buf  []byte // buffer of the chunk being consumed
+	data []byte // unread data of the chunk
+	free [][]byte
+	err  error // sticky
+}
+
+type readAheadChunk struct {
+	offset int64
+	buf    []byte
+	n      int
+	err    error
+	done   chan struct{}
+}
+
+var (
+	_ io.Reader = &ReadAhead{}
+	_ io.Closer = &ReadAhead{}
+)
+
+// NewReadAhead returns a ReadAhead for fid, opened for reading on session,
+// starting at offset with up to window reads in flight. Ctx governs every
+// read.
+func NewReadAhead(ctx context.Context, session Session, fid Fid, offset int64, window int) *ReadAhead {
+	if window < 1 {
+		window = 1
+	}
+
+	ra := &ReadAhead{
+		parent:  ctx,
+		session: session,
+		fid:     fid,
+		size:    IOUnit(session, fid),
+		window:  window,
+	}
+	ra.restart(offset)
+
+	return ra
+}
+
+// Read reads up to len(p) bytes from the data read ahead, waiting on the
+// next read if there is none. At the end of the file, it returns io.EOF.
+func (ra *ReadAhead) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for len(ra.data) == 0 {
+		if ra.err != nil {
+			return 0, ra.err
+		}
+
+		ra.recycle()
+		ra.fill()
+
+		c := ra.pending[0]
+		<-c.done
+		ra.pending[0] = nil
+		ra.pending = ra.pending[1:]
+
+		if c.err == io.EOF || (c.err == nil && c.n == 0) {
+			ra.fail(io.EOF)
+			continue
+		}
+
+		if c.err != nil {
+			ra.fail(c.err)
+			continue
+		}
+
+		ra.buf, ra.data = c.buf, c.buf[:c.n]
+		if c.n < len(c.buf) {
+			// the reads ahead skipped the rest of the chunk.
+			ra.restart(c.offset + int64(c.n))
+			ra.probing = true
+		} else {
+			ra.probing = false
+		}
+	}
+
+	n := copy(p, ra.data)
+	ra.data = ra.data[n:]
+	return n, nil
+}
+
+// Close abandons the reads in flight. Later reads fail.
+func (ra *ReadAhead) Close() error {
+	if ra.err == errFileClosed {
+		return errFileClosed
+	}
+
+	ra.fail(errFileClosed)
+	ra.data = nil
+	return nil
+}
+
+// fill issues reads until the window is full.
+func (ra *ReadAhead) fill() {
+	window := ra.window
+	if ra.probing {
+		window = 1
+	}
+
+	ctx := ra.ctx
+	for len(ra.pending) < window {
+		c := &readAheadChunk{
+			offset: ra.next,
+			buf:    ra.alloc(),
+			done:   make(chan struct{}),
+		}
+		ra.next += int64(len(c.buf))
+		ra.pending = append(ra.pending, c)
+
+		go func(ctx context.Context) {
+			defer close(c.done)
+			c.n, c.err = ra.session.Read(ctx, ra.fid, c.buf, c.offset)
+		}(ctx)
+	}
+}
+
+// restart abandons the reads in flight, reading ahead from offset instead.
+func (ra *ReadAhead) restart(offset int64) {
+	if ra.cancel != nil {
+		ra.cancel()
+	}
+
+	// the buffers of abandoned reads are left to them.
+	ra.pending = nil
+	ra.next = offset
+
+	ra.ctx, ra.cancel = context.WithCancel(ra.parent)
+}
+
+// fail makes err sticky and abandons the reads in flight.
+func (ra *ReadAhead) fail(err error) {
+	ra.err = err
+	ra.cancel()
+	ra.pending = nil
+}
+
+// recycle returns the buffer of the consumed chunk for reuse.
+func (ra *ReadAhead) recycle() {
+	if ra.buf != nil {
+		ra.free = append(ra.free, ra.buf)
+		ra.buf = nil
+	}
+}
+
+func (ra *ReadAhead) alloc() []byte {
+	if n := len(ra.free); n > 0 {
+		buf := ra.free[n-1]
+		ra.free = ra.free[:n-1]
+		return buf
+	}
+
+	return make([]byte, ra.size)
+}
@@ -0,0 +1,126 @@
+package p9p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestReadAhead reads a file with reads in flight ahead of the consumer,
+// ensuring that the window is respected and that a short read in the middle
+// of the file doesn't lose data.
+func TestReadAhead(t *testing.T) {
+	const (
+		iounit = 100
+		window = 4
+	)
+	data := bytes.Repeat([]byte("0123456789"), 205)
+	tree := newMemTree("file")
+	tree.data["file"] = data
+
+	var (
+		mu               sync.Mutex
+		inflight, maxinf int
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch m := msg.(type) {
+		case MessageTopen:
+			resp, err := tree.Handle(ctx, msg)
+			if ropen, ok := resp.(MessageRopen); ok {
+				ropen.IOUnit = iounit
+				resp = ropen
+			}
+			return resp, err
+		case MessageTread:
+			mu.Lock()
+			inflight++
+			if inflight > maxinf {
+				maxinf = inflight
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+
+			if m.Offset == 5*iounit {
+				m.Count = iounit / 3 // a short read in the middle of the file.
+				msg = m
+			}
+		}
+
+		return tree.Handle(ctx, msg)
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := session.Open(ctx, 2, OREAD); err != nil {
+		t.Fatal(err)
+	}
+
+	ra := NewReadAhead(ctx, session, 2, 10, window)
+	p, err := ioutil.ReadAll(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, data[10:]) {
+		t.Fatalf("unexpected data: %v bytes, expected %v", len(p), len(data)-10)
+	}
+
+	if err := ra.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ra.Read(make([]byte, 1)); err != errFileClosed {
+		t.Fatalf("expected error after close: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxinf < 2 || maxinf > window {
+		t.Fatalf("unexpected reads in flight: %v", maxinf)
+	}
+}
+
+// TestPipelinedRequests sends many requests at once over a synchronous pipe,
+// ensuring that the client keeps reading responses while writing requests.
+func TestPipelinedRequests(t *testing.T) {
+	tree := newMemTree("file")
+	session, cleanup := newTestSession(t, tree)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	fids := make([]Fid, n)
+	errs := Batch(ctx, n, func(ctx context.Context, i int) error {
+		fids[i] = Fid(100 + i)
+		_, err := session.Walk(ctx, 1, fids[i], "file")
+		return err
+	})
+	errs = append(errs, ClunkAll(ctx, session, fids)...)
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,14 +1,193 @@
 package p9p
 
 import (
+	"bytes"
+	"errors"
 	"io"
 
 	"golang.org/x/net/context"
 )
 
-// ReaddirAll reads all the directory entries for the resource fid.
-func ReaddirAll(session Session, fid Fid) ([]Dir, error) {
-	panic("not implemented")
+// DefaultMaxDirReads is the number of reads ReaddirAll issues for a single
+// directory before giving up, unless set with WithMaxDirReads. Even at a
+// small msize, this allows for millions of entries.
+const DefaultMaxDirReads = 1 << 16
+
+// ErrDirReadLimit is returned when a directory is not exhausted within the
+// maximum number of reads. This usually means the server never returns the
+// empty read that ends a directory listing.
+var ErrDirReadLimit = errors.New("9p: directory read limit exceeded, server may not terminate listing")
+
+// ReaddirAll reads all the directory entries for the opened directory fid.
+// If the end of the directory is not reached within the maximum number of
+// reads, ErrDirReadLimit is returned along with the entries read so far.
+//
+// The context is checked before each read. A read in flight when ctx is done
+// is flushed by the session.
+func ReaddirAll(ctx context.Context, session Session, fid Fid) ([]Dir, error) {
+	var (
+		dr   = NewDirReader(session, fid)
+		dirs []Dir
+	)
+
+	for {
+		d, err := dr.Next(ctx)
+		if err == io.EOF {
+			return dirs, nil
+		}
+		if err != nil {
+			return dirs, err
+		}
+
+		dirs = append(dirs, d)
+	}
+}
+
+// DirReader decodes the entries of an opened directory one at a time,
+// issuing reads at increasing offsets as entries run out, so that large
+// directories need not be held in memory. A DirReader is not safe for
+// concurrent use.
+type DirReader struct {
+	session Session
+	fid     Fid
+	codec   Codec
+	limit   int // reads allowed, see WithMaxDirReads
+	reads   int
+	offset  int64
+	p       []byte
+	rd      bytes.Reader
+	err     error // sticky, once the end is reached or a read fails
+}
+
+// NewDirReader returns a DirReader for the opened directory fid on session,
+// starting from the first entry.
+func NewDirReader(session Session, fid Fid) *DirReader {
+	return &DirReader{
+		session: session,
+		fid:     fid,
+		codec:   NewCodec(), // TODO(stevvooe): Need way to resolve codec based on session.
+		limit:   maxDirReads(session),
+	}
+}
+
+// Next returns the next entry of the directory, reading from the server when
+// the entries of the last read are exhausted. At the end of the directory,
+// Next returns io.EOF. Errors are returned as with ReaddirAll, and are
+// returned again by later calls.
+func (dr *DirReader) Next(ctx context.Context) (Dir, error) {
+	for dr.rd.Len() == 0 {
+		if dr.err != nil {
+			return Dir{}, dr.err
+		}
+
+		dr.err = dr.read(ctx)
+	}
+
+	var d Dir
+	if err := DecodeDir(dr.codec, &dr.rd, &d); err != nil {
+		dr.err = err
+		dr.rd.Reset(nil)
+		return Dir{}, err
+	}
+
+	return d, nil
+}
+
+// read fills the buffer with the next read of the directory.
+func (dr *DirReader) read(ctx context.Context) error {
+	if dr.reads >= dr.limit {
+		return ErrDirReadLimit
+	}
+	dr.reads++
+
+	if err := ctx.Err(); err != nil {
+		return CancelError{Err: err, Flushed: true}
+	}
+
+	if dr.p == nil {
+		dr.p = make([]byte, IOUnit(dr.session, dr.fid))
+	}
+
+	n, err := dr.session.Read(ctx, dr.fid, dr.p, dr.offset)
+	if err == io.EOF && n == 0 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return io.EOF
+	}
+	dr.offset += int64(n)
+
+	dr.rd.Reset(dr.p[:n])
+	return nil
+}
+
+// ReaddirPath reads all the directory entries of the directory at path,
+// relative to root, as with ReaddirAll. The directory is opened on a fresh fid
+// from the session's pool, which is clunked before returning.
+//
+// If ctx is done, the fid is clunked in the background, so the caller isn't
+// held up by the server.
+func ReaddirPath(ctx context.Context, session Session, root Fid, path string) ([]Dir, error) {
+	fids, err := fidpoolOf(session)
+	if err != nil {
+		return nil, err
+	}
+
+	fid, err := fids.get()
+	if err != nil {
+		return nil, err
+	}
+
+	names := splitpath(path)
+	qids, err := walkNames(ctx, session, root, fid, names)
+	if err != nil || len(qids) != len(names) {
+		// the new fid is not established on a failed walk.
+		fids.put(fid)
+		if err == nil {
+			err = ErrNotfound
+		}
+
+		return nil, &PathError{Op: "walk", Path: path, Err: err}
+	}
+
+	defer func() {
+		if ctx.Err() != nil {
+			go session.Clunk(context.Background(), fid)
+			return
+		}
+
+		session.Clunk(ctx, fid)
+	}()
+
+	if _, _, err := session.Open(ctx, fid, OREAD); err != nil {
+		return nil, &PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return ReaddirAll(ctx, session, fid)
+}
+
+// dirReadLimiter is implemented by sessions with a configured limit on
+// directory reads.
+type dirReadLimiter interface {
+	maxDirReads() int
+}
+
+func maxDirReads(session Session) int {
+	var drl dirReadLimiter
+	walkSessions(session, func(session Session) bool {
+		drl, _ = session.(dirReadLimiter)
+		return drl != nil
+	})
+
+	if drl != nil {
+		return drl.maxDirReads()
+	}
+
+	return DefaultMaxDirReads
 }
 
 // Readdir helps one to implement the server-side of Session.Read on
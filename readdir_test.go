@@ -0,0 +1,203 @@
+package p9p
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReaddirAll(t *testing.T) {
+	var dirs []Dir
+	for i := 0; i < 100; i++ {
+		dirs = append(dirs, Dir{Name: fmt.Sprintf("file%d", i)})
+	}
+
+	codec := NewCodec()
+	rd := NewFixedReaddir(codec, dirs)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			p := make([]byte, msg.Count)
+			n, err := rd.Read(ctx, p, int64(msg.Offset))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			return MessageRread{Data: p[:n]}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	read, err := ReaddirAll(context.Background(), session, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(read) != len(dirs) {
+		t.Fatalf("unexpected number of entries: %v != %v", len(read), len(dirs))
+	}
+
+	for i := range dirs {
+		if read[i].Name != dirs[i].Name {
+			t.Fatalf("unexpected entry %d: %v != %v", i, read[i].Name, dirs[i].Name)
+		}
+	}
+}
+
+// TestDirReader reads a directory listed a few entries at a time, ensuring
+// that entries are decoded in order until io.EOF.
+func TestDirReader(t *testing.T) {
+	var dirs []Dir
+	for i := 0; i < 100; i++ {
+		dirs = append(dirs, Dir{Name: fmt.Sprintf("file%d", i)})
+	}
+
+	var reads int
+	rd := NewFixedReaddir(NewCodec(), dirs)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			reads++
+			p := make([]byte, 200) // a few entries per read.
+			n, err := rd.Read(ctx, p, int64(msg.Offset))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			return MessageRread{Data: p[:n]}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	dr := NewDirReader(session, 1)
+	for i := range dirs {
+		d, err := dr.Next(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error at entry %d: %v", i, err)
+		}
+
+		if d.Name != dirs[i].Name {
+			t.Fatalf("unexpected entry %d: %v != %v", i, d.Name, dirs[i].Name)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := dr.Next(ctx); err != io.EOF {
+			t.Fatalf("expected io.EOF: %v", err)
+		}
+	}
+
+	if reads < 10 {
+		t.Fatalf("expected entries to span reads: %v reads", reads)
+	}
+}
+
+// TestReaddirAllLimit ensures that reading a directory from a server that
+// never ends the listing gives up after the configured number of reads.
+func TestReaddirAllLimit(t *testing.T) {
+	const limit = 10
+	var reads int
+	codec := NewCodec()
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			reads++
+			p, err := codec.Marshal(Dir{Name: "again"})
+			if err != nil {
+				return nil, err
+			}
+
+			return MessageRread{Data: p}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithMaxDirReads(limit))
+	defer cleanup()
+
+	dirs, err := ReaddirAll(context.Background(), session, 1)
+	if err != ErrDirReadLimit {
+		t.Fatalf("expected read limit error: %v", err)
+	}
+
+	if reads != limit || len(dirs) != limit {
+		t.Fatalf("unexpected reads: %v reads, %v entries", reads, len(dirs))
+	}
+}
+
+// TestReaddirPathCancel cancels a directory read while a read is in flight
+// and ensures that the read is flushed and the fid is clunked.
+func TestReaddirPathCancel(t *testing.T) {
+	codec := NewCodec()
+	blocked := make(chan struct{})
+	clunked := make(chan Fid, 1)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTwalk:
+			return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+		case MessageTopen:
+			return MessageRopen{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTread:
+			if msg.Offset == 0 {
+				p, err := codec.Marshal(Dir{Name: "first"})
+				if err != nil {
+					return nil, err
+				}
+
+				return MessageRread{Data: p}, nil
+			}
+
+			// the rest of the directory takes forever.
+			close(blocked)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case MessageTclunk:
+			clunked <- msg.Fid
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	if _, err := session.Attach(context.Background(), 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-blocked
+		cancel()
+	}()
+
+	if _, err := ReaddirPath(ctx, session, 1, "dir"); err == nil {
+		t.Fatalf("expected error from canceled read")
+	} else if cerr, ok := err.(CancelError); !ok || cerr.Err != context.Canceled {
+		t.Fatalf("expected cancel error: %v", err)
+	}
+
+	if fid := <-clunked; fid == 1 {
+		t.Fatalf("clunked the root fid")
+	}
+
+	tr := session.(*client).transport.(*transport)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		fids, tags := OpenFids(session), tr.tags.len()
+		if len(fids) == 1 && fids[0].Fid == 1 && tags == 0 {
+			break
+		}
+
+		if time.Since(start) > time.Second {
+			t.Fatalf("resources not reclaimed: fids %v, %v tags", fids, tags)
+		}
+	}
+}
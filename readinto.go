@@ -0,0 +1,138 @@
+package p9p
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ReadInto reads from fid, starting at offset, until p is full or the end of
+// the file is reached, in which case io.EOF is returned with the count read.
+// It is meant for callers that need their own buffer, such as a page aligned
+// region to be mapped or handed off for DMA.
+//
+// ReadInto never reallocates p. On client sessions, the data of each read is
+// decoded from the connection directly into p, without an intermediate copy.
+// Reads are issued in chunks of the IOUnit of fid, rounded down to a multiple
+// of the page size. Each chunk starts at an offset into p that is a
+// multiple of the page size, so a page aligned p receives page aligned
+// chunks. A short read is completed with a read up to the next chunk
+// boundary.
+func ReadInto(ctx context.Context, session Session, fid Fid, p []byte, offset int64) (int, error) {
+	return readInto(ctx, session, fid, p, offset, IOUnit(session, fid))
+}
+
+// readInto reads into p as ReadInto does, with chunks of at most size.
+func readInto(ctx context.Context, session Session, fid Fid, p []byte, offset int64, size int) (int, error) {
+	chunk := size
+	if pagesize := os.Getpagesize(); chunk > pagesize {
+		chunk -= chunk % pagesize
+	}
+
+	var n int
+	for n < len(p) {
+		end := (n/chunk + 1) * chunk
+		if end > len(p) {
+			end = len(p)
+		}
+
+		nn, err := session.Read(ctx, fid, p[n:end], offset+int64(n))
+		n += nn
+		if err != nil {
+			return n, err
+		}
+
+		if nn == 0 {
+			return n, io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// readIntoer is implemented by roundTrippers that can decode the data of an
+// Rread directly into a caller buffer.
+type readIntoer interface {
+	sendInto(ctx context.Context, msg Message, rbuf []byte) (Message, error)
+}
+
+// readBufferer is implemented by channels that accept buffers to decode Rread
+// data into.
+type readBufferer interface {
+	setReadBuffers(fn func(tag Tag) (buf []byte, release func()))
+}
+
+// readBuffers tracks the caller buffers of outstanding Treads by tag. It is
+// shared between the read loop, the handle loop and callers of send.
+type readBuffers struct {
+	mu   sync.Mutex
+	reqs map[Tag]*readBuffer
+}
+
+// readBuffer is the buffer of a request, pinned while the read loop writes
+// to it.
+type readBuffer struct {
+	req *fcallRequest
+
+	mu       sync.Mutex // held while the buffer is written
+	canceled bool
+}
+
+func newReadBuffers() *readBuffers {
+	return &readBuffers{
+		reqs: make(map[Tag]*readBuffer),
+	}
+}
+
+func (rb *readBuffers) add(tag Tag, req *fcallRequest) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.reqs[tag] = &readBuffer{req: req}
+}
+
+func (rb *readBuffers) remove(tag Tag) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	delete(rb.reqs, tag)
+}
+
+// cancel removes the buffer of req. Once cancel returns, the buffer will not
+// be written. It waits only for a write to the buffer of req in progress.
+func (rb *readBuffers) cancel(req *fcallRequest) {
+	var canceled []*readBuffer
+	rb.mu.Lock()
+	for tag, b := range rb.reqs {
+		if b.req == req {
+			delete(rb.reqs, tag)
+			canceled = append(canceled, b)
+		}
+	}
+	rb.mu.Unlock()
+
+	for _, b := range canceled {
+		b.mu.Lock()
+		b.canceled = true
+		b.mu.Unlock()
+	}
+}
+
+// lookup returns the buffer for tag, pinned until release is called. If
+// there is no buffer for tag, release is nil.
+func (rb *readBuffers) lookup(tag Tag) ([]byte, func()) {
+	rb.mu.Lock()
+	b, ok := rb.reqs[tag]
+	rb.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	b.mu.Lock()
+	if b.canceled {
+		b.mu.Unlock()
+		return nil, nil
+	}
+
+	return b.req.rbuf, b.mu.Unlock
+}
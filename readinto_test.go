@@ -0,0 +1,131 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestReadInto(t *testing.T) {
+	data := make([]byte, 3*DefaultMSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var counts []int
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			counts = append(counts, int(msg.Count))
+			if msg.Offset >= uint64(len(data)) {
+				return MessageRread{}, nil
+			}
+
+			p := data[msg.Offset:]
+			if len(p) > int(msg.Count) {
+				p = p[:msg.Count]
+			}
+
+			return MessageRread{Data: p}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// reading the whole file fills p in page sized multiples.
+	p := make([]byte, len(data))
+	n, err := ReadInto(ctx, session, 1, p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(data) || !bytes.Equal(p, data) {
+		t.Fatalf("unexpected data read: %v bytes", n)
+	}
+
+	pagesize := os.Getpagesize()
+	for _, count := range counts[:len(counts)-1] {
+		if count%pagesize != 0 || count > DefaultMSize-IOHDRSZ {
+			t.Fatalf("unexpected read size: %v", count)
+		}
+	}
+
+	// reading past the end returns io.EOF with the partial count.
+	p = make([]byte, 200)
+	n, err = ReadInto(ctx, session, 1, p, int64(len(data)-100))
+	if err != io.EOF || n != 100 {
+		t.Fatalf("expected EOF after 100 bytes: %v, %v", n, err)
+	}
+
+	if !bytes.Equal(p[:n], data[len(data)-100:]) {
+		t.Fatalf("unexpected data at end of file")
+	}
+
+	// the client decodes read data in place.
+	tr := session.(*client).transport.(*transport)
+	p = make([]byte, 10)
+	resp, err := tr.sendInto(ctx, MessageTread{Fid: 1, Count: uint32(len(p))}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rread := resp.(MessageRread); &rread.Data[0] != &p[0] {
+		t.Fatalf("data was not decoded into the provided buffer")
+	}
+}
+
+// TestReadBuffers ensures that a buffer being written pins only its own
+// request: other requests come and go meanwhile, and canceling the request
+// waits for the write to finish.
+func TestReadBuffers(t *testing.T) {
+	rb := newReadBuffers()
+	a := &fcallRequest{rbuf: make([]byte, 10)}
+	b := &fcallRequest{rbuf: make([]byte, 10)}
+
+	rb.add(1, a)
+	buf, release := rb.lookup(1)
+	if release == nil || &buf[0] != &a.rbuf[0] {
+		t.Fatalf("unexpected buffer for tag 1")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rb.add(2, b)
+		rb.remove(2)
+		rb.add(2, b)
+		rb.cancel(b)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("other requests blocked by a pinned buffer")
+	}
+
+	canceled := make(chan struct{})
+	go func() {
+		rb.cancel(a)
+		close(canceled)
+	}()
+
+	select {
+	case <-canceled:
+		t.Fatalf("cancel returned while the buffer was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-canceled
+
+	if _, release := rb.lookup(1); release != nil {
+		t.Fatalf("canceled buffer still returned")
+	}
+}
@@ -0,0 +1,428 @@
+package p9p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ErrInterrupted is returned by a reconnecting session for a request that was
+// in flight when the connection was lost and cannot be safely sent again. The
+// request may or may not have been executed by the server.
+var ErrInterrupted = errors.New("request interrupted by reconnect")
+
+// reconnectTransport sends requests over a transport, dialing a new one when
+// the connection is lost. Requests in flight when the connection drops are
+// sent again on the new transport if they are idempotent and fail with
+// ErrInterrupted otherwise.
+type reconnectTransport struct {
+	// dial returns a new transport, ready for requests. Any state the
+	// requests depend on, such as established fids, must be restored by dial
+	// before it returns.
+	dial func(ctx context.Context) (roundTripper, error)
+
+	// dialctx is the context of dials, canceled once the session is done or
+	// the transport is closed. A dial outlives the requests waiting on it,
+	// so it is not run with the context of any one of them.
+	dialctx context.Context
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex // protects rt, dialing and closed
+	rt      roundTripper
+	dialing *redial // the dial in progress, if any
+	closed  bool
+}
+
+// redial is a dial of a new transport, shared by the requests waiting on it.
+type redial struct {
+	done chan struct{} // closed once rt and err are set
+	rt   roundTripper
+	err  error
+}
+
+var _ roundTripper = &reconnectTransport{}
+var _ readIntoer = &reconnectTransport{}
+var _ requestLister = &reconnectTransport{}
+var _ tagFlusher = &reconnectTransport{}
+var _ shutdowner = &reconnectTransport{}
+var _ flushAller = &reconnectTransport{}
+
+func newReconnectTransport(ctx context.Context, rt roundTripper, dial func(ctx context.Context) (roundTripper, error)) *reconnectTransport {
+	dialctx, cancel := context.WithCancel(ctx)
+	return &reconnectTransport{
+		dial:    dial,
+		dialctx: dialctx,
+		cancel:  cancel,
+		rt:      rt,
+	}
+}
+
+// closeNotifier is implemented by transports that can report that they have
+// closed. This lets a lost connection be replaced before sending a request,
+// rather than after the request fails.
+type closeNotifier interface {
+	done() <-chan struct{}
+}
+
+// idempotent reports whether msg may be sent again after a reconnect, when it
+// is unknown whether the server executed it. A request qualifies if executing
+// it twice has the same effect as executing it once.
+func idempotent(msg Message) bool {
+	switch msg := msg.(type) {
+	case MessageTstat, MessageTread, MessageTwalk, MessageTclunk:
+		// reads don't change the file. A walk or clunk only changes the
+		// fid, which is restored before the request is sent again.
+		return true
+	case MessageTopen:
+		// opening twice is harmless unless the open truncates the file,
+		// possibly discarding data written since the first, or removes
+		// the file on clunk.
+		return msg.Mode&(OTRUNC|ORCLOSE) == 0
+	}
+
+	// Twrite, Tcreate, Tremove and Twstat change the file tree, and the
+	// second attempt may fail or change it again. Tauth and Tattach are part
+	// of establishing the session.
+	return false
+}
+
+// transport returns the transport to send requests on. If failed is the
+// current transport or the current transport has closed, a new one is
+// dialed. Callers needing a new transport meanwhile wait for the same dial,
+// each giving up when its own ctx is done.
+func (r *reconnectTransport) transport(ctx context.Context, failed roundTripper) (roundTripper, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	if r.rt != nil && r.rt != failed && !isClosed(r.rt) {
+		rt := r.rt
+		r.mu.Unlock()
+		return rt, nil
+	}
+
+	d := r.dialing
+	if d == nil {
+		if closer, ok := r.rt.(io.Closer); ok {
+			closer.Close()
+		}
+		r.rt = nil
+
+		d = &redial{done: make(chan struct{})}
+		r.dialing = d
+		go r.redial(d)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.rt, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// redial dials a new transport for d, making it the current transport unless
+// the transport was closed meanwhile.
+func (r *reconnectTransport) redial(d *redial) {
+	rt, err := r.dial(r.dialctx)
+
+	r.mu.Lock()
+	r.dialing = nil
+	if err == nil && r.closed {
+		if closer, ok := rt.(io.Closer); ok {
+			closer.Close()
+		}
+		rt, err = nil, ErrClosed
+	} else if err == nil {
+		r.rt = rt
+	}
+	d.rt, d.err = rt, err
+	r.mu.Unlock()
+
+	close(d.done)
+}
+
+// isClosed reports whether rt is known to have closed.
+func isClosed(rt roundTripper) bool {
+	cn, ok := rt.(closeNotifier)
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-cn.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// connLost reports whether err is a network error that leaves the connection
+// unusable, such as writing to a connection the server closed. Timeouts and
+// temporary errors are left to the caller.
+func connLost(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && !nerr.Timeout() && !nerr.Temporary()
+}
+
+// roundTrip calls fn with the current transport. If the transport closes or
+// its connection fails before fn returns, fn is called again with a new transport if msg is
+// idempotent.
+func (r *reconnectTransport) roundTrip(ctx context.Context, msg Message, fn func(rt roundTripper) (Message, error)) (Message, error) {
+	rt, err := r.transport(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fn(rt)
+	if err != ErrClosed && !connLost(err) {
+		return resp, err
+	}
+
+	// the connection was lost while the request was in flight or being
+	// written, or the session has been closed.
+	rt, err = r.transport(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+
+	if !idempotent(msg) {
+		return nil, ErrInterrupted
+	}
+
+	return fn(rt)
+}
+
+func (r *reconnectTransport) send(ctx context.Context, msg Message) (Message, error) {
+	return r.roundTrip(ctx, msg, func(rt roundTripper) (Message, error) {
+		return rt.send(ctx, msg)
+	})
+}
+
+func (r *reconnectTransport) sendInto(ctx context.Context, msg Message, rbuf []byte) (Message, error) {
+	return r.roundTrip(ctx, msg, func(rt roundTripper) (Message, error) {
+		if ri, ok := rt.(readIntoer); ok {
+			return ri.sendInto(ctx, msg, rbuf)
+		}
+
+		return rt.send(ctx, msg)
+	})
+}
+
+func (r *reconnectTransport) outstanding() []RequestInfo {
+	r.mu.Lock()
+	rt := r.rt
+	r.mu.Unlock()
+
+	if rl, ok := rt.(requestLister); ok {
+		return rl.outstanding()
+	}
+
+	return nil
+}
+
+// flushAll flushes the current transport.
+func (r *reconnectTransport) flushAll(ctx context.Context) error {
+	r.mu.Lock()
+	rt := r.rt
+	r.mu.Unlock()
+
+	if fa, ok := rt.(flushAller); ok {
+		return fa.flushAll(ctx)
+	}
+
+	return nil
+}
+
+// flush flushes tag on the current transport. Tags of a lost connection are
+// no longer outstanding.
+func (r *reconnectTransport) flush(ctx context.Context, tag Tag) error {
+	r.mu.Lock()
+	rt := r.rt
+	r.mu.Unlock()
+
+	if tf, ok := rt.(tagFlusher); ok {
+		return tf.flush(ctx, tag)
+	}
+
+	return nil
+}
+
+// shutdown shuts down the current transport. No new transport is dialed
+// afterwards.
+func (r *reconnectTransport) shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	rt := r.rt
+	r.mu.Unlock()
+	r.cancel()
+
+	if sd, ok := rt.(shutdowner); ok {
+		return sd.shutdown(ctx)
+	}
+
+	if closer, ok := rt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Close closes the current transport. No new transport is dialed afterwards,
+// and requests fail with ErrClosed.
+func (r *reconnectTransport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	r.closed = true
+	r.cancel()
+
+	if closer, ok := r.rt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// redialer returns the dial function of a reconnectTransport for a session
+// connected with connect. Each new transport must negotiate the version and an
+// msize no smaller than the original, so that calls made with the original
+// values remain valid. If restore is set, the fids in fids are established
+// again before the transport is used.
+func redialer(ctx context.Context, connect connectFunc, so sessionOptions, version string, msize int, fids *fidPool, restore bool) func(ctx context.Context) (roundTripper, error) {
+	return func(dialctx context.Context) (roundTripper, error) {
+		if ctx.Err() != nil {
+			// the session is over, not the connection.
+			return nil, ErrSessionDone
+		}
+
+		ch, v, m, err := connect(dialctx)
+		if err != nil {
+			return nil, err
+		}
+
+		t := newTransport(ctx, ch, so)
+		if v != version || m < msize {
+			t.(io.Closer).Close()
+			return nil, fmt.Errorf("reconnect negotiated version %v with msize %d, expected %v with msize %d", v, m, version, msize)
+		}
+
+		if restore {
+			if err := restoreFids(dialctx, t, fids, so.logger); err != nil {
+				t.(io.Closer).Close()
+				return nil, err
+			}
+		}
+
+		return t, nil
+	}
+}
+
+// restoreFids attaches, walks and opens each restorable fid in fids on rt,
+// as it was on the lost connection. A fid that can no longer be established
+// or that now refers to a different file is left unestablished on the
+// server, so calls using it fail rather than act on the wrong file. An error
+// is returned only if rt fails.
+func restoreFids(ctx context.Context, rt roundTripper, fids *fidPool, logger Logger) error {
+	ids, origins, qids := fids.restorable()
+	for i, fid := range ids {
+		err := restoreFid(ctx, rt, fid, origins[i], qids[i])
+		if err == nil {
+			continue
+		}
+
+		if isClosed(rt) || ctx.Err() != nil {
+			return err
+		}
+
+		logf(logger, LogWarn, "9p: cannot restore fid %v after reconnect: %v", fid, err)
+		rt.send(ctx, MessageTclunk{Fid: fid})
+	}
+
+	return nil
+}
+
+// restoreFid establishes fid on rt as described by origin, checking that it
+// refers to the file with qid.
+func restoreFid(ctx context.Context, rt roundTripper, fid Fid, origin fidOrigin, qid Qid) error {
+	resp, err := rt.send(ctx, MessageTattach{
+		Fid:   fid,
+		Afid:  NOFID,
+		Uname: origin.uname,
+		Aname: origin.aname,
+	})
+	if err != nil {
+		return err
+	}
+
+	rattach, ok := resp.(MessageRattach)
+	if !ok {
+		return ErrUnexpectedMsg
+	}
+	found := rattach.Qid
+
+	// walk in place, at most 16 names at a time.
+	for names := origin.names; len(names) > 0; {
+		n := len(names)
+		if n > 16 {
+			n = 16
+		}
+
+		resp, err := rt.send(ctx, MessageTwalk{
+			Fid:    fid,
+			Newfid: fid,
+			Wnames: names[:n],
+		})
+		if err != nil {
+			return err
+		}
+
+		rwalk, ok := resp.(MessageRwalk)
+		if !ok {
+			return ErrUnexpectedMsg
+		}
+
+		if len(rwalk.Qids) != n {
+			return ErrNotfound
+		}
+
+		found = rwalk.Qids[n-1]
+		names = names[n:]
+	}
+
+	if origin.opened {
+		resp, err := rt.send(ctx, MessageTopen{
+			Fid:  fid,
+			Mode: origin.mode,
+		})
+		if err != nil {
+			return err
+		}
+
+		ropen, ok := resp.(MessageRopen)
+		if !ok {
+			return ErrUnexpectedMsg
+		}
+		found = ropen.Qid
+	}
+
+	if found.Path != qid.Path {
+		return fmt.Errorf("fid now refers to qid path %#x, expected %#x", found.Path, qid.Path)
+	}
+
+	return nil
+}
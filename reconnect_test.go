@@ -0,0 +1,363 @@
+package p9p
+
+import (
+	"io"
+	"net"
+	pathpkg "path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestReconnectReplay ensures that idempotent requests in flight when the
+// connection drops are sent again on a new connection, and that other
+// requests fail with ErrInterrupted.
+func TestReconnectReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		conns   []net.Conn
+		started = make(chan struct{}, 2)
+	)
+
+	dial := func(ctx context.Context) (roundTripper, error) {
+		cconn, sconn := net.Pipe()
+
+		mu.Lock()
+		first := len(conns) == 0
+		conns = append(conns, cconn, sconn)
+		mu.Unlock()
+
+		go ServeConn(ctx, sconn, HandlerFunc(func(hctx context.Context, msg Message) (Message, error) {
+			if first {
+				// hold every request on the first connection until it
+				// drops.
+				started <- struct{}{}
+				<-hctx.Done()
+				return nil, hctx.Err()
+			}
+
+			switch msg.(type) {
+			case MessageTstat:
+				return MessageRstat{Stat: Dir{Name: "replayed"}}, nil
+			case MessageTwrite:
+				return MessageRwrite{Count: 1}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}))
+
+		ch, _, _, err := negotiateConn(ctx, cconn, sessionOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		return newTransport(ctx, ch, sessionOptions{}), nil
+	}
+
+	rt, err := dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReconnectTransport(ctx, rt, dial)
+	defer r.Close()
+
+	type result struct {
+		resp Message
+		err  error
+	}
+	stat, write := make(chan result, 1), make(chan result, 1)
+
+	go func() {
+		resp, err := r.send(ctx, MessageTstat{Fid: 1})
+		stat <- result{resp, err}
+	}()
+
+	go func() {
+		resp, err := r.send(ctx, MessageTwrite{Fid: 1, Data: []byte("x")})
+		write <- result{resp, err}
+	}()
+
+	<-started
+	<-started
+
+	// drop the first connection.
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+
+	res := <-stat
+	if res.err != nil {
+		t.Fatalf("expected stat to be replayed: %v", res.err)
+	}
+
+	if rstat, ok := res.resp.(MessageRstat); !ok || rstat.Stat.Name != "replayed" {
+		t.Fatalf("unexpected response: %#v", res.resp)
+	}
+
+	if res := <-write; res.err != ErrInterrupted {
+		t.Fatalf("expected write to be interrupted: %v", res.err)
+	}
+
+	// new requests go to the new connection.
+	if _, err := r.send(ctx, MessageTwrite{Fid: 1, Data: []byte("x")}); err != nil {
+		t.Fatalf("unexpected error after reconnect: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.send(ctx, MessageTstat{Fid: 1}); err != ErrClosed {
+		t.Fatalf("expected closed error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 4 {
+		t.Fatalf("unexpected number of connections: %v", len(conns)/2)
+	}
+}
+
+// closedTransport is a roundTripper that has closed, answering nothing.
+type closedTransport struct{}
+
+func (closedTransport) send(ctx context.Context, msg Message) (Message, error) {
+	return nil, ErrClosed
+}
+
+func (closedTransport) done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// stubTransport is a roundTripper answering every request with an Rstat.
+type stubTransport struct{}
+
+func (stubTransport) send(ctx context.Context, msg Message) (Message, error) {
+	return MessageRstat{}, nil
+}
+
+// TestReconnectSharedDial ensures that requests waiting for a new connection
+// share one dial, and that each stops waiting when its own context is done
+// without failing the others.
+func TestReconnectSharedDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		dials   int32
+		dialing = make(chan struct{}, 1)
+		release = make(chan struct{})
+	)
+	r := newReconnectTransport(ctx, closedTransport{}, func(ctx context.Context) (roundTripper, error) {
+		atomic.AddInt32(&dials, 1)
+		dialing <- struct{}{}
+		<-release
+		return stubTransport{}, nil
+	})
+	defer r.Close()
+
+	reqctx, reqcancel := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		_, err := r.send(reqctx, MessageTstat{Fid: 1})
+		first <- err
+	}()
+	<-dialing
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := r.send(ctx, MessageTstat{Fid: 1})
+		second <- err
+	}()
+
+	reqcancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("expected the canceled request to give up: %v", err)
+	}
+
+	select {
+	case err := <-second:
+		t.Fatalf("request returned before the dial completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatalf("unexpected error after the dial: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("unexpected number of dials: %v", n)
+	}
+}
+
+// TestDialReconnect drops the connection of a session dialed WithReconnect
+// and ensures that fids are restored on the new connection only if asked.
+func TestDialReconnect(t *testing.T) {
+	for _, restore := range []bool{true, false} {
+		testDialReconnect(t, restore)
+	}
+}
+
+func testDialReconnect(t *testing.T, restore bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+		opens int
+	)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+
+			// each connection has its own fids.
+			var fmu sync.Mutex
+			fids := map[Fid]string{}
+			qid := func(p string) Qid {
+				if p == "/" {
+					return Qid{Type: QTDIR, Path: 1}
+				}
+				return Qid{Path: 2}
+			}
+
+			go ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+				fmu.Lock()
+				defer fmu.Unlock()
+
+				switch msg := msg.(type) {
+				case MessageTattach:
+					fids[msg.Fid] = "/"
+					return MessageRattach{Qid: qid("/")}, nil
+				case MessageTwalk:
+					p, ok := fids[msg.Fid]
+					if !ok {
+						return nil, ErrUnknownfid
+					}
+
+					var qids []Qid
+					for _, name := range msg.Wnames {
+						p = pathpkg.Join(p, name)
+						qids = append(qids, qid(p))
+					}
+					fids[msg.Newfid] = p
+					return MessageRwalk{Qids: qids}, nil
+				case MessageTopen:
+					p, ok := fids[msg.Fid]
+					if !ok {
+						return nil, ErrUnknownfid
+					}
+
+					mu.Lock()
+					opens++
+					mu.Unlock()
+					return MessageRopen{Qid: qid(p)}, nil
+				case MessageTstat:
+					p, ok := fids[msg.Fid]
+					if !ok {
+						return nil, ErrUnknownfid
+					}
+					return MessageRstat{Stat: Dir{Name: p, Qid: qid(p)}}, nil
+				case MessageTclunk:
+					delete(fids, msg.Fid)
+					return MessageRclunk{}, nil
+				}
+
+				return nil, ErrUnknownMsg
+			}))
+		}
+	}()
+
+	session, err := Dial(ctx, "tcp", l.Addr().String(), WithReconnect(restore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Walk(ctx, 1, 2, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := session.Open(ctx, 2, OREAD); err != nil {
+		t.Fatal(err)
+	}
+
+	// drop the connection.
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+
+	d, err := session.Stat(ctx, 2)
+	if !restore {
+		if err != ErrUnknownfid {
+			t.Fatalf("expected ErrUnknownfid without restoring fids: %v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("unexpected error after reconnect: %v", err)
+	}
+
+	if d.Name != "/a" {
+		t.Fatalf("unexpected stat after reconnect: %v", d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 2 || opens != 2 {
+		t.Fatalf("unexpected reconnect: %d connections, %d opens", len(conns), opens)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	for _, testcase := range []struct {
+		msg        Message
+		idempotent bool
+	}{
+		{MessageTstat{}, true},
+		{MessageTread{}, true},
+		{MessageTwalk{}, true},
+		{MessageTclunk{}, true},
+		{MessageTopen{Mode: OREAD}, true},
+		{MessageTopen{Mode: OWRITE | OTRUNC}, false},
+		{MessageTopen{Mode: OREAD | ORCLOSE}, false},
+		{MessageTwrite{}, false},
+		{MessageTcreate{}, false},
+		{MessageTremove{}, false},
+		{MessageTwstat{}, false},
+		{MessageTattach{}, false},
+	} {
+		if idempotent(testcase.msg) != testcase.idempotent {
+			t.Errorf("%v: expected idempotent %v", testcase.msg.Type(), testcase.idempotent)
+		}
+	}
+}
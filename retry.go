@@ -0,0 +1,85 @@
+package p9p
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy configures how a session retries requests that fail with a
+// transient error, set with WithRetry. Only Twalk, Tstat and Tread are
+// retried, since sending them again on the same connection has the same
+// effect as sending them once.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a request is sent, including
+	// the first.
+	Attempts int
+
+	// Backoff is the wait before the first retry, doubled for each retry
+	// after it, up to MaxBackoff if set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether a request that failed with err may be sent
+	// again. If nil, IsTransient is used. A classifier retrying errors
+	// after which the server may have executed the request, such as a lost
+	// response, risks a retried walk failing because the first established
+	// its newfid.
+	Retryable func(err error) bool
+}
+
+// IsTransient reports whether err is a transient failure to send a request,
+// after which the request was not executed and sending it again may
+// succeed: ErrTooManyRequests. Errors writing to the connection are not
+// transient, since part of the request may have been written; the session
+// is closed after them.
+func IsTransient(err error) bool {
+	return err == ErrTooManyRequests
+}
+
+// backoff returns the wait before the given retry, starting at 1.
+func (rp *RetryPolicy) backoff(retry int) time.Duration {
+	d := rp.Backoff
+	for i := 1; i < retry && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+
+	return d
+}
+
+func (rp *RetryPolicy) retryable(err error) bool {
+	if rp.Retryable != nil {
+		return rp.Retryable(err)
+	}
+
+	return IsTransient(err)
+}
+
+// retry calls send until it succeeds or fails with an error the retry policy
+// of the session does not retry, waiting between attempts.
+func (c *client) retry(ctx context.Context, send func() (Message, error)) (Message, error) {
+	resp, err := send()
+	if c.retries == nil {
+		return resp, err
+	}
+
+	for retry := 1; err != nil && retry < c.retries.Attempts && c.retries.retryable(err); retry++ {
+		t := time.NewTimer(c.retries.backoff(retry))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+
+		logf(c.logger, LogDebug, "9p: retrying request after error: %v", err)
+		resp, err = send()
+	}
+
+	return resp, err
+}
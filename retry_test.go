@@ -0,0 +1,84 @@
+package p9p
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type roundTripFunc func(ctx context.Context, msg Message) (Message, error)
+
+func (fn roundTripFunc) RoundTrip(ctx context.Context, msg Message) (Message, error) {
+	return fn(ctx, msg)
+}
+
+// TestRetry ensures that requests safe to send again are retried after
+// transient errors, up to the number of attempts, and others are not.
+func TestRetry(t *testing.T) {
+	var (
+		failures int // transient failures before each request succeeds
+		sent     map[FcallType]int
+	)
+	rt := roundTripFunc(func(ctx context.Context, msg Message) (Message, error) {
+		sent[msg.Type()]++
+		if sent[msg.Type()] <= failures {
+			return nil, ErrTooManyRequests
+		}
+
+		switch msg.(type) {
+		case MessageTstat:
+			return MessageRstat{}, nil
+		case MessageTwrite:
+			return MessageRwrite{}, nil
+		case MessageTwalk:
+			return nil, ErrNotfound
+		}
+
+		return nil, ErrUnknownMsg
+	})
+
+	ctx := context.Background()
+	session := NewRoundTripperSession(ctx, rt, DefaultMSize, DefaultVersion,
+		WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond}))
+
+	for _, tc := range []struct {
+		failures int
+		call     func() error
+		typ      FcallType
+		sent     int
+		ok       bool
+	}{
+		{2, func() error { _, err := session.Stat(ctx, 1); return err }, Tstat, 3, true},
+		{3, func() error { _, err := session.Stat(ctx, 1); return err }, Tstat, 3, false},
+		{1, func() error { _, err := session.Write(ctx, 1, []byte("data"), 0); return err }, Twrite, 1, false},
+		{0, func() error { _, err := session.Walk(ctx, 1, 2, "missing"); return err }, Twalk, 1, false},
+	} {
+		failures, sent = tc.failures, map[FcallType]int{}
+		if err := tc.call(); (err == nil) != tc.ok {
+			t.Fatalf("%v: unexpected error: %v", tc.typ, err)
+		}
+
+		if sent[tc.typ] != tc.sent {
+			t.Fatalf("%v: sent %v times, expected %v", tc.typ, sent[tc.typ], tc.sent)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	rp := RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	for retry, expected := range []time.Duration{0, 1, 2, 4, 4, 4} {
+		if retry == 0 {
+			continue
+		}
+
+		if d := rp.backoff(retry); d != expected*time.Millisecond {
+			t.Fatalf("retry %v: unexpected backoff: %v != %v", retry, d, expected*time.Millisecond)
+		}
+	}
+
+	rp.MaxBackoff = 0
+	if d := rp.backoff(100); d <= 0 {
+		t.Fatalf("backoff overflowed: %v", d)
+	}
+}
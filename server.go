@@ -1,20 +1,391 @@
 package p9p
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 )
 
-// TODO(stevvooe): Add net/http.Server-like type here to manage connections.
-// Coupled with Handler mux, we can get a very http-like experience for 9p
-// servers.
+// ConnInfo describes a connection being served. It is available to the
+// handlers of the connection from GetConnInfo.
+type ConnInfo struct {
+	LocalAddr  net.Addr // nil if not served from a net.Conn
+	RemoteAddr net.Addr
+
+	// MSize and Version are those negotiated as the connection was
+	// established. A later Tversion may change the msize.
+	MSize   int
+	Version string
+
+	// TLS is the state of the connection if served with ServeTLS.
+	TLS *tls.ConnectionState
+}
+
+// SessionFactory returns the session serving a connection, once its version
+// is negotiated. The context is done when the connection ends.
+type SessionFactory func(ctx context.Context, info ConnInfo) (Session, error)
+
+// Serve accepts connections on l and serves each with a session from
+// newSession, until l fails or ctx is done. Each connection is served in its
+// own goroutine and, if its session implements io.Closer, the session is
+// closed when the connection ends. Errors ending a connection are logged.
+//
+// Connections still open when Serve returns are closed, and Serve waits for
+// them to end. Use a Server for more control, such as to shut down
+// gracefully.
+func Serve(ctx context.Context, l net.Listener, newSession SessionFactory, opts ...ServerOption) error {
+	s := &Server{Sessions: newSession, Options: opts}
+	return s.Serve(ctx, l)
+}
+
+// Server serves a Handler on the connections accepted from listeners,
+// keeping track of them so they can be shut down together, as with
+// net/http.Server. The fields must not be changed once serving.
+type Server struct {
+	Handler Handler
+	Options []ServerOption // used for each connection, as with ServeConn
+
+	// Sessions, if set, returns the session serving each connection, which
+	// is dispatched in place of Handler, as with Serve.
+	Sessions SessionFactory
+
+	// ConnError, if set, is called with the error ending each connection
+	// accepted by Serve, unless the server was shut down. Otherwise, those
+	// errors are logged at LogDebug.
+	ConnError func(cn net.Conn, err error)
+
+	// MaxConns, if positive, limits the connections served at once by
+	// Serve. Beyond it, under BusyWait, Serve stops accepting until a
+	// connection ends. Under BusyReject, connections are accepted only to
+	// fail their Tversion with ErrBusy.
+	MaxConns   int
+	ConnPolicy BusyPolicy
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	done      chan struct{} // closed with closed
+	slots     chan struct{} // held by each connection under MaxConns
+}
+
+// Serve accepts connections on l and serves each in its own goroutine until
+// l fails, ctx is done or the server is shut down, when ErrServerClosed is
+// returned. The listener is closed on return.
+//
+// Serve returns once the connections it accepted have ended. Unless the
+// server is being shut down, they are closed first.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	// the listener is closed to stop accepting once ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = map[net.Conn]struct{}{}
+	)
+	defer func() {
+		if !s.shuttingDown() {
+			mu.Lock()
+			for cn := range conns {
+				cn.Close()
+			}
+			mu.Unlock()
+		}
+
+		wg.Wait()
+	}()
+
+	var delay time.Duration
+	for {
+		var held bool
+		if s.MaxConns > 0 && s.ConnPolicy == BusyWait {
+			if err := s.waitSlot(ctx); err != nil {
+				return err
+			}
+			held = true
+		}
+
+		cn, err := l.Accept()
+		if err != nil {
+			if held {
+				s.releaseSlot()
+			}
+
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off, as running out of file descriptors may not
+				// last.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+
+				s.logf(LogWarn, "9p server: error accepting: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			return err
+		}
+		delay = 0
+
+		busy := false
+		if s.MaxConns > 0 && !held {
+			held = s.trySlot()
+			busy = !held
+		}
+
+		mu.Lock()
+		conns[cn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(held bool) {
+			defer wg.Done()
+			if held {
+				defer s.releaseSlot()
+			}
+			err := s.serveConn(ctx, cn, busy)
+
+			mu.Lock()
+			delete(conns, cn)
+			mu.Unlock()
+
+			if err == nil || err == ErrServerClosed {
+				return
+			}
+
+			if s.ConnError != nil {
+				s.ConnError(cn, err)
+				return
+			}
+
+			s.logf(LogDebug, "9p server: serving %v: %v", cn.RemoteAddr(), err)
+		}(held)
+	}
+}
+
+// ServeConn serves the connection cn, as with ServeConn, closing it on
+// return. If the server is shut down, ErrServerClosed is returned.
+func (s *Server) ServeConn(ctx context.Context, cn net.Conn) error {
+	return s.serveConn(ctx, cn, false)
+}
+
+// serveConn serves cn, or refuses it with ErrBusy if busy.
+func (s *Server) serveConn(ctx context.Context, cn net.Conn, busy bool) error {
+	defer cn.Close()
+
+	opts := append(append([]ServerOption(nil), s.Options...), func(so *serverOptions) {
+		so.server = s
+		so.sessions = s.Sessions
+		so.busy = busy
+	})
+	return ServeConn(ctx, cn, s.Handler, opts...)
+}
+
+// Shutdown gracefully shuts down the server. The listeners are closed, then
+// each connection stops taking new requests, failing them with
+// ErrServerClosed, and waits for those in flight to complete. The fids still
+// in use on it are then clunked with the handler and the connection is
+// closed. Shutdown returns once every connection is closed.
+//
+// If ctx is done first, the requests still in flight are canceled, as if
+// flushed, and their connections are closed after clunking their fids,
+// without waiting for the handlers to return. The error from ctx is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	conns := s.close()
+	for c := range conns {
+		c.drain()
+	}
+
+	for c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			for c := range conns {
+				c.abort()
+			}
+
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Close closes the listeners and connections of the server immediately,
+// without waiting for the requests in flight or clunking fids. Use Shutdown
+// to close them gracefully.
+func (s *Server) Close() error {
+	for c := range s.close() {
+		c.CloseWithError(ErrServerClosed)
+	}
+
+	return nil
+}
+
+// close marks the server closed and closes its listeners, returning the
+// connections being served.
+func (s *Server) close() map[*conn]struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.doneLocked())
+	}
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	conns := make(map[*conn]struct{}, len(s.conns))
+	for c := range s.conns {
+		conns[c] = struct{}{}
+	}
+
+	return conns
+}
+
+func (s *Server) doneLocked() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+
+	return s.done
+}
+
+// waitSlot takes a slot for a connection under MaxConns, waiting for one to
+// be released until ctx is done or the server is closed.
+func (s *Server) waitSlot(ctx context.Context) error {
+	s.mu.Lock()
+	slots, done := s.slotsLocked(), s.doneLocked()
+	s.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return ErrServerClosed
+	}
+}
+
+// trySlot takes a slot for a connection under MaxConns, if one is free.
+func (s *Server) trySlot() bool {
+	s.mu.Lock()
+	slots := s.slotsLocked()
+	s.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	<-s.slots
+}
+
+func (s *Server) slotsLocked() chan struct{} {
+	if s.slots == nil {
+		s.slots = make(chan struct{}, s.MaxConns)
+	}
+
+	return s.slots
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes l from the listeners of the server,
+// reporting false if it cannot be added because the server is closed.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[l] = struct{}{}
+
+	return true
+}
+
+// trackConn is trackListener for the connections of the server.
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+
+	if s.closed {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = map[*conn]struct{}{}
+	}
+	s.conns[c] = struct{}{}
+
+	return true
+}
+
+func (s *Server) logf(level LogLevel, format string, args ...interface{}) {
+	logf(newServerOptions(s.Options).logger, level, format, args...)
+}
 
 // ServeConn the 9p handler over the provided network connection.
-func ServeConn(ctx context.Context, cn net.Conn, handler Handler) error {
+func ServeConn(ctx context.Context, cn net.Conn, handler Handler, opts ...ServerOption) error {
+	so := newServerOptions(opts)
 
 	// TODO(stevvooe): It would be nice if the handler could declare the
 	// supported version. Before we had handler, we used the session to get
@@ -22,13 +393,41 @@ func ServeConn(ctx context.Context, cn net.Conn, handler Handler) error {
 	// we want to proxy version and message size decisions all the back to the
 	// origin server or make those decisions at each link of a proxy chain.
 
-	ch := newChannel(cn, codec9p{}, DefaultMSize)
+	var codec Codec = codec9p{}
+	if so.frameCompress != nil {
+		codec = newFrameCompressCodec(codec, so.frameCompress)
+	}
+
+	if so.checksums {
+		codec = newChecksumCodec(codec, so.newHash)
+	}
+
+	ch := newChannel(cn, codec, DefaultMSize)
+	ch.logger = so.logger
+
+	so.info = ConnInfo{LocalAddr: cn.LocalAddr(), RemoteAddr: cn.RemoteAddr()}
+	return serveChannel(ctx, ch, handler, so)
+}
+
+// ServeChannel serves the 9p handler over ch, a Channel framing fcalls over a
+// transport other than a net.Conn. Options are used as with ServeConn, except
+// for WithServerChecksums and WithServerFrameCompression: framing is left to
+// ch.
+func ServeChannel(ctx context.Context, ch Channel, handler Handler, opts ...ServerOption) error {
+	return serveChannel(ctx, ch, handler, newServerOptions(opts))
+}
+
+func serveChannel(ctx context.Context, ch Channel, handler Handler, so serverOptions) error {
+	if so.trace != nil {
+		ch = TraceChannel(ch, so.trace)
+	}
+
 	negctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	// TODO(stevvooe): For now, we negotiate here. It probably makes sense to
-	// do this outside of this function and then pass in a ready made channel.
-	// We are not really ready to export the channel type yet.
+	if so.busy {
+		return refuse(negctx, ch)
+	}
 
 	if err := servernegotiate(negctx, ch, DefaultVersion); err != nil {
 		// TODO(stevvooe): Need better error handling and retry support here.
@@ -37,16 +436,72 @@ func ServeConn(ctx context.Context, cn net.Conn, handler Handler) error {
 
 	ctx = withVersion(ctx, DefaultVersion)
 
+	// handlers still running are canceled once the connection ends.
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	info := so.info
+	info.MSize, info.Version = ch.MSize(), DefaultVersion
+	if state, ok := TLSConnectionState(ctx); ok {
+		info.TLS = &state
+	}
+	ctx = withConnInfo(ctx, info)
+
+	if so.sessions != nil {
+		session, err := so.sessions(ctx, info)
+		if err != nil {
+			return fmt.Errorf("error creating session: %v", err)
+		}
+
+		if closer, ok := closerOf(session); ok {
+			defer closer.Close()
+		}
+		handler = Dispatch(session)
+	}
+
 	c := &conn{
 		ctx:     ctx,
 		ch:      ch,
 		handler: handler,
 		closed:  make(chan struct{}),
+		logger:  so.logger,
+		resume:  make(chan struct{}, 1),
+		workers: so.workers,
+
+		maxRequests:   so.maxRequests,
+		requestPolicy: so.requestPolicy,
+
+		draining: make(chan struct{}),
+		aborted:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	defer close(c.done)
+
+	if so.server != nil {
+		if !so.server.trackConn(c, true) {
+			return ErrServerClosed
+		}
+		defer so.server.trackConn(c, false)
 	}
 
 	return c.serve()
 }
 
+// refuse answers the Tversion on ch with ErrBusy, for a connection over the
+// limit of its server.
+func refuse(ctx context.Context, ch Channel) error {
+	req := new(Fcall)
+	if err := ch.ReadFcall(ctx, req); err != nil {
+		return err
+	}
+
+	if err := ch.WriteFcall(ctx, newErrorFcall(req.Tag, ErrBusy)); err != nil {
+		return err
+	}
+
+	return ErrBusy
+}
+
 // conn plays role of session dispatch for handler in a server.
 type conn struct {
 	ctx     context.Context
@@ -55,31 +510,188 @@ type conn struct {
 	handler Handler
 	closed  chan struct{}
 	err     error // terminal error for the conn
+	logger  Logger
+
+	// resume restarts the read loop after a Tversion, once the write loop
+	// has answered it and resized the channel.
+	resume chan struct{}
+
+	// workers is the number of requests handled at once, in the order
+	// received on each fid, or zero to handle each request as it arrives.
+	workers int
+
+	// maxRequests, if positive, limits the requests handled at once, with
+	// those beyond it treated according to requestPolicy.
+	maxRequests   int
+	requestPolicy BusyPolicy
+
+	// draining is closed to shut the connection down once the requests in
+	// flight complete, aborted to shut it down without waiting for them.
+	// Done is closed once serve returns.
+	draining  chan struct{}
+	aborted   chan struct{}
+	done      chan struct{}
+	drainOnce sync.Once
+	abortOnce sync.Once
+
+	closeOnce sync.Once
+}
+
+func (c *conn) logf(level LogLevel, format string, args ...interface{}) {
+	logf(c.logger, level, format, args...)
+}
+
+// drain shuts the connection down once the requests in flight complete.
+func (c *conn) drain() {
+	c.drainOnce.Do(func() { close(c.draining) })
+}
+
+// abort shuts the connection down, canceling the requests in flight.
+func (c *conn) abort() {
+	c.abortOnce.Do(func() { close(c.aborted) })
 }
 
 // activeRequest includes information about the active request.
 type activeRequest struct {
 	ctx     context.Context
 	request *Fcall
-	cancel  context.CancelFunc
+	cancel  context.CancelFunc // nil for a Tflush
+
+	// flushes holds the Tflushes of the request, answered once it is.
+	flushes []*activeRequest
+}
+
+// completion is the response of the handler to an active request.
+type completion struct {
+	active *activeRequest
+	resp   *Fcall
+}
+
+// answer removes active, with the flushes waiting on it, from tags, and
+// returns the responses to send: resp, followed by an Rflush for each flush
+// in the order they were received. Per flush(5), the response to a flushed
+// request is only sent if it succeeded, since it may signify a change of
+// state the client must honor.
+func answer(tags map[Tag]*activeRequest, active *activeRequest, resp *Fcall) []*Fcall {
+	delete(tags, active.request.Tag)
+	if active.cancel != nil {
+		active.cancel()
+	}
+
+	var resps []*Fcall
+	if _, failed := resp.Message.(error); !failed || len(active.flushes) == 0 {
+		resps = append(resps, resp)
+	}
+
+	for _, flush := range active.flushes {
+		resps = append(resps, answer(tags, flush, newFcall(flush.request.Tag, MessageRflush{}))...)
+	}
+
+	return resps
 }
 
 // serve messages on the connection until an error is encountered.
 func (c *conn) serve() error {
 	tags := map[Tag]*activeRequest{} // active requests
+	fids := fidSet{}                 // established, to clunk on shutdown
+
+	requests := make(chan *Fcall)      // sync, read-limited
+	responses := make(chan *Fcall)     // sync, goroutine consumed
+	completed := make(chan completion) // sync, send in goroutine per request
+
+	// with workers, requests wait in order for their fids, then in ready
+	// for a worker.
+	var (
+		work  chan *activeRequest
+		order fidOrder
+		ready []*activeRequest
+	)
+	if c.workers > 0 {
+		work = make(chan *activeRequest)
+		for i := 0; i < c.workers; i++ {
+			go c.worker(work, completed)
+		}
+	}
 
-	requests := make(chan *Fcall)  // sync, read-limited
-	responses := make(chan *Fcall) // sync, goroutine consumed
-	completed := make(chan *Fcall) // sync, send in goroutine per request
+	// requests beyond maxRequests are held in waiting, under BusyWait.
+	// Running counts the requests started and not yet completed, including
+	// those aborted by a Tversion.
+	var (
+		running int
+		waiting []*activeRequest
+	)
+	start := func(active *activeRequest) {
+		running++
+		if work == nil {
+			go c.handle(active, completed)
+		} else if order.push(active) {
+			ready = append(ready, active)
+		}
+	}
+	busy := func() bool {
+		return c.maxRequests > 0 && running >= c.maxRequests
+	}
 
 	// read loop
+	written := make(chan struct{}) // closed once the write loop exits
 	go c.read(requests)
-	go c.write(responses)
+	go func() {
+		defer close(written)
+		c.write(responses)
+	}()
 
-	log.Println("server.run()")
+	c.logf(LogDebug, "server.run()")
+	var (
+		draining = c.draining
+		drained  bool
+		version  *Fcall // a Tversion waiting on the requests it aborted
+	)
 	for {
+		if version != nil && running == 0 {
+			// the session is reset once its requests are done with.
+			c.clunk(fids, "on version")
+			fids = fidSet{}
+
+			resp := newFcall(NOTAG, versionResponse(version.Message.(MessageTversion), GetVersion(c.ctx), DefaultMSize))
+			version = nil
+			select {
+			case responses <- resp:
+				// the write loop resizes the channel.
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			case <-c.closed:
+				return c.err
+			}
+		}
+
+		if drained && version == nil && len(tags) == 0 && running == 0 {
+			return c.shutdown(fids, responses, written)
+		}
+
+		var (
+			dispatch chan *activeRequest
+			next     *activeRequest
+		)
+		if len(ready) > 0 {
+			dispatch, next = work, ready[0]
+		}
+
 		select {
+		case dispatch <- next:
+			ready = ready[1:]
 		case req := <-requests:
+			if req.Type == Rerror {
+				// the answer to a request too large to read.
+				select {
+				case responses <- req:
+				case <-c.ctx.Done():
+					return c.ctx.Err()
+				case <-c.closed:
+					return c.err
+				}
+				continue
+			}
+
 			if _, ok := tags[req.Tag]; ok {
 				select {
 				case responses <- newErrorFcall(req.Tag, ErrDuptag):
@@ -92,78 +704,150 @@ func (c *conn) serve() error {
 				continue
 			}
 
+			if drained && req.Type != Tflush {
+				// shutting down. Flushes still pass, to abort the
+				// requests in flight.
+				select {
+				case responses <- newErrorFcall(req.Tag, ErrServerClosed):
+				case <-c.ctx.Done():
+					return c.ctx.Err()
+				case <-c.closed:
+					return c.err
+				}
+				continue
+			}
+
 			switch msg := req.Message.(type) {
+			case MessageTversion:
+				// Per version(5), a Tversion aborts all outstanding
+				// requests and clunks the fids in use. The requests
+				// started are canceled, and the Rversion is sent once
+				// they complete, without a response of their own. No
+				// requests are read until then.
+				for tag, active := range tags {
+					if active.cancel != nil {
+						active.cancel()
+					}
+					delete(tags, tag)
+				}
+				waiting = nil
+				version = req
 			case MessageTflush:
-				log.Println("server: flushing message", msg.Oldtag)
+				c.logf(LogDebug, "server: flushing message %v", msg.Oldtag)
 
-				var resp *Fcall
 				// check if we have actually know about the requested flush
-				active, ok := tags[msg.Oldtag]
-				if ok {
-					active.cancel() // propagate cancellation to callees
-					delete(tags, msg.Oldtag)
-					resp = newFcall(req.Tag, MessageRflush{})
-				} else {
-					resp = newErrorFcall(req.Tag, ErrUnknownTag)
+				target, ok := tags[msg.Oldtag]
+				if !ok {
+					select {
+					case responses <- newErrorFcall(req.Tag, ErrUnknownTag):
+						// bypass tag management in completed.
+					case <-c.ctx.Done():
+						return c.ctx.Err()
+					case <-c.closed:
+						return c.err
+					}
+					continue
 				}
 
-				select {
-				case responses <- resp:
-					// bypass tag management in completed.
-				case <-c.ctx.Done():
-					return c.ctx.Err()
-				case <-c.closed:
-					return c.err
+				// The Rflush is sent once the handler of the request, or
+				// the flush it targets, returns.
+				flush := &activeRequest{request: req}
+				tags[req.Tag] = flush
+				target.flushes = append(target.flushes, flush)
+				if target.cancel != nil {
+					target.cancel() // propagate cancellation to callees
+				}
+
+				if i := indexRequest(waiting, target); i >= 0 {
+					// never handled, so flushed at once.
+					waiting = append(waiting[:i], waiting[i+1:]...)
+					for _, resp := range answer(tags, target, newErrorFcall(target.request.Tag, context.Canceled)) {
+						select {
+						case responses <- resp:
+						case <-c.ctx.Done():
+							return c.ctx.Err()
+						case <-c.closed:
+							return c.err
+						}
+					}
 				}
 			default:
+				if busy() && c.requestPolicy == BusyReject {
+					select {
+					case responses <- newErrorFcall(req.Tag, ErrBusy):
+						// bypass tag management in completed.
+					case <-c.ctx.Done():
+						return c.ctx.Err()
+					case <-c.closed:
+						return c.err
+					}
+					continue
+				}
+
 				// Allows us to session handlers to cancel processing of the fcall
 				// through context.
 				ctx, cancel := context.WithCancel(c.ctx)
 
 				// The contents of these instances are only writable in the main
 				// server loop. The value of tag will not change.
-				tags[req.Tag] = &activeRequest{
+				active := &activeRequest{
 					ctx:     ctx,
 					request: req,
 					cancel:  cancel,
 				}
+				tags[req.Tag] = active
 
-				go func(ctx context.Context, req *Fcall) {
-					var resp *Fcall
-					msg, err := c.handler.Handle(ctx, req.Message)
-					if err != nil {
-						// all handler errors are forwarded as protocol errors.
-						resp = newErrorFcall(req.Tag, err)
-					} else {
-						resp = newFcall(req.Tag, msg)
-					}
+				if busy() {
+					waiting = append(waiting, active)
+				} else {
+					start(active)
+				}
+			}
+		case done := <-completed:
+			if work != nil {
+				ready = append(ready, order.done(done.active)...)
+			}
 
-					select {
-					case completed <- resp:
-					case <-ctx.Done():
-						return
-					case <-c.closed:
-						return
-					}
-				}(ctx, req)
+			running--
+			if len(waiting) > 0 && !busy() {
+				next := waiting[0]
+				waiting = waiting[1:]
+				start(next)
 			}
-		case resp := <-completed:
+
+			// fids established by requests aborted by a Tversion are
+			// clunked with the others.
+			fids.update(done.active.request.Message, done.resp.Message)
+
 			// only responses that flip the tag state traverse this section.
-			active, ok := tags[resp.Tag]
-			if !ok {
-				// The tag is no longer active. Likely a flushed message.
+			if tags[done.resp.Tag] != done.active {
+				// The request was aborted by a Tversion.
 				continue
 			}
 
-			select {
-			case responses <- resp:
-			case <-active.ctx.Done():
-				// the context was canceled for some reason, perhaps timeout or
-				// due to a flush call. We treat this as a condition where a
-				// response should not be sent.
-				log.Println("canceled", resp, active.ctx.Err())
+			if len(done.active.flushes) > 0 {
+				c.logf(LogDebug, "flushed %v", done.resp)
+			}
+
+			for _, resp := range answer(tags, done.active, done.resp) {
+				select {
+				case responses <- resp:
+				case <-c.ctx.Done():
+					return c.ctx.Err()
+				case <-c.closed:
+					return c.err
+				}
 			}
-			delete(tags, resp.Tag)
+		case <-draining:
+			draining, drained = nil, true
+		case <-c.aborted:
+			for _, active := range tags {
+				if active.cancel != nil {
+					active.cancel()
+				}
+			}
+
+			return c.shutdown(fids, responses, written)
 		case <-c.ctx.Done():
 			return c.ctx.Err()
 		case <-c.closed:
@@ -172,22 +856,149 @@ func (c *conn) serve() error {
 	}
 }
 
+// indexRequest returns the index of active in requests, or -1.
+func indexRequest(requests []*activeRequest, active *activeRequest) int {
+	for i, r := range requests {
+		if r == active {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// shutdown clunks the fids in use with the handler, as the connection is
+// shut down by its Server, then closes the connection once the responses
+// sent so far are written, unless it is aborted.
+func (c *conn) shutdown(fids fidSet, responses chan *Fcall, written <-chan struct{}) error {
+	c.clunk(fids, "on shutdown")
+
+	close(responses)
+	select {
+	case <-written:
+	case <-c.aborted:
+	case <-c.ctx.Done():
+	}
+
+	return c.CloseWithError(ErrServerClosed)
+}
+
+// clunk clunks each of fids with the handler, as the session is reset or
+// shut down, logging the errors.
+func (c *conn) clunk(fids fidSet, why string) {
+	for _, fid := range fids.sorted() {
+		if _, err := c.call(c.ctx, MessageTclunk{Fid: fid}); err != nil {
+			c.logf(LogDebug, "server: error clunking fid %v %s: %v", fid, why, err)
+		}
+	}
+}
+
+// fidSet holds the fids established on a connection. It is owned by the
+// server loop.
+type fidSet map[Fid]struct{}
+
+// update records the fids established or released by the request req,
+// answered with resp.
+func (fs fidSet) update(req, resp Message) {
+	switch req := req.(type) {
+	case MessageTclunk:
+		delete(fs, req.Fid)
+	case MessageTremove:
+		// the fid is clunked even if the remove fails.
+		delete(fs, req.Fid)
+	}
+
+	if _, failed := resp.(error); failed {
+		return
+	}
+
+	switch req := req.(type) {
+	case MessageTauth:
+		fs[req.Afid] = struct{}{}
+	case MessageTattach:
+		fs[req.Fid] = struct{}{}
+	case MessageTwalk:
+		if rwalk, ok := resp.(MessageRwalk); ok && len(rwalk.Qids) == len(req.Wnames) {
+			fs[req.Newfid] = struct{}{}
+		}
+	}
+}
+
+func (fs fidSet) sorted() []Fid {
+	fids := make(fidList, 0, len(fs))
+	for fid := range fs {
+		fids = append(fids, fid)
+	}
+	sort.Sort(fids)
+
+	return fids
+}
+
+// handle calls the handler with the request of active, and reports the
+// response on completed. A request flushed before it is handled fails
+// without calling the handler.
+func (c *conn) handle(active *activeRequest, completed chan<- completion) {
+	req := active.request
+
+	var (
+		resp *Fcall
+		msg  Message
+		err  = active.ctx.Err()
+	)
+	if err == nil {
+		msg, err = c.call(active.ctx, req.Message)
+	}
+
+	if err != nil {
+		// all handler errors are forwarded as protocol errors.
+		resp = newErrorFcall(req.Tag, err)
+	} else {
+		resp = newFcall(req.Tag, msg)
+	}
+
+	// completion is reported even when flushed, so that the Rflush follows
+	// the return of the handler.
+	select {
+	case completed <- completion{active: active, resp: resp}:
+	case <-c.ctx.Done():
+	case <-c.closed:
+	}
+}
+
+// call calls the handler with msg. A panic in the handler is logged and
+// fails the request with ErrInternal, leaving the connection open.
+func (c *conn) call(ctx context.Context, msg Message) (resp Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logf(LogError, "9p server: panic handling %v%v: %v\n%s", msg.Type(), traceMessage(msg), r, debug.Stack())
+			resp, err = nil, ErrInternal
+		}
+	}()
+
+	return c.handler.Handle(ctx, msg)
+}
+
 // read takes requests off the channel and sends them on requests.
 func (c *conn) read(requests chan *Fcall) {
 	for {
 		req := new(Fcall)
 		if err := c.ch.ReadFcall(c.ctx, req); err != nil {
-			if err, ok := err.(net.Error); ok {
-				if err.Timeout() || err.Temporary() {
-					// TODO(stevvooe): A full idle timeout on the connection
-					// should be enforced here. No logging because it is quite
-					// chatty.
-					continue
-				}
+			if retryable(err) {
+				// TODO(stevvooe): A full idle timeout on the connection
+				// should be enforced here. No logging because it is quite
+				// chatty.
+				continue
 			}
 
-			c.CloseWithError(fmt.Errorf("error reading fcall: %v", err))
-			return
+			tlerr, ok := err.(MessageTooLargeError)
+			if !ok {
+				c.CloseWithError(fmt.Errorf("error reading fcall: %v", err))
+				return
+			}
+
+			// the request was discarded. Its answer, an error, is passed
+			// on in its place.
+			req = newErrorFcall(tlerr.Tag, err)
 		}
 
 		select {
@@ -198,27 +1009,52 @@ func (c *conn) read(requests chan *Fcall) {
 		case <-c.closed:
 			return
 		}
+
+		if req.Type == Tversion {
+			// the channel may be resized before the next read.
+			select {
+			case <-c.resume:
+			case <-c.closed:
+				return
+			}
+		}
 	}
 }
 
 func (c *conn) write(responses chan *Fcall) {
 	for {
 		select {
-		case resp := <-responses:
-			if err := c.ch.WriteFcall(c.ctx, resp); err != nil {
-				if err, ok := err.(net.Error); ok {
-					if err.Timeout() || err.Temporary() {
-						// TODO(stevvooe): A full idle timeout on the
-						// connection should be enforced here. We log here,
-						// since this is less common.
-						log.Println("9p server: temporary error writing fcall: %v", err)
-						continue
-					}
-				}
+		case resp, ok := <-responses:
+			if !ok {
+				// shutting down, with every response written.
+				return
+			}
+
+			err := c.ch.WriteFcall(c.ctx, resp)
+			if _, ok := err.(MessageTooLargeError); ok && resp.Type != Rerror {
+				// the handler answered with more than the client can take.
+				// Nothing was written, so the error is sent in its place.
+				c.logf(LogWarn, "9p server: dropping response: %v", err)
+				resp = newErrorFcall(resp.Tag, err)
+				err = c.ch.WriteFcall(c.ctx, resp)
+			}
 
+			if err != nil {
+				// even a timeout may leave part of the frame written, after
+				// which the client cannot find the next one, so any error
+				// is fatal.
 				c.CloseWithError(fmt.Errorf("error writing fcall: %v", err))
 				return
 			}
+
+			if rv, ok := resp.Message.(MessageRversion); ok {
+				// the read loop waits for the Tversion to be answered,
+				// so the channel is idle.
+				if int(rv.MSize) != c.ch.MSize() {
+					c.ch.SetMSize(int(rv.MSize))
+				}
+				c.resume <- struct{}{}
+			}
 		case <-c.ctx.Done():
 			c.CloseWithError(c.ctx.Err())
 			return
@@ -233,17 +1069,14 @@ func (c *conn) Close() error {
 }
 
 func (c *conn) CloseWithError(err error) error {
-	select {
-	case <-c.closed:
-		return c.err
-	default:
-		close(c.closed)
+	c.closeOnce.Do(func() {
 		if err == nil {
-			c.err = err
-		} else {
-			c.err = ErrClosed
+			err = ErrClosed
 		}
 
-		return c.err
-	}
+		c.err = err
+		close(c.closed)
+	})
+
+	return c.err
 }
@@ -0,0 +1,880 @@
+package p9p
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestServerFlush flushes requests in flight, ensuring that the context of
+// the handler is canceled and that the Rflush is held until the handler
+// returns, after a response to honor, if it succeeded.
+func TestServerFlush(t *testing.T) {
+	var (
+		started  = make(chan struct{}, 1)
+		release  = make(chan struct{})
+		returned int32
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread, MessageTstat:
+			started <- struct{}{}
+			<-ctx.Done()
+			<-release
+			defer atomic.StoreInt32(&returned, 1)
+
+			if _, ok := msg.(MessageTstat); ok {
+				// changes made before the flush are still reported.
+				return MessageRstat{Stat: Dir{Name: "file"}}, nil
+			}
+
+			return nil, ctx.Err()
+		case MessageTclunk:
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	for _, testcase := range []struct {
+		name    string
+		call    func(ctx context.Context) error
+		flushed bool
+	}{
+		{
+			name: "failed",
+			call: func(ctx context.Context) error {
+				_, err := session.Read(ctx, 1, make([]byte, 10), 0)
+				return err
+			},
+			flushed: true,
+		},
+		{
+			name: "succeeded",
+			call: func(ctx context.Context) error {
+				_, err := session.Stat(ctx, 1)
+				return err
+			},
+		},
+	} {
+		atomic.StoreInt32(&returned, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() { errs <- testcase.call(ctx) }()
+
+		<-started
+		cancel()
+
+		select {
+		case err := <-errs:
+			t.Fatalf("%v: flush answered before the handler returned: %v", testcase.name, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		release <- struct{}{}
+
+		err := <-errs
+		if cerr, ok := err.(CancelError); !ok || cerr.Flushed != testcase.flushed {
+			t.Fatalf("%v: unexpected error: %#v", testcase.name, err)
+		}
+
+		if atomic.LoadInt32(&returned) != 1 {
+			t.Fatalf("%v: call returned before the handler", testcase.name)
+		}
+	}
+
+	// the tags were released by the server.
+	if err := session.Clunk(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServerWorkers ensures that a server with workers handles requests on
+// different fids concurrently, up to the number of workers, while requests
+// on the same fid wait for those before them.
+func TestServerWorkers(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		events  []string
+		started = make(chan uint64, 5)
+		block   = map[uint64]chan struct{}{1: make(chan struct{}), 4: make(chan struct{})}
+	)
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+
+	// requests are told apart by offset.
+	handler := HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		read := msg.(MessageTread)
+		record("start %d", read.Offset)
+		started <- read.Offset
+		if ch, ok := block[read.Offset]; ok {
+			<-ch
+		}
+		record("end %d", read.Offset)
+
+		return MessageRread{}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go ServeConn(ctx, sconn, handler, WithServerWorkers(2))
+
+	session, err := NewSession(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	read := func(fid Fid, offset int64) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := session.Read(ctx, fid, make([]byte, 1), offset); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	expectStart := func(offsets ...uint64) {
+		want := map[uint64]bool{}
+		for _, offset := range offsets {
+			want[offset] = true
+		}
+
+		for range offsets {
+			select {
+			case offset := <-started:
+				if !want[offset] {
+					t.Fatalf("unexpected start of %d, want %v", offset, offsets)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %v", offsets)
+			}
+		}
+	}
+
+	expectNoStart := func() {
+		select {
+		case offset := <-started:
+			t.Fatalf("unexpected start of %d", offset)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	read(1, 1) // blocks on fid 1
+	expectStart(1)
+	read(2, 2) // proceeds on fid 2
+	expectStart(2)
+	read(1, 3) // waits for 1
+	expectNoStart()
+	read(3, 4) // blocks on fid 3, taking the second worker
+	expectStart(4)
+	read(4, 5) // waits for a worker
+	expectNoStart()
+
+	close(block[1])
+	expectStart(3, 5)
+	close(block[4])
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	order := map[string]int{}
+	for i, event := range events {
+		order[event] = i
+	}
+
+	if order["start 3"] < order["end 1"] {
+		t.Fatalf("request on fid 1 started before the one before it ended: %v", events)
+	}
+}
+
+// TestServerShutdown shuts down a server with a request in flight, ensuring
+// that new requests are refused, the request completes and the fids in use
+// are clunked before the connection is closed.
+func TestServerShutdown(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		clunked []Fid
+		started = make(chan struct{}, 1)
+		release = make(chan struct{})
+		flushed = make(chan struct{}, 1)
+	)
+	server := &Server{Handler: HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{}, nil
+		case MessageTwalk:
+			return MessageRwalk{Qids: make([]Qid, len(msg.Wnames))}, nil
+		case MessageTstat:
+			return MessageRstat{}, nil
+		case MessageTread:
+			started <- struct{}{}
+			select {
+			case <-release:
+				return MessageRread{Data: []byte("data")}, nil
+			case <-ctx.Done():
+				flushed <- struct{}{}
+				return nil, ctx.Err()
+			}
+		case MessageTclunk:
+			mu.Lock()
+			defer mu.Unlock()
+			clunked = append(clunked, msg.Fid)
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns []net.Conn
+	defer func() {
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}()
+
+	dial := func(server *Server) Session {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(ctx, l) }()
+
+		cn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conns = append(conns, cn)
+
+		session, err := NewSession(ctx, cn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := session.Walk(ctx, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			if err := <-served; err != ErrServerClosed {
+				t.Errorf("unexpected error serving: %v", err)
+			}
+		}()
+
+		return session
+	}
+
+	session := dial(server)
+	reads := make(chan error, 1)
+	go func() {
+		_, err := session.Read(ctx, 2, make([]byte, 10), 0)
+		reads <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+
+	// requests are refused once the connection drains.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := session.Stat(ctx, 1)
+		if err != nil {
+			if rerr, ok := err.(MessageRerror); !ok || rerr.Ename != ErrServerClosed.Error() {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("requests still served while shutting down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shut down with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-reads; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if len(clunked) != 2 || clunked[0] != 1 || clunked[1] != 2 {
+		t.Fatalf("unexpected clunks on shutdown: %v", clunked)
+	}
+	clunked = nil
+	mu.Unlock()
+
+	if err := server.Serve(ctx, &net.TCPListener{}); err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed: %v", err)
+	}
+
+	// past the deadline, the request in flight is canceled.
+	release = make(chan struct{})
+	server = &Server{Handler: server.Handler}
+	session = dial(server)
+	go session.Read(ctx, 2, make([]byte, 10), 0)
+	<-started
+
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer scancel()
+	if err := server.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded: %v", err)
+	}
+	<-flushed
+}
+
+// closingSession answers attaches and clunks and records being closed.
+type closingSession struct {
+	Session
+	closed chan struct{}
+}
+
+func (s closingSession) Attach(ctx context.Context, fid, afid Fid, uname, aname string) (Qid, error) {
+	if _, ok := GetConnInfo(ctx); !ok || GetVersion(ctx) != DefaultVersion {
+		return Qid{}, ErrBadattach
+	}
+
+	return Qid{Type: QTDIR}, nil
+}
+
+func (s closingSession) Clunk(ctx context.Context, fid Fid) error {
+	return nil
+}
+
+func (s closingSession) Close() error {
+	close(s.closed)
+	return nil
+}
+
+// TestServe serves a session for each connection from a factory, ensuring
+// that it and the handlers of the session receive the negotiated connection,
+// and that the sessions and connections are closed once Serve returns.
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := make(chan ConnInfo, 1)
+	session := closingSession{closed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, l, func(ctx context.Context, info ConnInfo) (Session, error) {
+			infos <- info
+			return session, nil
+		})
+	}()
+
+	cn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	client, err := NewSession(ctx, cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	info := <-infos
+	if info.RemoteAddr.String() != cn.LocalAddr().String() || info.MSize != DefaultMSize || info.Version != DefaultVersion || info.TLS != nil {
+		t.Fatalf("unexpected connection info: %+v", info)
+	}
+
+	cancel()
+	if err := <-served; err != context.Canceled {
+		t.Fatalf("unexpected error serving: %v", err)
+	}
+
+	select {
+	case <-session.closed:
+	default:
+		t.Fatal("session not closed once serving returned")
+	}
+
+	if _, err := client.Attach(context.Background(), 2, NOFID, "test", "/"); err == nil {
+		t.Fatal("expected connection closed")
+	}
+}
+
+// TestServerMSize ensures that the server answers requests larger than the
+// msize with an error, and fails responses larger than it, without ending
+// the connection.
+func TestServerMSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTread:
+			return MessageRread{Data: make([]byte, msg.Count)}, nil
+		case MessageTclunk:
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+
+	ch := newChannel(cconn, codec9p{}, DefaultMSize)
+	if _, err := clientnegotiate(ctx, ch, DefaultVersion); err != nil {
+		t.Fatal(err)
+	}
+	ch.SetMSize(4 * DefaultMSize) // larger than negotiated.
+
+	for _, req := range []*Fcall{
+		newFcall(1, MessageTwrite{Fid: 1, Data: make([]byte, DefaultMSize)}),
+		newFcall(2, MessageTread{Fid: 1, Count: uint32(DefaultMSize)}),
+	} {
+		if err := ch.WriteFcall(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+
+		var resp Fcall
+		if err := ch.ReadFcall(ctx, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Type != Rerror || resp.Tag != req.Tag {
+			t.Fatalf("expected error for a message larger than msize: %v", &resp)
+		}
+	}
+
+	if err := ch.WriteFcall(ctx, newFcall(3, MessageTclunk{Fid: 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp Fcall
+	if err := ch.ReadFcall(ctx, &resp); err != nil || resp.Type != Rclunk {
+		t.Fatalf("unexpected response: %v, %v", &resp, err)
+	}
+}
+
+// TestServerVersion ensures that a Tversion waits for the requests it aborts
+// to complete, then clunks the fids in use with the handler, without
+// disturbing the count of requests under WithMaxRequests.
+func TestServerVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		events   []string
+		started  = make(chan struct{}, 2)
+		releases = map[uint64]chan struct{}{1: make(chan struct{}), 2: make(chan struct{})}
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTread:
+			started <- struct{}{}
+			<-releases[msg.Offset] // ignoring cancellation
+			record(fmt.Sprintf("read %d", msg.Offset))
+			return MessageRread{}, nil
+		case MessageTstat:
+			return MessageRstat{}, nil
+		case MessageTclunk:
+			record(fmt.Sprintf("clunk %d", msg.Fid))
+			return MessageRclunk{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}), WithMaxRequests(1, BusyReject))
+
+	ch := newChannel(cconn, codec9p{}, DefaultMSize)
+	if _, err := clientnegotiate(ctx, ch, DefaultVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	roundtrip := func(req *Fcall) *Fcall {
+		if err := ch.WriteFcall(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := new(Fcall)
+		if err := ch.ReadFcall(ctx, resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	if resp := roundtrip(newFcall(1, MessageTattach{Fid: 1, Afid: NOFID})); resp.Type != Rattach {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	if err := ch.WriteFcall(ctx, newFcall(2, MessageTread{Fid: 1, Offset: 1, Count: 1})); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if err := ch.WriteFcall(ctx, newFcall(NOTAG, MessageTversion{MSize: uint32(DefaultMSize), Version: DefaultVersion})); err != nil {
+		t.Fatal(err)
+	}
+
+	waitctx, waitcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	var resp Fcall
+	err := ch.ReadFcall(waitctx, &resp)
+	waitcancel()
+	if err == nil {
+		t.Fatalf("version answered before the request it aborted completed: %v, %v", &resp, err)
+	}
+
+	close(releases[1])
+	if err := ch.ReadFcall(ctx, &resp); err != nil || resp.Type != Rversion {
+		t.Fatalf("expected the aborted request unanswered: %v, %v", &resp, err)
+	}
+
+	mu.Lock()
+	if len(events) != 2 || events[0] != "read 1" || events[1] != "clunk 1" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	mu.Unlock()
+
+	// the aborted request no longer counts against the limit.
+	if err := ch.WriteFcall(ctx, newFcall(3, MessageTread{Fid: 1, Offset: 2, Count: 1})); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if resp := roundtrip(newFcall(4, MessageTstat{Fid: 1})); resp.Type != Rerror || resp.Tag != 4 {
+		t.Fatalf("expected request over the limit rejected: %v", resp)
+	}
+
+	close(releases[2])
+	if err := ch.ReadFcall(ctx, &resp); err != nil || resp.Type != Rread || resp.Tag != 3 {
+		t.Fatalf("unexpected response: %v, %v", &resp, err)
+	}
+}
+
+// TestServerPanic ensures that a panic in a handler fails only its request,
+// with the stack logged.
+func TestServerPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	logged := make(chan string, 1)
+	go ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		if _, ok := msg.(MessageTclunk); ok {
+			return MessageRclunk{}, nil
+		}
+
+		var m map[string]int
+		m["boom"]++ // panics
+		return nil, nil
+	}), WithServerLogger(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		if level == LogError {
+			logged <- fmt.Sprintf(format, args...)
+		}
+	})))
+
+	session, err := NewSession(ctx, cconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != ErrInternal {
+		t.Fatalf("expected ErrInternal: %v", err)
+	}
+
+	if msg := <-logged; !strings.Contains(msg, "panic handling Tstat") || !strings.Contains(msg, "TestServerPanic") {
+		t.Fatalf("unexpected log: %q", msg)
+	}
+
+	if err := session.Clunk(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServerMaxRequests limits a connection to one request at once, holding
+// or rejecting the others.
+func TestServerMaxRequests(t *testing.T) {
+	for _, policy := range []BusyPolicy{BusyWait, BusyReject} {
+		var (
+			started = make(chan int64, 2)
+			release = make(chan struct{})
+		)
+		handler := HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			read := msg.(MessageTread)
+			started <- int64(read.Offset)
+			if read.Offset == 1 {
+				<-release
+			}
+
+			return MessageRread{}, nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cconn, sconn := net.Pipe()
+		go ServeConn(ctx, sconn, handler, WithMaxRequests(1, policy))
+
+		session, err := NewSession(ctx, cconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read := func(ctx context.Context, offset int64) chan error {
+			errs := make(chan error, 1)
+			go func() {
+				_, err := session.Read(ctx, 1, make([]byte, 1), offset)
+				errs <- err
+			}()
+			return errs
+		}
+
+		first := read(ctx, 1)
+		<-started
+
+		if policy == BusyReject {
+			if err := <-read(ctx, 2); err != ErrBusy {
+				t.Fatalf("expected ErrBusy: %v", err)
+			}
+		} else {
+			// a held request is flushed without waiting its turn.
+			rctx, rcancel := context.WithCancel(ctx)
+			flushed := read(rctx, 3)
+			second := read(ctx, 2)
+
+			time.Sleep(50 * time.Millisecond)
+			rcancel()
+			if err, ok := (<-flushed).(CancelError); !ok || !err.Flushed {
+				t.Fatalf("expected held request flushed: %#v", err)
+			}
+
+			select {
+			case offset := <-started:
+				t.Fatalf("request %d started beyond the limit", offset)
+			default:
+			}
+
+			close(release)
+			if err := <-second; err != nil {
+				t.Fatal(err)
+			}
+
+			if offset := <-started; offset != 2 {
+				t.Fatalf("unexpected request started: %d", offset)
+			}
+		}
+
+		if policy == BusyReject {
+			close(release)
+		}
+
+		if err := <-first; err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+// TestServerMaxConns limits a server to one connection at once, holding or
+// refusing the others.
+func TestServerMaxConns(t *testing.T) {
+	for _, policy := range []BusyPolicy{BusyWait, BusyReject} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		server := &Server{
+			Handler:    Dispatch(closingSession{closed: make(chan struct{})}),
+			MaxConns:   1,
+			ConnPolicy: policy,
+		}
+		go server.Serve(ctx, l)
+
+		dial := func() chan error {
+			errs := make(chan error, 1)
+			go func() {
+				cn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				session, err := NewSession(ctx, cn)
+				if err == nil {
+					_, err = session.Attach(ctx, 1, NOFID, "test", "/")
+				}
+
+				errs <- err
+				if err == nil {
+					// the connection is held until the second returns.
+					<-ctx.Done()
+				}
+				cn.Close()
+			}()
+			return errs
+		}
+
+		first := dial()
+		if err := <-first; err != nil {
+			t.Fatal(err)
+		}
+
+		second := dial()
+		if policy == BusyReject {
+			if err := <-second; err == nil || !strings.Contains(err.Error(), ErrBusy.Error()) {
+				t.Fatalf("expected connection refused as busy: %v", err)
+			}
+		} else {
+			select {
+			case err := <-second:
+				t.Fatalf("connection served beyond the limit: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		if err := server.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+	}
+}
+
+// countingChannel counts the reads of the channel it wraps.
+type countingChannel struct {
+	Channel
+	reads int64
+}
+
+func (ch *countingChannel) ReadFcall(ctx context.Context, fcall *Fcall) error {
+	atomic.AddInt64(&ch.reads, 1)
+	return ch.Channel.ReadFcall(ctx, fcall)
+}
+
+// TestServeDeadline ensures that the read loop of a connection exits once a
+// serve context with a deadline expires, rather than retrying its reads as
+// timeouts.
+func TestServeDeadline(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	sch := &countingChannel{Channel: newChannel(sconn, codec9p{}, DefaultMSize)}
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeChannel(ctx, sch, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return nil, ErrUnknownMsg
+		}))
+	}()
+
+	ch := newChannel(cconn, codec9p{}, DefaultMSize)
+	if _, err := clientnegotiate(context.Background(), ch, DefaultVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-served; err != context.DeadlineExceeded {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	reads := atomic.LoadInt64(&sch.reads)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&sch.reads); n != reads {
+		t.Fatalf("read loop still reading after the deadline: %v reads, then %v", reads, n)
+	}
+}
+
+// TestServerWriteTimeout ensures that a connection is closed once writing a
+// response times out, since part of it may have been written.
+func TestServerWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		}))
+	}()
+
+	ch := newChannel(cconn, codec9p{}, DefaultMSize)
+	if _, err := clientnegotiate(ctx, ch, DefaultVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// the response is never read, so writing it times out.
+	if err := ch.WriteFcall(ctx, newFcall(1, MessageTattach{Fid: 1, Afid: NOFID})); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatalf("expected error serving after the write timed out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not closed after the write timed out")
+	}
+}
@@ -0,0 +1,83 @@
+package p9p
+
+import (
+	"sync"
+	"time"
+)
+
+// statCache holds the directory entries returned by Stat, keyed by the qid
+// path of the file, for sessions created WithStatCache. Entries expire after
+// ttl and are invalidated by calls through the session that change the file.
+type statCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uint64]statEntry
+	gen     uint64 // incremented by each invalidation
+	sweepAt int    // size of entries that triggers a sweep of expired entries
+}
+
+type statEntry struct {
+	dir     Dir
+	expires time.Time
+}
+
+const minStatSweep = 64
+
+func newStatCache(ttl time.Duration) *statCache {
+	return &statCache{
+		ttl:     ttl,
+		entries: make(map[uint64]statEntry),
+		sweepAt: minStatSweep,
+	}
+}
+
+// get returns the unexpired entry for the file with qid path. If there is
+// none, the returned generation is passed to put with the response.
+func (sc *statCache) get(path uint64) (Dir, uint64, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	entry, ok := sc.entries[path]
+	if ok && time.Now().Before(entry.expires) {
+		return entry.dir, sc.gen, true
+	}
+
+	return Dir{}, sc.gen, false
+}
+
+// put caches dir for the file with qid path, unless the cache was
+// invalidated since gen was returned by get, in which case dir may be stale.
+func (sc *statCache) put(path uint64, gen uint64, dir Dir) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if gen != sc.gen {
+		return
+	}
+
+	now := time.Now()
+	if len(sc.entries) >= sc.sweepAt {
+		for path, entry := range sc.entries {
+			if !now.Before(entry.expires) {
+				delete(sc.entries, path)
+			}
+		}
+
+		sc.sweepAt = 2 * len(sc.entries)
+		if sc.sweepAt < minStatSweep {
+			sc.sweepAt = minStatSweep
+		}
+	}
+
+	sc.entries[path] = statEntry{dir: dir, expires: now.Add(sc.ttl)}
+}
+
+// invalidate drops the entry for the file with qid path.
+func (sc *statCache) invalidate(path uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	delete(sc.entries, path)
+	sc.gen++
+}
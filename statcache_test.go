@@ -0,0 +1,90 @@
+package p9p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestStatCache ensures that Stat is answered from the cache for any fid
+// referring to the same file, until a write through the session changes it.
+func TestStatCache(t *testing.T) {
+	tree := newMemTree("file", "dir/")
+
+	var stats int32
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		if _, ok := msg.(MessageTstat); ok {
+			atomic.AddInt32(&stats, 1)
+		}
+
+		return tree.Handle(ctx, msg)
+	}), WithStatCache(time.Hour))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fid := range []Fid{2, 3} {
+		if _, err := session.Walk(ctx, 1, fid, "file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(fid Fid, length uint64, n int32) {
+		d, err := session.Stat(ctx, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d.Length != length {
+			t.Fatalf("unexpected length: %v != %v", d.Length, length)
+		}
+
+		if got := atomic.LoadInt32(&stats); got != n {
+			t.Fatalf("unexpected number of stats sent: %v != %v", got, n)
+		}
+	}
+
+	expect(2, 0, 1)
+	expect(2, 0, 1)
+	expect(3, 0, 1) // same file, different fid.
+	expect(1, 0, 2)
+
+	if _, _, err := session.Open(ctx, 2, OWRITE); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Write(ctx, 2, []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(3, 4, 3)
+	expect(2, 4, 3)
+}
+
+func TestStatCacheExpires(t *testing.T) {
+	sc := newStatCache(10 * time.Millisecond)
+
+	_, gen, _ := sc.get(1)
+	sc.put(1, gen, Dir{Name: "file"})
+	if d, _, ok := sc.get(1); !ok || d.Name != "file" {
+		t.Fatalf("expected cached entry: %v %v", d, ok)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, _, ok := sc.get(1); ok {
+		t.Fatal("expected entry to expire")
+	}
+
+	// a response racing with an invalidation is not cached.
+	_, gen, _ = sc.get(2)
+	sc.invalidate(2)
+	sc.put(2, gen, Dir{Name: "stale"})
+	if _, _, ok := sc.get(2); ok {
+		t.Fatal("expected stale entry to be dropped")
+	}
+}
@@ -0,0 +1,158 @@
+package p9p
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// openStripes opens the file at path with mode on each stripe of c, returning
+// f, already open on c, first.
+func (c *Client) openStripes(ctx context.Context, f *File, path string, mode Flag) ([]*File, error) {
+	files := []*File{f}
+	for _, sc := range c.stripes {
+		sf, err := sc.Open(ctx, path, mode)
+		if err != nil {
+			closeFiles(files[1:])
+			return nil, err
+		}
+		files = append(files, sf)
+	}
+
+	return files, nil
+}
+
+func closeFiles(files []*File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// stripe calls fn for each chunk of size bytes in [0, length), spreading the
+// chunks over files in turn with one in flight on each. It stops at the first
+// error, which is returned.
+func stripe(ctx context.Context, files []*File, length int64, size int, fn func(ctx context.Context, f *File, offset int64, n int) error) error {
+	var (
+		mu    sync.Mutex
+		first error
+	)
+	step := int64(len(files)) * int64(size)
+
+	Batch(ctx, len(files), func(ctx context.Context, i int) error {
+		for offset := int64(i) * int64(size); offset < length; offset += step {
+			n := size
+			if rem := length - offset; rem < int64(n) {
+				n = int(rem)
+			}
+
+			if err := fn(ctx, files[i], offset, n); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+				return err
+			}
+		}
+
+		return nil
+	}, WithFailFast())
+
+	return first
+}
+
+// stripeSize returns the size of the chunks striped over files, which fits
+// in a message on each.
+func stripeSize(files []*File) int {
+	size := files[0].size
+	for _, f := range files[1:] {
+		if f.size < size {
+			size = f.size
+		}
+	}
+
+	return size
+}
+
+// maxStripedRead bounds the files read whole in memory by stripes, which
+// must fit in a slice on every platform.
+const maxStripedRead = 1<<31 - 1
+
+// readStriped reads the file f, opened at path for reading, with its chunks
+// striped across the stripes of c. It returns the data read from the start
+// of the file up to the first short read, which the caller continues from,
+// or nil if the file is too small to stripe.
+func (c *Client) readStriped(ctx context.Context, f *File, path string) ([]byte, error) {
+	dir, err := f.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir.Length <= uint64(f.size) || dir.Length > uint64(maxStripedRead) {
+		return nil, nil
+	}
+
+	files, err := c.openStripes(ctx, f, path, OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files[1:])
+
+	var (
+		buf = make([]byte, dir.Length)
+		mu  sync.Mutex
+		end = int64(len(buf)) // end of the data read in full
+	)
+	err = stripe(ctx, files, int64(len(buf)), stripeSize(files), func(ctx context.Context, f *File, offset int64, n int) error {
+		mu.Lock()
+		skip := offset >= end
+		mu.Unlock()
+		if skip {
+			return nil // past a short read.
+		}
+
+		m, err := f.session.Read(ctx, f.fid, buf[offset:offset+int64(n)], offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if m < n {
+			// the file shrank, or the server returned less data than
+			// asked. Either way, the data after it is not trusted.
+			mu.Lock()
+			if offset+int64(m) < end {
+				end = offset + int64(m)
+			}
+			mu.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:end], nil
+}
+
+// writeStriped writes data to the file f, opened at path for writing, with
+// its chunks striped across the stripes of c. It reports whether data was
+// large enough to stripe. Append only files are not striped, since their
+// writes land at the end whatever their offset.
+func (c *Client) writeStriped(ctx context.Context, f *File, path string, data []byte) (bool, error) {
+	if len(data) <= f.size || f.qid.Type&QTAPPEND != 0 {
+		return false, nil
+	}
+
+	files, err := c.openStripes(ctx, f, path, OWRITE)
+	if err != nil {
+		return true, err
+	}
+	defer closeFiles(files[1:])
+
+	return true, stripe(ctx, files, int64(len(data)), stripeSize(files), func(ctx context.Context, f *File, offset int64, n int) error {
+		_, err := writeFull(ctx, f.session, f.fid, data[offset:offset+int64(n)], offset)
+		return err
+	})
+}
@@ -0,0 +1,114 @@
+package p9p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestStripes reads and writes a file over several connections, ensuring
+// that every connection carries part of the transfer and that a short read
+// on one of them doesn't lose data.
+func TestStripes(t *testing.T) {
+	const stripes = 3
+	dir, err := ioutil.TempDir("", "p9p-stripes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "9p.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := ListenUnix(ctx, path)
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+
+	// the connections share a tree, each with its own fids.
+	var (
+		mu    sync.Mutex
+		tree  = newMemTree("file")
+		reads = map[int]int{}
+		conns int
+	)
+	data := bytes.Repeat([]byte("0123456789"), 105)
+	tree.data["file"] = data
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			id := conns
+			conns++
+			mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				fids := map[Fid]string{}
+				ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					if m, ok := msg.(MessageTread); ok {
+						reads[id]++
+						if id == 1 && m.Offset == 400 {
+							m.Count = 30 // a short read in the middle of the file.
+							msg = m
+						}
+					}
+
+					tree.fids = fids
+					return tree.Handle(ctx, msg)
+				}))
+			}()
+		}
+	}()
+
+	client, err := DialAddr(ctx, "unix!"+path, "test", WithStripes(stripes), WithMSize(IOHDRSZ+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	p, err := client.ReadFile(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, data) {
+		t.Fatalf("unexpected data: %q", p)
+	}
+
+	mu.Lock()
+	if conns != stripes || len(reads) != stripes {
+		t.Fatalf("expected reads on %v connections: %v", stripes, reads)
+	}
+	mu.Unlock()
+
+	written := bytes.Repeat([]byte("abcdefghij"), 95)
+	if err := client.WriteFile(ctx, "file", written, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(tree.data["file"], written) {
+		t.Fatalf("unexpected data written: %q", tree.data["file"])
+	}
+
+	// only the root should remain in use on the last connection used.
+	if len(tree.fids) != 1 {
+		t.Fatalf("fids leaked: %v", tree.fids)
+	}
+}
@@ -0,0 +1,197 @@
+package p9p
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RequestInfo describes a request outstanding on a client session.
+type RequestInfo struct {
+	Tag     Tag
+	Type    FcallType // type of the request message
+	Started time.Time // time the tag was allocated
+}
+
+// tagPool allocates tags for outstanding requests on a transport. Released
+// tags are reused in the order they were released, so a tag that was just
+// freed is the last to be handed out again. The pool is safe for concurrent
+// use, allowing it to be inspected outside of the handle loop.
+type tagPool struct {
+	mu    sync.Mutex
+	next  Tag
+	free  []Tag
+	inuse map[Tag]*RequestInfo
+
+	// low, high and pressure configure the watermark callback. pressured is
+	// set while the pool is above the low watermark after reaching high.
+	low, high int
+	pressure  func(inuse int, pressured bool)
+	pressured bool
+}
+
+func newTagPool() *tagPool {
+	return &tagPool{
+		inuse: make(map[Tag]*RequestInfo),
+	}
+}
+
+// setWatermarks arranges for fn to be called from get when the number of tags
+// in use reaches high, and from put when it falls back to low.
+func (p *tagPool) setWatermarks(low, high int, fn func(inuse int, pressured bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.low, p.high, p.pressure = low, high, fn
+}
+
+// watermark checks the occupancy of the pool against the watermarks,
+// returning a function to notify the callback if one has been crossed. It
+// must be called with mu held and the returned function called without it.
+func (p *tagPool) watermark() func() {
+	if p.pressure == nil {
+		return func() {}
+	}
+
+	inuse := len(p.inuse)
+	switch {
+	case !p.pressured && inuse >= p.high:
+		p.pressured = true
+	case p.pressured && inuse <= p.low:
+		p.pressured = false
+	default:
+		return func() {}
+	}
+
+	fn, pressured := p.pressure, p.pressured
+	return func() { fn(inuse, pressured) }
+}
+
+// get allocates an unused tag for a request of type typ. NOTAG is never
+// allocated.
+func (p *tagPool) get(typ FcallType) (Tag, error) {
+	p.mu.Lock()
+	tag, err := p.alloc(typ)
+	notify := p.watermark()
+	p.mu.Unlock()
+
+	notify()
+	return tag, err
+}
+
+// alloc takes the next tag from the pool. It must be called with mu held.
+func (p *tagPool) alloc(typ FcallType) (Tag, error) {
+	var tag Tag
+	switch {
+	case len(p.free) > 0:
+		tag, p.free = p.free[0], p.free[1:]
+	case p.next != NOTAG:
+		tag = p.next
+		p.next++
+	default:
+		return NOTAG, ErrNomem
+	}
+
+	p.inuse[tag] = &RequestInfo{Tag: tag, Type: typ, Started: time.Now()}
+	return tag, nil
+}
+
+// put returns tag to the pool. It returns false if tag was not allocated,
+// leaving the pool unchanged.
+func (p *tagPool) put(tag Tag) bool {
+	p.mu.Lock()
+	if _, ok := p.inuse[tag]; !ok {
+		p.mu.Unlock()
+		return false
+	}
+
+	delete(p.inuse, tag)
+	p.free = append(p.free, tag)
+	notify := p.watermark()
+	p.mu.Unlock()
+
+	notify()
+	return true
+}
+
+// len returns the number of tags in use.
+func (p *tagPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inuse)
+}
+
+// list returns a description of each tag in use, ordered by tag.
+func (p *tagPool) list() []RequestInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	infos := make([]RequestInfo, 0, len(p.inuse))
+	for _, info := range p.inuse {
+		infos = append(infos, *info)
+	}
+
+	sort.Sort(requestInfos(infos))
+	return infos
+}
+
+type requestInfos []RequestInfo
+
+func (ri requestInfos) Len() int           { return len(ri) }
+func (ri requestInfos) Less(i, j int) bool { return ri[i].Tag < ri[j].Tag }
+func (ri requestInfos) Swap(i, j int)      { ri[i], ri[j] = ri[j], ri[i] }
+
+// requestLister is implemented by transports that can describe their
+// outstanding requests.
+type requestLister interface {
+	outstanding() []RequestInfo
+}
+
+// OutstandingRequests describes the requests on session that hold a tag,
+// including flushes. A request holds its tag from when it is sent until its
+// response arrives or, if it was flushed, until the flush is answered. This
+// is useful for finding requests that a server never answers. If session
+// does not track requests, nil is returned.
+func OutstandingRequests(session Session) []RequestInfo {
+	c, ok := clientOf(session)
+	if !ok {
+		return nil
+	}
+
+	rl, ok := c.transport.(requestLister)
+	if !ok {
+		return nil
+	}
+
+	return rl.outstanding()
+}
+
+// tagFlusher is implemented by transports that can flush a request by tag.
+type tagFlusher interface {
+	flush(ctx context.Context, tag Tag) error
+}
+
+// Flush flushes the outstanding request with tag, as listed by
+// OutstandingRequests, blocking until the server answers the flush. This
+// aborts a request, such as a long running read, without canceling its
+// context. If the request has not been answered by then, its call fails with
+// a CancelError holding ErrFlushed. Flushing the tag of a Tflush flushes the
+// flush. If tag is not outstanding, Flush does nothing.
+//
+// Calls made on session are flushed automatically when their context is
+// done. Flush is for calls that must be aborted from elsewhere.
+func Flush(ctx context.Context, session Session, tag Tag) error {
+	c, ok := clientOf(session)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	tf, ok := c.transport.(tagFlusher)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	return tf.flush(ctx, tag)
+}
@@ -0,0 +1,138 @@
+package p9p
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestTagPoolWatermarks ensures the watermark callback fires once on crossing
+// each watermark.
+func TestTagPoolWatermarks(t *testing.T) {
+	type event struct {
+		inuse     int
+		pressured bool
+	}
+
+	var events []event
+	p := newTagPool()
+	p.setWatermarks(1, 3, func(inuse int, pressured bool) {
+		events = append(events, event{inuse, pressured})
+	})
+
+	var tags []Tag
+	for i := 0; i < 4; i++ {
+		tag, err := p.get(Tread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+
+	for _, tag := range tags {
+		if !p.put(tag) {
+			t.Fatalf("tag %v not in use", tag)
+		}
+	}
+
+	// get and put again, crossing the watermarks a second time.
+	for i := 0; i < 3; i++ {
+		if _, err := p.get(Tread); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []event{
+		{3, true},
+		{1, false},
+		{3, true},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("unexpected events: %v != %v", events, expected)
+	}
+}
+
+// TestOutstandingRequests ensures a request is listed while it holds a tag.
+func TestOutstandingRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			close(started)
+			<-release
+			return MessageRread{}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := session.Read(context.Background(), 1, make([]byte, 8), 0)
+		errs <- err
+	}()
+
+	<-started
+	requests := OutstandingRequests(session)
+	if len(requests) != 1 || requests[0].Type != Tread || requests[0].Started.IsZero() {
+		t.Fatalf("unexpected outstanding requests: %v", requests)
+	}
+
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := OutstandingRequests(session); len(requests) != 0 {
+		t.Fatalf("tag not returned: %v", requests)
+	}
+}
+
+// TestFlush ensures that Flush aborts a request that the server holds.
+func TestFlush(t *testing.T) {
+	started := make(chan struct{})
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTread:
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := session.Read(context.Background(), 1, make([]byte, 8), 0)
+		errs <- err
+	}()
+
+	<-started
+	requests := OutstandingRequests(session)
+	if len(requests) != 1 {
+		t.Fatalf("unexpected outstanding requests: %v", requests)
+	}
+
+	if err := Flush(context.Background(), session, requests[0].Tag); err != nil {
+		t.Fatal(err)
+	}
+
+	cerr, ok := (<-errs).(CancelError)
+	if !ok || !cerr.Flushed || cerr.Err != ErrFlushed {
+		t.Fatalf("expected flushed read: %#v", cerr)
+	}
+
+	if requests := OutstandingRequests(session); len(requests) != 0 {
+		t.Fatalf("tags not returned: %v", requests)
+	}
+
+	// flushing a tag that is no longer outstanding is harmless.
+	if err := Flush(context.Background(), session, requests[0].Tag); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,164 @@
+package p9p
+
+import (
+	"archive/tar"
+	"io"
+	pathpkg "path"
+
+	"golang.org/x/net/context"
+)
+
+// ExportTar writes the tree at path on c to w as a tar archive, with the
+// names of entries relative to path. Directories and regular files are
+// archived with their permissions, owner and modification time. The
+// contents of files are streamed as with OpenStream.
+func ExportTar(ctx context.Context, c *Client, path string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := exportTar(ctx, c, tw, path, ""); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// exportTar archives the file at path on c as name, recursively.
+func exportTar(ctx context.Context, c *Client, tw *tar.Writer, path, name string) error {
+	dir, err := c.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(dir.Mode & 0777),
+		Uname:   dir.UID,
+		Gname:   dir.GID,
+		ModTime: dir.ModTime,
+	}
+
+	if dir.Qid.Type&QTDIR != 0 {
+		if name != "" {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+
+		entries, err := c.ReadDir(ctx, path)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range entries {
+			if err := exportTar(ctx, c, tw, pathpkg.Join(path, d.Name), pathpkg.Join(name, d.Name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if name == "" {
+		hdr.Name = pathpkg.Base(pathpkg.Clean("/" + path))
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = int64(dir.Length)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	rc, err := c.OpenStream(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// the archive holds exactly the length in the header.
+	n, err := io.CopyN(tw, rc, hdr.Size)
+	if err == io.EOF && n < hdr.Size {
+		err = io.ErrUnexpectedEOF // the file shrank.
+	}
+
+	if err != nil {
+		return &PathError{Op: "read", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// ImportTar extracts the tar archive read from r into the directory at path
+// on c, creating it and any missing parents. Files are created or replaced,
+// with the permissions and modification time of their entries. Entries
+// other than directories and regular files, such as links, are skipped.
+// Names are confined to path: leading slashes and ".." elements cannot
+// escape it.
+func ImportTar(ctx context.Context, c *Client, path string, r io.Reader) error {
+	if err := c.MkdirAll(ctx, path, 0777); err != nil {
+		return err
+	}
+
+	// directories are set last, since extracting into them changes their
+	// modification time.
+	var dirs []*tar.Header
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := pathpkg.Join(path, pathpkg.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := c.MkdirAll(ctx, name, uint32(hdr.Mode)&0777); err != nil {
+				return err
+			}
+
+			hdr.Name = name
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			if err := importFile(ctx, c, name, hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := c.setModes(ctx, dirs[i].Name, Dir{Mode: DMDIR | uint32(dirs[i].Mode)&0777, ModTime: dirs[i].ModTime}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importFile writes the contents of the regular file entry hdr, read from r,
+// to path on c.
+func importFile(ctx context.Context, c *Client, path string, hdr *tar.Header, r io.Reader) error {
+	if err := c.MkdirAll(ctx, pathpkg.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	perm := uint32(hdr.Mode) & 0777
+	f, err := c.createTrunc(ctx, path, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFrom(ctx, c.session, f.fid, 0, r, f.size)
+	if cerr := c.session.Clunk(ctx, f.fid); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return &PathError{Op: "write", Path: path, Err: err}
+	}
+
+	return c.setModes(ctx, path, Dir{Mode: perm, ModTime: hdr.ModTime})
+}
@@ -0,0 +1,118 @@
+package p9p
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestTar exports a tree to a tar archive and imports it into another,
+// ensuring that contents, permissions and modification times survive, and
+// that names in the archive cannot escape the target directory.
+func TestTar(t *testing.T) {
+	ctx := context.Background()
+	mtime := time.Unix(1000000000, 0)
+
+	src := newMemTree("dir/a", "dir/sub/b")
+	src.data["dir/a"] = bytes.Repeat([]byte("0123456789"), 100)
+	src.data["dir/sub/b"] = []byte("b")
+	src.modes["dir/a"] = 0640
+	src.modes["dir/sub"] = DMDIR | 0750
+	src.mtimes["dir/a"] = mtime
+	src.mtimes["dir/sub"] = mtime.Add(time.Hour)
+	dst := newMemTree()
+
+	clients := make([]*Client, 2)
+	for i, tree := range []*memTree{src, dst} {
+		session, cleanup := newTestSession(t, tree, WithMSize(IOHDRSZ+300))
+		defer cleanup()
+
+		c, err := NewClient(ctx, session, "test", "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	var buf bytes.Buffer
+	if err := ExportTar(ctx, clients[0], "/dir", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries are copied to another archive, to be imported.
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+
+	entries := map[string]*tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg && !bytes.Equal(p, src.data["dir/"+hdr.Name]) {
+			t.Fatalf("%v: unexpected data: %q", hdr.Name, p)
+		}
+		entries[hdr.Name] = hdr
+
+		tw.WriteHeader(hdr)
+		tw.Write(p)
+	}
+
+	if len(entries) != 3 || entries["sub/"] == nil || entries["sub/"].Typeflag != tar.TypeDir {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	if hdr := entries["a"]; hdr == nil || hdr.Mode != 0640 || !hdr.ModTime.Equal(mtime) {
+		t.Fatalf("unexpected entry for a: %+v", hdr)
+	}
+
+	// an entry trying to escape the target directory.
+	tw.WriteHeader(&tar.Header{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0600, Size: 1, ModTime: mtime})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	if err := ImportTar(ctx, clients[1], "/restore", &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	for _, p := range []string{"a", "sub/b"} {
+		if !bytes.Equal(dst.data["restore/"+p], src.data["dir/"+p]) {
+			t.Fatalf("%v: unexpected data: %q", p, dst.data["restore/"+p])
+		}
+	}
+
+	if dst.modes["restore/a"] != 0640 || dst.modes["restore/sub"] != DMDIR|0750 {
+		t.Fatalf("unexpected modes: %o, %o", dst.modes["restore/a"], dst.modes["restore/sub"])
+	}
+
+	if !dst.mtimes["restore/a"].Equal(mtime) || !dst.mtimes["restore/sub"].Equal(mtime.Add(time.Hour)) {
+		t.Fatalf("unexpected modification times: %v", dst.mtimes)
+	}
+
+	if _, ok := dst.files["restore/escape"]; !ok {
+		t.Fatalf("expected the escaping entry confined to the target: %v", dst.files)
+	}
+
+	if len(dst.fids) != 1 {
+		t.Fatalf("fids leaked: %v", dst.fids)
+	}
+}
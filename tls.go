@@ -0,0 +1,104 @@
+package p9p
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultTLSHandshakeTimeout bounds the TLS handshake of a connection served
+// with ServeTLS, so that a client that never completes it does not hold the
+// connection open.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// DialTLS connects to address on the named network and returns a session over
+// a TLS connection configured by config, as with Dial. The handshake is
+// completed before the version is negotiated and is abandoned when ctx is
+// done. If config does not name the server, the host of address is used.
+func DialTLS(ctx context.Context, network, address string, config *tls.Config, opts ...SessionOption) (Session, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	return Dial(ctx, network, address, append(opts, func(so *sessionOptions) {
+		so.tlsConfig = config
+	})...)
+}
+
+// ServeTLS serves handler over a TLS connection on cn configured by config,
+// as with ServeConn. The handshake must complete within
+// DefaultTLSHandshakeTimeout and before ctx is done. The state of the
+// connection, including the certificates of the peer, is available to the
+// handler from TLSConnectionState.
+func ServeTLS(ctx context.Context, cn net.Conn, config *tls.Config, handler Handler, opts ...ServerOption) error {
+	conn := tls.Server(cn, config)
+
+	hsctx, cancel := context.WithTimeout(ctx, DefaultTLSHandshakeTimeout)
+	err := handshake(hsctx, conn, conn.Handshake)
+	cancel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	ctx = context.WithValue(ctx, tlsStateKey, conn.ConnectionState())
+	return ServeConn(ctx, conn, handler, opts...)
+}
+
+const tlsStateKey contextKey = "9p.tls"
+
+// TLSConnectionState returns the state of the TLS connection a request was
+// received on, from the context passed to a handler of ServeTLS. If the
+// connection is not a TLS connection, false is returned.
+func TLSConnectionState(ctx context.Context) (tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey).(tls.ConnectionState)
+	return state, ok
+}
+
+// handshake runs fn, the handshake of conn, abandoning it when ctx is done.
+// The deadline of conn is cleared afterwards.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock the handshake.
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	<-stopped
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() && hasDeadline {
+		// the deadline of ctx has passed, but ctx may not be done yet.
+		<-ctx.Done()
+	}
+
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	conn.SetDeadline(time.Time{})
+	return err
+}
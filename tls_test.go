@@ -0,0 +1,146 @@
+package p9p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and the
+// pool trusting it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "p9p test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// TestTLS dials a session with DialTLS to a server using ServeTLS and ensures
+// that the handler sees the certificate of the client.
+func TestTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+
+	cert, pool := newTestCertificate(t)
+	peers := make(chan string, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		ServeTLS(ctx, conn, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			state, ok := TLSConnectionState(ctx)
+			if !ok || len(state.PeerCertificates) == 0 {
+				return nil, ErrPerm
+			}
+
+			if info, ok := GetConnInfo(ctx); !ok || info.TLS == nil || RemoteAddr(ctx) == nil {
+				return nil, ErrPerm
+			}
+
+			select {
+			case peers <- state.PeerCertificates[0].Subject.CommonName:
+			default:
+			}
+
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		}))
+	}()
+
+	session, err := DialTLS(ctx, "tcp", l.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if peer := <-peers; peer != "p9p test" {
+		t.Fatalf("unexpected peer: %q", peer)
+	}
+
+	if _, ok := TLSConnectionState(ctx); ok {
+		t.Fatalf("unexpected connection state outside of a handler")
+	}
+}
+
+// TestTLSHandshakeTimeout ensures that DialTLS gives up on a server that
+// never completes the handshake when the context is done.
+func TestTLSHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// read the client hello, but never answer it.
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := DialTLS(ctx, "tcp", l.Addr().String(), nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package p9p
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// traceDataLen is the number of bytes of a payload included in a trace.
+const traceDataLen = 32
+
+// TraceChannel returns a Channel that writes each fcall read from or written
+// to ch to w, one line per fcall. Written fcalls are prefixed with "->" and
+// fcalls read with "<-", followed by the type, tag and fields of the message.
+// Payloads are truncated to 32 bytes. This is intended for debugging interop
+// problems and costs a formatted line for every message.
+func TraceChannel(ch Channel, w io.Writer) Channel {
+	return &traceChannel{Channel: ch, w: w}
+}
+
+// traceChannel traces the fcalls on a Channel. Reads and writes may be traced
+// concurrently.
+type traceChannel struct {
+	Channel
+	mu sync.Mutex // serializes lines written to w
+	w  io.Writer
+}
+
+var _ readBufferer = &traceChannel{}
+
+func (tc *traceChannel) ReadFcall(ctx context.Context, fcall *Fcall) error {
+	if err := tc.Channel.ReadFcall(ctx, fcall); err != nil {
+		return err
+	}
+
+	tc.trace("<-", fcall)
+	return nil
+}
+
+// WriteFcall traces fcall before writing it, so that it is traced before the
+// response.
+func (tc *traceChannel) WriteFcall(ctx context.Context, fcall *Fcall) error {
+	tc.trace("->", fcall)
+	return tc.Channel.WriteFcall(ctx, fcall)
+}
+
+// Close closes the traced channel, if it implements io.Closer.
+func (tc *traceChannel) Close() error {
+	if closer, ok := tc.Channel.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// setReadBuffers passes read buffers through to the traced channel, so that
+// tracing does not change how responses are read.
+func (tc *traceChannel) setReadBuffers(fn func(tag Tag) (buf []byte, release func())) {
+	if rb, ok := tc.Channel.(readBufferer); ok {
+		rb.setReadBuffers(fn)
+	}
+}
+
+func (tc *traceChannel) trace(dir string, fcall *Fcall) {
+	line := fmt.Sprintf("%s %v(%v)%s", dir, fcall.Type, fcall.Tag, traceMessage(fcall.Message))
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	fmt.Fprintln(tc.w, line)
+}
+
+// traceMessage formats the fields of msg as in the String method of Fcall,
+// truncating payloads.
+func traceMessage(msg Message) string {
+	if msg == nil {
+		return " nil"
+	}
+
+	rv := reflect.Indirect(reflect.ValueOf(msg))
+	if rv.Kind() != reflect.Struct {
+		return fmt.Sprintf(" %v", msg)
+	}
+
+	var s string
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // unexported, possibly in an extension message
+		}
+		name := strings.ToLower(field.Name)
+		f := rv.Field(i)
+
+		if p, ok := f.Interface().([]byte); ok {
+			s += fmt.Sprintf(" %v=%s", name, traceData(p))
+			continue
+		}
+
+		s += fmt.Sprintf(" %v=%v", name, f.Interface())
+	}
+
+	return s
+}
+
+// traceData quotes the first traceDataLen bytes of p, noting the length of
+// the rest.
+func traceData(p []byte) string {
+	if len(p) <= traceDataLen {
+		return fmt.Sprintf("%q", p)
+	}
+
+	return fmt.Sprintf("%q...(%d bytes)", p[:traceDataLen], len(p))
+}
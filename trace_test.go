@@ -0,0 +1,85 @@
+package p9p
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// TestTrace traces both ends of a session and ensures that each fcall is
+// written in each direction, with payloads truncated.
+func TestTrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ctrace, strace logBuffer
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		ServeConn(ctx, sconn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			if msg, ok := msg.(MessageTwrite); ok {
+				return MessageRwrite{Count: uint32(len(msg.Data))}, nil
+			}
+
+			return nil, ErrUnknownMsg
+		}), WithServerTrace(&strace))
+	}()
+
+	session, err := NewSession(ctx, cconn, WithTrace(&ctrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Write(ctx, 1, bytes.Repeat([]byte("x"), 100), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.Stat(ctx, 1); err != ErrUnknownMsg {
+		t.Fatalf("expected ErrUnknownMsg: %v", err)
+	}
+
+	// wait for the server to trace its last response.
+	cconn.Close()
+	<-served
+
+	data := `data="` + strings.Repeat("x", traceDataLen) + `"...(100 bytes)`
+	for _, testcase := range []struct {
+		trace    *logBuffer
+		expected []string
+	}{
+		{&ctrace, []string{
+			"-> Tversion(65535) msize=",
+			"<- Rversion(65535) msize=",
+			"-> Twrite(0) fid=1 offset=0 " + data,
+			"<- Rwrite(0) count=100",
+			"-> Tstat(0) fid=1",
+			"<- Rerror(0) ename=unknown message",
+		}},
+		{&strace, []string{
+			"<- Tversion(65535) msize=",
+			"-> Rversion(65535) msize=",
+			"<- Twrite(0) fid=1 offset=0 " + data,
+			"-> Rwrite(0) count=100",
+			"<- Tstat(0) fid=1",
+			"-> Rerror(0) ename=unknown message",
+		}},
+	} {
+		lines := strings.Split(strings.TrimSpace(testcase.trace.String()), "\n")
+		if len(lines) != len(testcase.expected) {
+			t.Fatalf("unexpected trace:\n%s", testcase.trace)
+		}
+
+		for i, line := range lines {
+			if !strings.HasPrefix(line, testcase.expected[i]) {
+				t.Fatalf("unexpected trace line %q, expected %q", line, testcase.expected[i])
+			}
+		}
+	}
+}
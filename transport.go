@@ -2,12 +2,40 @@ package p9p
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
+// RoundTripper sends a request message and returns the response, much like
+// http.RoundTripper. An error response from the server is returned as the
+// error, and the response is nil. RoundTrip must be safe for concurrent use.
+//
+// The RoundTripper returned by NewRoundTripper manages tag assignment and
+// message serialization. Wrap it to add retries, caching or instrumentation,
+// then create a session over the wrapper with NewRoundTripperSession.
+type RoundTripper interface {
+	RoundTrip(ctx context.Context, msg Message) (Message, error)
+}
+
+// NewRoundTripper negotiates a connection on conn, as NewSession does, and
+// returns a RoundTripper for it with the negotiated msize and version. The
+// context ctx governs the lifetime of the RoundTripper, which implements
+// io.Closer.
+func NewRoundTripper(ctx context.Context, conn net.Conn, opts ...SessionOption) (RoundTripper, int, string, error) {
+	so := newSessionOptions(opts)
+
+	ch, version, msize, err := negotiateConn(ctx, conn, so)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	return newTransport(ctx, ch, so).(*transport), msize, version, nil
+}
+
 // roundTripper manages the request and response from the client-side. A
 // roundTripper must abide by similar rules to the http.RoundTripper.
 // Typically, the roundTripper will manage tag assignment and message
@@ -16,26 +44,128 @@ type roundTripper interface {
 	send(ctx context.Context, msg Message) (Message, error)
 }
 
+// roundTripperFunc adapts a RoundTripper provided by the caller. Only Close
+// is passed through, since the optional features of the transport can't be
+// reached through a wrapper.
+type roundTripperFunc struct {
+	rt RoundTripper
+}
+
+func (rf roundTripperFunc) send(ctx context.Context, msg Message) (Message, error) {
+	return rf.rt.RoundTrip(ctx, msg)
+}
+
+func (rf roundTripperFunc) Close() error {
+	if closer, ok := rf.rt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// flushAller is implemented by roundTrippers that can flush all outstanding
+// requests before closing.
+type flushAller interface {
+	flushAll(ctx context.Context) error
+}
+
 // transport plays the role of being a client channel manager. It multiplexes
 // function calls onto the wire and dispatches responses to blocking calls to
 // send. On the whole, transport is thread-safe for calling send
 type transport struct {
-	ctx      context.Context
-	ch       Channel
-	requests chan *fcallRequest
-	closed   chan struct{}
+	ctx       context.Context
+	ch        Channel
+	queue     *requestQueue
+	flushalls chan flushAllRequest
+	cancels   chan *fcallRequest
+	flushtags chan flushTagRequest
+	shutdowns chan chan struct{}
+	versions  chan *fcallRequest // Tversion requests from renegotiate
+	vcancels  chan *fcallRequest // renegotiate requests given up on
+	resume    chan struct{}      // resumes the read loop after an Rversion
+	tags      *tagPool
+	rbufs     *readBuffers
+	closed    chan struct{}
+	err       error // reason for closing, valid once closed is closed
+
+	// drain is how long to keep delivering responses to outstanding
+	// requests once ctx is done.
+	drain time.Duration
 
-	tags uint16
+	// strict closes the transport on a response with an unknown tag, rather
+	// than dropping it.
+	strict bool
+
+	// slots, if set, holds a token for each outstanding request, bounding
+	// how many may be in flight. If nowait is set, a request fails with
+	// ErrTooManyRequests rather than waiting for a slot.
+	slots  chan struct{}
+	nowait bool
+
+	// metrics, if set, observes each request.
+	metrics RequestMetrics
+
+	// overhead is the number of bytes of each frame taken by the codec,
+	// beyond the message.
+	overhead int
+
+	// logger receives diagnostic output, nil for the default logger.
+	logger Logger
+
+	// closeOnce guards closed. The handle loop, the read loop and external
+	// callers may all race to close the transport.
+	closeOnce sync.Once
 }
 
 var _ roundTripper = &transport{}
+var _ flushAller = &transport{}
+var _ readIntoer = &transport{}
+var _ closeNotifier = &transport{}
+var _ requestLister = &transport{}
+var _ tagFlusher = &transport{}
+var _ shutdowner = &transport{}
 
-func newTransport(ctx context.Context, ch *channel) roundTripper {
+// newTransport returns a transport sending requests over ch. The context ctx
+// governs the lifetime of the transport, not of any one request. When it is
+// done, the transport shuts down and outstanding requests fail with
+// ErrSessionDone. Each request is governed by the context passed to send.
+func newTransport(ctx context.Context, ch Channel, so sessionOptions) roundTripper {
 	t := &transport{
-		ctx:      ctx,
-		ch:       ch,
-		requests: make(chan *fcallRequest),
-		closed:   make(chan struct{}),
+		drain:     so.drainTimeout,
+		strict:    so.strictTags,
+		logger:    so.logger,
+		nowait:    so.maxOutstandingNoWait,
+		ctx:       ctx,
+		ch:        ch,
+		queue:     newRequestQueue(),
+		flushalls: make(chan flushAllRequest),
+		cancels:   make(chan *fcallRequest),
+		flushtags: make(chan flushTagRequest),
+		shutdowns: make(chan chan struct{}),
+		versions:  make(chan *fcallRequest),
+		vcancels:  make(chan *fcallRequest),
+		resume:    make(chan struct{}, 1),
+		tags:      newTagPool(),
+		rbufs:     newReadBuffers(),
+		closed:    make(chan struct{}),
+	}
+
+	t.overhead = so.frameOverhead()
+
+	if rm, ok := so.metrics.(RequestMetrics); ok {
+		t.metrics = rm
+	}
+
+	if so.maxOutstanding > 0 {
+		t.slots = make(chan struct{}, so.maxOutstanding)
+	}
+
+	if so.tagPressure != nil {
+		t.tags.setWatermarks(so.tagLow, so.tagHigh, so.tagPressure)
+	}
+
+	if rb, ok := ch.(readBufferer); ok {
+		rb.setReadBuffers(t.rbufs.lookup)
 	}
 
 	go t.handle()
@@ -49,6 +179,16 @@ type fcallRequest struct {
 	message  Message
 	response chan *Fcall
 	err      chan error
+	rbuf     []byte // destination for data of an Rread, if any
+
+	// fields managed by requestQueue
+	priority Priority
+	seq      uint64
+	index    int
+
+	// fields managed by the handle loop
+	tag  Tag
+	sent time.Time
 }
 
 func newFcallRequest(ctx context.Context, msg Message) *fcallRequest {
@@ -57,131 +197,699 @@ func newFcallRequest(ctx context.Context, msg Message) *fcallRequest {
 		message:  msg,
 		response: make(chan *Fcall, 1),
 		err:      make(chan error, 1),
+		index:    -1,
 	}
 }
 
+// flushTagRequest asks the handle loop to flush tag. done receives the
+// outcome once the flush has been answered.
+type flushTagRequest struct {
+	ctx  context.Context
+	tag  Tag
+	done chan error
+}
+
+// flushAllRequest asks the handle loop to flush all outstanding requests.
+// done is closed once every flush has been answered.
+type flushAllRequest struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
 func (t *transport) send(ctx context.Context, msg Message) (Message, error) {
+	return t.sendInto(ctx, msg, nil)
+}
+
+// sendInto sends msg, decoding the data of an Rread response into rbuf if the
+// channel supports it.
+func (t *transport) sendInto(ctx context.Context, msg Message, rbuf []byte) (Message, error) {
 	req := newFcallRequest(ctx, msg)
+	req.rbuf = rbuf
 
-	// dispatch the request.
 	select {
 	case <-t.closed:
-		return nil, ErrClosed
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case t.requests <- req:
+		return nil, t.err
+	default:
 	}
 
-	// wait for the response.
+	if err := t.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer t.release()
+
+	// queue the request and wait for the response.
+	t.queue.push(req)
+
 	select {
 	case <-t.closed:
-		return nil, ErrClosed
+		select {
+		case resp := <-req.response:
+			// answered just before the connection was lost.
+			return responseMessage(resp)
+		default:
+		}
+
+		t.rbufs.cancel(req)
+		return nil, t.err
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		t.rbufs.cancel(req)
+		if t.queue.remove(req) {
+			// the request never left the client.
+			return nil, CancelError{Err: ctx.Err(), Flushed: true}
+		}
+
+		// the request may have reached the server. Flush it, so the server
+		// can abandon it and the tag can be reclaimed.
+		select {
+		case t.cancels <- req:
+		case <-t.closed:
+			return nil, CancelError{Err: ctx.Err()}
+		}
+
+		// Per flush(5), wait for the Rflush or the response, whichever is
+		// first, to find out whether the server acted on the request.
+		select {
+		case <-t.closed:
+			return nil, CancelError{Err: ctx.Err()}
+		case err := <-req.err:
+			if cerr, ok := err.(CancelError); ok {
+				cerr.Err = ctx.Err()
+				return nil, cerr
+			}
+
+			return nil, err
+		case <-req.response:
+			// the request completed before the flush.
+			return nil, CancelError{Err: ctx.Err()}
+		}
 	case err := <-req.err:
 		return nil, err
 	case resp := <-req.response:
-		if resp.Type == Rerror {
-			// pack the error into something useful
-			respmesg, ok := resp.Message.(MessageRerror)
-			if !ok {
-				return nil, fmt.Errorf("invalid error response: %v", resp)
-			}
+		return responseMessage(resp)
+	}
+}
+
+// responseMessage returns the message of resp, or the error it carries.
+func responseMessage(resp *Fcall) (Message, error) {
+	if resp.Type == Rerror {
+		// pack the error into something useful
+		respmesg, ok := resp.Message.(MessageRerror)
+		if !ok {
+			return nil, fmt.Errorf("invalid error response: %v", resp)
+		}
+
+		return nil, respmesg
+	}
+
+	if resp.Type == Rlerror {
+		respmesg, ok := resp.Message.(MessageRlerror)
+		if !ok {
+			return nil, fmt.Errorf("invalid error response: %v", resp)
+		}
+
+		return nil, respmesg
+	}
+
+	return resp.Message, nil
+}
+
+// acquire takes a slot for a new request, if the number of outstanding
+// requests is bounded. Slots are held until the request is answered or, if
+// canceled, until its flush completes.
+func (t *transport) acquire(ctx context.Context) error {
+	if t.slots == nil {
+		return nil
+	}
 
-			return nil, respmesg
+	if t.nowait {
+		select {
+		case t.slots <- struct{}{}:
+			return nil
+		default:
+			return ErrTooManyRequests
 		}
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return CancelError{Err: ctx.Err(), Flushed: true}
+	case <-t.closed:
+		return t.err
+	}
+}
 
-		return resp.Message, nil
+func (t *transport) release() {
+	if t.slots != nil {
+		<-t.slots
 	}
 }
 
+// CancelError is returned from a call when its context is done before a
+// response arrives. Err holds the error from the context. If the call was
+// flushed because the session closed, Err is ErrClosed. If it was flushed
+// with Flush, Err is ErrFlushed.
+//
+// Flushed reports whether the request is known to have had no effect on the
+// server, either because it was never sent or because the server confirmed a
+// flush before responding. When Flushed is false, the request may have been
+// executed. This matters for calls with side effects, such as Write or
+// Create, that a caller may want to retry.
+type CancelError struct {
+	Err     error
+	Flushed bool
+}
+
+func (e CancelError) Error() string {
+	return fmt.Sprintf("9p: request canceled: %v", e.Err)
+}
+
+// Unwrap returns the context error.
+func (e CancelError) Unwrap() error {
+	return e.Err
+}
+
+func (t *transport) logf(level LogLevel, format string, args ...interface{}) {
+	logf(t.logger, level, format, args...)
+}
+
 // handle takes messages off the wire and wakes up the waiting tag call.
 func (t *transport) handle() {
 	defer func() {
-		log.Println("exited handle loop")
+		t.logf(LogDebug, "exited handle loop")
 		t.Close()
 	}()
 	// the following variable block are protected components owned by this thread.
 	var (
 		responses = make(chan *Fcall)
-		tags      Tag
+		// received takes responses from the read loop to the relay.
+		received = make(chan *Fcall)
 		// outstanding provides a map of tags to outstanding requests.
 		outstanding = map[Tag]*fcallRequest{}
+		// flushes maps the tag of each outstanding Tflush to the tag it is
+		// flushing.
+		flushes = map[Tag]Tag{}
+		// pending counts the unanswered flushes of each tag. Per flush(5),
+		// a tag being flushed may not be reused until the last of its
+		// flushes is answered.
+		pending = map[Tag]int{}
+		// reasons holds the error for requests that are flushed without a
+		// response, by tag.
+		reasons = map[Tag]error{}
+		// held marks tags that have been answered but are waiting on
+		// pending flushes before they are released.
+		held = map[Tag]bool{}
+		// waiters holds the done channels for each call to flush, by the
+		// tag being flushed, notified once the tag has no pending flushes.
+		waiters = map[Tag][]chan error{}
+		// flushed holds the done channels for each call to flushAll, closed
+		// when flushes empties.
+		flushed []chan struct{}
+		// idle holds the done channels for each call to shutdown, closed
+		// when outstanding and flushes empty.
+		idle []chan struct{}
+		// draining is set after flushAll or shutdown, refusing new
+		// requests.
+		draining bool
+		// done is the done channel of ctx, cleared once ctx is done and the
+		// transport is draining outstanding requests.
+		done = t.ctx.Done()
+		// drained fires when the time to drain is up.
+		drained <-chan time.Time
+		// versionq holds calls to renegotiate waiting for outstanding
+		// requests to complete. New requests are held while it is not
+		// empty or versioning is set.
+		versionq []*fcallRequest
+		// versioning is the renegotiation waiting for its Rversion.
+		versioning *fcallRequest
 	)
 
+	// write sends fcall, closing the transport if the write fails after
+	// the frame may have been partly written: the server may execute the
+	// request, and the channel cannot frame the requests after it.
+	write := func(ctx context.Context, fcall *Fcall) error {
+		err := t.ch.WriteFcall(ctx, fcall)
+		if err != nil && writeBroken(ctx, err) {
+			t.logf(LogError, "closing transport on failed write: %v", err)
+			t.closeWithError(err)
+		}
+
+		return err
+	}
+
+	// startVersion sends the next Tversion, if any, once no requests are
+	// outstanding.
+	startVersion := func() {
+		for versioning == nil && len(versionq) > 0 && len(outstanding) == 0 && len(flushes) == 0 {
+			req := versionq[0]
+			versionq = versionq[1:]
+
+			if err := write(req.ctx, newFcall(NOTAG, req.message)); err != nil {
+				req.err <- err
+				continue
+			}
+
+			versioning = req
+		}
+	}
+
+	// the read loop outlives ctx when draining.
+	readctx := t.ctx
+	if t.drain > 0 {
+		var cancel context.CancelFunc
+		readctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+	}
+
+	// notify wakes up callers of flushAll once all flushes are answered and
+	// callers of shutdown once all requests are answered.
+	notify := func() {
+		startVersion()
+
+		if len(flushes) > 0 {
+			return
+		}
+
+		for _, done := range flushed {
+			close(done)
+		}
+		flushed = nil
+
+		if len(outstanding) > 0 {
+			return
+		}
+
+		for _, done := range idle {
+			close(done)
+		}
+		idle = nil
+	}
+
+	// flush sends a Tflush for oldtag, which may be the tag of a request or
+	// of another flush. If the flush is answered before oldtag, the request
+	// fails with a CancelError holding reason.
+	flush := func(ctx context.Context, oldtag Tag, reason error) error {
+		tag, err := t.tags.get(Tflush)
+		if err != nil {
+			return err
+		}
+
+		fcall := newFcall(tag, MessageTflush{Oldtag: oldtag})
+		if err := write(ctx, fcall); err != nil {
+			t.tags.put(tag)
+			return err
+		}
+
+		flushes[tag] = oldtag
+		pending[oldtag]++
+		reasons[oldtag] = reason
+		return nil
+	}
+
+	// requestDone reports the outcome of req to the metrics, if any.
+	requestDone := func(req *fcallRequest, err error) {
+		if t.metrics != nil {
+			t.metrics.RequestDone(req.message.Type(), time.Since(req.sent), len(outstanding), err)
+		}
+	}
+
+	// release returns an answered tag to the pool, unless it is waiting on
+	// a flush.
+	release := func(tag Tag) {
+		if pending[tag] > 0 {
+			held[tag] = true
+			return
+		}
+
+		delete(held, tag)
+		t.tags.put(tag)
+	}
+
+	// flushAnswered handles the answer to the Tflush with tag. A Tflush that
+	// is itself flushed is treated as answered once the flush of the flush
+	// is.
+	var flushAnswered func(tag Tag)
+	flushAnswered = func(tag Tag) {
+		oldtag := flushes[tag]
+		delete(flushes, tag)
+		release(tag)
+
+		pending[oldtag]--
+		if pending[oldtag] > 0 {
+			return // wait for the last flush of oldtag.
+		}
+		delete(pending, oldtag)
+
+		reason := reasons[oldtag]
+		delete(reasons, oldtag)
+
+		// Per flush(5), if oldtag has not been answered by now, it never
+		// will be, and the tag is free to reuse.
+		if req, ok := outstanding[oldtag]; ok {
+			t.rbufs.remove(oldtag)
+			delete(outstanding, oldtag)
+			release(oldtag)
+			err := CancelError{Err: reason, Flushed: true}
+			requestDone(req, err)
+			req.err <- err
+		} else if _, ok := flushes[oldtag]; ok {
+			flushAnswered(oldtag)
+		} else if held[oldtag] {
+			release(oldtag)
+		}
+
+		for _, done := range waiters[oldtag] {
+			done <- nil
+		}
+		delete(waiters, oldtag)
+	}
+
 	// loop to read messages off of the connection
 	go func() {
+		var lost bool
 		defer func() {
-			log.Println("exited read loop")
+			t.logf(LogDebug, "exited read loop")
+			if lost {
+				// the transport is closed once the responses read so
+				// far are handled.
+				close(received)
+				return
+			}
+
 			t.Close()
 		}()
 	loop:
 		for {
 			fcall := new(Fcall)
-			if err := t.ch.ReadFcall(t.ctx, fcall); err != nil {
-				switch err := err.(type) {
-				case net.Error:
-					if err.Timeout() || err.Temporary() {
-						// BUG(stevvooe): There may be partial reads under
-						// timeout errors where this is actually fatal.
-
-						// can only retry if we haven't offset the frame.
-						continue loop
+			if err := t.ch.ReadFcall(readctx, fcall); err != nil {
+				if readctx.Err() != nil {
+					// the read was interrupted by the end of the
+					// transport, which no read recovers from.
+					t.closeWithError(ErrSessionDone)
+					return
+				}
+
+				if retryable(err) {
+					// the channel resumes the frame, if part of it was
+					// read.
+					continue loop
+				}
+
+				tlerr, ok := err.(MessageTooLargeError)
+				if !ok {
+					if t.ctx.Err() != nil {
+						// the read was interrupted by the end of the
+						// transport.
+						t.closeWithError(ErrSessionDone)
+						return
 					}
+
+					t.logf(LogError, "fatal error reading msg: %v", err)
+					lost = true
+					return
 				}
 
-				log.Println("fatal error reading msg:", err)
-				t.Close()
-				return
+				// the response was discarded. Its request fails with the
+				// error instead.
+				t.logf(LogWarn, "dropping response: %v", err)
+				fcall = newErrorFcall(tlerr.Tag, err)
 			}
 
 			select {
-			case <-t.ctx.Done():
-				log.Println("ctx done")
+			case <-readctx.Done():
+				t.logf(LogDebug, "ctx done")
+				t.closeWithError(ErrSessionDone)
+				return
+			case <-t.closed:
+				t.logf(LogDebug, "transport closed")
+				return
+			case received <- fcall:
+			}
+
+			if fcall.Type == Rversion {
+				// the handle loop may resize the channel before the next
+				// read.
+				select {
+				case <-t.resume:
+				case <-t.closed:
+					return
+				}
+			}
+		}
+	}()
+
+	// relay queues responses for the handle loop, so that the read loop
+	// keeps reading while the handle loop is blocked writing a request.
+	// Otherwise, a server blocked writing responses would stop reading
+	// requests, deadlocking both ends. The queue is bounded by the number of
+	// outstanding requests.
+	go func() {
+		var (
+			queue []*Fcall
+			in    = received
+		)
+		for {
+			if in == nil && len(queue) == 0 {
+				// the connection was lost. The handle loop closes the
+				// transport, after the responses before.
+				close(responses)
 				return
+			}
+
+			var (
+				out  chan *Fcall
+				next *Fcall
+			)
+			if len(queue) > 0 {
+				out, next = responses, queue[0]
+			}
+
+			select {
+			case fcall, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, fcall)
+			case out <- next:
+				queue[0] = nil
+				queue = queue[1:]
 			case <-t.closed:
-				log.Println("transport closed")
 				return
-			case responses <- fcall:
 			}
 		}
 	}()
 
 	for {
+		ready := t.queue.ready
+		if versioning != nil || len(versionq) > 0 {
+			ready = nil // hold new requests until the version is settled.
+		}
+
 		select {
-		case req := <-t.requests:
-			// BUG(stevvooe): This is an awful tag allocation procedure.
-			// Replace this with something that let's us allocate tags and
-			// associate data with them, returning to them to a pool when
-			// complete. Such a system would provide a lot of information
-			// about outstanding requests.
-			tags++
-			fcall := newFcall(tags, req.message)
-			outstanding[fcall.Tag] = req
+		case <-ready:
+			req := t.queue.pop()
+			if req == nil {
+				continue
+			}
+
+			if draining {
+				req.err <- ErrClosed
+				continue
+			}
+
+			if done == nil {
+				req.err <- ErrSessionDone
+				continue
+			}
+
+			tag, err := t.tags.get(req.message.Type())
+			if err != nil {
+				req.err <- err
+				continue
+			}
+
+			req.tag = tag
+			fcall := newFcall(tag, req.message)
+			outstanding[tag] = req
 
 			// TODO(stevvooe): Consider the case of requests that never
-			// receive a response. We need to remove the fcall context from
-			// the tag map and dealloc the tag. We may also want to send a
-			// flush for the tag.
-			if err := t.ch.WriteFcall(req.ctx, fcall); err != nil {
-				delete(outstanding, fcall.Tag)
+			// receive a response and are never canceled. They hold their tag
+			// until the transport is closed.
+			if req.rbuf != nil {
+				t.rbufs.add(tag, req)
+			}
+
+			if err := write(req.ctx, fcall); err != nil {
+				t.rbufs.remove(tag)
+				delete(outstanding, tag)
+				t.tags.put(tag)
 				req.err <- err
+				notify()
+				continue
+			}
+
+			req.sent = time.Now()
+			if t.metrics != nil {
+				t.metrics.RequestSent(req.message.Type(), len(outstanding))
+			}
+		case req := <-t.cancels:
+			if outstanding[req.tag] != req || pending[req.tag] > 0 {
+				continue // already answered or being flushed.
+			}
+
+			if err := flush(t.ctx, req.tag, ErrClosed); err != nil {
+				// the caller gives up without knowing the outcome. The
+				// request holds its tag until the response arrives.
+				t.logf(LogWarn, "error flushing canceled request: %v", err)
+				req.err <- CancelError{Err: err}
 			}
-		case b := <-responses:
+		case r := <-t.flushalls:
+			draining = true
+			flushed = append(flushed, r.done)
+
+			for tag := range outstanding {
+				if pending[tag] > 0 {
+					continue // already being flushed.
+				}
+
+				if err := flush(r.ctx, tag, ErrClosed); err != nil {
+					t.logf(LogWarn, "error flushing outstanding requests: %v", err)
+					break
+				}
+			}
+
+			notify()
+		case done := <-t.shutdowns:
+			draining = true
+			idle = append(idle, done)
+			notify()
+		case r := <-t.flushtags:
+			_, isreq := outstanding[r.tag]
+			_, isflush := flushes[r.tag]
+			if !isreq && !isflush {
+				r.done <- nil // already answered, there is nothing to flush.
+				continue
+			}
+
+			if err := flush(r.ctx, r.tag, ErrFlushed); err != nil {
+				r.done <- err
+				continue
+			}
+
+			waiters[r.tag] = append(waiters[r.tag], r.done)
+		case req := <-t.versions:
+			if draining {
+				req.err <- ErrClosed
+				continue
+			}
+
+			if done == nil {
+				req.err <- ErrSessionDone
+				continue
+			}
+
+			versionq = append(versionq, req)
+			startVersion()
+		case req := <-t.vcancels:
+			for i, r := range versionq {
+				if r == req {
+					versionq = append(versionq[:i], versionq[i+1:]...)
+					req.err <- CancelError{Err: req.ctx.Err(), Flushed: true}
+					break
+				}
+			}
+
+			// if it has been sent, it is answered as usual.
+			notify()
+		case b, ok := <-responses:
+			if !ok {
+				return
+			}
+
+			if b.Tag == NOTAG {
+				req := versioning
+				versioning = nil
+
+				if rv, ok := b.Message.(MessageRversion); ok && req != nil {
+					if tv := req.message.(MessageTversion); rv.Version == tv.Version && rv.MSize <= tv.MSize {
+						t.ch.SetMSize(int(rv.MSize))
+					}
+				}
+
+				if b.Type == Rversion {
+					t.resume <- struct{}{}
+				}
+
+				if req != nil {
+					req.response <- b
+				} else {
+					t.logf(LogWarn, "dropping unexpected version response: %v", b)
+				}
+
+				notify()
+				continue
+			}
+
+			if _, ok := flushes[b.Tag]; ok {
+				flushAnswered(b.Tag)
+
+				notify()
+				if done == nil && len(outstanding) == 0 {
+					t.closeWithError(ErrSessionDone)
+					return
+				}
+				continue
+			}
+
 			req, ok := outstanding[b.Tag]
 			if !ok {
-				panic("unknown tag received")
+				if t.strict {
+					t.logf(LogError, "closing transport on response for unknown tag: %v", b)
+					t.closeWithError(ErrUnknownTag)
+					return
+				}
+
+				// This may be a duplicate response or a late response to a
+				// request that has already been flushed, so the frame is
+				// dropped rather than failing every request on the
+				// transport.
+				t.logf(LogWarn, "dropping response for unknown tag: %v", b)
+				continue
 			}
 
 			// BUG(stevvooe): Must detect duplicate tag and ensure that we are
 			// waking up the right caller. If a duplicate is received, the
 			// entry should not be deleted.
+			t.rbufs.remove(b.Tag)
 			delete(outstanding, b.Tag)
+			release(b.Tag)
+
+			rerr, _ := b.Message.(error) // Rerror or Rlerror
+			requestDone(req, rerr)
 
+			// the caller may have given up on a flushed request, but the
+			// channel is buffered, so this never blocks.
 			req.response <- b
+			notify()
 
-			// TODO(stevvooe): Reclaim tag id.
-		case <-t.ctx.Done():
+			if done == nil && len(outstanding) == 0 {
+				t.closeWithError(ErrSessionDone)
+				return
+			}
+		case <-done:
+			if t.drain <= 0 || len(outstanding) == 0 {
+				t.closeWithError(ErrSessionDone)
+				return
+			}
+
+			// stop taking requests, but wait a while for responses to the
+			// requests in flight.
+			done = nil
+			drained = time.After(t.drain)
+		case <-drained:
+			t.closeWithError(ErrSessionDone)
 			return
 		case <-t.closed:
 			return
@@ -189,21 +897,211 @@ func (t *transport) handle() {
 	}
 }
 
+// flush sends a Tflush for tag, blocking until the server has answered it. A
+// request that has not been answered by then fails with a CancelError holding
+// ErrFlushed. If tag belongs to a flush, that flush is flushed. If tag is
+// not outstanding, flush returns immediately.
 func (t *transport) flush(ctx context.Context, tag Tag) error {
-	// TODO(stevvooe): We need to fire and forget flush messages when a call
-	// context gets cancelled.
-	panic("not implemented")
+	done := make(chan error, 1)
+
+	select {
+	case <-t.closed:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case t.flushtags <- flushTagRequest{ctx: ctx, tag: tag, done: done}:
+	}
+
+	select {
+	case <-t.closed:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
 }
 
-func (t *transport) Close() error {
+// flushAll stops the transport from sending new requests, then sends a
+// Tflush for every outstanding request. It blocks until the server has
+// answered each flush or ctx is done. Flushed requests that have not received
+// a response fail with a CancelError.
+func (t *transport) flushAll(ctx context.Context) error {
+	done := make(chan struct{})
+
 	select {
 	case <-t.closed:
-		return ErrClosed
-	case <-t.ctx.Done():
-		return t.ctx.Err()
-	default:
-		close(t.closed)
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case t.flushalls <- flushAllRequest{ctx: ctx, done: done}:
 	}
 
-	return nil
+	select {
+	case <-t.closed:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+func (t *transport) outstanding() []RequestInfo {
+	return t.tags.list()
+}
+
+// done returns a channel that is closed when the transport closes.
+func (t *transport) done() <-chan struct{} {
+	return t.closed
+}
+
+// shutdown stops the transport from sending new requests, which fail with
+// ErrClosed, then waits for every outstanding request to be answered or
+// flushed before closing the transport. If ctx is done first, the transport
+// is closed anyway, failing the remaining requests, and the error from ctx is
+// returned.
+func (t *transport) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+
+	select {
+	case <-t.closed:
+		return t.err
+	case <-ctx.Done():
+		t.Close()
+		return ctx.Err()
+	case t.shutdowns <- done:
+	}
+
+	select {
+	case <-t.closed:
+		return t.err
+	case <-ctx.Done():
+		t.Close()
+		return ctx.Err()
+	case <-done:
+		return t.Close()
+	}
+}
+
+// renegotiator is implemented by transports that can renegotiate the msize
+// of their channel.
+type renegotiator interface {
+	renegotiate(ctx context.Context, version string, msize int) (int, error)
+}
+
+// renegotiate sends a Tversion offering version and msize, once no requests
+// are outstanding, and resizes the channel to the msize answered. Requests
+// made in the meantime wait for the Rversion. The msize excludes the
+// overhead of the codec, as does the returned msize. If the server answers
+// with another version, the transport is closed, since the server has reset
+// the session regardless.
+func (t *transport) renegotiate(ctx context.Context, version string, msize int) (int, error) {
+	req := newFcallRequest(ctx, MessageTversion{
+		MSize:   uint32(msize + t.overhead),
+		Version: version,
+	})
+
+	select {
+	case t.versions <- req:
+	case <-t.closed:
+		return 0, t.err
+	case <-ctx.Done():
+		return 0, CancelError{Err: ctx.Err(), Flushed: true}
+	}
+
+	select {
+	case <-t.closed:
+		return 0, t.err
+	case err := <-req.err:
+		return 0, err
+	case resp := <-req.response:
+		return t.versioned(req, resp)
+	case <-ctx.Done():
+		// a Tversion can't be flushed. If it has been sent, wait for the
+		// answer.
+		select {
+		case t.vcancels <- req:
+		case <-t.closed:
+			return 0, t.err
+		}
+
+		select {
+		case <-t.closed:
+			return 0, t.err
+		case err := <-req.err:
+			return 0, err
+		case resp := <-req.response:
+			return t.versioned(req, resp)
+		}
+	}
+}
+
+// writeBroken reports whether err, returned writing a request, may leave
+// part of the frame on the channel. Errors refusing the request before it is
+// written, such as a frame too large or a name that cannot be encoded, leave
+// the channel usable.
+func writeBroken(ctx context.Context, err error) bool {
+	switch err.(type) {
+	case MessageTooLargeError, MessageRerror:
+		return false
+	}
+
+	return err != ErrClosed && err != ctx.Err()
+}
+
+// versioned checks the response to the Tversion of req.
+func (t *transport) versioned(req *fcallRequest, resp *Fcall) (int, error) {
+	tv := req.message.(MessageTversion)
+
+	switch rv := resp.Message.(type) {
+	case MessageRversion:
+		if rv.Version != tv.Version {
+			err := fmt.Errorf("server renegotiated unexpected version: %v", rv.Version)
+			t.closeWithError(err)
+			return 0, err
+		}
+
+		if rv.MSize > tv.MSize {
+			err := fmt.Errorf("server renegotiated msize %d, larger than %d", rv.MSize, tv.MSize)
+			t.closeWithError(err)
+			return 0, err
+		}
+
+		return int(rv.MSize) - t.overhead, nil
+	case MessageRerror:
+		return 0, rv
+	}
+
+	return 0, ErrUnexpectedMsg
+}
+
+// RoundTrip sends msg, implementing RoundTripper.
+func (t *transport) RoundTrip(ctx context.Context, msg Message) (Message, error) {
+	return t.send(ctx, msg)
+}
+
+// Close shuts down the transport, failing outstanding requests with
+// ErrClosed. It is safe to call Close concurrently and more than once. Only
+// the first call returns nil, all others return ErrClosed.
+func (t *transport) Close() error {
+	return t.closeWithError(ErrClosed)
+}
+
+// closeWithError shuts down the transport, failing outstanding requests with
+// err, unless the transport is already closed. A channel that implements
+// io.Closer, such as one passed to NewChannelSession, is closed with it.
+func (t *transport) closeWithError(err error) error {
+	result := ErrClosed
+	t.closeOnce.Do(func() {
+		t.err = err
+		close(t.closed)
+		result = nil
+
+		if closer, ok := t.ch.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+
+	return result
 }
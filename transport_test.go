@@ -0,0 +1,797 @@
+package p9p
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testChannel is an in-memory Channel for driving a transport from a test.
+// Fcalls written by the transport appear on outgoing. Fcalls sent on incoming
+// or errors sent on errs are returned from ReadFcall.
+type testChannel struct {
+	incoming chan *Fcall
+	outgoing chan *Fcall
+	errs     chan error
+}
+
+var _ Channel = &testChannel{}
+
+func newTestChannel() *testChannel {
+	return &testChannel{
+		incoming: make(chan *Fcall),
+		outgoing: make(chan *Fcall),
+		errs:     make(chan error),
+	}
+}
+
+func (ch *testChannel) ReadFcall(ctx context.Context, fcall *Fcall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-ch.errs:
+		return err
+	case fc := <-ch.incoming:
+		*fcall = *fc
+		return nil
+	}
+}
+
+func (ch *testChannel) WriteFcall(ctx context.Context, fcall *Fcall) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch.outgoing <- fcall:
+		return nil
+	}
+}
+
+func (ch *testChannel) MSize() int         { return DefaultMSize }
+func (ch *testChannel) SetMSize(msize int) {}
+
+// TestTransportCloseRace triggers every path that closes the transport at the
+// same time: a fatal read error, cancellation of the transport context and
+// several explicit calls to Close. None of these may panic and only one
+// explicit call may observe the transition to closed.
+func TestTransportCloseRace(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := newTestChannel()
+		tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+
+		const closers = 4
+		var (
+			start sync.WaitGroup
+			done  sync.WaitGroup
+			errs  = make(chan error, closers)
+		)
+		start.Add(1)
+
+		done.Add(2 + closers)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			select {
+			case ch.errs <- errors.New("fatal read error"):
+			case <-tr.closed:
+			}
+		}()
+
+		go func() {
+			defer done.Done()
+			start.Wait()
+			cancel()
+		}()
+
+		for j := 0; j < closers; j++ {
+			go func() {
+				defer done.Done()
+				start.Wait()
+				errs <- tr.Close()
+			}()
+		}
+
+		start.Done()
+		done.Wait()
+		close(errs)
+
+		var nils int
+		for err := range errs {
+			switch err {
+			case nil:
+				nils++
+			case ErrClosed:
+			default:
+				t.Fatalf("unexpected error from close: %v", err)
+			}
+		}
+
+		if nils > 1 {
+			t.Fatalf("transport closed %d times", nils)
+		}
+
+		select {
+		case <-tr.closed:
+		default:
+			t.Fatalf("transport not closed")
+		}
+
+		if err := tr.Close(); err != ErrClosed {
+			t.Fatalf("close after close: %v != %v", err, ErrClosed)
+		}
+	}
+}
+
+// TestTransportCancel ensures that cancellation reports whether the request
+// may have reached the server.
+func TestTransportCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// without a handle loop, requests are never taken off the queue, so they
+	// never leave the client.
+	idle := &transport{
+		ctx:    ctx,
+		queue:  newRequestQueue(),
+		rbufs:  newReadBuffers(),
+		closed: make(chan struct{}),
+	}
+
+	waitctx, waitcancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer waitcancel()
+	_, err := idle.send(waitctx, MessageTstat{Fid: 1})
+	cerr, ok := err.(CancelError)
+	if !ok {
+		t.Fatalf("expected cancel error: %v", err)
+	}
+
+	if !cerr.Flushed || cerr.Err != context.DeadlineExceeded {
+		t.Fatalf("unexpected cancel error for unsent request: %#v", cerr)
+	}
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	sentctx, sentcancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.send(sentctx, MessageTstat{Fid: 2})
+		errs <- err
+	}()
+
+	// once written, the request may have been executed.
+	sent := <-ch.outgoing
+	sentcancel()
+
+	fcall := <-ch.outgoing
+	if msg, ok := fcall.Message.(MessageTflush); !ok || msg.Oldtag != sent.Tag {
+		t.Fatalf("expected flush of tag %v: %v", sent.Tag, fcall)
+	}
+
+	// the caller waits for the outcome of the flush.
+	select {
+	case err := <-errs:
+		t.Fatalf("returned before the flush was answered: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ch.incoming <- newFcall(fcall.Tag, MessageRflush{})
+
+	err = <-errs
+	cerr, ok = err.(CancelError)
+	if !ok {
+		t.Fatalf("expected cancel error: %v", err)
+	}
+
+	if !cerr.Flushed || cerr.Err != context.Canceled {
+		t.Fatalf("unexpected cancel error for flushed request: %#v", cerr)
+	}
+}
+
+// TestTransportLifetime ensures that the end of the transport context fails
+// outstanding and future requests with ErrSessionDone, while the end of a
+// request context only affects that request.
+func TestTransportLifetime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	reqctx, reqcancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.send(reqctx, MessageTstat{Fid: 1})
+		errs <- err
+	}()
+
+	<-ch.outgoing
+	reqcancel()
+	flush := <-ch.outgoing // flush of the canceled request
+	ch.incoming <- newFcall(flush.Tag, MessageRflush{})
+	if err, ok := (<-errs).(CancelError); !ok || err.Err != context.Canceled {
+		t.Fatalf("expected request cancellation: %v", err)
+	}
+
+	go func() {
+		_, err := tr.send(context.Background(), MessageTstat{Fid: 2})
+		errs <- err
+	}()
+
+	<-ch.outgoing
+	cancel()
+
+	if err := <-errs; err != ErrSessionDone {
+		t.Fatalf("expected session done for outstanding request: %v", err)
+	}
+
+	if _, err := tr.send(context.Background(), MessageTstat{Fid: 3}); err != ErrSessionDone {
+		t.Fatalf("expected session done for new request: %v", err)
+	}
+
+	if err := tr.Close(); err != ErrClosed {
+		t.Fatalf("close after shutdown: %v != %v", err, ErrClosed)
+	}
+}
+
+// TestTransportLifetimeDeadline ensures that the read loop exits once a
+// lifetime context with a deadline expires, rather than retrying its reads as
+// timeouts.
+func TestTransportLifetimeDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	exited := make(chan struct{})
+	logger := LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		if format == "exited read loop" {
+			close(exited)
+		}
+	})
+
+	tr := newTransport(ctx, newTestChannel(), sessionOptions{logger: logger}).(*transport)
+	defer tr.Close()
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("read loop did not exit after the lifetime deadline")
+	}
+
+	if _, err := tr.send(context.Background(), MessageTstat{Fid: 1}); err != ErrSessionDone {
+		t.Fatalf("expected session done: %v", err)
+	}
+}
+
+// TestTransportFlushRace cancels a sent request and answers both the request
+// and the resulting flush, in either order. The caller must see a cancellation,
+// both tags must be reclaimed exactly once and a response arriving after the
+// flush must be dropped without disturbing the transport.
+func TestTransportFlushRace(t *testing.T) {
+	for _, responseFirst := range []bool{true, false} {
+		for i := 0; i < 100; i++ {
+			testTransportFlushRace(t, responseFirst)
+		}
+	}
+}
+
+func testTransportFlushRace(t *testing.T, responseFirst bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	reqctx, reqcancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.send(reqctx, MessageTstat{Fid: 1})
+		errs <- err
+	}()
+
+	req := <-ch.outgoing
+	reqcancel()
+
+	flush := <-ch.outgoing
+	if msg, ok := flush.Message.(MessageTflush); !ok || msg.Oldtag != req.Tag {
+		t.Fatalf("expected flush of tag %v: %v", req.Tag, flush)
+	}
+
+	responses := []*Fcall{
+		newFcall(req.Tag, MessageRstat{}),
+		newFcall(flush.Tag, MessageRflush{}),
+	}
+	if !responseFirst {
+		responses[0], responses[1] = responses[1], responses[0]
+	}
+
+	for _, resp := range responses {
+		ch.incoming <- resp
+	}
+
+	// the request was only flushed if the Rflush came first.
+	cerr, ok := (<-errs).(CancelError)
+	if !ok {
+		t.Fatalf("expected cancel error")
+	}
+
+	if cerr.Flushed == responseFirst {
+		t.Fatalf("unexpected cancel error: %#v", cerr)
+	}
+
+	// responses are handled in order, so once another request completes,
+	// both have been processed.
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.send(ctx, MessageTclunk{Fid: 2})
+		done <- err
+	}()
+
+	clunk := <-ch.outgoing
+	ch.incoming <- newFcall(clunk.Tag, MessageRclunk{})
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error after flush: %v", err)
+	}
+
+	tr.tags.mu.Lock()
+	defer tr.tags.mu.Unlock()
+
+	if len(tr.tags.inuse) != 0 {
+		t.Fatalf("tags not reclaimed: %v", tr.tags.inuse)
+	}
+
+	seen := map[Tag]bool{}
+	for _, tag := range tr.tags.free {
+		if seen[tag] {
+			t.Fatalf("tag %v reclaimed more than once: %v", tag, tr.tags.free)
+		}
+		seen[tag] = true
+	}
+
+	for _, tag := range []Tag{req.Tag, flush.Tag, clunk.Tag} {
+		if !seen[tag] {
+			t.Fatalf("tag %v not reclaimed: %v", tag, tr.tags.free)
+		}
+	}
+}
+
+// TestTransportPriority ensures that queued requests are sent in order of
+// their context priority.
+func TestTransportPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	// waitQueued blocks until n requests have been pushed and pending remain
+	// on the queue.
+	waitQueued := func(n uint64, pending int) {
+		for {
+			tr.queue.mu.Lock()
+			seq, queued := tr.queue.seq, len(tr.queue.items)
+			tr.queue.mu.Unlock()
+
+			if seq == n && queued == pending {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the first request holds the handle loop until the test reads it.
+	go tr.send(ctx, MessageTstat{Fid: 0})
+	waitQueued(1, 0)
+
+	for fid, priority := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		go tr.send(WithPriority(ctx, priority), MessageTstat{Fid: Fid(fid + 1)})
+	}
+	waitQueued(4, 3)
+
+	for _, expected := range []Fid{0, 3, 2, 1} {
+		fcall := <-ch.outgoing
+		if fid := fcall.Message.(MessageTstat).Fid; fid != expected {
+			t.Fatalf("unexpected request order: %v != %v", fid, expected)
+		}
+	}
+}
+
+// TestTransportDrain ensures that a draining transport delivers responses to
+// requests sent before the end of its context, but no longer than allowed.
+func TestTransportDrain(t *testing.T) {
+	for _, respond := range []bool{true, false} {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := newTestChannel()
+		tr := newTransport(ctx, ch, sessionOptions{drainTimeout: 50 * time.Millisecond}).(*transport)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := tr.send(context.Background(), MessageTstat{Fid: 1})
+			errs <- err
+		}()
+
+		req := <-ch.outgoing
+		cancel()
+
+		expected := ErrSessionDone
+		if respond {
+			ch.incoming <- newFcall(req.Tag, MessageRstat{})
+			expected = nil
+		}
+
+		if err := <-errs; err != expected {
+			t.Fatalf("unexpected error for outstanding request: %v != %v", err, expected)
+		}
+
+		select {
+		case <-tr.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("transport not closed after draining")
+		}
+
+		if _, err := tr.send(context.Background(), MessageTstat{Fid: 2}); err != ErrSessionDone {
+			t.Fatalf("expected session done after draining: %v", err)
+		}
+	}
+}
+
+// TestTransportUnknownTag ensures that a response with a tag the transport
+// never sent is dropped, without disturbing requests in flight.
+func TestTransportUnknownTag(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	type result struct {
+		msg Message
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msg, err := tr.send(ctx, MessageTstat{Fid: 1})
+		results <- result{msg, err}
+	}()
+
+	req := <-ch.outgoing
+	ch.incoming <- newFcall(req.Tag+100, MessageRstat{Stat: Dir{Name: "bogus"}})
+	ch.incoming <- newFcall(req.Tag, MessageRstat{Stat: Dir{Name: "legit"}})
+
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+
+	if rstat, ok := r.msg.(MessageRstat); !ok || rstat.Stat.Name != "legit" {
+		t.Fatalf("unexpected response: %v", r.msg)
+	}
+
+	select {
+	case <-tr.closed:
+		t.Fatalf("transport closed by unknown tag")
+	default:
+	}
+}
+
+// TestTransportWriteTimeout ensures that a write failing after the frame may
+// have been partly written closes the transport, while requests refused
+// before they are written leave it usable.
+func TestTransportWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tr := newTransport(ctx, NewChannel(c1, DefaultMSize), sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	if _, err := tr.send(ctx, MessageTwrite{Fid: 1, Data: make([]byte, DefaultMSize)}); err == nil {
+		t.Fatalf("expected error writing a message too large")
+	} else if _, ok := err.(MessageTooLargeError); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-tr.closed:
+		t.Fatalf("transport closed by a message too large")
+	default:
+	}
+
+	// nothing reads from c2, so the write times out.
+	_, err := tr.send(ctx, MessageTstat{Fid: 1})
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	if IsTransient(err) {
+		t.Fatalf("write timeout reported as transient")
+	}
+
+	select {
+	case <-tr.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("transport not closed by a failed write")
+	}
+
+	if _, err := tr.send(ctx, MessageTstat{Fid: 1}); err != tr.err {
+		t.Fatalf("unexpected error after failed write: %v", err)
+	}
+}
+
+// TestTransportOutOfOrder ensures that responses are matched to requests by
+// tag, not by the order in which they arrive.
+func TestTransportOutOfOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	type result struct {
+		msg Message
+		err error
+	}
+
+	send := func(fid Fid) (*Fcall, chan result) {
+		results := make(chan result, 1)
+		go func() {
+			msg, err := tr.send(ctx, MessageTstat{Fid: fid})
+			results <- result{msg, err}
+		}()
+
+		return <-ch.outgoing, results
+	}
+
+	reqA, resultsA := send(1)
+	reqB, resultsB := send(2)
+
+	if reqA.Tag == reqB.Tag {
+		t.Fatalf("requests share tag %v", reqA.Tag)
+	}
+
+	// answer B before A.
+	ch.incoming <- newFcall(reqB.Tag, MessageRstat{Stat: Dir{Name: "b"}})
+
+	r := <-resultsB
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+
+	if rstat, ok := r.msg.(MessageRstat); !ok || rstat.Stat.Name != "b" {
+		t.Fatalf("unexpected response to B: %v", r.msg)
+	}
+
+	select {
+	case r := <-resultsA:
+		t.Fatalf("A answered with the response to B: %v", r)
+	default:
+	}
+
+	ch.incoming <- newFcall(reqA.Tag, MessageRstat{Stat: Dir{Name: "a"}})
+
+	r = <-resultsA
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+
+	if rstat, ok := r.msg.(MessageRstat); !ok || rstat.Stat.Name != "a" {
+		t.Fatalf("unexpected response to A: %v", r.msg)
+	}
+}
+
+// TestTransportFlushOfFlush flushes a request, then flushes the flush. Once
+// the flush of the flush is answered, the first flush never will be, so the
+// request fails and every tag is reclaimed.
+func TestTransportFlushOfFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	errs := make(chan error, 3)
+	go func() {
+		_, err := tr.send(ctx, MessageTread{Fid: 1})
+		errs <- err
+	}()
+	req := <-ch.outgoing
+
+	go func() { errs <- tr.flush(ctx, req.Tag) }()
+	flush1 := <-ch.outgoing
+	if msg, ok := flush1.Message.(MessageTflush); !ok || msg.Oldtag != req.Tag {
+		t.Fatalf("expected flush of tag %v: %v", req.Tag, flush1)
+	}
+
+	go func() { errs <- tr.flush(ctx, flush1.Tag) }()
+	flush2 := <-ch.outgoing
+	if msg, ok := flush2.Message.(MessageTflush); !ok || msg.Oldtag != flush1.Tag {
+		t.Fatalf("expected flush of tag %v: %v", flush1.Tag, flush2)
+	}
+
+	ch.incoming <- newFcall(flush2.Tag, MessageRflush{})
+
+	var flushed bool
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		if cerr, ok := err.(CancelError); ok {
+			if !cerr.Flushed || cerr.Err != ErrFlushed {
+				t.Fatalf("unexpected cancel error: %#v", cerr)
+			}
+			flushed = true
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if !flushed {
+		t.Fatalf("request not flushed")
+	}
+
+	if n := tr.tags.len(); n != 0 {
+		t.Fatalf("tags not reclaimed: %v", tr.outstanding())
+	}
+}
+
+// TestTransportFlushTwice ensures that a request flushed twice is held until
+// the last flush is answered.
+func TestTransportFlushTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{}).(*transport)
+	defer tr.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tr.send(ctx, MessageTread{Fid: 1})
+		errs <- err
+	}()
+	req := <-ch.outgoing
+
+	flushed := make(chan error, 2)
+	go func() { flushed <- tr.flush(ctx, req.Tag) }()
+	flush1 := <-ch.outgoing
+	go func() { flushed <- tr.flush(ctx, req.Tag) }()
+	flush2 := <-ch.outgoing
+
+	ch.incoming <- newFcall(flush1.Tag, MessageRflush{})
+
+	select {
+	case err := <-errs:
+		t.Fatalf("request failed before the last flush was answered: %v", err)
+	case err := <-flushed:
+		t.Fatalf("flush returned before the last flush was answered: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ch.incoming <- newFcall(flush2.Tag, MessageRflush{})
+
+	if cerr, ok := (<-errs).(CancelError); !ok || !cerr.Flushed {
+		t.Fatalf("expected flushed request: %v", cerr)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-flushed; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := tr.tags.len(); n != 0 {
+		t.Fatalf("tags not reclaimed: %v", tr.outstanding())
+	}
+}
+
+// TestTransportStrictTags ensures that a strict transport closes on a
+// duplicate response, failing the requests in flight.
+func TestTransportStrictTags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{strictTags: true}).(*transport)
+	defer tr.Close()
+
+	errs := make(chan error, 2)
+	send := func(fid Fid) *Fcall {
+		go func() {
+			_, err := tr.send(ctx, MessageTstat{Fid: fid})
+			errs <- err
+		}()
+
+		return <-ch.outgoing
+	}
+
+	answered, waiting := send(1), send(2)
+	ch.incoming <- newFcall(answered.Tag, MessageRstat{})
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// answer the first request again.
+	ch.incoming <- newFcall(answered.Tag, MessageRstat{})
+
+	if err := <-errs; err != ErrUnknownTag {
+		t.Fatalf("expected unknown tag error for %v: %v", waiting.Tag, err)
+	}
+
+	select {
+	case <-tr.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("transport not closed")
+	}
+}
+
+// TestTransportMaxOutstanding ensures that requests beyond the limit wait for
+// a slot, or fail with ErrTooManyRequests when configured not to wait.
+func TestTransportMaxOutstanding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := newTestChannel()
+	tr := newTransport(ctx, ch, sessionOptions{maxOutstanding: 1}).(*transport)
+	defer tr.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := tr.send(ctx, MessageTstat{Fid: 1})
+		errs <- err
+	}()
+	req := <-ch.outgoing
+
+	// the second request waits for the first to be answered.
+	go func() {
+		_, err := tr.send(ctx, MessageTstat{Fid: 2})
+		errs <- err
+	}()
+
+	select {
+	case fcall := <-ch.outgoing:
+		t.Fatalf("request sent beyond limit: %v", fcall)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ch.incoming <- newFcall(req.Tag, MessageRstat{})
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req = <-ch.outgoing
+	ch.incoming <- newFcall(req.Tag, MessageRstat{})
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// without waiting, requests beyond the limit fail.
+	ch = newTestChannel()
+	nowait := newTransport(ctx, ch, sessionOptions{maxOutstanding: 1, maxOutstandingNoWait: true}).(*transport)
+	defer nowait.Close()
+
+	go func() {
+		_, err := nowait.send(ctx, MessageTstat{Fid: 1})
+		errs <- err
+	}()
+	req = <-ch.outgoing
+
+	if _, err := nowait.send(ctx, MessageTstat{Fid: 2}); err != ErrTooManyRequests {
+		t.Fatalf("expected ErrTooManyRequests: %v", err)
+	}
+
+	ch.incoming <- newFcall(req.Tag, MessageRstat{})
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
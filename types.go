@@ -8,6 +8,10 @@ import (
 const (
 	DefaultMSize   = 64 << 10
 	DefaultVersion = "9P2000"
+
+	// IOHDRSZ is the maximum size of the header of Rread and Twrite messages.
+	// The data of a single read or write may be up to msize-IOHDRSZ bytes.
+	IOHDRSZ = 24
 )
 
 const (
@@ -0,0 +1,92 @@
+package p9p
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DialUnix connects to the unix domain socket at path and returns a session
+// over the connection, as with Dial. A path beginning with "@" names a socket
+// in the Linux abstract namespace.
+func DialUnix(ctx context.Context, path string, opts ...SessionOption) (Session, error) {
+	return Dial(ctx, "unix", unixAddress(path), opts...)
+}
+
+// ListenUnix listens on the unix domain socket at path. A stale socket file
+// left at path by a server that did not shut down cleanly is removed first,
+// but a socket that still accepts connections is left alone and an error is
+// returned. The socket file is removed when the listener is closed, which
+// happens once ctx is done.
+//
+// A path beginning with "@" names a socket in the Linux abstract namespace,
+// which has no file to manage and disappears with the listener.
+func ListenUnix(ctx context.Context, path string) (net.Listener, error) {
+	path = unixAddress(path)
+	if !abstractUnix(path) {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(!abstractUnix(path))
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	return l, nil
+}
+
+// unixAddress returns path with a leading NUL, the raw form of an abstract
+// socket name, replaced by "@", as expected by the net package.
+func unixAddress(path string) string {
+	if strings.HasPrefix(path, "\x00") {
+		return "@" + path[1:]
+	}
+
+	return path
+}
+
+func abstractUnix(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes the socket file at path if no server is accepting
+// connections on it. Files that are not sockets are left for net.Listen to
+// report.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("listen unix %v: socket in use", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
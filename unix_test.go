@@ -0,0 +1,107 @@
+package p9p
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TestListenUnix ensures that ListenUnix replaces a stale socket file, refuses
+// a socket in use and removes the socket file on shutdown.
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p9p-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "9p.sock")
+
+	// leave a stale socket file behind.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := ListenUnix(ctx, path)
+	if err != nil {
+		t.Fatalf("unexpected error replacing stale socket: %v", err)
+	}
+
+	if _, err := ListenUnix(ctx, path); err == nil {
+		t.Fatalf("expected error listening on a socket in use")
+	}
+
+	testServeUnix(t, ctx, l, path)
+
+	cancel()
+	for i := 0; ; i++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			break
+		}
+
+		if i == 100 {
+			t.Fatalf("socket file not removed on shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenUnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets require linux")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := fmt.Sprintf("\x00p9p-test-%d", os.Getpid())
+	l, err := ListenUnix(ctx, path)
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+
+	testServeUnix(t, ctx, l, path)
+}
+
+// testServeUnix serves the connections accepted from l and attaches to it
+// with DialUnix at path.
+func testServeUnix(t *testing.T, ctx context.Context, l net.Listener, path string) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+					return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+				}))
+			}()
+		}
+	}()
+
+	session, err := DialUnix(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+}
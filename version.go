@@ -13,9 +13,42 @@ import (
 // support resets through version messages during the protocol exchange.
 
 // clientnegotiate negiotiates the protocol version using channel, blocking
-// until a response is received. The received value will be the version
-// implemented by the server.
-func clientnegotiate(ctx context.Context, ch Channel, version string) (string, error) {
+// until a response is received. Each of versions is offered in order of
+// preference. The server may answer with an earlier version than the one
+// offered, which is accepted if it is one of versions. Otherwise, the next
+// version is offered. The returned value will be the version implemented by
+// the server.
+func clientnegotiate(ctx context.Context, ch Channel, versions ...string) (string, error) {
+	return negotiateVersions(versions, func(version string) (string, error) {
+		return offerVersion(ctx, ch, version)
+	})
+}
+
+// negotiateVersions offers each of versions with offer, as clientnegotiate
+// does, returning the version accepted.
+func negotiateVersions(versions []string, offer func(version string) (string, error)) (string, error) {
+	var version string
+	for _, v := range versions {
+		var err error
+		version, err = offer(v)
+		if err != nil {
+			return "", err
+		}
+
+		for _, accepted := range versions {
+			if version == accepted {
+				return version, nil
+			}
+		}
+	}
+
+	// TODO(stevvooe): A stubborn client indeed!
+	return "", fmt.Errorf("unsupported server version: %v", version)
+}
+
+// offerVersion sends a Tversion offering version, returning the version of
+// the server's response.
+func offerVersion(ctx context.Context, ch Channel, version string) (string, error) {
 	req := newFcall(NOTAG, MessageTversion{
 		MSize:   uint32(ch.MSize()),
 		Version: version,
@@ -32,14 +65,9 @@ func clientnegotiate(ctx context.Context, ch Channel, version string) (string, e
 
 	switch v := resp.Message.(type) {
 	case MessageRversion:
-
-		if v.Version != version {
-			// TODO(stevvooe): A stubborn client indeed!
-			return "", fmt.Errorf("unsupported server version: %v", version)
-		}
-
-		if int(v.MSize) > ch.MSize() {
-			// upgrade msize if server differs.
+		if int(v.MSize) != ch.MSize() {
+			// use the msize of the server if it differs, usually smaller
+			// than offered.
 			ch.SetMSize(int(v.MSize))
 		}
 
@@ -51,6 +79,50 @@ func clientnegotiate(ctx context.Context, ch Channel, version string) (string, e
 	}
 }
 
+// NegotiateRoundTripper negotiates the protocol version through rt, as
+// NewSession does over a connection, offering the msize and versions
+// configured by opts. It returns the msize and version to pass to
+// NewRoundTripperSession. The Tversion sent through rt must go out with
+// NOTAG.
+func NegotiateRoundTripper(ctx context.Context, rt RoundTripper, opts ...SessionOption) (int, string, error) {
+	so := newSessionOptions(opts)
+	ctx, cancel := so.handshakeContext(ctx)
+	defer cancel()
+
+	versions, err := so.offers()
+	if err != nil {
+		return 0, "", err
+	}
+
+	msize := DefaultMSize
+	if so.msize > 0 {
+		msize = so.msize
+	}
+
+	version, err := negotiateVersions(versions, func(version string) (string, error) {
+		resp, err := rt.RoundTrip(ctx, MessageTversion{MSize: uint32(msize), Version: version})
+		if err != nil {
+			return "", err
+		}
+
+		mv, ok := resp.(MessageRversion)
+		if !ok {
+			return "", ErrUnexpectedMsg
+		}
+
+		if int(mv.MSize) < msize {
+			msize = int(mv.MSize)
+		}
+
+		return mv.Version, nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	return msize, version, nil
+}
+
 // servernegotiate blocks until a version message is received or a timeout
 // occurs. The msize for the tranport will be set from the negotiation. If
 // negotiate returns nil, a server may proceed with the connection.
@@ -73,6 +145,26 @@ func servernegotiate(ctx context.Context, ch Channel, version string) error {
 		return fmt.Errorf("expected version message: %v", mv)
 	}
 
+	respmsg := versionResponse(mv, version, ch.MSize())
+	if int(respmsg.MSize) != ch.MSize() {
+		ch.SetMSize(int(respmsg.MSize))
+	}
+
+	resp := newFcall(NOTAG, respmsg)
+	if err := ch.WriteFcall(ctx, resp); err != nil {
+		return err
+	}
+
+	if respmsg.Version == "unknown" {
+		return fmt.Errorf("bad version negotiation")
+	}
+
+	return nil
+}
+
+// versionResponse returns the server's answer to mv, for a server speaking
+// version with messages of at most msize.
+func versionResponse(mv MessageTversion, version string, msize int) MessageRversion {
 	respmsg := MessageRversion{
 		Version: version,
 	}
@@ -91,22 +183,38 @@ func servernegotiate(ctx context.Context, ch Channel, version string) error {
 		respmsg.Version = "9P2000"
 	}
 
-	if int(mv.MSize) < ch.MSize() {
+	if int(mv.MSize) < msize {
 		// if the server msize is too large, use the client's suggested msize.
-		ch.SetMSize(int(mv.MSize))
 		respmsg.MSize = mv.MSize
 	} else {
-		respmsg.MSize = uint32(ch.MSize())
+		respmsg.MSize = uint32(msize)
 	}
 
-	resp := newFcall(NOTAG, respmsg)
-	if err := ch.WriteFcall(ctx, resp); err != nil {
-		return err
-	}
+	return respmsg
+}
 
-	if respmsg.Version == "unknown" {
-		return fmt.Errorf("bad version negotiation")
+// implemented reports whether the package implements the protocol version.
+func implemented(version string) bool {
+	return versionSupports(version, Tversion)
+}
+
+// Supports reports whether the protocol version negotiated for session
+// defines the message type typ. Portable code can use this to choose between
+// messages specific to a dialect and a fallback available in plain 9P2000.
+func Supports(session Session, typ FcallType) bool {
+	_, version := session.Version()
+	return versionSupports(version, typ)
+}
+
+// versionSupports reports whether the protocol version defines the message
+// type typ.
+func versionSupports(version string, typ FcallType) bool {
+	switch version {
+	case "9P2000":
+		return typ >= Tversion && typ < Tmax && typ != Terror
+	case Version9P2000L:
+		return dotLSupports(typ)
 	}
 
-	return nil
+	return false
 }
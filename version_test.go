@@ -0,0 +1,246 @@
+package p9p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSupports(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	for _, typ := range []FcallType{Tversion, Tattach, Twalk, Rread, Twstat, Rwstat} {
+		if !Supports(session, typ) {
+			t.Fatalf("%v should be supported by %v", typ, DefaultVersion)
+		}
+	}
+
+	for _, typ := range []FcallType{Terror, Tmax, FcallType(0)} {
+		if Supports(session, typ) {
+			t.Fatalf("%v should not be supported by %v", typ, DefaultVersion)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	go serveVersion(ctx, sconn, Version9P2000L, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		return nil, ErrUnknownMsg
+	}))
+
+	session, err := NewSession(ctx, cconn, WithVersion(Version9P2000L))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []FcallType{Tversion, Tattach, Twalk, Rread, Tremove, Rlerror, Tgetattr, Treadlink} {
+		if !Supports(session, typ) {
+			t.Fatalf("%v should be supported by %v", typ, Version9P2000L)
+		}
+	}
+
+	for _, typ := range []FcallType{Topen, Tcreate, Tstat, Twstat, Rerror, Terror, Tmax} {
+		if Supports(session, typ) {
+			t.Fatalf("%v should not be supported by %v", typ, Version9P2000L)
+		}
+	}
+}
+
+// TestVersionPreference ensures the effective version is the most preferred
+// version accepted by the server.
+func TestVersionPreference(t *testing.T) {
+	for _, testcase := range []struct {
+		description string
+		server      string   // version of the server
+		preferred   []string // versions offered by the client
+		expected    string   // effective version, empty if negotiation fails
+	}{
+		{"dotl server", Version9P2000L, []string{Version9P2000L, DefaultVersion}, Version9P2000L},
+		{"plain server", DefaultVersion, []string{Version9P2000L, DefaultVersion}, DefaultVersion},
+		{"plain preferred", Version9P2000L, []string{DefaultVersion, Version9P2000L}, DefaultVersion},
+		{"dotl only", DefaultVersion, []string{Version9P2000L}, ""},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cconn, sconn := net.Pipe()
+
+		go serveVersion(ctx, sconn, testcase.server, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return nil, ErrUnknownMsg
+		}))
+
+		session, err := NewSession(ctx, cconn, WithVersion(testcase.preferred...))
+		if testcase.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected negotiation to fail", testcase.description)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", testcase.description, err)
+		} else if _, version := session.Version(); version != testcase.expected {
+			t.Errorf("%s: unexpected version: %v != %v", testcase.description, version, testcase.expected)
+		}
+
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+// TestVersionFallback ensures that the next version is offered when the
+// server doesn't understand the first.
+func TestVersionFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	offers := make(chan string, 2)
+	go func() {
+		ch := newChannel(sconn, codec9p{}, DefaultMSize)
+		for {
+			req := new(Fcall)
+			if err := ch.ReadFcall(ctx, req); err != nil {
+				return
+			}
+
+			tversion, ok := req.Message.(MessageTversion)
+			if !ok {
+				return
+			}
+			offers <- tversion.Version
+
+			version := "unknown"
+			if tversion.Version == DefaultVersion {
+				version = DefaultVersion
+			}
+
+			if err := ch.WriteFcall(ctx, newFcall(NOTAG, MessageRversion{MSize: tversion.MSize, Version: version})); err != nil {
+				return
+			}
+		}
+	}()
+
+	ch := newChannel(cconn, codec9p{}, DefaultMSize)
+	version, err := clientnegotiate(ctx, ch, Version9P2000L, DefaultVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != DefaultVersion {
+		t.Fatalf("unexpected version: %v", version)
+	}
+
+	for _, expected := range []string{Version9P2000L, DefaultVersion} {
+		if offer := <-offers; offer != expected {
+			t.Fatalf("unexpected offer: %v != %v", offer, expected)
+		}
+	}
+}
+
+func TestVersionUnimplemented(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+
+	if _, err := NewSession(context.Background(), cconn, WithVersion("9P2000.u")); err == nil {
+		t.Fatalf("expected error negotiating unimplemented version")
+	}
+}
+
+// TestRenegotiate renegotiates the msize of a session while a request is
+// outstanding, ensuring that the request completes first and that the new
+// msize holds on both ends.
+func TestRenegotiate(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTattach:
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		case MessageTstat:
+			started <- struct{}{}
+			<-release
+			return MessageRstat{}, nil
+		case MessageTread:
+			return MessageRread{Data: make([]byte, msg.Count)}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := make(chan error, 1)
+	go func() {
+		_, err := session.Stat(ctx, 1)
+		stat <- err
+	}()
+	<-started
+
+	type result struct {
+		msize int
+		err   error
+	}
+	renegotiated := make(chan result, 1)
+	go func() {
+		msize, err := Renegotiate(ctx, session, 8192)
+		renegotiated <- result{msize, err}
+	}()
+
+	select {
+	case r := <-renegotiated:
+		t.Fatalf("renegotiated with a request outstanding: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-stat; err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-renegotiated
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	if msize, version := session.Version(); r.msize != 8192 || msize != 8192 || version != DefaultVersion {
+		t.Fatalf("unexpected version after renegotiating: %v %v %v", r.msize, msize, version)
+	}
+
+	if fids := OpenFids(session); len(fids) != 0 {
+		t.Fatalf("fids survived renegotiation: %v", fids)
+	}
+
+	// a read of the full iounit fits the new msize.
+	p := make([]byte, IOUnit(session, 1))
+	if n, err := session.Read(ctx, 1, p, 0); err != nil || n != len(p) {
+		t.Fatalf("unexpected read after renegotiating: %v %v", n, err)
+	}
+
+	// the server does not grow beyond its own msize.
+	msize, err := Renegotiate(ctx, session, 4*DefaultMSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msize != DefaultMSize {
+		t.Fatalf("unexpected msize: %v", msize)
+	}
+
+	p = make([]byte, IOUnit(session, 1))
+	if n, err := session.Read(ctx, 1, p, 0); err != nil || n != len(p) {
+		t.Fatalf("unexpected read after renegotiating: %v %v", n, err)
+	}
+}
@@ -0,0 +1,80 @@
+package p9p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ErrVsockUnsupported is returned when dialing or listening on vsock on a
+// platform without support for it.
+var ErrVsockUnsupported = errors.New("vsock not supported on this platform")
+
+// Well known context identifiers of vsock endpoints.
+const (
+	VsockCIDAny  uint32 = 0xffffffff // listen on any local cid
+	VsockCIDHost uint32 = 2          // the host, as seen from a guest
+)
+
+// VsockAddr is the address of a vsock endpoint, a context identifier naming
+// the VM or host and a port.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+var _ net.Addr = &VsockAddr{}
+
+func (a *VsockAddr) Network() string { return "vsock" }
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+// parseVsockAddr parses an address of the form "cid:port".
+func parseVsockAddr(address string) (*VsockAddr, error) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("vsock address %q: missing port", address)
+	}
+
+	cid, err := strconv.ParseUint(address[:i], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("vsock address %q: invalid cid", address)
+	}
+
+	port, err := strconv.ParseUint(address[i+1:], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("vsock address %q: invalid port", address)
+	}
+
+	return &VsockAddr{CID: uint32(cid), Port: uint32(port)}, nil
+}
+
+// DialVsock connects to port on the vsock endpoint cid and returns a session
+// over the connection, as with Dial. Dial also accepts the "vsock" network,
+// with addresses of the form "cid:port". vsock is only supported on Linux.
+func DialVsock(ctx context.Context, cid, port uint32, opts ...SessionOption) (Session, error) {
+	return Dial(ctx, "vsock", (&VsockAddr{CID: cid, Port: port}).String(), opts...)
+}
+
+// ListenVsock listens on port of the local vsock endpoint, accepting
+// connections from VMs or the host addressed to any local cid. The listener
+// is closed once ctx is done. vsock is only supported on Linux.
+func ListenVsock(ctx context.Context, port uint32) (net.Listener, error) {
+	l, err := listenVsock(&VsockAddr{CID: VsockCIDAny, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	return l, nil
+}
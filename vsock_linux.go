@@ -0,0 +1,265 @@
+//go:build linux && (amd64 || arm64 || arm || ppc64le || riscv64)
+// +build linux
+// +build amd64 arm64 arm ppc64le riscv64
+
+package p9p
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/context"
+)
+
+// The syscall package knows neither AF_VSOCK nor its socket address, so calls
+// taking an address are made directly.
+
+const afVsock = 40
+
+// rawSockaddrVM is struct sockaddr_vm from linux/vm_sockets.h.
+type rawSockaddrVM struct {
+	Family    uint16
+	Reserved1 uint16
+	Port      uint32
+	CID       uint32
+	Zero      [4]uint8
+}
+
+func (rsa *rawSockaddrVM) addr() *VsockAddr {
+	return &VsockAddr{CID: rsa.CID, Port: rsa.Port}
+}
+
+// sockaddr calls the getsockname or getpeername syscall trap on fd.
+func sockaddr(trap uintptr, fd uintptr) (*VsockAddr, error) {
+	var (
+		rsa rawSockaddrVM
+		n   = uint32(unsafe.Sizeof(rsa))
+	)
+
+	if _, _, errno := syscall.Syscall(trap, fd, uintptr(unsafe.Pointer(&rsa)), uintptr(unsafe.Pointer(&n))); errno != 0 {
+		return nil, errno
+	}
+
+	return rsa.addr(), nil
+}
+
+// vsockConn is a connected vsock socket. Reads, writes and deadlines are
+// provided by the runtime poller through os.File.
+type vsockConn struct {
+	*os.File
+	local, remote *VsockAddr
+}
+
+var _ net.Conn = &vsockConn{}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// newVsockConn returns a conn for the nonblocking socket fd, connected to
+// remote.
+func newVsockConn(fd int, remote *VsockAddr) (*vsockConn, error) {
+	local, err := sockaddr(syscall.SYS_GETSOCKNAME, uintptr(fd))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), "vsock:"+remote.String()),
+		local:  local,
+		remote: remote,
+	}, nil
+}
+
+func dialVsock(ctx context.Context, addr *VsockAddr) (net.Conn, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	rsa := rawSockaddrVM{Family: afVsock, Port: addr.Port, CID: addr.CID}
+	_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&rsa)), unsafe.Sizeof(rsa))
+	if errno != 0 && errno != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", errno)
+	}
+
+	f := os.NewFile(uintptr(fd), "vsock")
+	if err := waitConnect(ctx, f, errno == syscall.EINPROGRESS); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	local, err := sockaddr(syscall.SYS_GETSOCKNAME, uintptr(fd))
+	if err != nil {
+		f.Close()
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+
+	return &vsockConn{File: f, local: local, remote: addr}, nil
+}
+
+// waitConnect waits for the connect of the socket f to complete, as the
+// net package does, abandoning it when ctx is done.
+func waitConnect(ctx context.Context, f *os.File, inprogress bool) error {
+	if !inprogress {
+		return nil
+	}
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		f.SetWriteDeadline(deadline)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			f.SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var cerr error
+	first := true
+	err = rc.Write(func(fd uintptr) bool {
+		if first {
+			// wait for the socket to become writable.
+			first = false
+			return false
+		}
+
+		v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			cerr = os.NewSyscallError("getsockopt", err)
+			return true
+		}
+
+		switch errno := syscall.Errno(v); errno {
+		case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+			return false
+		case 0:
+			// make sure the socket is connected, rather than woken
+			// spuriously.
+			if _, err := sockaddr(syscall.SYS_GETPEERNAME, fd); err == syscall.ENOTCONN {
+				return false
+			}
+			return true
+		default:
+			cerr = os.NewSyscallError("connect", errno)
+			return true
+		}
+	})
+	close(done)
+	<-stopped
+
+	if os.IsTimeout(err) && hasDeadline {
+		// the deadline of ctx has passed, but ctx may not be done yet.
+		<-ctx.Done()
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// vsockListener accepts vsock connections.
+type vsockListener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *VsockAddr
+}
+
+var _ net.Listener = &vsockListener{}
+
+func listenVsock(addr *VsockAddr) (net.Listener, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	rsa := rawSockaddrVM{Family: afVsock, Port: addr.Port, CID: addr.CID}
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&rsa)), unsafe.Sizeof(rsa)); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", errno)
+	}
+
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	local, err := sockaddr(syscall.SYS_GETSOCKNAME, uintptr(fd))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "vsock:"+local.String())
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &vsockListener{f: f, rc: rc, addr: local}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var (
+		nfd  int
+		rsa  rawSockaddrVM
+		aerr error
+	)
+
+	err := l.rc.Read(func(fd uintptr) bool {
+		for {
+			n := uint32(unsafe.Sizeof(rsa))
+			r, _, errno := syscall.Syscall6(syscall.SYS_ACCEPT4, fd, uintptr(unsafe.Pointer(&rsa)), uintptr(unsafe.Pointer(&n)), syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0, 0)
+			switch errno {
+			case syscall.EINTR, syscall.ECONNABORTED:
+				// try the next connection.
+				continue
+			case syscall.EAGAIN:
+				return false
+			case 0:
+				nfd = int(r)
+			default:
+				aerr = os.NewSyscallError("accept", errno)
+			}
+			return true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return newVsockConn(nfd, rsa.addr())
+}
+
+func (l *vsockListener) Close() error   { return l.f.Close() }
+func (l *vsockListener) Addr() net.Addr { return l.addr }
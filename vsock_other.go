@@ -0,0 +1,18 @@
+//go:build !linux || !(amd64 || arm64 || arm || ppc64le || riscv64)
+// +build !linux !amd64,!arm64,!arm,!ppc64le,!riscv64
+
+package p9p
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+func dialVsock(ctx context.Context, addr *VsockAddr) (net.Conn, error) {
+	return nil, ErrVsockUnsupported
+}
+
+func listenVsock(addr *VsockAddr) (net.Listener, error) {
+	return nil, ErrVsockUnsupported
+}
@@ -0,0 +1,84 @@
+package p9p
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseVsockAddr(t *testing.T) {
+	for _, testcase := range []struct {
+		address  string
+		expected *VsockAddr
+	}{
+		{"3:564", &VsockAddr{CID: 3, Port: 564}},
+		{"4294967295:1", &VsockAddr{CID: VsockCIDAny, Port: 1}},
+		{"3", nil},
+		{"x:564", nil},
+		{"3:65536000000", nil},
+	} {
+		addr, err := parseVsockAddr(testcase.address)
+		if testcase.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", testcase.address)
+			}
+			continue
+		}
+
+		if err != nil || *addr != *testcase.expected {
+			t.Errorf("%q: unexpected address %v: %v", testcase.address, addr, err)
+		}
+
+		if addr.String() != testcase.address {
+			t.Errorf("%q: unexpected string %q", testcase.address, addr)
+		}
+	}
+}
+
+// TestVsockLoopback attaches over vsock to the local cid. It is skipped where
+// vsock or its loopback transport is unavailable.
+func TestVsockLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const cidLocal = 1
+	l, err := ListenVsock(ctx, 0)
+	if err != nil {
+		t.Skipf("cannot listen on vsock: %v", err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		ServeConn(ctx, conn, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+			return MessageRattach{Qid: Qid{Type: QTDIR}}, nil
+		}))
+	}()
+
+	dialctx, dialcancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer dialcancel()
+
+	// dial separately, so that the timeout does not bound the session.
+	addr := &VsockAddr{CID: cidLocal, Port: l.Addr().(*VsockAddr).Port}
+	conn, err := dialConn(dialctx, "vsock", addr.String())
+	if err != nil {
+		t.Skipf("cannot dial vsock loopback: %v", err)
+	}
+	defer conn.Close()
+
+	session, err := NewSession(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.(io.Closer).Close()
+
+	if _, err := session.Attach(ctx, 1, NOFID, "test", "/"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,114 @@
+package p9p
+
+// requestFids returns the fids named by msg, which requests on the same fid
+// are ordered by under WithServerWorkers.
+func requestFids(msg Message) []Fid {
+	switch msg := msg.(type) {
+	case MessageTauth:
+		return []Fid{msg.Afid}
+	case MessageTattach:
+		if msg.Afid != NOFID && msg.Afid != msg.Fid {
+			return []Fid{msg.Fid, msg.Afid}
+		}
+		return []Fid{msg.Fid}
+	case MessageTwalk:
+		if msg.Newfid != msg.Fid {
+			return []Fid{msg.Fid, msg.Newfid}
+		}
+		return []Fid{msg.Fid}
+	case MessageTopen:
+		return []Fid{msg.Fid}
+	case MessageTcreate:
+		return []Fid{msg.Fid}
+	case MessageTread:
+		return []Fid{msg.Fid}
+	case MessageTwrite:
+		return []Fid{msg.Fid}
+	case MessageTclunk:
+		return []Fid{msg.Fid}
+	case MessageTremove:
+		return []Fid{msg.Fid}
+	case MessageTstat:
+		return []Fid{msg.Fid}
+	case MessageTwstat:
+		return []Fid{msg.Fid}
+	case MessageTreadlink:
+		return []Fid{msg.Fid}
+	case MessageTgetattr:
+		return []Fid{msg.Fid}
+	case MessageTsetattr:
+		return []Fid{msg.Fid}
+	}
+
+	return nil
+}
+
+// fidOrder holds each request until the requests received before it on the
+// same fids have been handled. It is owned by the server loop.
+type fidOrder struct {
+	queues map[Fid][]*activeRequest // by fid, in the order received
+}
+
+// push adds active behind the requests on its fids, reporting whether it
+// can be handled now.
+func (o *fidOrder) push(active *activeRequest) bool {
+	if o.queues == nil {
+		o.queues = map[Fid][]*activeRequest{}
+	}
+
+	for _, fid := range requestFids(active.request.Message) {
+		o.queues[fid] = append(o.queues[fid], active)
+	}
+
+	return o.ready(active)
+}
+
+// ready reports whether active is first in line on each of its fids.
+func (o *fidOrder) ready(active *activeRequest) bool {
+	for _, fid := range requestFids(active.request.Message) {
+		if o.queues[fid][0] != active {
+			return false
+		}
+	}
+
+	return true
+}
+
+// done removes active, handled, returning the requests that can be handled
+// now. Requests not in line are ignored.
+func (o *fidOrder) done(active *activeRequest) []*activeRequest {
+	var next []*activeRequest
+	for _, fid := range requestFids(active.request.Message) {
+		queue := o.queues[fid]
+		if len(queue) == 0 || queue[0] != active {
+			continue
+		}
+
+		queue = queue[1:]
+		if len(queue) == 0 {
+			delete(o.queues, fid)
+			continue
+		}
+		o.queues[fid] = queue
+
+		if o.ready(queue[0]) {
+			next = append(next, queue[0])
+		}
+	}
+
+	return next
+}
+
+// worker handles the requests sent on work until the connection ends.
+func (c *conn) worker(work <-chan *activeRequest, completed chan<- completion) {
+	for {
+		select {
+		case active := <-work:
+			c.handle(active, completed)
+		case <-c.ctx.Done():
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
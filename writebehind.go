@@ -0,0 +1,113 @@
+package p9p
+
+import (
+	"sync"
+	"time"
+)
+
+// syncDir changes nothing when written with WStat, which asks the server to
+// commit the file to stable storage. See stat(5).
+var syncDir = Dir{
+	Type:       ^uint16(0),
+	Dev:        ^uint32(0),
+	Qid:        Qid{Type: ^QType(0), Version: ^uint32(0), Path: ^uint64(0)},
+	Mode:       ^uint32(0),
+	AccessTime: time.Unix(int64(^uint32(0)), 0),
+	ModTime:    time.Unix(int64(^uint32(0)), 0),
+	Length:     ^uint64(0),
+}
+
+// writeBehind coalesces the writes to a FidIO into messages of its full
+// message size, sent in the background with a bounded number in flight.
+// Buffering is protected by the lock of the FidIO.
+type writeBehind struct {
+	f      *FidIO
+	slots  chan struct{} // holds a value for each write in flight
+	wg     sync.WaitGroup
+	buf    []byte
+	offset int64 // offset of buf in the file
+
+	mu  sync.Mutex
+	err error // first error of a write in the background, sticky
+}
+
+func newWriteBehind(f *FidIO, window int) *writeBehind {
+	return &writeBehind{f: f, slots: make(chan struct{}, window)}
+}
+
+// write buffers p, to be written at offset.
+func (wb *writeBehind) write(p []byte, offset int64) error {
+	if err := wb.failed(); err != nil {
+		return err
+	}
+
+	if len(wb.buf) > 0 && offset != wb.offset+int64(len(wb.buf)) {
+		wb.send() // not contiguous with the buffered data.
+	}
+
+	if len(wb.buf) == 0 {
+		wb.offset = offset
+	}
+
+	for len(p) > 0 {
+		if wb.buf == nil {
+			wb.buf = make([]byte, 0, wb.f.size)
+		}
+
+		n := wb.f.size - len(wb.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		wb.buf = append(wb.buf, p[:n]...)
+		p = p[n:]
+
+		if len(wb.buf) == wb.f.size {
+			wb.send()
+		}
+	}
+
+	return nil
+}
+
+// send writes the buffered data in the background, waiting for a slot if
+// the window is full.
+func (wb *writeBehind) send() {
+	if len(wb.buf) == 0 {
+		return
+	}
+
+	buf, offset := wb.buf, wb.offset
+	wb.buf = nil
+	wb.offset += int64(len(buf))
+
+	wb.slots <- struct{}{}
+	wb.wg.Add(1)
+	go func() {
+		defer func() {
+			<-wb.slots
+			wb.wg.Done()
+		}()
+
+		if _, err := writeFull(wb.f.ctx(), wb.f.session, wb.f.fid, buf, offset); err != nil {
+			wb.mu.Lock()
+			if wb.err == nil {
+				wb.err = err
+			}
+			wb.mu.Unlock()
+		}
+	}()
+}
+
+// flush sends the buffered data and waits for every write in flight.
+func (wb *writeBehind) flush() error {
+	wb.send()
+	wb.wg.Wait()
+	return wb.failed()
+}
+
+func (wb *writeBehind) failed() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.err
+}
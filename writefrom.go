@@ -0,0 +1,62 @@
+package p9p
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// WriteFrom writes data read from r to fid, starting at offset, until r
+// returns io.EOF. It returns the number of bytes written. Data is read and
+// written in chunks of the IOUnit of fid, so the payload is never held in
+// memory at once.
+//
+// Short writes from the server are retried with the remainder of the chunk.
+// If the server accepts no data at all, WriteFrom gives up with
+// io.ErrShortWrite.
+func WriteFrom(ctx context.Context, session Session, fid Fid, offset int64, r io.Reader) (int64, error) {
+	return writeFrom(ctx, session, fid, offset, r, IOUnit(session, fid))
+}
+
+// writeFrom writes data read from r as WriteFrom does, in chunks of size.
+func writeFrom(ctx context.Context, session Session, fid Fid, offset int64, r io.Reader, size int) (int64, error) {
+	buf := make([]byte, size)
+
+	var written int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+
+		nn, err := writeFull(ctx, session, fid, buf[:n], offset+written)
+		written += int64(nn)
+		if err != nil {
+			return written, err
+		}
+
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return written, nil
+		default:
+			return written, rerr
+		}
+	}
+}
+
+// writeFull writes all of p to fid at offset, retrying short writes with the
+// remainder.
+func writeFull(ctx context.Context, session Session, fid Fid, p []byte, offset int64) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := session.Write(ctx, fid, p[written:], offset+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+
+	return written, nil
+}
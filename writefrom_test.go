@@ -0,0 +1,81 @@
+package p9p
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteFrom(t *testing.T) {
+	const (
+		offset   = 10
+		maxwrite = 1000 // force short writes
+	)
+
+	var (
+		file   []byte
+		writes int
+	)
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg := msg.(type) {
+		case MessageTwrite:
+			writes++
+			data := msg.Data
+			if len(data) > maxwrite {
+				data = data[:maxwrite]
+			}
+
+			if end := int(msg.Offset) + len(data); end > len(file) {
+				file = append(file, make([]byte, end-len(file))...)
+			}
+			copy(file[msg.Offset:], data)
+
+			return MessageRwrite{Count: uint32(len(data))}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	data := make([]byte, 2*DefaultMSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	n, err := WriteFrom(context.Background(), session, 1, offset, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != int64(len(data)) {
+		t.Fatalf("unexpected count: %v != %v", n, len(data))
+	}
+
+	if !bytes.Equal(file[offset:], data) {
+		t.Fatalf("written data does not match")
+	}
+
+	if min := (len(data) + maxwrite - 1) / maxwrite; writes < min {
+		t.Fatalf("short writes not retried: %v writes < %v", writes, min)
+	}
+}
+
+// TestWriteFromStalled ensures that a server accepting no data does not hang
+// the writer.
+func TestWriteFromStalled(t *testing.T) {
+	session, cleanup := newTestSession(t, HandlerFunc(func(ctx context.Context, msg Message) (Message, error) {
+		switch msg.(type) {
+		case MessageTwrite:
+			return MessageRwrite{Count: 0}, nil
+		}
+
+		return nil, ErrUnknownMsg
+	}))
+	defer cleanup()
+
+	n, err := WriteFrom(context.Background(), session, 1, 0, bytes.NewReader(make([]byte, 10)))
+	if err != io.ErrShortWrite || n != 0 {
+		t.Fatalf("expected short write: %v, %v", n, err)
+	}
+}